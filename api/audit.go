@@ -0,0 +1,370 @@
+package api
+
+import (
+	"authserver-backend/internal/audit"
+	"authserver-backend/internal/events"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default and largest page sizes of the audit queries.
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+)
+
+// The reasons recorded for the failed authentications.
+const (
+	reasonUnknownUser     = "unknown_user"
+	reasonInvalidPassword = "invalid_password"
+	reasonInvalidToken    = "invalid_token"
+	reasonInvalidCode     = "invalid_code"
+	reasonUnmapped        = "unmapped_certificate"
+	reasonUpstream        = "upstream_error"
+	reasonRateLimited     = "rate_limited"
+	reasonSessionRevoked  = "session_revoked"
+	reasonSessionLimit    = "session_limit"
+	reasonInactive        = "inactive_user"
+	reasonError           = "error"
+)
+
+// The entity types of the admin audit log.
+const (
+	auditEntityApp  = "app"
+	auditEntitySAML = "saml_service_provider"
+)
+
+// recordLoginEvent appends an event to the login audit trail with the address, the user agent and
+// the time of the request. A failure to record it is logged, it does not fail the request.
+// Every event is published as an authentication event, and the lockouts and the failed multi-factor
+// authentications as security events too.
+func (app *AuthServerApp) recordLoginEvent(r *http.Request, event models.LoginEvent) {
+	event.IP = clientIP(r)
+	event.UserAgent = r.UserAgent()
+	event.Created = time.Now().Unix()
+	if _, err := app.DB.InsertLoginEvent(event); err != nil {
+		logerror.LogError(err)
+	}
+
+	app.publish(r, events.Event{
+		Type:   events.AuthPrefix + event.Event,
+		UserID: event.UserID,
+		Login:  event.Login,
+		Data: map[string]any{
+			"success":    event.Success,
+			"method":     event.Method,
+			"reason":     event.Reason,
+			"user_agent": event.UserAgent,
+		},
+	})
+
+	security := events.Event{UserID: event.UserID, Login: event.Login, Data: map[string]any{"reason": event.Reason}}
+	switch {
+	case event.Event == models.LoginEventLockout:
+		security.Type = events.TypeLockout
+	case event.Event == models.LoginEventMFA && !event.Success:
+		security.Type = events.TypeMFAFailed
+		security.Data["method"] = event.Method
+	default:
+		return
+	}
+	app.publish(r, security)
+}
+
+// recordLogin records the outcome of a login of a user, or of an attempt with a login identifier
+// when user is nil.
+func (app *AuthServerApp) recordLogin(r *http.Request, user *models.User, login, method, reason string) {
+	event := models.LoginEvent{
+		Login:   login,
+		Event:   models.LoginEventLogin,
+		Success: reason == "",
+		Method:  method,
+		Reason:  reason,
+	}
+	if user != nil {
+		event.UserID = user.ID
+		event.Login = user.Email
+	}
+	app.recordLoginEvent(r, event)
+}
+
+// recordAdminEvent appends an admin action on an entity to the admin audit log, with the user of the
+// verified claims of the request, or the admin impersonating them, as actor and the diff of the entity before and after the action.
+// before is nil for a creation, after for a deletion. A failure to record it is logged.
+// The action is published as a security event too.
+func (app *AuthServerApp) recordAdminEvent(r *http.Request, action, entityType string, entityID int, before, after any) {
+	changes, err := audit.Diff(before, after)
+	if err != nil {
+		logerror.LogError(err)
+		return
+	}
+	diff, err := json.Marshal(changes)
+	if err != nil {
+		logerror.LogError(err)
+		return
+	}
+
+	event := models.AdminEvent{
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Diff:       diff,
+		IP:         clientIP(r),
+		Created:    time.Now().Unix(),
+	}
+	if claims, ok := claimsFromContext(r.Context()); ok {
+		event.ActorID, event.ActorEmail = claims.UserID, claims.Email
+		if claims.Actor != nil {
+			event.ActorID, _ = strconv.Atoi(claims.Actor.Subject)
+			event.ActorEmail = claims.Actor.Email
+		}
+	}
+	if _, err := app.DB.InsertAdminEvent(event); err != nil {
+		logerror.LogError(err)
+	}
+
+	app.publish(r, events.Event{
+		Type:   events.TypeAdminChange,
+		UserID: event.ActorID,
+		Login:  event.ActorEmail,
+		Data: map[string]any{
+			"action":      action,
+			"entity_type": entityType,
+			"entity_id":   entityID,
+			"changes":     changes,
+		},
+	})
+}
+
+// LoginEvents returns a page of the login audit trail, newest first. The events can be filtered with
+// the user_id, login, event, success (true or false) and ip query parameters, and since and until,
+// as Unix times or RFC 3339 dates. page starts at 1, per_page defaults to 50 and is at most 500.
+// The answer holds the events and how many events the filters select in all.
+func (app *AuthServerApp) LoginEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.LoginEventFilter{
+		Login: query.Get("login"),
+		Event: query.Get("event"),
+		IP:    query.Get("ip"),
+	}
+
+	var err error
+	if v := query.Get("user_id"); v != "" {
+		if filter.UserID, err = strconv.Atoi(v); err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("user_id must be a number"))
+			return
+		}
+	}
+	if v := query.Get("success"); v != "" {
+		success, err := strconv.ParseBool(v)
+		if err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("success must be true or false"))
+			return
+		}
+		filter.Success = &success
+	}
+	if filter.Since, err = auditTime(query.Get("since")); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	if filter.Until, err = auditTime(query.Get("until")); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	page, perPage, err := auditPage(r)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	filter.Limit = perPage
+	filter.Offset = (page - 1) * perPage
+
+	events, total, err := app.DB.LoginEvents(filter)
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not query the login events"), http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []*models.LoginEvent{}
+	}
+
+	response := struct {
+		Events  []*models.LoginEvent `json:"events"`
+		Total   int                  `json:"total"`
+		Page    int                  `json:"page"`
+		PerPage int                  `json:"per_page"`
+	}{events, total, page, perPage}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, response)
+}
+
+// auditTime parses a time of an audit query, a Unix time or an RFC 3339 date. An empty value is 0.
+func auditTime(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return unix, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: want a Unix time or an RFC 3339 date", v)
+	}
+	return t.Unix(), nil
+}
+
+// auditPage returns the page and the page size asked by an audit query.
+func auditPage(r *http.Request) (int, int, error) {
+	page, perPage := 1, defaultAuditPageSize
+	var err error
+	if v := r.URL.Query().Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return 0, 0, errors.New("page must be a positive number")
+		}
+	}
+	if v := r.URL.Query().Get("per_page"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 {
+			return 0, 0, errors.New("per_page must be a positive number")
+		}
+	}
+	if perPage > maxAuditPageSize {
+		perPage = maxAuditPageSize
+	}
+	return page, perPage, nil
+}
+
+// AdminEvents searches the admin audit log, newest first. The actions can be filtered with the actor_id,
+// action, entity_type and entity_id query parameters, and since and until like for LoginEvents.
+// By default a page of them is returned as JSON, paged like LoginEvents. With format=csv or
+// format=ndjson every selected action is exported as a CSV or newline-delimited JSON file.
+func (app *AuthServerApp) AdminEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.AdminEventFilter{
+		Action:     query.Get("action"),
+		EntityType: query.Get("entity_type"),
+	}
+
+	var err error
+	if v := query.Get("actor_id"); v != "" {
+		if filter.ActorID, err = strconv.Atoi(v); err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("actor_id must be a number"))
+			return
+		}
+	}
+	if v := query.Get("entity_id"); v != "" {
+		if filter.EntityID, err = strconv.Atoi(v); err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("entity_id must be a number"))
+			return
+		}
+	}
+	if filter.Since, err = auditTime(query.Get("since")); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	if filter.Until, err = auditTime(query.Get("until")); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	format := query.Get("format")
+	switch format {
+	case "", "json", "csv", "ndjson":
+	default:
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("format must be json, csv or ndjson"))
+		return
+	}
+
+	page, perPage := 0, 0
+	if format == "" || format == "json" {
+		if page, perPage, err = auditPage(r); err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, err)
+			return
+		}
+		filter.Limit = perPage
+		filter.Offset = (page - 1) * perPage
+	}
+
+	events, total, err := app.DB.AdminEvents(filter)
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not query the admin events"), http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []*models.AdminEvent{}
+	}
+
+	switch format {
+	case "csv":
+		writeAdminEventsCSV(w, events)
+	case "ndjson":
+		writeAdminEventsNDJSON(w, events)
+	default:
+		response := struct {
+			Events  []*models.AdminEvent `json:"events"`
+			Total   int                  `json:"total"`
+			Page    int                  `json:"page"`
+			PerPage int                  `json:"per_page"`
+		}{events, total, page, perPage}
+		_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, response)
+	}
+}
+
+// writeAdminEventsCSV writes the admin actions as a CSV file, with a header row.
+func writeAdminEventsCSV(w http.ResponseWriter, events []*models.AdminEvent) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="admin-audit.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"id", "created", "actor_id", "actor_email", "action", "entity_type", "entity_id", "ip", "diff"})
+	for _, e := range events {
+		_ = out.Write([]string{
+			strconv.Itoa(e.ID),
+			time.Unix(e.Created, 0).UTC().Format(time.RFC3339),
+			strconv.Itoa(e.ActorID),
+			csvCell(e.ActorEmail),
+			csvCell(e.Action),
+			csvCell(e.EntityType),
+			strconv.Itoa(e.EntityID),
+			csvCell(e.IP),
+			csvCell(string(e.Diff)),
+		})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		logerror.LogError(err)
+	}
+}
+
+// csvCell keeps a spreadsheet from reading a value as a formula.
+func csvCell(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// writeAdminEventsNDJSON writes the admin actions as newline-delimited JSON, one action per line.
+func writeAdminEventsNDJSON(w http.ResponseWriter, events []*models.AdminEvent) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="admin-audit.ndjson"`)
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	for _, e := range events {
+		if err := encoder.Encode(e); err != nil {
+			logerror.LogError(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// allowLoginEvents lets the handlers record their login events in a mock database.
+func allowLoginEvents(mockDB *dbrepo.MockDBRepo) {
+	mockDB.On("InsertLoginEvent", mock.Anything).Return(1, nil).Maybe()
+}
+
+// allowAdminEvents lets the admin handlers record their actions in a mock database.
+func allowAdminEvents(mockDB *dbrepo.MockDBRepo) {
+	mockDB.On("InsertAdminEvent", mock.Anything).Return(1, nil).Maybe()
+}
+
+// TestAuthenticate_LoginEvents tests the events recorded for a failed and a successful password login.
+func TestAuthenticate_LoginEvents(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowSessions(mockDB)
+	allowLoginEvents(mockDB)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	mockDB.On("GetUserByEmail", "user@example.com").Return(&models.User{ID: 1, Email: "user@example.com", Password: string(hash), Active: true}, nil)
+	mockDB.On("GetUserByEmail", "nobody@example.com").Return((*models.User)(nil), errors.New("no user"))
+
+	app := &AuthServerApp{
+		DB:        mockDB,
+		Auth:      auth.Auth{Audience: "example.com", JWTSecret: "test_secret", CookieName: "refresh_token"},
+		JWTSecret: "test_secret",
+	}
+
+	login := func(email, password string) {
+		req := httptest.NewRequest(http.MethodPost, "/authenticate",
+			strings.NewReader(`{"email":"`+email+`","password":"`+password+`"}`))
+		req.RemoteAddr = "10.0.0.1:40000"
+		req.Header.Set("User-Agent", "curl/8.0")
+		app.Authenticate(httptest.NewRecorder(), req)
+	}
+	login("user@example.com", "wrong")
+	login("nobody@example.com", "password123")
+	login("user@example.com", "password123")
+
+	mockDB.AssertCalled(t, "InsertLoginEvent", mock.MatchedBy(func(e models.LoginEvent) bool {
+		return e.Event == models.LoginEventLogin && !e.Success && e.Reason == reasonInvalidPassword &&
+			e.Login == "user@example.com" && e.Method == auth.AMRPassword &&
+			e.IP == "10.0.0.1" && e.UserAgent == "curl/8.0" && e.Created > 0
+	}))
+	mockDB.AssertCalled(t, "InsertLoginEvent", mock.MatchedBy(func(e models.LoginEvent) bool {
+		return !e.Success && e.Reason == reasonUnknownUser && e.Login == "nobody@example.com" && e.UserID == 0
+	}))
+	mockDB.AssertCalled(t, "InsertLoginEvent", mock.MatchedBy(func(e models.LoginEvent) bool {
+		return e.Success && e.UserID == 1 && e.Reason == ""
+	}))
+}
+
+// TestLoginEvents tests the filters and the pagination of the login audit query.
+func TestLoginEvents(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	failed := false
+	mockDB.On("LoginEvents", models.LoginEventFilter{
+		UserID:  1,
+		Event:   "login",
+		Success: &failed,
+		Since:   1700000000,
+		Until:   1704067200,
+		Limit:   10,
+		Offset:  20,
+	}).Return([]*models.LoginEvent{{ID: 4, UserID: 1, Event: "login", Reason: reasonInvalidPassword}}, 21, nil)
+	app := &AuthServerApp{DB: mockDB}
+
+	req := httptest.NewRequest(http.MethodGet,
+		"/admin/audit/logins?user_id=1&event=login&success=false&since=1700000000&until=2024-01-01T00:00:00Z&page=3&per_page=10", nil)
+	rr := httptest.NewRecorder()
+	app.LoginEvents(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response struct {
+		Events  []models.LoginEvent `json:"events"`
+		Total   int                 `json:"total"`
+		Page    int                 `json:"page"`
+		PerPage int                 `json:"per_page"`
+	}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.Equal(t, 21, response.Total)
+	assert.Equal(t, 3, response.Page)
+	assert.Equal(t, 10, response.PerPage)
+	if assert.Len(t, response.Events, 1) {
+		assert.Equal(t, reasonInvalidPassword, response.Events[0].Reason)
+	}
+
+	for _, query := range []string{"user_id=me", "success=maybe", "since=yesterday", "page=0", "per_page=-1"} {
+		rr := httptest.NewRecorder()
+		app.LoginEvents(rr, httptest.NewRequest(http.MethodGet, "/admin/audit/logins?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
+
+// TestLoginEvents_AdminOnly tests that only admins read the login events of the users.
+func TestLoginEvents_AdminOnly(t *testing.T) {
+	assertAdminOnly(t, "GET /admin/audit/logins", "GET /admin/audit/logins?user_id=2")
+}
+
+// TestLoginEvents_PageSize tests the default and largest page sizes.
+func TestLoginEvents_PageSize(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("LoginEvents", models.LoginEventFilter{Limit: defaultAuditPageSize}).Return([]*models.LoginEvent(nil), 0, nil)
+	mockDB.On("LoginEvents", models.LoginEventFilter{Limit: maxAuditPageSize}).Return([]*models.LoginEvent(nil), 0, nil)
+	app := &AuthServerApp{DB: mockDB}
+
+	rr := httptest.NewRecorder()
+	app.LoginEvents(rr, httptest.NewRequest(http.MethodGet, "/admin/audit/logins", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"events":[]`)
+
+	rr = httptest.NewRecorder()
+	app.LoginEvents(rr, httptest.NewRequest(http.MethodGet, "/admin/audit/logins?per_page=100000", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"per_page":500`)
+}
+
+// TestRecordAdminEvent tests that an update is recorded with its actor and the changed fields only.
+func TestRecordAdminEvent(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowAdminEvents(mockDB)
+	app := &AuthServerApp{DB: mockDB}
+
+	before := models.ThisApp{ID: 7, NewApp: models.NewApp{Name: "billing", Title: "Billing"}}
+	after := before
+	after.Title = "Billing 2"
+
+	req := httptest.NewRequest(http.MethodPut, "/admin/update-app", nil)
+	req.RemoteAddr = "10.0.0.1:40000"
+	req = withClaims(req, &auth.Claims{UserID: 1, Email: "admin@example.com"})
+	app.recordAdminEvent(req, models.AdminActionUpdate, auditEntityApp, 7, before, after)
+
+	mockDB.AssertCalled(t, "InsertAdminEvent", mock.MatchedBy(func(e models.AdminEvent) bool {
+		return e.ActorID == 1 && e.ActorEmail == "admin@example.com" && e.Action == models.AdminActionUpdate &&
+			e.EntityType == auditEntityApp && e.EntityID == 7 && e.IP == "10.0.0.1" && e.Created > 0 &&
+			string(e.Diff) == `{"title":{"old":"Billing","new":"Billing 2"}}`
+	}))
+}
+
+// TestAdminEvents tests the filters and the pagination of the admin audit search.
+func TestAdminEvents(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("AdminEvents", models.AdminEventFilter{
+		ActorID:    1,
+		Action:     "update",
+		EntityType: "app",
+		EntityID:   7,
+		Since:      1700000000,
+		Limit:      10,
+		Offset:     10,
+	}).Return([]*models.AdminEvent{{ID: 3, ActorID: 1, Action: "update", Diff: json.RawMessage(`{}`)}}, 11, nil)
+	app := &AuthServerApp{DB: mockDB}
+
+	rr := httptest.NewRecorder()
+	app.AdminEvents(rr, httptest.NewRequest(http.MethodGet,
+		"/admin/audit?actor_id=1&action=update&entity_type=app&entity_id=7&since=1700000000&page=2&per_page=10", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"total":11`)
+	assert.Contains(t, rr.Body.String(), `"page":2`)
+
+	for _, query := range []string{"actor_id=me", "entity_id=x", "until=tomorrow", "format=xml", "page=-2"} {
+		rr := httptest.NewRecorder()
+		app.AdminEvents(rr, httptest.NewRequest(http.MethodGet, "/admin/audit?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
+
+// TestAdminEvents_AdminOnly tests that only admins read, export and verify the admin audit log.
+func TestAdminEvents_AdminOnly(t *testing.T) {
+	assertAdminOnly(t, "GET /admin/audit", "GET /admin/audit?format=csv", "GET /admin/audit?format=ndjson", "GET /admin/audit/verify")
+}
+
+// TestAdminEvents_Export tests the CSV and NDJSON exports of every selected action.
+func TestAdminEvents_Export(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("AdminEvents", models.AdminEventFilter{EntityType: "app"}).Return([]*models.AdminEvent{
+		{ID: 4, ActorID: 1, ActorEmail: "=cmd()", Action: "delete", EntityType: "app", EntityID: 7,
+			Diff: json.RawMessage(`{"name":{"old":"billing"}}`), IP: "10.0.0.1", Created: 1700000000},
+		{ID: 3, ActorID: 1, ActorEmail: "admin@example.com", Action: "create", EntityType: "app", EntityID: 7,
+			Diff: json.RawMessage(`{"name":{"new":"billing"}}`), IP: "10.0.0.1", Created: 1699999000},
+	}, 2, nil)
+	app := &AuthServerApp{DB: mockDB}
+
+	rr := httptest.NewRecorder()
+	app.AdminEvents(rr, httptest.NewRequest(http.MethodGet, "/admin/audit?entity_type=app&format=csv&per_page=1", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Equal(t, "id,created,actor_id,actor_email,action,entity_type,entity_id,ip,diff", lines[0])
+		assert.Equal(t, `4,2023-11-14T22:13:20Z,1,'=cmd(),delete,app,7,10.0.0.1,"{""name"":{""old"":""billing""}}"`, lines[1])
+	}
+
+	rr = httptest.NewRecorder()
+	app.AdminEvents(rr, httptest.NewRequest(http.MethodGet, "/admin/audit?entity_type=app&format=ndjson", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+	lines = strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		var event models.AdminEvent
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &event))
+		assert.Equal(t, models.AdminActionCreate, event.Action)
+	}
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"authserver-backend/internal/audit"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// auditLogs are the hash-chained audit logs, in the order they are verified.
+var auditLogs = []string{models.AuditLogLogins, models.AuditLogAdmin}
+
+// auditRecords reads the records of an audit log for its verification.
+func (app *AuthServerApp) auditRecords(name string) (audit.Records, error) {
+	switch name {
+	case models.AuditLogLogins:
+		return func(afterID, limit int) ([]audit.Record, error) {
+			events, err := app.DB.LoginEventsAfter(afterID, limit)
+			if err != nil {
+				return nil, err
+			}
+			records := make([]audit.Record, 0, len(events))
+			for _, e := range events {
+				records = append(records, audit.Record{ID: e.ID, PrevHash: e.PrevHash, Hash: e.Hash, Content: e})
+			}
+			return records, nil
+		}, nil
+	case models.AuditLogAdmin:
+		return func(afterID, limit int) ([]audit.Record, error) {
+			events, err := app.DB.AdminEventsAfter(afterID, limit)
+			if err != nil {
+				return nil, err
+			}
+			records := make([]audit.Record, 0, len(events))
+			for _, e := range events {
+				records = append(records, audit.Record{ID: e.ID, PrevHash: e.PrevHash, Hash: e.Hash, Content: e})
+			}
+			return records, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown audit log %q", name)
+}
+
+// VerifyAudit walks the hash chain of an audit log and reports its first broken link. The signatures
+// of its checkpoints are checked when AuditSigningKey is set.
+func (app *AuthServerApp) VerifyAudit(name string) (audit.Report, error) {
+	records, err := app.auditRecords(name)
+	if err != nil {
+		return audit.Report{}, err
+	}
+	checkpoints, err := app.DB.AuditCheckpoints(name)
+	if err != nil {
+		return audit.Report{}, err
+	}
+	var key ed25519.PublicKey
+	if app.AuditSigningKey != nil {
+		key = app.AuditSigningKey.Public().(ed25519.PublicKey)
+	}
+	return audit.Verify(name, records, checkpoints, key)
+}
+
+// CheckpointAudit signs a checkpoint of the last record of every audit log that grew since its
+// last checkpoint. It returns how many checkpoints were stored.
+func (app *AuthServerApp) CheckpointAudit() (int, error) {
+	if app.AuditSigningKey == nil {
+		return 0, errors.New("no audit signing key is configured")
+	}
+
+	stored := 0
+	for _, name := range auditLogs {
+		id, hash, err := app.DB.AuditHead(name)
+		if err != nil {
+			return stored, err
+		}
+		if hash == "" {
+			continue
+		}
+		checkpoints, err := app.DB.AuditCheckpoints(name)
+		if err != nil {
+			return stored, err
+		}
+		if n := len(checkpoints); n > 0 && checkpoints[n-1].EventID == id {
+			continue
+		}
+
+		cp := models.AuditCheckpoint{Log: name, EventID: id, Hash: hash, Created: time.Now().Unix()}
+		audit.SignCheckpoint(app.AuditSigningKey, &cp)
+		if _, err := app.DB.InsertAuditCheckpoint(cp); err != nil {
+			return stored, err
+		}
+		stored++
+	}
+	return stored, nil
+}
+
+// StartAuditCheckpointer runs CheckpointAudit every interval until the context is cancelled.
+// It is meant to be started in its own goroutine from main.
+func (app *AuthServerApp) StartAuditCheckpointer(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stored, err := app.CheckpointAudit()
+			if err != nil {
+				logerror.LogError(err)
+				continue
+			}
+			if stored > 0 {
+				log.Printf("Signed %d audit checkpoints", stored)
+			}
+		}
+	}
+}
+
+// VerifyAuditLogs walks the hash chains of the audit logs, or of the one named by the log query
+// parameter (logins or admin), and reports the first broken link of each.
+func (app *AuthServerApp) VerifyAuditLogs(w http.ResponseWriter, r *http.Request) {
+	names := auditLogs
+	if name := r.URL.Query().Get("log"); name != "" {
+		if _, err := app.auditRecords(name); err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("log must be logins or admin"))
+			return
+		}
+		names = []string{name}
+	}
+
+	response := struct {
+		Valid bool           `json:"valid"`
+		Logs  []audit.Report `json:"logs"`
+	}{Valid: true}
+	for _, name := range names {
+		report, err := app.VerifyAudit(name)
+		if err != nil {
+			logerror.LogError(err)
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("could not verify the audit logs"), http.StatusInternalServerError)
+			return
+		}
+		response.Valid = response.Valid && report.Valid
+		response.Logs = append(response.Logs, report)
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, response)
+}
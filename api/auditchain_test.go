@@ -0,0 +1,90 @@
+package api
+
+import (
+	"authserver-backend/internal/audit"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// chainedLoginEvents returns n login events chained like the repository does.
+func chainedLoginEvents(n int) []*models.LoginEvent {
+	var events []*models.LoginEvent
+	prev := ""
+	for id := 1; id <= n; id++ {
+		event := &models.LoginEvent{ID: id, UserID: 1, Login: "user@example.com", Event: models.LoginEventLogin,
+			Success: true, Created: int64(1700000000 + id)}
+		event.Hash, _ = audit.Hash(prev, event)
+		event.PrevHash, prev = prev, event.Hash
+		events = append(events, event)
+	}
+	return events
+}
+
+// TestVerifyAuditLogs tests that the first broken link of each log is reported.
+func TestVerifyAuditLogs(t *testing.T) {
+	logins := chainedLoginEvents(3)
+	logins[1].UserID = 2
+
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("LoginEventsAfter", 0, mock.Anything).Return(logins, nil)
+	mockDB.On("AdminEventsAfter", 0, mock.Anything).Return([]*models.AdminEvent(nil), nil)
+	mockDB.On("AuditCheckpoints", mock.Anything).Return([]*models.AuditCheckpoint(nil), nil)
+	app := &AuthServerApp{DB: mockDB}
+
+	rr := httptest.NewRecorder()
+	app.VerifyAuditLogs(rr, httptest.NewRequest(http.MethodGet, "/admin/audit/verify", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response struct {
+		Valid bool           `json:"valid"`
+		Logs  []audit.Report `json:"logs"`
+	}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	assert.False(t, response.Valid)
+	if assert.Len(t, response.Logs, 2) {
+		assert.Equal(t, models.AuditLogLogins, response.Logs[0].Log)
+		assert.Equal(t, &audit.Break{EventID: 2, Reason: "the hash does not match the contents of the record"}, response.Logs[0].Break)
+		assert.True(t, response.Logs[1].Valid)
+	}
+
+	rr = httptest.NewRecorder()
+	app.VerifyAuditLogs(rr, httptest.NewRequest(http.MethodGet, "/admin/audit/verify?log=admin", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"valid":true,"logs":[{"log":"admin","records":0,"checkpoints":0,"head":"","valid":true}]}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	app.VerifyAuditLogs(rr, httptest.NewRequest(http.MethodGet, "/admin/audit/verify?log=users", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// TestCheckpointAudit tests that only the logs that grew since their last checkpoint are checkpointed.
+func TestCheckpointAudit(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("AuditHead", models.AuditLogLogins).Return(7, "h7", nil)
+	mockDB.On("AuditHead", models.AuditLogAdmin).Return(3, "h3", nil)
+	mockDB.On("AuditCheckpoints", models.AuditLogLogins).Return([]*models.AuditCheckpoint{{ID: 1, EventID: 5}}, nil)
+	mockDB.On("AuditCheckpoints", models.AuditLogAdmin).Return([]*models.AuditCheckpoint{{ID: 2, EventID: 3}}, nil)
+	mockDB.On("InsertAuditCheckpoint", mock.Anything).Return(3, nil)
+	app := &AuthServerApp{DB: mockDB, AuditSigningKey: private}
+
+	stored, err := app.CheckpointAudit()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stored)
+	mockDB.AssertNumberOfCalls(t, "InsertAuditCheckpoint", 1)
+	mockDB.AssertCalled(t, "InsertAuditCheckpoint", mock.MatchedBy(func(cp models.AuditCheckpoint) bool {
+		return cp.Log == models.AuditLogLogins && cp.EventID == 7 && cp.Hash == "h7" && audit.VerifyCheckpoint(public, cp)
+	}))
+
+	app.AuditSigningKey = nil
+	_, err = app.CheckpointAudit()
+	assert.Error(t, err)
+}
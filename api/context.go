@@ -0,0 +1,121 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"errors"
+	"net/http"
+)
+
+// userContext is the context a user starts a session in: their company, and the database and app
+// they last worked in.
+func userContext(user *models.User) *auth.ActiveContext {
+	return &auth.ActiveContext{CompanyID: user.CompanyId, DbID: user.LastDb, AppID: user.LastApp}
+}
+
+// SessionContext answers the company, database and app the token of the request is working in.
+func (app *AuthServerApp) SessionContext(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	current := auth.ActiveContext{}
+	if claims.Context != nil {
+		current = *claims.Context
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, current)
+}
+
+// SwitchSessionContext switches the company, database or app the user is working in, to ones they
+// are entitled to: a company they belong to, a database or an app they have a grant on. The fields
+// left out of the body keep their value, a 0 leaves the field unchosen. The token pair is issued
+// again with the new context, in the same session, and the database and app are kept for the next login.
+func (app *AuthServerApp) SwitchSessionContext(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	// the tokens of an app or bound to a certificate cannot be exchanged for a login token pair
+	if claims.AppID != 0 || claims.Confirmation != nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("this token cannot switch its context, log in"), http.StatusForbidden)
+		return
+	}
+
+	var payload struct {
+		CompanyID *int `json:"company_id"`
+		DbID      *int `json:"db_id"`
+		AppID     *int `json:"app_id"`
+	}
+	if err := (utils.JSONResponse{}).ReadJSON(w, r, &payload); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	next := auth.ActiveContext{}
+	if claims.Context != nil {
+		next = *claims.Context
+	}
+	if payload.CompanyID != nil && *payload.CompanyID != next.CompanyID {
+		if *payload.CompanyID != 0 {
+			member, err := app.DB.UserInCompany(claims.UserID, *payload.CompanyID)
+			if err != nil {
+				logerror.LogError(err)
+			}
+			if !member {
+				utils.JSONResponse{}.ErrorJSON(w, errors.New("you do not belong to this company"), http.StatusForbidden)
+				return
+			}
+		}
+		next.CompanyID = *payload.CompanyID
+	}
+	if payload.DbID != nil && *payload.DbID != next.DbID {
+		if *payload.DbID != 0 {
+			if _, err := app.DB.GetDBGrant(claims.UserID, *payload.DbID); err != nil {
+				utils.JSONResponse{}.ErrorJSON(w, errors.New("you have no access to this database"), http.StatusForbidden)
+				return
+			}
+		}
+		next.DbID = *payload.DbID
+	}
+	if payload.AppID != nil && *payload.AppID != next.AppID {
+		if *payload.AppID != 0 {
+			if _, err := app.DB.GetAppGrant(claims.UserID, *payload.AppID); err != nil {
+				utils.JSONResponse{}.ErrorJSON(w, errors.New("you have no access to this app"), http.StatusForbidden)
+				return
+			}
+		}
+		next.AppID = *payload.AppID
+	}
+
+	// the new tokens keep how and when the user logged in, and their session
+	u := auth.JWTUser{
+		ID:        claims.UserID,
+		Email:     claims.Email,
+		AMR:       claims.AMR,
+		AuthTime:  claims.AuthTime,
+		SessionID: claims.SessionID,
+		Context:   &next,
+	}
+	tokens, err := app.Auth.GenerateTokenPair(&u)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := app.DB.UpdateUserContext(claims.UserID, next.DbID, next.AppID); err != nil {
+		logerror.LogError(err)
+	}
+	app.setRefreshCookie(w, &tokens)
+
+	resp := struct {
+		auth.TokenPairs
+		Context auth.ActiveContext `json:"ctx"`
+	}{
+		TokenPairs: tokens,
+		Context:    next,
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestIssueTokenPair_Context tests that a login starts in the company of the user, with the database
+// and app they last worked in.
+func TestIssueTokenPair_Context(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := sessionsApp(mockDB)
+
+	req := httptest.NewRequest(http.MethodPost, "/authenticate", nil)
+	tokens, err := app.issueTokenPair(httptest.NewRecorder(), req, &models.User{ID: 1, CompanyId: 3, LastDb: 5, LastApp: 7, Active: true}, auth.AMRPassword)
+	assert.NoError(t, err)
+	claims, err := app.Auth.VerifyToken(tokens.Token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &auth.ActiveContext{CompanyID: 3, DbID: 5, AppID: 7}, claims.Context)
+	}
+
+	tokens, err = app.issueTokenPair(httptest.NewRecorder(), req, &models.User{ID: 1, Active: true}, auth.AMRPassword)
+	assert.NoError(t, err)
+	claims, err = app.Auth.VerifyToken(tokens.Token)
+	if assert.NoError(t, err) {
+		assert.Nil(t, claims.Context, "no context is chosen")
+	}
+}
+
+// TestSwitchSessionContext tests that users switch to the companies, databases and apps they are
+// entitled to only, that the tokens are issued again in their session and that the choice is kept.
+func TestSwitchSessionContext(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := sessionsApp(mockDB)
+	mockDB.On("UserInCompany", 1, 4).Return(true, nil)
+	mockDB.On("UserInCompany", 1, 9).Return(false, nil)
+	mockDB.On("GetDBGrant", 1, 6).Return(&models.DBGrant{UserID: 1, DbID: 6}, nil)
+	mockDB.On("GetDBGrant", 1, 9).Return((*models.DBGrant)(nil), errors.New("user 1 has no grant on database 9"))
+	mockDB.On("GetAppGrant", 1, 9).Return((*models.AppGrant)(nil), errors.New("user 1 has no grant on app 9"))
+	mockDB.On("UpdateUserContext", 1, 6, 7).Return(nil).Once()
+	routes := app.Routes()
+
+	tokens, err := app.Auth.GenerateTokenPair(&auth.JWTUser{ID: 1, Email: "user@example.com", AMR: []string{auth.AMRPassword}, SessionID: 5,
+		Context: &auth.ActiveContext{CompanyID: 3, DbID: 5, AppID: 7}})
+	assert.NoError(t, err)
+	switchContext := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/session/context", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := switchContext(tokens.Token, `{"company_id": 4, "db_id": 6}`)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	var resp struct {
+		auth.TokenPairs
+		Context auth.ActiveContext `json:"ctx"`
+	}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, auth.ActiveContext{CompanyID: 4, DbID: 6, AppID: 7}, resp.Context)
+	claims, err := app.Auth.VerifyToken(resp.Token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &resp.Context, claims.Context)
+		assert.Equal(t, 5, claims.SessionID)
+		assert.Equal(t, []string{auth.AMRPassword}, claims.AMR)
+	}
+	assert.NotEmpty(t, rr.Result().Cookies(), "the refresh token is set again")
+
+	req := httptest.NewRequest(http.MethodGet, "/session/context", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.Token)
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	assert.JSONEq(t, `{"company_id": 4, "db_id": 6, "app_id": 7}`, rr.Body.String())
+
+	assert.Equal(t, http.StatusForbidden, switchContext(tokens.Token, `{"company_id": 9}`).Code)
+	assert.Equal(t, http.StatusForbidden, switchContext(tokens.Token, `{"db_id": 9}`).Code)
+	assert.Equal(t, http.StatusForbidden, switchContext(tokens.Token, `{"app_id": 9}`).Code)
+	mockDB.AssertExpectations(t)
+
+	appToken, err := app.Auth.GenerateAppToken(&auth.JWTUser{ID: 1, Email: "user@example.com"}, 7, auth.AppTokenOptions{Audience: "https://crm.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, switchContext(appToken, `{"db_id": 6}`).Code, "an app token cannot get a login token pair")
+	mockDB.AssertNumberOfCalls(t, "UpdateUserContext", 1)
+	mockDB.AssertNotCalled(t, "GetAppGrant", 1, 7)
+}
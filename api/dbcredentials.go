@@ -0,0 +1,163 @@
+package api
+
+import (
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Default lifetimes of the dynamic database credentials.
+// They are used when AuthServerApp.DBCredentialTTL or DBCredentialMaxTTL are not set.
+const (
+	defaultDBCredentialTTL    = time.Hour
+	defaultDBCredentialMaxTTL = time.Hour * 8
+)
+
+// newRoleName builds the name of a temporary database role for a user.
+// It only contains lower case letters, digits and underscores, so it can be used in psql without quoting.
+func newRoleName(userID int) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("dyn_%d_%s", userID, hex.EncodeToString(b)), nil
+}
+
+// dbCredentialTTL returns the lifetime requested by the client in seconds,
+// falling back to the configured default and capped to the configured maximum.
+func (app *AuthServerApp) dbCredentialTTL(requested int) time.Duration {
+	ttl := app.DBCredentialTTL
+	if ttl <= 0 {
+		ttl = defaultDBCredentialTTL
+	}
+	maxTTL := app.DBCredentialMaxTTL
+	if maxTTL <= 0 {
+		maxTTL = defaultDBCredentialMaxTTL
+	}
+	if requested > 0 {
+		ttl = time.Duration(requested) * time.Second
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+// CreateDBCredential creates a temporary Postgres role for the authenticated user
+// with the privileges of the user's grant on the database given in the URL.
+// The body is optional and may hold the requested lifetime in seconds: {"ttl": 900}.
+// The password is returned only in this response, the reaper drops the role once it expires.
+func (app *AuthServerApp) CreateDBCredential(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("id is missing in URL"), http.StatusBadRequest)
+		return
+	}
+
+	dbID, err := strconv.Atoi(id)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	var payload struct {
+		TTL int `json:"ttl"`
+	}
+	if r.ContentLength > 0 {
+		if err := (utils.JSONResponse{}).ReadJSON(w, r, &payload); err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, err)
+			return
+		}
+	}
+
+	grant, err := app.DB.GetDBGrant(claims.UserID, dbID)
+	if errors.Is(err, dbrepo.ErrNoDBGrant) {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("you have no access to this database"), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not check the database grant"), http.StatusInternalServerError)
+		return
+	}
+
+	role, err := newRoleName(claims.UserID)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	password, err := utils.RandomToken(24)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Now().Add(app.dbCredentialTTL(payload.TTL)).Unix()
+	cred, err := app.DB.CreateDBCredential(*grant, role, password, expiresAt)
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not create database credentials"), http.StatusInternalServerError)
+		return
+	}
+
+	utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, cred)
+}
+
+// ReapDBCredentials drops the roles of all the dynamic credentials that have expired.
+// It returns how many were revoked. A credential that fails is left for the next run.
+func (app *AuthServerApp) ReapDBCredentials() (int, error) {
+	creds, err := app.DB.ExpiredDBCredentials(time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, cred := range creds {
+		if err := app.DB.RevokeDBCredential(*cred); err != nil {
+			logerror.LogError(err)
+			continue
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// StartDBCredentialReaper runs ReapDBCredentials every interval until the context is cancelled.
+// It is meant to be started in its own goroutine from main.
+func (app *AuthServerApp) StartDBCredentialReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			revoked, err := app.ReapDBCredentials()
+			if err != nil {
+				logerror.LogError(err)
+				continue
+			}
+			if revoked > 0 {
+				log.Printf("Revoked %d expired database credentials", revoked)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// withClaims returns a copy of the request carrying the claims the way authRequired stores them.
+func withClaims(r *http.Request, claims *auth.Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey, claims))
+}
+
+// TestCreateDBCredentialHandler tests that a granted user gets a temporary role
+// with the requested lifetime and a generated password.
+func TestCreateDBCredentialHandler(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+
+	grant := &models.DBGrant{ID: 1, UserID: 2, DbID: 3, DbName: "sales", Schema: "public", Privileges: pq.StringArray{"SELECT"}}
+	mockDB.On("GetDBGrant", 2, 3).Return(grant, nil)
+	roleIsForUser := mock.MatchedBy(func(role string) bool { return strings.HasPrefix(role, "dyn_2_") })
+	passwordIsSet := mock.MatchedBy(func(password string) bool { return len(password) >= 32 })
+	expiresInTenMinutes := mock.MatchedBy(func(expiresAt int64) bool {
+		diff := expiresAt - time.Now().Add(10*time.Minute).Unix()
+		return diff >= -5 && diff <= 5
+	})
+	mockDB.On("CreateDBCredential", *grant, roleIsForUser, passwordIsSet, expiresInTenMinutes).
+		Return(&models.DBCredential{ID: 7, UserID: 2, GrantID: 1, Role: "dyn_2_abc", Password: "secret"}, nil)
+
+	app := &AuthServerApp{DB: mockDB}
+
+	r := chi.NewRouter()
+	r.Post("/dbs/{id}/credentials", app.CreateDBCredential)
+
+	req := httptest.NewRequest(http.MethodPost, "/dbs/3/credentials", strings.NewReader(`{"ttl":600}`))
+	req = withClaims(req, &auth.Claims{UserID: 2})
+	rr := httptest.NewRecorder()
+
+	r.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	var cred models.DBCredential
+	err := json.NewDecoder(rr.Body).Decode(&cred)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, cred.ID)
+	assert.Equal(t, "dyn_2_abc", cred.Role)
+	assert.Equal(t, "secret", cred.Password)
+
+	mockDB.AssertExpectations(t)
+}
+
+// TestCreateDBCredentialHandler_NoGrant tests that a user without a grant is refused, and that the
+// other errors of the grant lookup are not answered as a refusal.
+func TestCreateDBCredentialHandler_NoGrant(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("GetDBGrant", 2, 3).Return((*models.DBGrant)(nil), fmt.Errorf("user 2 has no grant on database 3: %w", dbrepo.ErrNoDBGrant))
+	mockDB.On("GetDBGrant", 2, 4).Return((*models.DBGrant)(nil), errors.New("pq: connection refused"))
+
+	app := &AuthServerApp{DB: mockDB}
+
+	r := chi.NewRouter()
+	r.Post("/dbs/{id}/credentials", app.CreateDBCredential)
+
+	req := httptest.NewRequest(http.MethodPost, "/dbs/3/credentials", nil)
+	req = withClaims(req, &auth.Claims{UserID: 2})
+	rr := httptest.NewRecorder()
+
+	r.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "user 2")
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, withClaims(httptest.NewRequest(http.MethodPost, "/dbs/4/credentials", nil), &auth.Claims{UserID: 2}))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "pq:")
+	mockDB.AssertNotCalled(t, "CreateDBCredential", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+// TestDBCredentialTTL tests the defaults and the cap of the credential lifetime.
+func TestDBCredentialTTL(t *testing.T) {
+	app := &AuthServerApp{}
+	assert.Equal(t, defaultDBCredentialTTL, app.dbCredentialTTL(0))
+	assert.Equal(t, defaultDBCredentialMaxTTL, app.dbCredentialTTL(int((100 * time.Hour).Seconds())))
+
+	app.DBCredentialTTL = time.Minute * 5
+	app.DBCredentialMaxTTL = time.Minute * 30
+	assert.Equal(t, time.Minute*5, app.dbCredentialTTL(0))
+	assert.Equal(t, time.Minute*10, app.dbCredentialTTL(600))
+	assert.Equal(t, time.Minute*30, app.dbCredentialTTL(3600))
+}
+
+// TestReapDBCredentials tests that every expired credential is revoked
+// and that a failing one does not stop the others.
+func TestReapDBCredentials(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+
+	expired := []*models.DBCredential{
+		{ID: 1, Role: "dyn_2_a"},
+		{ID: 2, Role: "dyn_2_b"},
+	}
+	mockDB.On("ExpiredDBCredentials", mock.AnythingOfType("int64")).Return(expired, nil)
+	mockDB.On("RevokeDBCredential", *expired[0]).Return(errors.New("role is in use"))
+	mockDB.On("RevokeDBCredential", *expired[1]).Return(nil)
+
+	app := &AuthServerApp{DB: mockDB}
+
+	revoked, err := app.ReapDBCredentials()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, revoked)
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/federation"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+// federationCookieName is the cookie that keeps the state, nonce and PKCE verifier
+// of a federated login between the redirect to the provider and the callback.
+const federationCookieName = "federation_state"
+
+// federationCookieTTL is how long a user has to log in at the provider.
+const federationCookieTTL = time.Minute * 10
+
+// errNoLocalUser is returned when an upstream identity does not belong to any local user.
+var errNoLocalUser = errors.New("no local account for this identity")
+
+// FederatedLogin redirects the browser to the login page of the upstream provider named in the URL.
+func (app *AuthServerApp) FederatedLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.Federation[chi.URLParam(r, "provider")]
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unknown identity provider"), http.StatusNotFound)
+		return
+	}
+
+	state, err := utils.RandomToken(24)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	nonce, err := utils.RandomToken(24)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     federationCookieName,
+		Path:     "/login",
+		Value:    strings.Join([]string{state, nonce, verifier}, "."),
+		MaxAge:   int(federationCookieTTL.Seconds()),
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   true,
+	})
+
+	http.Redirect(w, r, provider.AuthCodeURL(state, nonce, verifier), http.StatusFound)
+}
+
+// FederatedCallback is where the upstream provider sends the browser back after the login.
+// It checks the state, exchanges the code, finds the local user of the upstream identity
+// and issues the server's own token pair. When FederationRedirectURL is set the browser is sent there
+// and the frontend gets its access token from /refresh, otherwise the tokens are returned as JSON.
+func (app *AuthServerApp) FederatedCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.Federation[chi.URLParam(r, "provider")]
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unknown identity provider"), http.StatusNotFound)
+		return
+	}
+
+	// the state cookie is only good for one callback
+	http.SetCookie(w, &http.Cookie{
+		Name:     federationCookieName,
+		Path:     "/login",
+		Value:    "",
+		MaxAge:   -1,
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   true,
+	})
+
+	if upstreamErr := r.URL.Query().Get("error"); upstreamErr != "" {
+		app.recordLogin(r, nil, "", auth.AMRFederated, reasonUpstream)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("login failed at the identity provider: "+upstreamErr), http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(federationCookieName)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("login session not found or expired"), http.StatusBadRequest)
+		return
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || parts[0] != r.URL.Query().Get("state") {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("invalid login state"), http.StatusBadRequest)
+		return
+	}
+
+	identity, err := provider.Exchange(r.Context(), r.URL.Query().Get("code"), parts[1], parts[2])
+	if err != nil {
+		logerror.LogError(err)
+		app.recordLogin(r, nil, "", auth.AMRFederated, reasonInvalidToken)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not verify the identity provider response"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.federatedUser(provider, identity)
+	if err != nil {
+		reason := reasonUnknownUser
+		if errors.Is(err, errInactiveUser) {
+			reason = reasonInactive
+		}
+		app.recordLogin(r, nil, identity.Email, auth.AMRFederated, reason)
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	tokens, err := app.issueTokenPair(w, r, user, auth.AMRFederated)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, tokenPairStatus(err))
+		return
+	}
+	app.recordLogin(r, user, "", auth.AMRFederated, "")
+
+	if app.FederationRedirectURL != "" {
+		http.Redirect(w, r, app.FederationRedirectURL, http.StatusFound)
+		return
+	}
+	utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, tokens)
+}
+
+// federatedUser returns the local user of an upstream identity. An account linked before is used
+// directly, otherwise the user is matched by email, which the provider must have verified,
+// and the upstream account is linked to it for the next logins. When the provider has provisioning
+// enabled, a user is created for an unknown identity and the attributes of a known one are
+// updated from its claims on every login. A deactivated user is refused with errInactiveUser.
+func (app *AuthServerApp) federatedUser(provider *federation.Provider, identity *federation.Identity) (*models.User, error) {
+	rules := provider.Provisioning()
+
+	var user *models.User
+	link, err := app.DB.GetUserIdentity(identity.Provider, identity.Subject)
+	if err == nil {
+		user, err = app.DB.GetUserByID(link.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if err := activeUser(user); err != nil {
+			return nil, err
+		}
+	} else {
+		if identity.Email == "" || !identity.EmailVerified {
+			return nil, errors.New("the identity provider did not verify the email address")
+		}
+
+		user, err = app.DB.GetUserByEmail(identity.Email)
+		if err != nil {
+			if !rules.Enabled {
+				return nil, errNoLocalUser
+			}
+			return app.provisionUser(rules, identity)
+		}
+		if err := activeUser(user); err != nil {
+			return nil, err
+		}
+
+		_, err = app.DB.LinkUserIdentity(models.UserIdentity{
+			UserID:   user.ID,
+			Provider: identity.Provider,
+			Subject:  identity.Subject,
+			Email:    identity.Email,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rules.Enabled {
+		attrs, err := rules.Attributes(identity)
+		if err != nil {
+			return nil, err
+		}
+		if applyAttributes(user, attrs) {
+			err = app.DB.UpdateUserAttributes(user.ID, user.CompanyId, user.GroupId, user.ProfileId)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return user, nil
+}
+
+// provisionUser creates the local user of an upstream identity and links the two.
+// The user gets a random password, so it can only log in through its provider.
+func (app *AuthServerApp) provisionUser(rules federation.ProvisioningConfig, identity *federation.Identity) (*models.User, error) {
+	attrs, err := rules.Attributes(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	userName := identity.PreferredUsername
+	if userName == "" {
+		userName = identity.Email
+	}
+
+	user := models.User{
+		UserName:       userName,
+		Password:       string(hash),
+		Active:         true,
+		Email:          identity.Email,
+		ActivationTime: time.Now().Unix(),
+	}
+	applyAttributes(&user, attrs)
+
+	user.ID, err = app.DB.InsertUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = app.DB.LinkUserIdentity(models.UserIdentity{
+		UserID:   user.ID,
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// applyAttributes sets the attributes mapped by the provisioning rules on a user
+// and tells whether any of them changed.
+func applyAttributes(user *models.User, attrs federation.Attributes) bool {
+	changed := false
+	if attrs.CompanyID != nil && *attrs.CompanyID != user.CompanyId {
+		user.CompanyId = *attrs.CompanyID
+		changed = true
+	}
+	if attrs.GroupID != nil && *attrs.GroupID != user.GroupId {
+		user.GroupId = *attrs.GroupID
+		changed = true
+	}
+	if attrs.ProfileID != nil && *attrs.ProfileID != user.ProfileId {
+		user.ProfileId = *attrs.ProfileID
+		changed = true
+	}
+	return changed
+}
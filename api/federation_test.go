@@ -0,0 +1,263 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/federation"
+	"authserver-backend/internal/federation/oidctest"
+	"authserver-backend/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// federationTestApp returns an app with one upstream provider, named keycloak, served by a mock provider.
+func federationTestApp(t *testing.T, mockDB *dbrepo.MockDBRepo, rules federation.ProvisioningConfig) (*AuthServerApp, *oidctest.Provider) {
+	upstream := oidctest.NewProvider("authserver", "client-secret")
+	t.Cleanup(upstream.Close)
+	allowLoginEvents(mockDB)
+
+	providers, err := federation.NewProviders(context.Background(), []federation.ProviderConfig{{
+		Name:         "keycloak",
+		Issuer:       upstream.Issuer(),
+		ClientID:     "authserver",
+		ClientSecret: "client-secret",
+		RedirectURL:  "https://auth.example.com/login/keycloak/callback",
+		Provisioning: rules,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &AuthServerApp{
+		DB:         mockDB,
+		Federation: providers,
+		Auth: auth.Auth{
+			Issuer:        "example.com",
+			Audience:      "example.com",
+			JWTSecret:     "test_secret",
+			TokenExpiry:   time.Minute * 15,
+			RefreshExpiry: time.Hour,
+			CookieName:    "refresh_token",
+		},
+	}
+	return app, upstream
+}
+
+// federatedLogin runs a login through the app and the mock provider and returns the callback response.
+func federatedLogin(t *testing.T, app *AuthServerApp, upstream *oidctest.Provider) *httptest.ResponseRecorder {
+	r := chi.NewRouter()
+	r.Get("/login/{provider}", app.FederatedLogin)
+	r.Get("/login/{provider}/callback", app.FederatedCallback)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/login/keycloak", nil))
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected redirect to the provider, got %d", rr.Code)
+	}
+	stateCookie := rr.Result().Cookies()[0]
+
+	callback, err := upstream.Login(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	req.AddCookie(stateCookie)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
+
+// TestFederatedLogin_MatchByEmail tests that a first login is matched to the local user
+// by verified email, linked, and gets the server's own tokens.
+func TestFederatedLogin_MatchByEmail(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowSessions(mockDB)
+	app, upstream := federationTestApp(t, mockDB, federation.ProvisioningConfig{})
+	upstream.Claims = map[string]any{"email": "user@example.com", "email_verified": true}
+
+	mockDB.On("GetUserIdentity", "keycloak", "upstream-user-1").Return((*models.UserIdentity)(nil), errors.New("not linked"))
+	mockDB.On("GetUserByEmail", "user@example.com").Return(&models.User{ID: 1, Email: "user@example.com", Active: true}, nil)
+	mockDB.On("LinkUserIdentity", models.UserIdentity{UserID: 1, Provider: "keycloak", Subject: "upstream-user-1", Email: "user@example.com"}).Return(3, nil)
+
+	rr := federatedLogin(t, app, upstream)
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	var tokens auth.TokenPairs
+	err := json.NewDecoder(rr.Body).Decode(&tokens)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, tokens.Token)
+
+	var refreshCookie *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "refresh_token" {
+			refreshCookie = c
+		}
+	}
+	if assert.NotNil(t, refreshCookie) {
+		assert.Equal(t, tokens.RefreshToken, refreshCookie.Value)
+	}
+	mockDB.AssertExpectations(t)
+}
+
+// TestFederatedLogin_Linked tests that a linked account logs in as its user and is redirected to the frontend.
+func TestFederatedLogin_Linked(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowSessions(mockDB)
+	app, upstream := federationTestApp(t, mockDB, federation.ProvisioningConfig{})
+	app.FederationRedirectURL = "https://apps.example.com/"
+
+	mockDB.On("GetUserIdentity", "keycloak", "upstream-user-1").Return(&models.UserIdentity{UserID: 2, Provider: "keycloak", Subject: "upstream-user-1"}, nil)
+	mockDB.On("GetUserByID", 2).Return(&models.User{ID: 2, Email: "other@example.com", Active: true}, nil)
+
+	rr := federatedLogin(t, app, upstream)
+
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "https://apps.example.com/", rr.Header().Get("Location"))
+	mockDB.AssertNotCalled(t, "GetUserByEmail", mock.Anything)
+}
+
+// TestFederatedLogin_Inactive tests that a deactivated user is refused, linked or matched by email, and that the reason is recorded.
+func TestFederatedLogin_Inactive(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, upstream := federationTestApp(t, mockDB, federation.ProvisioningConfig{})
+	upstream.Claims = map[string]any{"email": "user@example.com", "email_verified": true}
+
+	mockDB.On("GetUserIdentity", "keycloak", "upstream-user-1").Return(&models.UserIdentity{UserID: 2, Provider: "keycloak", Subject: "upstream-user-1"}, nil).Once()
+	mockDB.On("GetUserByID", 2).Return(&models.User{ID: 2, Email: "user@example.com"}, nil)
+	assert.Equal(t, http.StatusForbidden, federatedLogin(t, app, upstream).Code)
+
+	mockDB.On("GetUserIdentity", "keycloak", "upstream-user-1").Return((*models.UserIdentity)(nil), errors.New("not linked"))
+	mockDB.On("GetUserByEmail", "user@example.com").Return(&models.User{ID: 2, Email: "user@example.com"}, nil)
+	assert.Equal(t, http.StatusForbidden, federatedLogin(t, app, upstream).Code)
+
+	mockDB.AssertNotCalled(t, "LinkUserIdentity", mock.Anything)
+	mockDB.AssertNotCalled(t, "InsertSession", mock.Anything)
+	mockDB.AssertNumberOfCalls(t, "InsertLoginEvent", 2)
+	mockDB.AssertCalled(t, "InsertLoginEvent", mock.MatchedBy(func(e models.LoginEvent) bool {
+		return e.Login == "user@example.com" && !e.Success && e.Method == auth.AMRFederated && e.Reason == reasonInactive
+	}))
+}
+
+// TestFederatedLogin_UnverifiedEmail tests that an unverified email is never used to match a user.
+func TestFederatedLogin_UnverifiedEmail(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, upstream := federationTestApp(t, mockDB, federation.ProvisioningConfig{})
+	upstream.Claims = map[string]any{"email": "admin@example.com", "email_verified": false}
+
+	mockDB.On("GetUserIdentity", "keycloak", "upstream-user-1").Return((*models.UserIdentity)(nil), errors.New("not linked"))
+
+	rr := federatedLogin(t, app, upstream)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	mockDB.AssertNotCalled(t, "GetUserByEmail", mock.Anything)
+}
+
+// TestFederatedCallback_InvalidState tests that a callback without the matching state cookie is refused.
+func TestFederatedCallback_InvalidState(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, _ := federationTestApp(t, mockDB, federation.ProvisioningConfig{})
+
+	r := chi.NewRouter()
+	r.Get("/login/{provider}/callback", app.FederatedCallback)
+
+	req := httptest.NewRequest(http.MethodGet, "/login/keycloak/callback?code=abc&state=forged", nil)
+	req.AddCookie(&http.Cookie{Name: federationCookieName, Value: "real.nonce.verifier"})
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/login/unknown/callback?code=abc&state=x", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// provisioningRules maps example.com to company 1 and the admins group claim to profile 7.
+func provisioningRules() federation.ProvisioningConfig {
+	company, group, profile := 1, 2, 7
+	return federation.ProvisioningConfig{
+		Enabled: true,
+		Domains: map[string]federation.Attributes{"example.com": {CompanyID: &company, GroupID: &group}},
+		ClaimRules: []federation.ClaimRule{
+			{Claim: "groups", Equals: "admins", Set: federation.Attributes{ProfileID: &profile}},
+		},
+	}
+}
+
+// TestFederatedLogin_Provisioning tests that a first login without a local user creates one
+// with the mapped attributes and links it.
+func TestFederatedLogin_Provisioning(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowSessions(mockDB)
+	app, upstream := federationTestApp(t, mockDB, provisioningRules())
+	upstream.Claims = map[string]any{
+		"email":              "new@example.com",
+		"email_verified":     true,
+		"preferred_username": "newuser",
+		"groups":             []string{"staff", "admins"},
+	}
+
+	mockDB.On("GetUserIdentity", "keycloak", "upstream-user-1").Return((*models.UserIdentity)(nil), errors.New("not linked"))
+	mockDB.On("GetUserByEmail", "new@example.com").Return((*models.User)(nil), errors.New("no user"))
+	mockDB.On("InsertUser", mock.MatchedBy(func(u models.User) bool {
+		return u.UserName == "newuser" && u.Email == "new@example.com" && u.Active &&
+			u.CompanyId == 1 && u.GroupId == 2 && u.ProfileId == 7 && u.Password != ""
+	})).Return(12, nil)
+	mockDB.On("LinkUserIdentity", models.UserIdentity{UserID: 12, Provider: "keycloak", Subject: "upstream-user-1", Email: "new@example.com"}).Return(4, nil)
+
+	rr := federatedLogin(t, app, upstream)
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	mockDB.AssertExpectations(t)
+}
+
+// TestFederatedLogin_ProvisioningDisabled tests that no user is created when the provider does not allow it.
+func TestFederatedLogin_ProvisioningDisabled(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	rules := provisioningRules()
+	rules.Enabled = false
+	app, upstream := federationTestApp(t, mockDB, rules)
+	upstream.Claims = map[string]any{"email": "new@example.com", "email_verified": true}
+
+	mockDB.On("GetUserIdentity", "keycloak", "upstream-user-1").Return((*models.UserIdentity)(nil), errors.New("not linked"))
+	mockDB.On("GetUserByEmail", "new@example.com").Return((*models.User)(nil), errors.New("no user"))
+
+	rr := federatedLogin(t, app, upstream)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	mockDB.AssertNotCalled(t, "InsertUser", mock.Anything)
+}
+
+// TestFederatedLogin_AttributeSync tests that the attributes of a linked user follow the upstream claims
+// on later logins, and are only written when they change.
+func TestFederatedLogin_AttributeSync(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowSessions(mockDB)
+	app, upstream := federationTestApp(t, mockDB, provisioningRules())
+	upstream.Claims = map[string]any{"email": "user@example.com", "email_verified": true, "groups": []string{"admins"}}
+
+	mockDB.On("GetUserIdentity", "keycloak", "upstream-user-1").Return(&models.UserIdentity{UserID: 2, Provider: "keycloak", Subject: "upstream-user-1"}, nil)
+	mockDB.On("GetUserByID", 2).Return(&models.User{ID: 2, Email: "user@example.com", CompanyId: 1, GroupId: 2, ProfileId: 3, Active: true}, nil).Once()
+	mockDB.On("UpdateUserAttributes", 2, 1, 2, 7).Return(nil).Once()
+
+	rr := federatedLogin(t, app, upstream)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	// nothing to write when the user already has the mapped attributes
+	mockDB.On("GetUserByID", 2).Return(&models.User{ID: 2, Email: "user@example.com", CompanyId: 1, GroupId: 2, ProfileId: 7, Active: true}, nil).Once()
+
+	rr = federatedLogin(t, app, upstream)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	mockDB.AssertNumberOfCalls(t, "UpdateUserAttributes", 1)
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultForwardAuthCookieName is used when AuthServerApp.ForwardAuthCookieName is not set.
+const defaultForwardAuthCookieName = "auth_session"
+
+// defaultForwardAuthAudience is used when AuthServerApp.ForwardAuthAudience is not set.
+const defaultForwardAuthAudience = "forward-auth"
+
+func (app *AuthServerApp) forwardAuthCookieName() string {
+	if app.ForwardAuthCookieName != "" {
+		return app.ForwardAuthCookieName
+	}
+	return defaultForwardAuthCookieName
+}
+
+func (app *AuthServerApp) forwardAuthAudience() string {
+	if app.ForwardAuthAudience != "" {
+		return app.ForwardAuthAudience
+	}
+	return defaultForwardAuthAudience
+}
+
+// originalURL rebuilds the address the user asked the reverse proxy for.
+// nginx sends it whole in X-Original-URL, Traefik and Caddy split it in the X-Forwarded-* headers.
+func originalURL(r *http.Request) (*url.URL, error) {
+	if original := r.Header.Get("X-Original-URL"); original != "" {
+		return url.Parse(original)
+	}
+
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return nil, errors.New("missing X-Forwarded-Host header")
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = "/"
+	}
+	return url.Parse(proto + "://" + host + uri)
+}
+
+// appForHost returns the catalogue app served on the given host.
+func (app *AuthServerApp) appForHost(host string) (*models.ThisApp, error) {
+	apps, err := app.DB.AllApps("")
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range apps {
+		u, err := url.Parse(launchURL(a))
+		if err != nil || u.Host == "" {
+			continue
+		}
+		if strings.EqualFold(u.Host, host) {
+			return a, nil
+		}
+	}
+	return nil, errors.New("no app is registered for " + host)
+}
+
+// forwardAuthToken returns the claims of the request, either of the access token of the Authorization header
+// or of the forward-auth session token of the cookie set by ForwardAuthSession. A certificate-bound access token
+// is only accepted with its certificate, and the token of an impersonation while it is active.
+func (app *AuthServerApp) forwardAuthToken(r *http.Request) (*auth.Claims, error) {
+	var claims *auth.Claims
+	var err error
+	if r.Header.Get("Authorization") != "" {
+		_, claims, err = app.Auth.GetTokenFromHeaderAndVerify(nil, r)
+	} else {
+		cookie, cookieErr := r.Cookie(app.forwardAuthCookieName())
+		if cookieErr != nil || cookie.Value == "" {
+			return nil, errors.New("no token")
+		}
+		claims, err = app.Auth.VerifyForwardAuthToken(cookie.Value, app.forwardAuthAudience())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCertificateBinding(r, claims); err != nil {
+		return nil, err
+	}
+	if err := app.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// forwardAuthUnauthenticated answers a request without a valid token. Browsers are sent to the login page
+// with the address they asked for, so they come back after logging in. Other clients get a 401.
+// nginx does not pass redirects from auth_request on, it has to map the 401 to the login page with error_page.
+func (app *AuthServerApp) forwardAuthUnauthenticated(w http.ResponseWriter, r *http.Request, original *url.URL) {
+	if app.ForwardAuthLoginURL != "" && original != nil && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		login, err := url.Parse(app.ForwardAuthLoginURL)
+		if err == nil {
+			query := login.Query()
+			query.Set("rd", original.String())
+			login.RawQuery = query.Encode()
+			http.Redirect(w, r, login.String(), http.StatusFound)
+			return
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="`+app.Domain+`"`)
+	utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+}
+
+// ForwardAuth is called by a reverse proxy (nginx auth_request, Traefik ForwardAuth, Caddy forward_auth)
+// before passing a request on to a catalogue app without authentication of its own.
+// It checks the bearer token or the session cookie and the entitlement of the user to the app
+// served on the original host. On success it answers 200 with the user in the
+// X-Auth-User (user id), X-Auth-Email and X-Auth-Roles (comma separated) headers,
+// which the proxy copies to the upstream request. When an admin impersonates the user,
+// X-Auth-Impersonator holds the email of the admin, so the app can show a banner.
+func (app *AuthServerApp) ForwardAuth(w http.ResponseWriter, r *http.Request) {
+	original, err := originalURL(r)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	claims, err := app.forwardAuthToken(r)
+	if err != nil {
+		app.forwardAuthUnauthenticated(w, r, original)
+		return
+	}
+
+	thisapp, err := app.appForHost(original.Host)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	grant, err := app.DB.GetAppGrant(claims.UserID, thisapp.ID)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("user has no access to this app"), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("X-Auth-User", strconv.Itoa(claims.UserID))
+	w.Header().Set("X-Auth-Email", claims.Email)
+	w.Header().Set("X-Auth-Roles", strings.Join(grant.Roles, ","))
+	if claims.Actor != nil {
+		w.Header().Set("X-Auth-Impersonator", claims.Actor.Email)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ForwardAuthSession stores a forward-auth session token for the bearer token of the request in the session
+// cookie read by ForwardAuth, so browsers can open the apps behind the proxy. The cookie is set for CookieDomain,
+// which has to be the parent domain of the apps, and it expires with the token. The apps receive the cookie,
+// so it does not hold the access token: its token has the ForwardAuthAudience and is only accepted by ForwardAuth.
+// A certificate-bound token opens no session.
+func (app *AuthServerApp) ForwardAuthSession(w http.ResponseWriter, r *http.Request) {
+	_, claims, err := app.Auth.GetTokenFromHeaderAndVerify(w, r)
+	if err == nil {
+		err = checkCertificateBinding(r, claims)
+	}
+	if err == nil {
+		err = app.checkClaims(claims)
+	}
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	token, err := app.Auth.GenerateForwardAuthToken(claims, app.forwardAuthAudience())
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     app.forwardAuthCookieName(),
+		Path:     "/",
+		Value:    token,
+		Expires:  time.Unix(claims.ExpiresAt, 0),
+		SameSite: http.SameSiteLaxMode,
+		Domain:   app.Auth.CookieDomain,
+		HttpOnly: true,
+		Secure:   true,
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ForwardAuthLogout removes the session cookie set by ForwardAuthSession.
+func (app *AuthServerApp) ForwardAuthLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     app.forwardAuthCookieName(),
+		Path:     "/",
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		SameSite: http.SameSiteLaxMode,
+		Domain:   app.Auth.CookieDomain,
+		HttpOnly: true,
+		Secure:   true,
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
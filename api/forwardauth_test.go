@@ -0,0 +1,204 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// forwardAuthApp returns an app with two catalogue apps and a token for user 1.
+func forwardAuthApp(t *testing.T) (*AuthServerApp, *dbrepo.MockDBRepo, string) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("AllApps").Return([]*models.ThisApp{
+		{ID: 7, NewApp: models.NewApp{URL: "https://crm.example.com"}},
+		{ID: 8, NewApp: models.NewApp{Web: "https://wiki.example.com:8443/home"}},
+	}, nil)
+
+	app := &AuthServerApp{
+		DB:                  mockDB,
+		ForwardAuthLoginURL: "https://auth.example.com/login",
+		Auth: auth.Auth{
+			Issuer:       "example.com",
+			Audience:     "example.com",
+			JWTSecret:    "test_secret",
+			TokenExpiry:  time.Minute * 15,
+			CookieDomain: "example.com",
+		},
+	}
+
+	tokens, err := app.Auth.GenerateTokenPair(&auth.JWTUser{ID: 1, Email: "user@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app, mockDB, tokens.Token
+}
+
+// TestForwardAuth tests that an entitled user is let through with the identity headers.
+func TestForwardAuth(t *testing.T) {
+	app, mockDB, token := forwardAuthApp(t)
+	mockDB.On("GetAppGrant", 1, 7).Return(&models.AppGrant{UserID: 1, AppID: 7, Roles: pq.StringArray{"viewer", "editor"}}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/forward-auth", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "crm.example.com")
+	req.Header.Set("X-Forwarded-Uri", "/customers/1")
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(app.ForwardAuth).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("X-Auth-User"))
+	assert.Equal(t, "user@example.com", rr.Header().Get("X-Auth-Email"))
+	assert.Equal(t, "viewer,editor", rr.Header().Get("X-Auth-Roles"))
+}
+
+// TestForwardAuth_SessionCookie tests that the session cookie is accepted, but not with an access token, and that
+// the nginx X-Original-URL header is understood.
+func TestForwardAuth_SessionCookie(t *testing.T) {
+	app, mockDB, token := forwardAuthApp(t)
+	mockDB.On("GetAppGrant", 1, 8).Return(&models.AppGrant{UserID: 1, AppID: 8}, nil)
+	claims, err := app.Auth.VerifyAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := app.Auth.GenerateForwardAuthToken(claims, defaultForwardAuthAudience)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwardAuth := func(cookie string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/forward-auth", nil)
+		req.AddCookie(&http.Cookie{Name: defaultForwardAuthCookieName, Value: cookie})
+		req.Header.Set("X-Original-URL", "https://wiki.example.com:8443/page")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.ForwardAuth).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := forwardAuth(session)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("X-Auth-User"))
+	assert.Equal(t, "", rr.Header().Get("X-Auth-Roles"))
+
+	assert.Equal(t, http.StatusUnauthorized, forwardAuth(token).Code, "an access token in the cookie")
+}
+
+// TestForwardAuth_CertificateBound tests that a certificate-bound token is refused without its certificate,
+// and opens no forward-auth session.
+func TestForwardAuth_CertificateBound(t *testing.T) {
+	app, _, _ := forwardAuthApp(t)
+	bound, err := app.Auth.GenerateCertificateBoundToken(&auth.JWTUser{ID: 1, Email: "user@example.com"}, "thumbprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/forward-auth", nil)
+	req.Header.Set("Authorization", "Bearer "+bound)
+	req.Header.Set("X-Forwarded-Host", "crm.example.com")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.ForwardAuth).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/forward-auth/session", nil)
+	req.Header.Set("Authorization", "Bearer "+bound)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(app.ForwardAuthSession).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+}
+
+// TestForwardAuth_NotEntitled tests that a valid user without a grant on the app is forbidden.
+func TestForwardAuth_NotEntitled(t *testing.T) {
+	app, mockDB, token := forwardAuthApp(t)
+	mockDB.On("GetAppGrant", 1, 7).Return((*models.AppGrant)(nil), errors.New("user 1 has no grant on app 7"))
+
+	req := httptest.NewRequest(http.MethodGet, "/forward-auth", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Forwarded-Host", "crm.example.com")
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(app.ForwardAuth).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+// TestForwardAuth_UnknownHost tests that hosts outside the catalogue are forbidden.
+func TestForwardAuth_UnknownHost(t *testing.T) {
+	app, _, token := forwardAuthApp(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/forward-auth", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Forwarded-Host", "other.example.org")
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(app.ForwardAuth).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+// TestForwardAuth_Unauthenticated tests that API clients get a 401
+// and browsers are redirected to the login page with the original address.
+func TestForwardAuth_Unauthenticated(t *testing.T) {
+	app, _, _ := forwardAuthApp(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/forward-auth", nil)
+	req.Header.Set("X-Forwarded-Host", "crm.example.com")
+	req.Header.Set("X-Forwarded-Uri", "/customers")
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(app.ForwardAuth).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("WWW-Authenticate"))
+
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rr = httptest.NewRecorder()
+
+	http.HandlerFunc(app.ForwardAuth).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusFound, rr.Code)
+	location, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "auth.example.com", location.Host)
+	assert.Equal(t, "https://crm.example.com/customers", location.Query().Get("rd"))
+}
+
+// TestForwardAuthSession tests that a forward-auth session token is stored in the session cookie for the parent domain,
+// and that the server does not accept it as an access token.
+func TestForwardAuthSession(t *testing.T) {
+	app, _, token := forwardAuthApp(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/forward-auth/session", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(app.ForwardAuthSession).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	cookies := rr.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, defaultForwardAuthCookieName, cookies[0].Name)
+	assert.NotEqual(t, token, cookies[0].Value)
+	assert.Equal(t, "example.com", cookies[0].Domain)
+	assert.True(t, cookies[0].HttpOnly)
+
+	claims, err := app.Auth.VerifyForwardAuthToken(cookies[0].Value, defaultForwardAuthAudience)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, claims.UserID)
+		assert.Equal(t, defaultForwardAuthAudience, claims.Audience)
+	}
+	replay := httptest.NewRequest(http.MethodGet, "/", nil)
+	replay.Header.Set("Authorization", "Bearer "+cookies[0].Value)
+	_, _, err = app.Auth.GetTokenFromHeaderAndVerify(httptest.NewRecorder(), replay)
+	assert.Error(t, err, "an app replaying the cookie")
+}
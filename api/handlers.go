@@ -7,16 +7,28 @@ package api
 
 import (
 	"authserver-backend/auth"
+	"authserver-backend/internal/authenticator"
+	"authserver-backend/internal/csrf"
 	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/events"
+	"authserver-backend/internal/federation"
+	"authserver-backend/internal/mailer"
 	"authserver-backend/internal/models"
+	"authserver-backend/internal/mtls"
+	"authserver-backend/internal/ratelimit"
+	"authserver-backend/internal/sessionpolicy"
 	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"crypto/ed25519"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/crewjam/saml"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -35,6 +47,91 @@ type AuthServerApp struct {
 	JWTIssuer    string
 	JWTAudience  string
 	CookieDomain string
+	// DBCredentialTTL is the default lifetime of the dynamic database credentials
+	// and DBCredentialMaxTTL the longest lifetime a client can ask for.
+	DBCredentialTTL    time.Duration
+	DBCredentialMaxTTL time.Duration
+	// LaunchCodeTTL is how long a launch code for a catalogue app can be exchanged.
+	LaunchCodeTTL time.Duration
+	// ForwardAuthLoginURL is where browsers without a session are sent by ForwardAuth,
+	// ForwardAuthCookieName the cookie holding their session token and ForwardAuthAudience its audience.
+	ForwardAuthLoginURL   string
+	ForwardAuthCookieName string
+	ForwardAuthAudience   string
+	// Federation holds the upstream OpenID Connect providers users can log in with,
+	// FederationRedirectURL is the frontend page the browser is sent to after such a login,
+	// or after following a magic login link.
+	Federation            federation.Providers
+	FederationRedirectURL string
+	// SAML is the SAML identity provider of the catalogue apps, nil when it is not configured.
+	SAML *saml.IdentityProvider
+	// Authenticator checks the credentials given to Authenticate,
+	// the local passwords when it is not set.
+	Authenticator authenticator.Authenticator
+	// Mailer sends the passwordless login emails, passwordless login is disabled when it is not set.
+	// MagicLinkURL is the page the emailed link points to, MagicLinkVerify when it is empty,
+	// and MagicLinkTTL how long the link and code can be used.
+	Mailer       mailer.Mailer
+	MagicLinkURL string
+	MagicLinkTTL time.Duration
+	// PersonalAccessTokenTTL is the default lifetime of the personal access tokens
+	// and PersonalAccessTokenMaxTTL the longest lifetime a user can ask for.
+	PersonalAccessTokenTTL    time.Duration
+	PersonalAccessTokenMaxTTL time.Duration
+	// ClientCertificates maps the TLS client certificates to users,
+	// certificate authentication is disabled when it is nil.
+	ClientCertificates *mtls.Config
+	// StepUpMaxAge is how recent the multi-factor authentication required by the sensitive admin routes must be.
+	StepUpMaxAge time.Duration
+	// RateLimitStore keeps the rate limit buckets of the authentication routes, they are not limited
+	// when it is not set. RateLimits holds the policies of the routes, the default ones when it is empty.
+	RateLimitStore ratelimit.Store
+	RateLimits     ratelimit.Config
+	// AuditSigningKey signs the checkpoints of the hash-chained audit logs, none are signed when it is nil.
+	AuditSigningKey ed25519.PrivateKey
+	// Events publishes the security events to the outbound integrations, like the webhooks.
+	// Nothing is published when it is nil.
+	Events *events.Bus
+	// AllowPrivateWebhooks lets the webhooks target the loopback and private addresses, see webhook.ErrPrivateTarget.
+	AllowPrivateWebhooks bool
+	// ImpersonationTTL is how long an admin can impersonate a user before starting again.
+	ImpersonationTTL time.Duration
+	// SessionPolicies limit the concurrent sessions of the users and how long they may stay idle,
+	// nothing is limited when it is empty. Activity batches the writes of the last seen times of the
+	// sessions, they are written on every use, at most once a minute, when it is nil.
+	SessionPolicies sessionpolicy.Config
+	Activity        *sessionpolicy.Tracker
+	// TrustedDeviceTTL is how long the browsers users trust after a step-up skip the second factor of stepUpRequired,
+	// TrustedDeviceCookieName the cookie they are remembered with.
+	TrustedDeviceTTL        time.Duration
+	TrustedDeviceCookieName string
+	// AdminProfiles are the profiles of the admins, the only users who can call the /admin routes
+	// and give the admin scope to their personal access tokens. Nobody can when it is empty.
+	AdminProfiles []int
+}
+
+// authenticator returns the configured authenticator, or the local one.
+func (app *AuthServerApp) authenticator() authenticator.Authenticator {
+	if app.Authenticator != nil {
+		return app.Authenticator
+	}
+	return authenticator.Local{DB: app.DB}
+}
+
+// errInactiveUser refuses the logins and the tokens of a deactivated user.
+var errInactiveUser = errors.New("the account is deactivated")
+
+// activeUser returns errInactiveUser when a user was deactivated. Every way of getting tokens checks it.
+func activeUser(user *models.User) error {
+	if user == nil || !user.Active {
+		return errInactiveUser
+	}
+	return nil
+}
+
+// isAdmin tells whether the user has one of the AdminProfiles.
+func (app *AuthServerApp) isAdmin(user *models.User) bool {
+	return slices.Contains(app.AdminProfiles, user.ProfileId)
 }
 
 // Home is a simple handler that responds with a JSON payload indicating the service status.
@@ -198,6 +295,7 @@ func (app *AuthServerApp) InsertApp(w http.ResponseWriter, r *http.Request) {
 		utils.JSONResponse{}.ErrorJSON(w, err)
 		return
 	}
+	app.recordAdminEvent(r, models.AdminActionCreate, auditEntityApp, newID, nil, models.ThisApp{ID: newID, NewApp: newapp})
 
 	resp := utils.JSONResponse{
 		Error:   false,
@@ -228,6 +326,7 @@ func (app *AuthServerApp) UpdateApp(w http.ResponseWriter, r *http.Request) {
 		utils.JSONResponse{}.ErrorJSON(w, err)
 		return
 	}
+	before := *thisapp
 
 	thisapp.ID = payload.ID
 	thisapp.Name = payload.Name
@@ -245,6 +344,7 @@ func (app *AuthServerApp) UpdateApp(w http.ResponseWriter, r *http.Request) {
 		utils.JSONResponse{}.ErrorJSON(w, err)
 		return
 	}
+	app.recordAdminEvent(r, models.AdminActionUpdate, auditEntityApp, thisapp.ID, before, *thisapp)
 
 	resp := utils.JSONResponse{
 		Error:   false,
@@ -270,11 +370,18 @@ func (app *AuthServerApp) DeleteApp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the deleted app is kept in the audit log
+	before, err := app.DB.ThisApp(appID, "")
+	if err != nil {
+		logerror.LogError(err)
+	}
+
 	err = app.DB.DeleteApp(appID)
 	if err != nil {
 		utils.JSONResponse{}.ErrorJSON(w, err)
 		return
 	}
+	app.recordAdminEvent(r, models.AdminActionDelete, auditEntityApp, appID, before, nil)
 
 	resp := utils.JSONResponse{
 		Error:   false,
@@ -316,65 +423,132 @@ func (app *AuthServerApp) Authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// validate user against database
-	user, err := app.DB.GetUserByEmail(requestPayload.Email)
+	// the directories also accept a username
+	login := requestPayload.Email
+	if login == "" {
+		login = requestPayload.UserName
+	}
 
-	if err != nil {
+	// check the credentials with the configured authenticators
+	user, err := app.authenticator().Authenticate(r.Context(), login, requestPayload.Password)
+	switch {
+	case errors.Is(err, authenticator.ErrUnknownUser):
+		app.recordLogin(r, nil, login, auth.AMRPassword, reasonUnknownUser)
 		utils.JSONResponse{}.ErrorJSON(w, errors.New("user not found or database error"), http.StatusBadRequest)
 		return
-	}
-	//check password
-	valid, err := app.User.PasswordMatches(requestPayload.Password, user.Password)
-	if err != nil {
+	case errors.Is(err, authenticator.ErrInvalidCredentials):
+		app.recordLogin(r, nil, login, auth.AMRPassword, reasonInvalidPassword)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("invalid password"), http.StatusUnauthorized)
+		return
+	case err != nil:
+		logerror.LogError(err)
+		app.recordLogin(r, nil, login, auth.AMRPassword, reasonError)
 		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
 		return
-	} else if !valid {
-		utils.JSONResponse{}.ErrorJSON(w, errors.New("invalid password"), http.StatusUnauthorized)
+	}
+
+	// a trusted device stands for the second factor
+	tokens, err := app.issueTokenPair(w, r, user, app.passwordAMR(r, user)...)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, tokenPairStatus(err))
 		return
 	}
+	app.recordLogin(r, user, login, auth.AMRPassword, "")
+
+	utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, tokens)
+
+}
+
+// issueTokenPair generates the token pair of a user who just logged in and sets the refresh token
+// in an http only cookie. Every way of logging in ends here, whatever checked the user's identity;
+// amr lists the methods it used, the tokens record them with the time of the login.
+// The login starts a session for the device of the request, in the context of userContext; a step-up
+// stays in the session and the context of its token.
+// A login past the session limit of the user fails with errSessionLimit when the policy denies it,
+// the login of a deactivated user with errInactiveUser.
+func (app *AuthServerApp) issueTokenPair(w http.ResponseWriter, r *http.Request, user *models.User, amr ...string) (auth.TokenPairs, error) {
+	if err := activeUser(user); err != nil {
+		app.recordLogin(r, user, "", amr[0], reasonInactive)
+		return auth.TokenPairs{}, err
+	}
 
 	// create a jwt user
 	u := auth.JWTUser{
-		ID:    user.ID,
-		Email: user.Email,
+		ID:       user.ID,
+		Email:    user.Email,
+		AMR:      amr,
+		AuthTime: time.Now().Unix(),
+		Context:  userContext(user),
+	}
+
+	var err error
+	if claims, ok := claimsFromContext(r.Context()); ok && claims.UserID == user.ID && claims.SessionID != 0 {
+		u.SessionID = claims.SessionID
+		u.Context = claims.Context
+		err = app.DB.TouchSession(u.SessionID, u.AuthTime, time.Now().Add(app.sessionLifetime()).Unix())
+	} else {
+		u.SessionID, err = app.startSession(r, user)
+	}
+	if errors.Is(err, errSessionLimit) {
+		app.recordLogin(r, user, "", amr[0], reasonSessionLimit)
+		return auth.TokenPairs{}, err
+	}
+	if err != nil {
+		logerror.LogError(err)
+		return auth.TokenPairs{}, errors.New("could not start the session")
 	}
 
 	//generate tokens
 	tokens, err := app.Auth.GenerateTokenPair(&u)
-
 	if err != nil {
-		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
-		return
+		return auth.TokenPairs{}, err
 	}
+
 	// set the refresh token in an http only cookie
+	app.setRefreshCookie(w, &tokens)
+
+	return tokens, nil
+}
+
+// setRefreshCookie sets the refresh token of the tokens in an http only cookie, with the CSRF token
+// of that cookie in a cookie the frontend can read. The CSRF token is also added to the tokens.
+func (app *AuthServerApp) setRefreshCookie(w http.ResponseWriter, tokens *auth.TokenPairs) {
 	refreshCookie := app.Auth.GetRefreshCookie(tokens.RefreshToken)
 	http.SetCookie(w, refreshCookie)
 
-	utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, tokens)
-
+	tokens.CSRFToken = csrf.Token(app.JWTSecret, tokens.RefreshToken)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrf.CookieName,
+		Path:     "/",
+		Value:    tokens.CSRFToken,
+		Expires:  refreshCookie.Expires,
+		MaxAge:   refreshCookie.MaxAge,
+		SameSite: http.SameSiteStrictMode,
+		Domain:   app.Auth.CookieDomain,
+		Secure:   true,
+	})
 }
 
 // RefreshToken handles the refresh token process.
 // It checks for a valid refresh token in the cookies, verifies it,
 // and issues a new pair of access and refresh tokens if valid.
-// The new refresh token is set in an HTTP-only cookie.
-// If the refresh token is missing, invalid, or expired, it responds with an error message.
+// The new refresh token is set in an HTTP-only cookie, with a new CSRF token.
+// The request must carry the CSRF token of the cookie, see csrfRequired.
+// If the refresh token is missing, invalid, or expired, or the user was deactivated, it responds with an error message.
 func (app *AuthServerApp) RefreshToken(w http.ResponseWriter, r *http.Request) {
 	for _, cookie := range r.Cookies() {
 		if cookie.Name == app.Auth.CookieName {
-			claims := &auth.Claims{}
 			refreshToken := cookie.Value
 			// check if the token is empty
 			if refreshToken == "" {
 				utils.JSONResponse{}.ErrorJSON(w, errors.New("no refresh token found"), http.StatusUnauthorized)
 				return
 			}
-			// parse the token to get the claims
-			_, err := jwt.ParseWithClaims(refreshToken, claims, func(token *jwt.Token) (any, error) {
-				return []byte(app.JWTSecret), nil
-			})
-
+			// validate the token to get the claims
+			// the refresh tokens of the apps are exchanged with RefreshAppToken
+			claims, err := app.Auth.VerifyRefreshToken(refreshToken)
 			if err != nil {
+				app.recordLoginEvent(r, models.LoginEvent{Event: models.LoginEventRefresh, Reason: reasonInvalidToken})
 				utils.JSONResponse{}.ErrorJSON(w, errors.New("no secret was found"), http.StatusUnauthorized)
 				return
 			}
@@ -384,12 +558,32 @@ func (app *AuthServerApp) RefreshToken(w http.ResponseWriter, r *http.Request) {
 			ID := claims.UserID
 			user, err := app.DB.GetUserByID(ID)
 			if err != nil {
+				app.recordLoginEvent(r, models.LoginEvent{UserID: ID, Event: models.LoginEventRefresh, Reason: reasonUnknownUser})
 				http.Error(w, "Unknown user", http.StatusUnauthorized)
 				return
 			}
+			if err := activeUser(user); err != nil {
+				app.recordLoginEvent(r, models.LoginEvent{UserID: user.ID, Login: user.Email, Event: models.LoginEventRefresh, Reason: reasonInactive})
+				utils.JSONResponse{}.ErrorJSON(w, err, http.StatusForbidden)
+				return
+			}
+			// a revoked or idle session cannot be refreshed, the tokens issued before the sessions were tracked carry none
+			var session *models.Session
+			if claims.SessionID != 0 {
+				if session, err = app.activeSession(claims.SessionID); err != nil {
+					app.recordLoginEvent(r, models.LoginEvent{UserID: user.ID, Login: user.Email, Event: models.LoginEventRefresh, Reason: reasonSessionRevoked})
+					utils.JSONResponse{}.ErrorJSON(w, err, http.StatusUnauthorized)
+					return
+				}
+			}
+			// the refreshed tokens keep how and when the user logged in, their session and their context
 			u := auth.JWTUser{
-				ID:    user.ID,
-				Email: user.Email,
+				ID:        user.ID,
+				Email:     user.Email,
+				AMR:       claims.AMR,
+				AuthTime:  claims.AuthTime,
+				SessionID: claims.SessionID,
+				Context:   claims.Context,
 			}
 
 			tokenPairs, err := app.Auth.GenerateTokenPair(&u)
@@ -397,7 +591,14 @@ func (app *AuthServerApp) RefreshToken(w http.ResponseWriter, r *http.Request) {
 				utils.JSONResponse{}.ErrorJSON(w, errors.New("error generating tokens"), http.StatusUnauthorized)
 				return
 			}
-			http.SetCookie(w, app.Auth.GetRefreshCookie(tokenPairs.RefreshToken))
+			// a refresh extends the session but is not an activity of the user, the idle timeout keeps running
+			if session != nil {
+				if err := app.DB.TouchSession(session.ID, session.LastSeen, time.Now().Add(app.sessionLifetime()).Unix()); err != nil {
+					logerror.LogError(err)
+				}
+			}
+			app.setRefreshCookie(w, &tokenPairs)
+			app.recordLoginEvent(r, models.LoginEvent{UserID: user.ID, Login: user.Email, Event: models.LoginEventRefresh, Success: true})
 			w.Header().Set("Content-Type", "AuthServerApp/json")
 			json.NewEncoder(w).Encode(tokenPairs)
 			return
@@ -426,19 +627,14 @@ func (app *AuthServerApp) ValidateSession(w http.ResponseWriter, r *http.Request
 	}
 	tokenString := authHeader[len(prefix):]
 
-	// Parse and validate the token
-	claims := &auth.Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
-		return []byte(app.JWTSecret), nil
-	})
-	if err != nil || !token.Valid {
+	// Validate the token, its signature and its standard claims
+	claims, err := app.Auth.VerifyAccessToken(tokenString)
+	if err != nil {
 		utils.JSONResponse{}.ErrorJSON(w, errors.New("invalid or expired token"), http.StatusUnauthorized)
 		return
 	}
-
-	// Check expiration (optional, as jwt.ParseWithClaims already does this)
-	if claims.ExpiresAt < time.Now().Unix() {
-		utils.JSONResponse{}.ErrorJSON(w, errors.New("token expired"), http.StatusUnauthorized)
+	if err := app.checkClaims(claims); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusUnauthorized)
 		return
 	}
 
@@ -453,8 +649,37 @@ func (app *AuthServerApp) ValidateSession(w http.ResponseWriter, r *http.Request
 
 // Logout invalidates the user's session by setting an expired refresh token cookie.
 // This effectively logs the user out by removing the ability to refresh the JWT token.
+// The session of the refresh token is revoked, so its access tokens are refused too.
+// The CSRF token cookie goes with it.
 // It responds with an HTTP 202 Accepted status to indicate the logout request was processed.
 func (app *AuthServerApp) Logout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, app.Auth.GetExpiredRefreshCookie())
+	event := models.LoginEvent{Event: models.LoginEventLogout, Success: true}
+	if claims := app.refreshClaims(r); claims != nil {
+		event.UserID, event.Login = claims.UserID, claims.Email
+		if claims.SessionID != 0 {
+			err := app.DB.RevokeSession(claims.SessionID, claims.UserID, time.Now().Unix())
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				logerror.LogError(err)
+			}
+		}
+	}
+	app.recordLoginEvent(r, event)
+
+	app.clearRefreshCookies(w)
 	w.WriteHeader(http.StatusAccepted)
 }
+
+// clearRefreshCookies expires the refresh token cookie and its CSRF token cookie.
+func (app *AuthServerApp) clearRefreshCookies(w http.ResponseWriter) {
+	http.SetCookie(w, app.Auth.GetExpiredRefreshCookie())
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrf.CookieName,
+		Path:     "/",
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		SameSite: http.SameSiteStrictMode,
+		Domain:   app.Auth.CookieDomain,
+		Secure:   true,
+	})
+}
@@ -1,6 +1,9 @@
 package api
 
 import (
+	"authserver-backend/internal/authenticator"
+	"authserver-backend/internal/authenticator/ldaptest"
+	"authserver-backend/internal/csrf"
 	"authserver-backend/internal/dbrepo"
 	"authserver-backend/internal/models"
 
@@ -14,9 +17,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
-	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -329,6 +330,7 @@ func TestThisAppForEditHandler(t *testing.T) {
 // with a new app payload and checking the response for successful insertion. Only for admin users.
 func TestInsertAppHandler(t *testing.T) {
 	mockDB := new(dbrepo.MockDBRepo)
+	allowAdminEvents(mockDB)
 
 	newApp := models.NewApp{
 		Name:    "Test App",
@@ -378,6 +380,7 @@ func TestInsertAppHandler(t *testing.T) {
 // with updated app details and checking the response for successful update. Only for admin users.
 func TestUpdateAppHandler(t *testing.T) {
 	mockDB := new(dbrepo.MockDBRepo)
+	allowAdminEvents(mockDB)
 
 	existingApp := models.ThisApp{
 		ID: 1,
@@ -446,7 +449,9 @@ func TestUpdateAppHandler(t *testing.T) {
 // and checking the response for successful deletion. Only for admin users.
 func TestDeleteAppHandler(t *testing.T) {
 	mockDB := new(dbrepo.MockDBRepo)
+	allowAdminEvents(mockDB)
 
+	mockDB.On("ThisApp", 1, "").Return(&models.ThisApp{ID: 1}, nil)
 	mockDB.On("DeleteApp", 1).Return(nil)
 
 	app := &AuthServerApp{
@@ -521,6 +526,8 @@ func TestGetReleasesHandler(t *testing.T) {
 // with valid user credentials and checking the response for the expected JWT tokens.
 func TestAuthenticateHandler(t *testing.T) {
 	mockDB := new(dbrepo.MockDBRepo)
+	allowSessions(mockDB)
+	allowLoginEvents(mockDB)
 
 	testPassword := "password123"
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.DefaultCost)
@@ -528,12 +535,14 @@ func TestAuthenticateHandler(t *testing.T) {
 		ID:       1,
 		Email:    "user@example.com",
 		Password: string(hashedPassword),
+		Active:   true,
 	}
 	mockDB.On("GetUserByEmail", "user@example.com").Return(expectedUser, nil)
 
 	app := &AuthServerApp{
 		DB: mockDB,
 		Auth: auth.Auth{
+			Audience:   "example.com",
 			Secret:     "test_secret",
 			CookieName: "refresh_token",
 		},
@@ -574,25 +583,24 @@ func TestAuthenticateHandler(t *testing.T) {
 // with a valid refresh token cookie and checking the response for new JWT tokens.
 func TestRefreshTokenHandler(t *testing.T) {
 	mockDB := new(dbrepo.MockDBRepo)
+	allowLoginEvents(mockDB)
 
 	app := &AuthServerApp{
 		DB: mockDB,
 		Auth: auth.Auth{
+			Audience:   "example.com",
+			JWTSecret:  "test_secret",
 			CookieName: "refresh_token",
 		},
 		JWTSecret: "test_secret",
 	}
 
-	refreshToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": 1,
-		"email":   "email",
-		"exp":     time.Now().Add(24 * time.Hour).Unix(),
-	}).SignedString([]byte("test_secret"))
+	refreshToken, err := app.Auth.GenerateRefreshToken(&auth.JWTUser{ID: 1, Email: "email"})
 
 	if err != nil {
 		t.Fatal(err)
 	}
-	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, Email: "email"}, nil)
+	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, Email: "email", Active: true}, nil)
 
 	cookie := &http.Cookie{
 		Name:  app.Auth.CookieName,
@@ -615,6 +623,7 @@ func TestRefreshTokenHandler(t *testing.T) {
 	var response struct {
 		Token        string `json:"access_token"`
 		RefreshToken string `json:"refresh_token"`
+		CSRFToken    string `json:"csrf_token"`
 	}
 
 	err = json.NewDecoder(rr.Body).Decode(&response)
@@ -624,15 +633,60 @@ func TestRefreshTokenHandler(t *testing.T) {
 
 	assert.NotEmpty(t, response.Token)
 	assert.NotEmpty(t, response.RefreshToken)
+	assert.Equal(t, csrf.Token(app.JWTSecret, response.RefreshToken), response.CSRFToken)
+}
+
+// TestInactiveUser tests that a deactivated user can neither log in with a valid password nor refresh
+// the tokens issued before, and that the reason is recorded.
+func TestInactiveUser(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowSessions(mockDB)
+	allowLoginEvents(mockDB)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	user := &models.User{ID: 1, Email: "user@example.com", Password: string(hash)}
+	mockDB.On("GetUserByEmail", "user@example.com").Return(user, nil)
+	mockDB.On("GetUserByID", 1).Return(user, nil)
+	app := &AuthServerApp{
+		DB:        mockDB,
+		Auth:      auth.Auth{Audience: "example.com", JWTSecret: "test_secret", CookieName: "refresh_token"},
+		JWTSecret: "test_secret",
+	}
+
+	rr := httptest.NewRecorder()
+	app.Authenticate(rr, httptest.NewRequest(http.MethodPost, "/authenticate",
+		strings.NewReader(`{"email":"user@example.com","password":"password123"}`)))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+
+	refreshToken, err := app.Auth.GenerateRefreshToken(&auth.JWTUser{ID: 1, Email: "user@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: "refresh_token", Value: refreshToken})
+	rr = httptest.NewRecorder()
+	app.RefreshToken(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	mockDB.AssertNotCalled(t, "InsertSession", mock.Anything)
+	for _, event := range []string{models.LoginEventLogin, models.LoginEventRefresh} {
+		mockDB.AssertCalled(t, "InsertLoginEvent", mock.MatchedBy(func(e models.LoginEvent) bool {
+			return e.UserID == 1 && e.Event == event && !e.Success && e.Reason == reasonInactive
+		}))
+	}
 }
 
 // TestLogoutHandler tests the Logout handler by sending a POST request to the /logout endpoint
 // and checking the response for successful logout and cookie deletion.
 func TestLogoutHandler(t *testing.T) {
 	testAuth := auth.Auth{
+		Audience:   "example.com",
 		CookieName: "refresh_token",
 	}
+	mockDB := new(dbrepo.MockDBRepo)
+	allowLoginEvents(mockDB)
 	app := &AuthServerApp{
+		DB:   mockDB,
 		Auth: testAuth,
 	}
 	type MockAutserver struct {
@@ -658,7 +712,59 @@ func TestLogoutHandler(t *testing.T) {
 	}
 
 	cookies := rr.Result().Cookies()
-	assert.Len(t, cookies, 1)
+	assert.Len(t, cookies, 2)
 	assert.Equal(t, cookies[0].Name, MockApp.Auth.CookieName)
 	assert.Equal(t, cookies[0].MaxAge, -1)
+	assert.Equal(t, cookies[1].Name, csrf.CookieName)
+	assert.Equal(t, cookies[1].MaxAge, -1)
+}
+
+// TestAuthenticateHandler_Directory tests a login checked by a directory after the local passwords,
+// with the username instead of the email.
+func TestAuthenticateHandler_Directory(t *testing.T) {
+	directory, err := ldaptest.NewServer(ldaptest.Entry{
+		DN:       "uid=jdoe,ou=people,dc=example,dc=com",
+		Password: "jdoe-secret",
+		Attributes: map[string][]string{
+			"uid":  {"jdoe"},
+			"mail": {"jdoe@example.com"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer directory.Close()
+
+	mockDB := new(dbrepo.MockDBRepo)
+	allowSessions(mockDB)
+	allowLoginEvents(mockDB)
+	mockDB.On("GetUserByEmail", "jdoe").Return((*models.User)(nil), errors.New("no user"))
+	mockDB.On("GetUserByEmail", "jdoe@example.com").Return(&models.User{ID: 8, UserName: "jdoe", Email: "jdoe@example.com", Active: true}, nil)
+	mockDB.On("GetDirectoryPasswordHash", 8).Return("", nil)
+	mockDB.On("RevokeUserTrustedDevices", 8, mock.AnythingOfType("int64")).Return(0, nil)
+	mockDB.On("SetDirectoryPasswordHash", 8, mock.AnythingOfType("string")).Return(nil)
+
+	app := &AuthServerApp{
+		DB: mockDB,
+		Auth: auth.Auth{
+			Audience:   "example.com",
+			JWTSecret:  "test_secret",
+			CookieName: "refresh_token",
+		},
+	}
+	app.Authenticator = authenticator.Chain{
+		authenticator.Local{DB: mockDB},
+		authenticator.LDAP{
+			Config: authenticator.LDAPConfig{URL: directory.URL(), UserDN: "uid=%s,ou=people,dc=example,dc=com"},
+			DB:     mockDB,
+		},
+	}
+
+	rr := httptest.NewRecorder()
+	app.Authenticate(rr, httptest.NewRequest(http.MethodPost, "/authenticate", strings.NewReader(`{"username":"jdoe","password":"jdoe-secret"}`)))
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	rr = httptest.NewRecorder()
+	app.Authenticate(rr, httptest.NewRequest(http.MethodPost, "/authenticate", strings.NewReader(`{"username":"jdoe","password":"wrong"}`)))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
 }
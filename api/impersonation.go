@@ -0,0 +1,208 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// defaultImpersonationTTL is used when AuthServerApp.ImpersonationTTL is not set.
+const defaultImpersonationTTL = time.Minute * 15
+
+// auditEntityUser is the entity type of the users in the admin audit log.
+const auditEntityUser = "user"
+
+// errImpersonationEnded refuses the tokens of a stopped or expired impersonation.
+var errImpersonationEnded = errors.New("the impersonation has ended")
+
+func (app *AuthServerApp) impersonationTTL() time.Duration {
+	if app.ImpersonationTTL > 0 {
+		return app.ImpersonationTTL
+	}
+	return defaultImpersonationTTL
+}
+
+// activeImpersonation returns an impersonation that was neither stopped nor expired.
+func (app *AuthServerApp) activeImpersonation(id int) (*models.Impersonation, error) {
+	imp, err := app.DB.GetImpersonation(id)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			logerror.LogError(err)
+		}
+		return nil, errImpersonationEnded
+	}
+	if !imp.Active(time.Now().Unix()) {
+		return nil, errImpersonationEnded
+	}
+	return imp, nil
+}
+
+// checkImpersonation refuses the token of an impersonation that was stopped or expired.
+// The tokens of the users themselves go through.
+func (app *AuthServerApp) checkImpersonation(claims *auth.Claims) error {
+	if claims.Actor == nil && !claims.Impersonated {
+		return nil
+	}
+	_, err := app.activeImpersonation(claims.ImpersonationID)
+	return err
+}
+
+// impersonationRefused refuses the requests of impersonated sessions, for the routes changing
+// or issuing credentials and the admin routes. It must run after authRequired.
+func (app *AuthServerApp) impersonationRefused(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims, ok := claimsFromContext(r.Context()); ok && claims.Actor != nil {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("an impersonated session cannot do this"), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// StartImpersonation logs the admin in as the user of the URL, for ImpersonationTTL, with an optional
+// reason, like a ticket number. The answer holds an access token for the user carrying the admin in its
+// act claim, and no refresh token. The start is recorded in the admin audit log.
+// Only active admins can impersonate, from a session of their own, and never themselves.
+func (app *AuthServerApp) StartImpersonation(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	if userID == claims.UserID {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("you cannot impersonate yourself"))
+		return
+	}
+	if claims.Actor != nil || claims.Impersonated {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("an impersonated session cannot do this"), http.StatusForbidden)
+		return
+	}
+	admin, err := app.DB.GetUserByID(claims.UserID)
+	if err != nil || admin == nil || !admin.Active || !app.isAdmin(admin) {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("only admins can impersonate users"), http.StatusForbidden)
+		return
+	}
+
+	var payload struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := (utils.JSONResponse{}).ReadJSON(w, r, &payload); err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, err)
+			return
+		}
+	}
+
+	user, err := app.DB.GetUserByID(userID)
+	if err != nil || user == nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err := activeUser(user); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	imp := models.Impersonation{
+		AdminID:    claims.UserID,
+		AdminEmail: claims.Email,
+		UserID:     user.ID,
+		Reason:     payload.Reason,
+		Started:    now.Unix(),
+		Expires:    now.Add(app.impersonationTTL()).Unix(),
+	}
+	imp.ID, err = app.DB.InsertImpersonation(imp)
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not start the impersonation"), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := app.Auth.GenerateImpersonationToken(impersonatedUser(user, &imp))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	app.recordAdminEvent(r, models.AdminActionStartImpersonation, auditEntityUser, user.ID, nil, imp)
+
+	resp := struct {
+		Token         string                `json:"access_token"`
+		TokenType     string                `json:"token_type"`
+		ExpiresAt     int64                 `json:"expires_at"`
+		Impersonation *models.Impersonation `json:"impersonation"`
+	}{
+		Token:         token,
+		TokenType:     "Bearer",
+		ExpiresAt:     imp.Expires,
+		Impersonation: &imp,
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusCreated, resp)
+}
+
+// StopImpersonation stops the impersonation of the token of the request: its tokens, and the ones
+// of the apps launched in it, are refused from now on. The stop is recorded in the admin audit log,
+// with the admin as actor.
+func (app *AuthServerApp) StopImpersonation(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	if claims.Actor == nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("the session is not impersonated"))
+		return
+	}
+
+	before, err := app.DB.GetImpersonation(claims.ImpersonationID)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, errImpersonationEnded, http.StatusNotFound)
+		return
+	}
+	after := *before
+	after.Ended = time.Now().Unix()
+	err = app.DB.EndImpersonation(before.ID, after.Ended)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.JSONResponse{}.ErrorJSON(w, errImpersonationEnded, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not stop the impersonation"), http.StatusInternalServerError)
+		return
+	}
+	app.recordAdminEvent(r, models.AdminActionStopImpersonation, auditEntityUser, before.UserID, before, after)
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "impersonation stopped",
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// impersonatedUser is the user of the tokens of an impersonation.
+func impersonatedUser(user *models.User, imp *models.Impersonation) *auth.JWTUser {
+	return &auth.JWTUser{
+		ID:    user.ID,
+		Email: user.Email,
+		Impersonation: &auth.Impersonation{
+			ID:         imp.ID,
+			ActorID:    imp.AdminID,
+			ActorEmail: imp.AdminEmail,
+			Expires:    imp.Expires,
+		},
+	}
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// impersonationApp returns an app signing real tokens, with impersonation 3 of user 2 by admin 1 active.
+func impersonationApp(mockDB *dbrepo.MockDBRepo) *AuthServerApp {
+	mockDB.On("GetImpersonation", 3).Return(&models.Impersonation{
+		ID: 3, AdminID: 1, AdminEmail: "admin@example.com", UserID: 2, Expires: time.Now().Add(time.Minute * 10).Unix(),
+	}, nil).Maybe()
+	return &AuthServerApp{
+		DB: mockDB,
+		Auth: auth.Auth{
+			Issuer:      "example.com",
+			Audience:    "example.com",
+			JWTSecret:   "test_secret",
+			TokenExpiry: time.Minute * 15,
+		},
+	}
+}
+
+// TestStartImpersonation tests the token of an impersonation, and that its start is audited with the admin as actor.
+func TestStartImpersonation(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := impersonationApp(mockDB)
+	app.ImpersonationTTL = time.Minute * 10
+	app.AdminProfiles = []int{1}
+	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, Email: "admin@example.com", ProfileId: 1, Active: true}, nil)
+	mockDB.On("GetUserByID", 2).Return(&models.User{ID: 2, Email: "user@example.com", ProfileId: 3, Active: true}, nil)
+	mockDB.On("GetUserByID", 9).Return((*models.User)(nil), sql.ErrNoRows)
+	mockDB.On("GetUserByID", 4).Return(&models.User{ID: 4, Email: "gone@example.com", ProfileId: 3}, nil)
+	mockDB.On("InsertImpersonation", mock.MatchedBy(func(imp models.Impersonation) bool {
+		return imp.AdminID == 1 && imp.UserID == 2 && imp.Reason == "ticket 42" && imp.Expires-imp.Started == 600
+	})).Return(3, nil)
+	mockDB.On("InsertAdminEvent", mock.Anything).Return(1, nil)
+	r := chi.NewRouter()
+	r.Post("/admin/users/{id}/impersonate", app.StartImpersonation)
+
+	impersonateAs := func(actor *auth.Claims, id int, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/users/%d/impersonate", id), strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, withClaims(req, actor))
+		return rr
+	}
+	impersonate := func(id int, body string) *httptest.ResponseRecorder {
+		return impersonateAs(&auth.Claims{UserID: 1, Email: "admin@example.com"}, id, body)
+	}
+
+	rr := impersonate(2, `{"reason":"ticket 42"}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var resp struct {
+		Token     string `json:"access_token"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+
+	claims, err := app.Auth.VerifyToken(resp.Token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, claims.UserID)
+		assert.Equal(t, &auth.Actor{Subject: "1", Email: "admin@example.com"}, claims.Actor)
+		assert.True(t, claims.Impersonated)
+		assert.Equal(t, 3, claims.ImpersonationID)
+		assert.Equal(t, resp.ExpiresAt, claims.ExpiresAt)
+	}
+	mockDB.AssertCalled(t, "InsertAdminEvent", mock.MatchedBy(func(e models.AdminEvent) bool {
+		return e.ActorID == 1 && e.Action == models.AdminActionStartImpersonation && e.EntityType == auditEntityUser && e.EntityID == 2
+	}))
+
+	assert.Equal(t, http.StatusBadRequest, impersonate(1, "").Code, "an admin cannot impersonate themselves")
+	assert.Equal(t, http.StatusNotFound, impersonate(9, "").Code)
+	assert.Equal(t, http.StatusForbidden, impersonate(4, "").Code, "a deactivated user")
+	assert.Equal(t, http.StatusForbidden, impersonateAs(&auth.Claims{UserID: 2, Email: "user@example.com"}, 1, "").Code,
+		"a user who is not an admin")
+	assert.Equal(t, http.StatusForbidden, impersonateAs(&auth.Claims{UserID: 2, Email: "user@example.com", Impersonated: true,
+		Actor: &auth.Actor{Subject: "1", Email: "admin@example.com"}}, 9, "").Code, "from an impersonated session")
+	mockDB.AssertNumberOfCalls(t, "InsertImpersonation", 1)
+}
+
+// TestStopImpersonation tests that a stopped impersonation is audited with the admin as actor
+// and that its token is refused afterwards.
+func TestStopImpersonation(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := impersonationApp(mockDB)
+	mockDB.On("EndImpersonation", 3, mock.AnythingOfType("int64")).Return(nil).Once()
+	mockDB.On("InsertAdminEvent", mock.Anything).Return(1, nil)
+
+	token, err := app.Auth.GenerateImpersonationToken(&auth.JWTUser{ID: 2, Email: "user@example.com",
+		Impersonation: &auth.Impersonation{ID: 3, ActorID: 1, ActorEmail: "admin@example.com", Expires: time.Now().Add(time.Minute).Unix()}})
+	assert.NoError(t, err)
+	handler := app.authRequired(http.HandlerFunc(app.StopImpersonation))
+	stop := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/impersonation", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusAccepted, stop().Code)
+	mockDB.AssertCalled(t, "InsertAdminEvent", mock.MatchedBy(func(e models.AdminEvent) bool {
+		return e.ActorID == 1 && e.ActorEmail == "admin@example.com" && e.Action == models.AdminActionStopImpersonation &&
+			e.EntityID == 2 && strings.Contains(string(e.Diff), "ended")
+	}))
+
+	mockDB.ExpectedCalls = nil
+	mockDB.On("GetImpersonation", 3).Return(&models.Impersonation{ID: 3, Ended: time.Now().Unix(), Expires: time.Now().Add(time.Minute).Unix()}, nil)
+	assert.Equal(t, http.StatusUnauthorized, stop().Code)
+}
+
+// TestImpersonationRefused tests that an impersonated session cannot manage credentials nor call the admin routes.
+func TestImpersonationRefused(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := impersonationApp(mockDB)
+	token, err := app.Auth.GenerateImpersonationToken(&auth.JWTUser{ID: 2, Email: "user@example.com",
+		Impersonation: &auth.Impersonation{ID: 3, ActorID: 1, ActorEmail: "admin@example.com", Expires: time.Now().Add(time.Minute).Unix()}})
+	assert.NoError(t, err)
+	routes := app.Routes()
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPost, "/tokens"},
+		{http.MethodDelete, "/tokens/1"},
+		{http.MethodDelete, "/sessions"},
+		{http.MethodPost, "/login/stepup"},
+		{http.MethodPost, "/dbs/1/credentials"},
+		{http.MethodGet, "/admin/apps"},
+		{http.MethodPost, "/admin/users/4/impersonate"},
+	} {
+		req := httptest.NewRequest(route.method, route.path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusForbidden, rr.Code, route.path)
+	}
+}
+
+// TestExchangeLaunchCode_Impersonated tests that the token of an app launched in an impersonation carries it.
+func TestExchangeLaunchCode_Impersonated(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := impersonationApp(mockDB)
+	allowAppClient(mockDB, 7)
+	mockDB.On("ConsumeLaunchCode", utils.HashToken("the-code"), 7, mock.AnythingOfType("int64")).Return(2, 3, nil)
+	mockDB.On("GetUserByID", 2).Return(&models.User{ID: 2, Email: "user@example.com", Active: true}, nil)
+	mockDB.On("ThisApp", 7, "").Return(&models.ThisApp{ID: 7, NewApp: models.NewApp{Web: "https://crm.example.com", TokenSettings: models.AppTokenSettings{Audience: "https://crm.example.com"}}}, nil)
+
+	rr := httptest.NewRecorder()
+	app.ExchangeLaunchCode(rr, appClientRequest("/apps/launch/exchange", 7, `{"code":"the-code"}`))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		Token     string `json:"access_token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.LessOrEqual(t, resp.ExpiresIn, 600)
+	claims, err := app.Auth.VerifyAppToken(resp.Token, "https://crm.example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 7, claims.AppID)
+		assert.True(t, claims.Impersonated)
+		assert.Equal(t, "1", claims.Actor.Subject)
+	}
+}
@@ -0,0 +1,453 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// defaultLaunchCodeTTL is used when AuthServerApp.LaunchCodeTTL is not set.
+// The code travels in a browser redirect and is exchanged right away, so it can be very short.
+const defaultLaunchCodeTTL = time.Minute
+
+// errInvalidClient is the answer to a catalogue app that did not authenticate with its client credentials.
+var errInvalidClient = errors.New("invalid client credentials")
+
+// launchURL returns the address a user is sent to when launching an app.
+// URL is preferred, Web is used for the apps that only have the older field filled in.
+func launchURL(thisapp *models.ThisApp) string {
+	if thisapp.URL != "" {
+		return thisapp.URL
+	}
+	return thisapp.Web
+}
+
+// reservedAudiences are the audiences of the tokens of the server, the apps cannot have them:
+// the ones it accepts and the one of the forward-auth sessions.
+func (app *AuthServerApp) reservedAudiences() []string {
+	return append(app.Auth.AcceptedAudiences(), app.forwardAuthAudience())
+}
+
+// appAudience returns the audience of the tokens of an app, the one of its token settings. An app without one,
+// or with an audience of the server, gets no token, see AppTokenSettings.ValidateAudience.
+func (app *AuthServerApp) appAudience(thisapp *models.ThisApp) (string, error) {
+	if err := thisapp.TokenSettings.ValidateAudience(app.reservedAudiences()); err != nil {
+		return "", err
+	}
+	return thisapp.TokenSettings.Audience, nil
+}
+
+// appTokenOptions are the token settings of an app for a user: the lifetimes of the settings, TokenExpiry
+// for the access tokens when they have none, their audience and the attributes of the user in their claim template.
+// The audience has been checked with appAudience.
+func (app *AuthServerApp) appTokenOptions(thisapp *models.ThisApp, user *models.User) auth.AppTokenOptions {
+	settings := thisapp.TokenSettings
+	opts := auth.AppTokenOptions{
+		Audience:      settings.Audience,
+		Expiry:        time.Duration(settings.AccessExpiry) * time.Second,
+		RefreshExpiry: time.Duration(settings.RefreshExpiry) * time.Second,
+	}
+	if opts.Expiry <= 0 {
+		opts.Expiry = app.Auth.TokenExpiry
+	}
+	if settings.HasClaim(models.AppClaimGroup) {
+		opts.Attributes.GroupID = user.GroupId
+	}
+	if settings.HasClaim(models.AppClaimProfile) {
+		opts.Attributes.ProfileID = user.ProfileId
+	}
+	if settings.HasClaim(models.AppClaimCompany) {
+		opts.Attributes.CompanyID = user.CompanyId
+	}
+	if settings.HasClaim(models.AppClaimLan) {
+		opts.Attributes.Lan = user.Lan
+	}
+	return opts
+}
+
+// appClient authenticates the catalogue app calling a server-to-server route with its client credentials:
+// HTTP Basic with the ID of the app as user name and its client secret as password (RFC 6749, section 2.3.1).
+// An app without a client secret cannot call them.
+func (app *AuthServerApp) appClient(r *http.Request) (*models.ThisApp, error) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || secret == "" {
+		return nil, errInvalidClient
+	}
+	appID, err := strconv.Atoi(clientID)
+	if err != nil {
+		return nil, errInvalidClient
+	}
+	secretHash, err := app.DB.GetAppClientSecret(appID)
+	if err != nil || secretHash == "" || subtle.ConstantTimeCompare([]byte(secretHash), []byte(utils.HashToken(secret))) != 1 {
+		return nil, errInvalidClient
+	}
+	thisapp, err := app.DB.ThisApp(appID, "")
+	if err != nil {
+		return nil, errInvalidClient
+	}
+	return thisapp, nil
+}
+
+// unauthorizedClient answers a request of a catalogue app that did not authenticate, or for another app
+// than the one it authenticated as.
+func unauthorizedClient(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="apps"`)
+	utils.JSONResponse{}.ErrorJSON(w, errInvalidClient, http.StatusUnauthorized)
+}
+
+// appTokens are the tokens of a catalogue app, RefreshToken is only set when its settings give it one.
+type appTokens struct {
+	Token        string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// writeAppTokens mints the tokens of an app for a user and answers them. The app gets a refresh token
+// when its settings have a refresh lifetime, unless the user is impersonated.
+func (app *AuthServerApp) writeAppTokens(w http.ResponseWriter, u *auth.JWTUser, appID int, opts auth.AppTokenOptions) bool {
+	token, err := app.Auth.GenerateAppToken(u, appID, opts)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	expiresIn := int64(opts.Expiry.Seconds())
+	if u.Impersonation != nil {
+		expiresIn = min(expiresIn, u.Impersonation.Expires-time.Now().Unix())
+	}
+	resp := appTokens{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresIn: int(expiresIn),
+	}
+	if opts.RefreshExpiry > 0 && u.Impersonation == nil {
+		if resp.RefreshToken, err = app.Auth.GenerateAppRefreshToken(u, appID, opts); err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+			return false
+		}
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, resp)
+	return true
+}
+
+// LaunchApp mints a one-time launch code for the authenticated user and the app given in the URL,
+// when the user has a grant on the app, and returns the address of the app with the code appended, so the frontend can redirect the browser there.
+// The app then exchanges the code with ExchangeLaunchCode, the user does not have to log in again.
+// The launched app is stored as the user's last app, unless an admin impersonates the user:
+// the code then carries the impersonation to the token of the app.
+func (app *AuthServerApp) LaunchApp(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("id is missing in URL"), http.StatusBadRequest)
+		return
+	}
+
+	appID, err := strconv.Atoi(id)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	thisapp, err := app.DB.ThisApp(appID, "")
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	}
+
+	if _, err := app.DB.GetAppGrant(claims.UserID, appID); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("user has no access to this app"), http.StatusForbidden)
+		return
+	}
+
+	redirect, err := url.Parse(launchURL(thisapp))
+	if err != nil || redirect.Host == "" {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("app has no address to launch"), http.StatusBadRequest)
+		return
+	}
+
+	code, err := utils.RandomToken(32)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	ttl := app.LaunchCodeTTL
+	if ttl <= 0 {
+		ttl = defaultLaunchCodeTTL
+	}
+	expiresAt := time.Now().Add(ttl).Unix()
+
+	if err := app.DB.InsertLaunchCode(utils.HashToken(code), claims.UserID, appID, claims.ImpersonationID, expiresAt); err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not create launch code"), http.StatusInternalServerError)
+		return
+	}
+
+	if claims.Actor == nil {
+		if err := app.DB.UpdateUserLastApp(claims.UserID, appID); err != nil {
+			logerror.LogError(err)
+		}
+	}
+
+	query := redirect.Query()
+	query.Set("code", code)
+	redirect.RawQuery = query.Encode()
+
+	resp := struct {
+		Code        string `json:"code"`
+		ExpiresAt   int64  `json:"expires_at"`
+		RedirectURL string `json:"redirect_url"`
+	}{
+		Code:        code,
+		ExpiresAt:   expiresAt,
+		RedirectURL: redirect.String(),
+	}
+	utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// ExchangeLaunchCode is called server-to-server by a catalogue app with the code it received
+// in the launch redirect, the app authenticating with its client credentials. It returns an access token
+// scoped to that app, minted with the token settings of the app, and a refresh token when they give it one.
+// A code is only valid for the app it was minted for and can be exchanged once, and not once its user is deactivated.
+// The code of an impersonated launch is exchanged for a token carrying the impersonation, while it is active.
+func (app *AuthServerApp) ExchangeLaunchCode(w http.ResponseWriter, r *http.Request) {
+	thisapp, err := app.appClient(r)
+	if err != nil {
+		unauthorizedClient(w)
+		return
+	}
+
+	var payload struct {
+		Code  string `json:"code"`
+		AppID int    `json:"app_id"`
+	}
+
+	if err := (utils.JSONResponse{}).ReadJSON(w, r, &payload); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	if payload.Code == "" {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("code is required"), http.StatusBadRequest)
+		return
+	}
+	// app_id is optional, the client credentials tell the app
+	if payload.AppID != 0 && payload.AppID != thisapp.ID {
+		unauthorizedClient(w)
+		return
+	}
+	if _, err := app.appAudience(thisapp); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	userID, impersonationID, err := app.DB.ConsumeLaunchCode(utils.HashToken(payload.Code), thisapp.ID, time.Now().Unix())
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("invalid or expired launch code"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(userID)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
+		return
+	}
+	if err := activeUser(user); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	u := &auth.JWTUser{
+		ID:    user.ID,
+		Email: user.Email,
+	}
+	if impersonationID != 0 {
+		imp, err := app.activeImpersonation(impersonationID)
+		if err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, err, http.StatusUnauthorized)
+			return
+		}
+		u = impersonatedUser(user, imp)
+	}
+	app.writeAppTokens(w, u, thisapp.ID, app.appTokenOptions(thisapp, user))
+}
+
+// RefreshAppToken is called server-to-server by a catalogue app with the refresh token it got along with
+// its access token, the app authenticating with its client credentials. It returns new tokens, minted with
+// the current token settings of the app and attributes of the user, while the user is active and keeps their grant on the app.
+// A refresh token is only valid for the app it was minted for.
+func (app *AuthServerApp) RefreshAppToken(w http.ResponseWriter, r *http.Request) {
+	thisapp, err := app.appClient(r)
+	if err != nil {
+		unauthorizedClient(w)
+		return
+	}
+
+	var payload struct {
+		RefreshToken string `json:"refresh_token"`
+		AppID        int    `json:"app_id"`
+	}
+
+	if err := (utils.JSONResponse{}).ReadJSON(w, r, &payload); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	if payload.RefreshToken == "" {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("refresh_token is required"), http.StatusBadRequest)
+		return
+	}
+	if payload.AppID != 0 && payload.AppID != thisapp.ID {
+		unauthorizedClient(w)
+		return
+	}
+
+	audience, err := app.appAudience(thisapp)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	claims, err := app.Auth.VerifyAppToken(payload.RefreshToken, audience)
+	if err != nil || claims.TokenUse != auth.TokenUseRefresh || claims.AppID != thisapp.ID {
+		app.recordLoginEvent(r, models.LoginEvent{Event: models.LoginEventRefresh, Reason: reasonInvalidToken})
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("invalid or expired refresh token"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(claims.UserID)
+	if err != nil {
+		app.recordLoginEvent(r, models.LoginEvent{UserID: claims.UserID, Event: models.LoginEventRefresh, Reason: reasonUnknownUser})
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
+		return
+	}
+	if err := activeUser(user); err != nil {
+		app.recordLoginEvent(r, models.LoginEvent{UserID: user.ID, Login: user.Email, Event: models.LoginEventRefresh, Reason: reasonInactive})
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	if _, err := app.DB.GetAppGrant(user.ID, thisapp.ID); err != nil {
+		app.recordLoginEvent(r, models.LoginEvent{UserID: user.ID, Login: user.Email, Event: models.LoginEventRefresh, Reason: reasonInvalidToken})
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("user has no access to this app"), http.StatusForbidden)
+		return
+	}
+
+	// the refresh lifetime may have been removed from the settings since the token was minted
+	opts := app.appTokenOptions(thisapp, user)
+	if opts.RefreshExpiry <= 0 {
+		app.recordLoginEvent(r, models.LoginEvent{UserID: user.ID, Login: user.Email, Event: models.LoginEventRefresh, Reason: reasonInvalidToken})
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("the app does not refresh its tokens"), http.StatusUnauthorized)
+		return
+	}
+
+	u := &auth.JWTUser{
+		ID:    user.ID,
+		Email: user.Email,
+	}
+	if app.writeAppTokens(w, u, thisapp.ID, opts) {
+		app.recordLoginEvent(r, models.LoginEvent{UserID: user.ID, Login: user.Email, Event: models.LoginEventRefresh, Success: true})
+	}
+}
+
+// GetAppTokenSettings returns the token settings of an app.
+func (app *AuthServerApp) GetAppTokenSettings(w http.ResponseWriter, r *http.Request) {
+	appID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	thisapp, err := app.DB.ThisApp(appID, "")
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, thisapp.TokenSettings)
+}
+
+// UpdateAppTokenSettings replaces the token settings of an app: the lifetimes of its tokens, their audience
+// and their claim template. They apply to the tokens minted from then on. The audience is required,
+// and cannot be one the server accepts.
+func (app *AuthServerApp) UpdateAppTokenSettings(w http.ResponseWriter, r *http.Request) {
+	appID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	var payload models.AppTokenSettings
+	if err := (utils.JSONResponse{}).ReadJSON(w, r, &payload); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	if err := payload.Validate(app.reservedAudiences()); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	thisapp, err := app.DB.ThisApp(appID, "")
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	}
+	if err := app.DB.UpdateAppTokenSettings(appID, payload); err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not update the token settings"), http.StatusInternalServerError)
+		return
+	}
+	app.recordAdminEvent(r, models.AdminActionUpdate, auditEntityApp, appID, thisapp.TokenSettings, payload)
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, payload)
+}
+
+// RotateAppClientSecret sets a new client secret for an app and returns it, it is not shown again:
+// the app authenticates with it on the launch code exchange and the refresh of its tokens, the previous
+// secret stops working. The rotation is recorded in the admin audit log, without the secret.
+func (app *AuthServerApp) RotateAppClientSecret(w http.ResponseWriter, r *http.Request) {
+	appID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	secret, err := utils.RandomToken(32)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = app.DB.SetAppClientSecret(appID, utils.HashToken(secret))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("app not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not set the client secret"), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().Unix()
+	app.recordAdminEvent(r, models.AdminActionUpdate, auditEntityApp, appID, nil, struct {
+		ClientSecretRotated int64 `json:"client_secret_rotated"`
+	}{now})
+
+	resp := struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}{strconv.Itoa(appID), secret}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusCreated, resp)
+}
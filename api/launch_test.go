@@ -0,0 +1,414 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// appClientSecret is the client secret of the catalogue apps of the tests.
+const appClientSecret = "app-secret"
+
+// allowAppClient lets a catalogue app authenticate with appClientSecret in a mock database.
+func allowAppClient(mockDB *dbrepo.MockDBRepo, appID int) {
+	mockDB.On("GetAppClientSecret", appID).Return(utils.HashToken(appClientSecret), nil).Maybe()
+}
+
+// appClientRequest returns a request of a catalogue app authenticated with its client credentials.
+func appClientRequest(path string, appID int, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.SetBasicAuth(strconv.Itoa(appID), appClientSecret)
+	return req
+}
+
+// TestLaunchAppHandler tests that launching an app stores a hashed code, records the last app
+// and returns the app address with the code.
+func TestLaunchAppHandler(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+
+	thisapp := &models.ThisApp{ID: 7, NewApp: models.NewApp{Name: "CRM", Web: "https://old.example.com", URL: "https://crm.example.com/start?lang=en"}}
+	mockDB.On("ThisApp", 7, "").Return(thisapp, nil)
+	mockDB.On("GetAppGrant", 1, 7).Return(&models.AppGrant{UserID: 1, AppID: 7}, nil)
+	mockDB.On("InsertLaunchCode", mock.AnythingOfType("string"), 1, 7, 0, mock.AnythingOfType("int64")).Return(nil)
+	mockDB.On("UpdateUserLastApp", 1, 7).Return(nil)
+
+	app := &AuthServerApp{DB: mockDB}
+
+	r := chi.NewRouter()
+	r.Post("/apps/{id}/launch", app.LaunchApp)
+
+	req := httptest.NewRequest(http.MethodPost, "/apps/7/launch", nil)
+	req = withClaims(req, &auth.Claims{UserID: 1})
+	rr := httptest.NewRecorder()
+
+	r.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	var resp struct {
+		Code        string `json:"code"`
+		ExpiresAt   int64  `json:"expires_at"`
+		RedirectURL string `json:"redirect_url"`
+	}
+	err := json.NewDecoder(rr.Body).Decode(&resp)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, resp.Code)
+	assert.InDelta(t, time.Now().Add(defaultLaunchCodeTTL).Unix(), resp.ExpiresAt, 5)
+
+	redirect, err := url.Parse(resp.RedirectURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "crm.example.com", redirect.Host)
+	assert.Equal(t, "en", redirect.Query().Get("lang"))
+	assert.Equal(t, resp.Code, redirect.Query().Get("code"))
+
+	// only the hash of the code is stored
+	mockDB.AssertCalled(t, "InsertLaunchCode", utils.HashToken(resp.Code), 1, 7, 0, resp.ExpiresAt)
+	mockDB.AssertExpectations(t)
+}
+
+// TestLaunchAppHandler_NoAddress tests that an app without an address cannot be launched.
+func TestLaunchAppHandler_NoAddress(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("ThisApp", 7, "").Return(&models.ThisApp{ID: 7}, nil)
+	mockDB.On("GetAppGrant", 1, 7).Return(&models.AppGrant{UserID: 1, AppID: 7}, nil)
+
+	app := &AuthServerApp{DB: mockDB}
+
+	r := chi.NewRouter()
+	r.Post("/apps/{id}/launch", app.LaunchApp)
+
+	req := httptest.NewRequest(http.MethodPost, "/apps/7/launch", nil)
+	req = withClaims(req, &auth.Claims{UserID: 1})
+	rr := httptest.NewRecorder()
+
+	r.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	mockDB.AssertNotCalled(t, "InsertLaunchCode", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+// TestLaunchAppHandler_NoGrant tests that a user cannot launch an app they have no grant on.
+func TestLaunchAppHandler_NoGrant(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("ThisApp", 7, "").Return(&models.ThisApp{ID: 7, NewApp: models.NewApp{URL: "https://crm.example.com"}}, nil)
+	mockDB.On("GetAppGrant", 1, 7).Return((*models.AppGrant)(nil), sql.ErrNoRows)
+
+	app := &AuthServerApp{DB: mockDB}
+
+	r := chi.NewRouter()
+	r.Post("/apps/{id}/launch", app.LaunchApp)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, withClaims(httptest.NewRequest(http.MethodPost, "/apps/7/launch", nil), &auth.Claims{UserID: 1}))
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	mockDB.AssertNotCalled(t, "InsertLaunchCode", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+// TestExchangeLaunchCodeHandler tests that a valid code is exchanged for a token scoped to the app.
+func TestExchangeLaunchCodeHandler(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+
+	allowAppClient(mockDB, 7)
+	mockDB.On("ConsumeLaunchCode", utils.HashToken("the-code"), 7, mock.AnythingOfType("int64")).Return(1, 0, nil)
+	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, Email: "user@example.com", Active: true}, nil)
+	mockDB.On("ThisApp", 7, "").Return(&models.ThisApp{ID: 7, NewApp: models.NewApp{Web: "https://crm.example.com", TokenSettings: models.AppTokenSettings{Audience: "https://crm.example.com"}}}, nil)
+
+	app := &AuthServerApp{
+		DB: mockDB,
+		Auth: auth.Auth{
+			Issuer:      "example.com",
+			Audience:    "example.com",
+			JWTSecret:   "test_secret",
+			TokenExpiry: time.Minute * 15,
+		},
+	}
+
+	req := appClientRequest("/apps/launch/exchange", 7, `{"code":"the-code"}`)
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(app.ExchangeLaunchCode).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		Token     string `json:"access_token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	err := json.NewDecoder(rr.Body).Decode(&resp)
+	assert.NoError(t, err)
+	assert.Equal(t, 900, resp.ExpiresIn)
+
+	claims, err := app.Auth.VerifyAppToken(resp.Token, "https://crm.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 7, claims.AppID)
+	assert.Equal(t, "https://crm.example.com", claims.Audience)
+
+	mockDB.AssertExpectations(t)
+}
+
+// TestExchangeLaunchCodeHandler_Invalid tests that a used or unknown code is refused.
+func TestExchangeLaunchCodeHandler_Invalid(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowAppClient(mockDB, 7)
+	mockDB.On("ThisApp", 7, "").Return(&models.ThisApp{ID: 7, NewApp: models.NewApp{TokenSettings: models.AppTokenSettings{Audience: "crm"}}}, nil)
+	mockDB.On("ConsumeLaunchCode", utils.HashToken("used-code"), 7, mock.AnythingOfType("int64")).Return(0, 0, errors.New("invalid or expired launch code"))
+
+	app := &AuthServerApp{DB: mockDB}
+
+	req := appClientRequest("/apps/launch/exchange", 7, `{"code":"used-code","app_id":7}`)
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(app.ExchangeLaunchCode).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	mockDB.AssertNotCalled(t, "GetUserByID", mock.Anything)
+}
+
+// TestExchangeLaunchCodeHandler_Client tests that the code is only exchanged by the app it was
+// minted for, authenticated with its client secret.
+func TestExchangeLaunchCodeHandler_Client(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowAppClient(mockDB, 7)
+	mockDB.On("GetAppClientSecret", 8).Return("", nil)
+	mockDB.On("ThisApp", 7, "").Return(&models.ThisApp{ID: 7}, nil)
+
+	app := &AuthServerApp{DB: mockDB}
+	exchange := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.ExchangeLaunchCode).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the code alone, as read from the redirect
+	rr := exchange(httptest.NewRequest(http.MethodPost, "/apps/launch/exchange", strings.NewReader(`{"code":"the-code","app_id":7}`)))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, `Basic realm="apps"`, rr.Header().Get("WWW-Authenticate"))
+
+	wrong := appClientRequest("/apps/launch/exchange", 7, `{"code":"the-code"}`)
+	wrong.SetBasicAuth("7", "guessed")
+	assert.Equal(t, http.StatusUnauthorized, exchange(wrong).Code)
+	assert.Equal(t, http.StatusUnauthorized, exchange(appClientRequest("/apps/launch/exchange", 8, `{"code":"the-code"}`)).Code, "an app without a secret")
+	assert.Equal(t, http.StatusUnauthorized, exchange(appClientRequest("/apps/launch/exchange", 7, `{"code":"the-code","app_id":8}`)).Code, "the code of another app")
+	mockDB.AssertNotCalled(t, "ConsumeLaunchCode", mock.Anything, mock.Anything, mock.Anything)
+}
+
+// TestExchangeLaunchCodeHandler_Audience tests that an app gets no token without an audience of its own,
+// the tokens would be accepted by the server.
+func TestExchangeLaunchCodeHandler_Audience(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowAppClient(mockDB, 7)
+	allowAppClient(mockDB, 8)
+	mockDB.On("ThisApp", 7, "").Return(&models.ThisApp{ID: 7, NewApp: models.NewApp{Web: "https://crm.example.com"}}, nil)
+	mockDB.On("ThisApp", 8, "").Return(&models.ThisApp{ID: 8, NewApp: models.NewApp{TokenSettings: models.AppTokenSettings{Audience: "example.com"}}}, nil)
+
+	app := &AuthServerApp{DB: mockDB, Auth: auth.Auth{Audience: "example.com"}}
+	for _, appID := range []int{7, 8} {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.ExchangeLaunchCode).ServeHTTP(rr, appClientRequest("/apps/launch/exchange", appID, `{"code":"the-code"}`))
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	}
+	mockDB.AssertNotCalled(t, "ConsumeLaunchCode", mock.Anything, mock.Anything, mock.Anything)
+}
+
+// TestRotateAppClientSecret tests that an admin gets a new client secret once, only its hash being stored, and that it is audited.
+func TestRotateAppClientSecret(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	var stored string
+	mockDB.On("SetAppClientSecret", 7, mock.MatchedBy(func(hash string) bool { stored = hash; return true })).Return(nil)
+	mockDB.On("SetAppClientSecret", 9, mock.Anything).Return(fmt.Errorf("app 9 not found: %w", sql.ErrNoRows))
+	mockDB.On("InsertAdminEvent", mock.Anything).Return(1, nil)
+
+	app := &AuthServerApp{DB: mockDB}
+	r := chi.NewRouter()
+	r.Post("/admin/apps/{id}/secret", app.RotateAppClientSecret)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, withClaims(httptest.NewRequest(http.MethodPost, "/admin/apps/7/secret", nil), &auth.Claims{UserID: 1}))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var resp struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, "7", resp.ClientID)
+	assert.Equal(t, utils.HashToken(resp.ClientSecret), stored)
+	mockDB.AssertCalled(t, "InsertAdminEvent", mock.MatchedBy(func(e models.AdminEvent) bool {
+		return e.EntityType == auditEntityApp && e.EntityID == 7 && !strings.Contains(string(e.Diff), resp.ClientSecret)
+	}))
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, withClaims(httptest.NewRequest(http.MethodPost, "/admin/apps/9/secret", nil), &auth.Claims{UserID: 1}))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// TestRotateAppClientSecret_AdminOnly tests that only admins rotate the client secrets.
+func TestRotateAppClientSecret_AdminOnly(t *testing.T) {
+	assertAdminOnly(t, "POST /admin/apps/7/secret")
+}
+
+// TestExchangeLaunchCodeHandler_TokenSettings tests that the token of an app is minted with its lifetimes,
+// audience and claim template, along with a refresh token that can be exchanged for new tokens.
+func TestExchangeLaunchCodeHandler_TokenSettings(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowLoginEvents(mockDB)
+	allowAppClient(mockDB, 7)
+	allowAppClient(mockDB, 8)
+
+	settings := models.AppTokenSettings{
+		AccessExpiry:  300,
+		RefreshExpiry: 86400,
+		Audience:      "billing",
+		Claims:        []string{models.AppClaimCompany, models.AppClaimLan},
+	}
+	mockDB.On("ConsumeLaunchCode", utils.HashToken("the-code"), 7, mock.AnythingOfType("int64")).Return(1, 0, nil)
+	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, Email: "user@example.com", GroupId: 2, CompanyId: 4, Lan: "es", Active: true}, nil)
+	mockDB.On("ThisApp", 7, "").Return(&models.ThisApp{ID: 7, NewApp: models.NewApp{Web: "https://crm.example.com", TokenSettings: settings}}, nil)
+	mockDB.On("ThisApp", 8, "").Return(&models.ThisApp{ID: 8, NewApp: models.NewApp{Web: "https://erp.example.com", TokenSettings: settings}}, nil)
+	mockDB.On("GetAppGrant", 1, 7).Return(&models.AppGrant{UserID: 1, AppID: 7}, nil).Once()
+
+	app := &AuthServerApp{
+		DB: mockDB,
+		Auth: auth.Auth{
+			Issuer:      "example.com",
+			Audience:    "example.com",
+			JWTSecret:   "test_secret",
+			TokenExpiry: time.Minute * 15,
+		},
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.ExchangeLaunchCode).ServeHTTP(rr, appClientRequest("/apps/launch/exchange", 7, `{"code":"the-code"}`))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var resp appTokens
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, 300, resp.ExpiresIn)
+	assert.NotEmpty(t, resp.RefreshToken)
+
+	claims, err := app.Auth.VerifyAppToken(resp.Token, "billing")
+	assert.NoError(t, err)
+	assert.Equal(t, "billing", claims.Audience)
+	assert.Equal(t, auth.UserAttributes{CompanyID: 4, Lan: "es"}, claims.UserAttributes)
+
+	// the refresh token is only valid for the app it was minted for
+	refresh := func(appID int) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{"refresh_token": resp.RefreshToken})
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.RefreshAppToken).ServeHTTP(rr, appClientRequest("/apps/token/refresh", appID, string(body)))
+		return rr
+	}
+	assert.Equal(t, http.StatusUnauthorized, refresh(8).Code)
+
+	rr = refresh(7)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var refreshed appTokens
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&refreshed))
+	assert.Equal(t, 300, refreshed.ExpiresIn)
+	claims, err = app.Auth.VerifyAppToken(refreshed.Token, "billing")
+	assert.NoError(t, err)
+	assert.Equal(t, 7, claims.AppID)
+	assert.Equal(t, "es", claims.Lan)
+
+	// the access token cannot be used as a refresh token
+	body, _ := json.Marshal(map[string]any{"refresh_token": resp.Token})
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(app.RefreshAppToken).ServeHTTP(rr, appClientRequest("/apps/token/refresh", 7, string(body)))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// nor without the client credentials of the app
+	body, _ = json.Marshal(map[string]any{"refresh_token": resp.RefreshToken, "app_id": 7})
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(app.RefreshAppToken).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/apps/token/refresh", strings.NewReader(string(body))))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// the user lost the grant on the app
+	mockDB.On("GetAppGrant", 1, 7).Return((*models.AppGrant)(nil), sql.ErrNoRows)
+	assert.Equal(t, http.StatusForbidden, refresh(7).Code)
+}
+
+// TestExchangeLaunchCodeHandler_Inactive tests that a deactivated user gets no app token, neither for
+// a launch code nor for a refresh token minted while they were active.
+func TestExchangeLaunchCodeHandler_Inactive(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowLoginEvents(mockDB)
+	allowAppClient(mockDB, 7)
+	user := &models.User{ID: 1, Email: "user@example.com", Active: true}
+	mockDB.On("ConsumeLaunchCode", utils.HashToken("the-code"), 7, mock.AnythingOfType("int64")).Return(1, 0, nil)
+	mockDB.On("GetUserByID", 1).Return(user, nil)
+	mockDB.On("ThisApp", 7, "").Return(&models.ThisApp{ID: 7, NewApp: models.NewApp{TokenSettings: models.AppTokenSettings{Audience: "billing", RefreshExpiry: 86400}}}, nil)
+	mockDB.On("GetAppGrant", 1, 7).Return(&models.AppGrant{UserID: 1, AppID: 7}, nil)
+	app := &AuthServerApp{DB: mockDB, Auth: auth.Auth{Issuer: "example.com", Audience: "example.com", JWTSecret: "test_secret", TokenExpiry: time.Minute * 15}}
+
+	exchange := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.ExchangeLaunchCode).ServeHTTP(rr, appClientRequest("/apps/launch/exchange", 7, `{"code":"the-code"}`))
+		return rr
+	}
+	rr := exchange()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resp appTokens
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+
+	user.Active = false
+	rr = exchange()
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "access_token")
+
+	body, _ := json.Marshal(map[string]any{"refresh_token": resp.RefreshToken})
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(app.RefreshAppToken).ServeHTTP(rr, appClientRequest("/apps/token/refresh", 7, string(body)))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	mockDB.AssertCalled(t, "InsertLoginEvent", mock.MatchedBy(func(e models.LoginEvent) bool {
+		return e.UserID == 1 && e.Event == models.LoginEventRefresh && !e.Success && e.Reason == reasonInactive
+	}))
+}
+
+// TestUpdateAppTokenSettings tests that the token settings of an app are validated, stored and audited.
+func TestUpdateAppTokenSettings(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowAdminEvents(mockDB)
+	mockDB.On("ThisApp", 7, "").Return(&models.ThisApp{ID: 7}, nil)
+	mockDB.On("UpdateAppTokenSettings", 7, models.AppTokenSettings{AccessExpiry: 600, Audience: "billing", Claims: []string{models.AppClaimGroup}}).Return(nil)
+
+	app := &AuthServerApp{DB: mockDB, Auth: auth.Auth{Audience: "example.com", Audiences: []string{"admin.example.com"}}}
+	r := chi.NewRouter()
+	r.Put("/admin/apps/{id}/tokens", app.UpdateAppTokenSettings)
+
+	put := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/admin/apps/7/tokens", strings.NewReader(body)))
+		return rr
+	}
+
+	assert.Equal(t, http.StatusBadRequest, put(`{"audience":"billing","claims":["password"]}`).Code)
+	// the server would accept the tokens of the app
+	assert.Equal(t, http.StatusBadRequest, put(`{"audience":"example.com"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, put(`{"audience":"admin.example.com"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, put(`{"access_expiry":600}`).Code)
+	mockDB.AssertNotCalled(t, "UpdateAppTokenSettings", mock.Anything, mock.Anything)
+
+	assert.Equal(t, http.StatusAccepted, put(`{"access_expiry":600,"audience":"billing","claims":["group_id"]}`).Code)
+	mockDB.AssertExpectations(t)
+}
+
+// TestAppTokenSettings_AdminOnly tests that only admins read and set the token settings of the apps.
+func TestAppTokenSettings_AdminOnly(t *testing.T) {
+	assertAdminOnly(t, "GET /admin/apps/7/tokens", "PUT /admin/apps/7/tokens")
+}
@@ -0,0 +1,320 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/mailer"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// magicCookieName is the cookie holding the secret of the browser that asked for a passwordless login
+// or a step-up code. The login only completes when the link is opened, or the code typed, in that browser.
+const magicCookieName = "magic_login"
+
+// defaultMagicLinkTTL is used when AuthServerApp.MagicLinkTTL is not set.
+const defaultMagicLinkTTL = time.Minute * 15
+
+// magicLoginMaxAttempts is how many wrong links or codes a pending login survives.
+// It keeps the 6-digit codes from being guessed.
+const magicLoginMaxAttempts = 5
+
+// magicLoginsPerWindow is how many emails a user can ask for during MagicLinkTTL.
+const magicLoginsPerWindow = 3
+
+// magicLoginSent is the answer to every accepted request, whether the email is known or not,
+// so the endpoint does not tell which accounts exist.
+const magicLoginSent = "if the email belongs to an account, a login link and code were sent to it"
+
+func (app *AuthServerApp) magicLinkTTL() time.Duration {
+	if app.MagicLinkTTL > 0 {
+		return app.MagicLinkTTL
+	}
+	return defaultMagicLinkTTL
+}
+
+// magicCookie returns the browser cookie of a passwordless login, an empty value removes it.
+func (app *AuthServerApp) magicCookie(value string) *http.Cookie {
+	maxAge := int(app.magicLinkTTL().Seconds())
+	if value == "" {
+		maxAge = -1
+	}
+	return &http.Cookie{
+		Name:     magicCookieName,
+		Path:     "/login",
+		Value:    value,
+		MaxAge:   maxAge,
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   true,
+	}
+}
+
+// signMagicToken appends to a token its HMAC with the JWT secret, so forged links are refused
+// before the database is asked.
+func (app *AuthServerApp) signMagicToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(app.JWTSecret))
+	mac.Write([]byte(token))
+	return token + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyMagicToken returns the token of a signed token, if the signature is valid.
+func (app *AuthServerApp) verifyMagicToken(signed string) (string, bool) {
+	token, _, found := strings.Cut(signed, ".")
+	if !found || !hmac.Equal([]byte(app.signMagicToken(token)), []byte(signed)) {
+		return "", false
+	}
+	return token, true
+}
+
+// magicCode returns a random 6-digit code.
+func magicCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// magicLinkURL returns the emailed link carrying a signed token. It points to MagicLinkURL,
+// or to MagicLinkVerify on the address the request was sent to.
+func (app *AuthServerApp) magicLinkURL(r *http.Request, token string) (string, error) {
+	base := app.MagicLinkURL
+	if base == "" {
+		base = "https://" + r.Host + "/login/magic/verify"
+	}
+	link, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	return link.String(), nil
+}
+
+// MagicLogin emails a passwordless login to the user of the given email: a single-use signed link
+// and a 6-digit code, both bound to the requesting browser by a cookie and valid for MagicLinkTTL.
+// A new request from the same browser replaces the pending one. The answer is the same for unknown
+// emails, and a user can only ask for a few emails during MagicLinkTTL.
+func (app *AuthServerApp) MagicLogin(w http.ResponseWriter, r *http.Request) {
+	if app.Mailer == nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("passwordless login is not enabled"), http.StatusNotFound)
+		return
+	}
+
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+	if err := (utils.JSONResponse{}).ReadJSON(w, r, &requestPayload); err != nil || requestPayload.Email == "" {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("email is required"), http.StatusBadRequest)
+		return
+	}
+
+	sent := utils.JSONResponse{Message: magicLoginSent}
+	user, err := app.DB.GetUserByEmail(requestPayload.Email)
+	if err != nil || !user.Active {
+		utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, sent)
+		return
+	}
+
+	if status, err := app.sendMagicLogin(w, r, user, true); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, status)
+		return
+	}
+	utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, sent)
+}
+
+// sendMagicLogin creates a pending login of the user bound to the browser and emails it, with the link
+// and the code when withLink is set, with the code only otherwise. On failure it returns the status
+// and the error to answer with.
+func (app *AuthServerApp) sendMagicLogin(w http.ResponseWriter, r *http.Request, user *models.User, withLink bool) (int, error) {
+	ttl := app.magicLinkTTL()
+	now := time.Now()
+	count, err := app.DB.CountMagicLogins(user.ID, now.Add(-ttl).Unix())
+	if err != nil {
+		logerror.LogError(err)
+		return http.StatusInternalServerError, errors.New("could not create login link")
+	}
+	if count >= magicLoginsPerWindow {
+		w.Header().Set("Retry-After", strconv.Itoa(int(ttl.Seconds())))
+		return http.StatusTooManyRequests, errors.New("too many login links asked, try again later")
+	}
+
+	// the browser keeps its secret across requests, so a new request replaces the pending one
+	browser := ""
+	if cookie, err := r.Cookie(magicCookieName); err == nil && len(cookie.Value) >= 43 {
+		browser = cookie.Value
+	} else if browser, err = utils.RandomToken(32); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	code, err := magicCode()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	message := mailer.Message{
+		To:      user.Email,
+		Subject: "Your verification code",
+		Body: fmt.Sprintf("Your verification code is %s.\n\n"+
+			"It works once, in the browser you asked it from, for %d minutes.\n"+
+			"If you did not ask for it, you can ignore this email.\n",
+			code, int(ttl.Minutes())),
+	}
+	if withLink {
+		link, err := app.magicLinkURL(r, app.signMagicToken(token))
+		if err != nil {
+			logerror.LogError(err)
+			return http.StatusInternalServerError, errors.New("could not create login link")
+		}
+		message.Subject = "Your login link"
+		message.Body = fmt.Sprintf("Open this link to log in:\n\n%s\n\nor enter the code %s on the login page.\n\n"+
+			"The link and the code work once, in the browser you asked them from, for %d minutes.\n"+
+			"If you did not ask for them, you can ignore this email.\n",
+			link, code, int(ttl.Minutes()))
+	}
+
+	_, err = app.DB.InsertMagicLogin(models.MagicLogin{
+		UserID:      user.ID,
+		TokenHash:   utils.HashToken(token),
+		CodeHash:    utils.HashToken(code),
+		BrowserHash: utils.HashToken(browser),
+		ExpiresAt:   now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		logerror.LogError(err)
+		return http.StatusInternalServerError, errors.New("could not create login link")
+	}
+
+	if err := app.Mailer.Send(r.Context(), message); err != nil {
+		logerror.LogError(err)
+		return http.StatusInternalServerError, errors.New("could not send login email")
+	}
+
+	http.SetCookie(w, app.magicCookie(browser))
+	return http.StatusAccepted, nil
+}
+
+// magicLoginUser completes the pending passwordless login of the browser with a signed link token
+// or a code, and returns its user. A wrong token or code counts as an attempt, the login is
+// dropped after magicLoginMaxAttempts of them.
+func (app *AuthServerApp) magicLoginUser(w http.ResponseWriter, r *http.Request, signed, code string) (*models.User, int, error) {
+	cookie, err := r.Cookie(magicCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, http.StatusForbidden, errors.New("open the login link in the browser it was asked from")
+	}
+
+	login, err := app.DB.GetMagicLogin(utils.HashToken(cookie.Value), time.Now().Unix())
+	if err != nil {
+		return nil, http.StatusUnauthorized, errors.New("invalid or expired login link")
+	}
+
+	valid := false
+	switch {
+	case signed != "":
+		if token, ok := app.verifyMagicToken(signed); ok {
+			valid = subtle.ConstantTimeCompare([]byte(utils.HashToken(token)), []byte(login.TokenHash)) == 1
+		}
+	case code != "":
+		valid = subtle.ConstantTimeCompare([]byte(utils.HashToken(code)), []byte(login.CodeHash)) == 1
+	}
+	if !valid {
+		if err := app.DB.FailMagicLogin(login.ID, magicLoginMaxAttempts); err != nil {
+			logerror.LogError(err)
+		}
+		return nil, http.StatusUnauthorized, errors.New("invalid or expired login link")
+	}
+
+	userID, err := app.DB.ConsumeMagicLogin(login.ID)
+	if err != nil {
+		return nil, http.StatusUnauthorized, errors.New("invalid or expired login link")
+	}
+	http.SetCookie(w, app.magicCookie(""))
+
+	user, err := app.DB.GetUserByID(userID)
+	if err != nil {
+		return nil, http.StatusUnauthorized, errors.New("unknown user")
+	}
+	return user, http.StatusOK, nil
+}
+
+// MagicLinkVerify is where the emailed link leads. It logs the user in with the token of the link
+// and, like FederatedCallback, sends the browser to FederationRedirectURL when it is set,
+// otherwise the tokens are returned as JSON.
+func (app *AuthServerApp) MagicLinkVerify(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("token is required"), http.StatusBadRequest)
+		return
+	}
+
+	user, status, err := app.magicLoginUser(w, r, token, "")
+	if err != nil {
+		app.recordLogin(r, nil, "", auth.AMROneTimePassword, reasonInvalidToken)
+		utils.JSONResponse{}.ErrorJSON(w, err, status)
+		return
+	}
+
+	tokens, err := app.issueTokenPair(w, r, user, auth.AMROneTimePassword)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, tokenPairStatus(err))
+		return
+	}
+	app.recordLogin(r, user, "", auth.AMROneTimePassword, "")
+
+	if app.FederationRedirectURL != "" {
+		http.Redirect(w, r, app.FederationRedirectURL, http.StatusFound)
+		return
+	}
+	utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, tokens)
+}
+
+// MagicLoginVerify logs the user in with the emailed code, or the token of the link for a frontend
+// page the link points to, and returns the token pair.
+func (app *AuthServerApp) MagicLoginVerify(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token string `json:"token"`
+		Code  string `json:"code"`
+	}
+	err := utils.JSONResponse{}.ReadJSON(w, r, &requestPayload)
+	if err != nil || (requestPayload.Token == "") == (requestPayload.Code == "") {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("either token or code is required"), http.StatusBadRequest)
+		return
+	}
+
+	user, status, err := app.magicLoginUser(w, r, requestPayload.Token, requestPayload.Code)
+	if err != nil {
+		reason := reasonInvalidCode
+		if requestPayload.Token != "" {
+			reason = reasonInvalidToken
+		}
+		app.recordLogin(r, nil, "", auth.AMROneTimePassword, reason)
+		utils.JSONResponse{}.ErrorJSON(w, err, status)
+		return
+	}
+
+	tokens, err := app.issueTokenPair(w, r, user, auth.AMROneTimePassword)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, tokenPairStatus(err))
+		return
+	}
+	app.recordLogin(r, user, "", auth.AMROneTimePassword, "")
+	utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, tokens)
+}
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/mailer"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// magicTestApp returns an app sending its emails to an in-memory outbox.
+func magicTestApp(mockDB *dbrepo.MockDBRepo) (*AuthServerApp, *mailer.Outbox) {
+	outbox := &mailer.Outbox{}
+	allowLoginEvents(mockDB)
+	app := &AuthServerApp{
+		DB:        mockDB,
+		JWTSecret: "test_secret",
+		Mailer:    outbox,
+		Auth: auth.Auth{
+			Issuer:        "example.com",
+			Audience:      "example.com",
+			JWTSecret:     "test_secret",
+			TokenExpiry:   time.Minute * 15,
+			RefreshExpiry: time.Hour,
+			CookieName:    "refresh_token",
+		},
+	}
+	return app, outbox
+}
+
+// requestMagicLogin asks for a login of user@example.com and returns the stored login,
+// the browser cookie, and the link and code of the email.
+func requestMagicLogin(t *testing.T, app *AuthServerApp, mockDB *dbrepo.MockDBRepo, outbox *mailer.Outbox) (*models.MagicLogin, *http.Cookie, string, string) {
+	mockDB.On("GetUserByEmail", "user@example.com").Return(&models.User{ID: 1, Email: "user@example.com", Active: true}, nil)
+	mockDB.On("CountMagicLogins", 1, mock.Anything).Return(0, nil)
+
+	var stored models.MagicLogin
+	mockDB.On("InsertMagicLogin", mock.MatchedBy(func(l models.MagicLogin) bool {
+		stored = l
+		return l.UserID == 1 && l.ExpiresAt > time.Now().Unix()
+	})).Return(3, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/login/magic", strings.NewReader(`{"email":"user@example.com"}`))
+	req.Host = "auth.example.com"
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != magicCookieName || !cookies[0].HttpOnly {
+		t.Fatalf("expected the browser cookie, got %v", cookies)
+	}
+	stored.ID = 3
+
+	email, ok := outbox.Last()
+	if !ok {
+		t.Fatal("no email sent")
+	}
+	assert.Equal(t, "user@example.com", email.To)
+	link := regexp.MustCompile(`https://\S+`).FindString(email.Body)
+	code := regexp.MustCompile(`\b\d{6}\b`).FindString(email.Body)
+	assert.True(t, strings.HasPrefix(link, "https://auth.example.com/login/magic/verify?token="))
+	assert.Equal(t, utils.HashToken(code), stored.CodeHash)
+	assert.Equal(t, utils.HashToken(cookies[0].Value), stored.BrowserHash)
+	return &stored, cookies[0], link, code
+}
+
+// TestMagicLogin_Link tests a login with the emailed link, in the browser that asked for it.
+func TestMagicLogin_Link(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowSessions(mockDB)
+	app, outbox := magicTestApp(mockDB)
+	stored, cookie, link, _ := requestMagicLogin(t, app, mockDB, outbox)
+
+	mockDB.On("GetMagicLogin", stored.BrowserHash, mock.Anything).Return(stored, nil)
+	mockDB.On("ConsumeMagicLogin", 3).Return(1, nil)
+	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, Email: "user@example.com", Active: true}, nil)
+
+	linkURL, _ := url.Parse(link)
+	req := httptest.NewRequest(http.MethodGet, linkURL.RequestURI(), nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	var tokens auth.TokenPairs
+	_ = json.Unmarshal(rr.Body.Bytes(), &tokens)
+	claims, err := app.Auth.VerifyToken(tokens.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{auth.AMROneTimePassword}, claims.AMR)
+	names := map[string]bool{}
+	for _, c := range rr.Result().Cookies() {
+		names[c.Name] = c.MaxAge >= 0
+	}
+	assert.True(t, names["refresh_token"], "refresh cookie not set")
+	assert.False(t, names[magicCookieName], "browser cookie not removed")
+	mockDB.AssertExpectations(t)
+}
+
+// TestMagicLogin_Code tests a login with the emailed code, then the link failing as it was used.
+func TestMagicLogin_Code(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowSessions(mockDB)
+	app, outbox := magicTestApp(mockDB)
+	app.FederationRedirectURL = "https://app.example.com/"
+	stored, cookie, _, code := requestMagicLogin(t, app, mockDB, outbox)
+
+	mockDB.On("GetMagicLogin", stored.BrowserHash, mock.Anything).Return(stored, nil).Once()
+	mockDB.On("ConsumeMagicLogin", 3).Return(1, nil)
+	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, Email: "user@example.com", Active: true}, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/login/magic/verify", strings.NewReader(`{"code":"`+code+`"}`))
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+
+	// the code is typed in the frontend, the tokens are returned whatever FederationRedirectURL is
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Contains(t, rr.Body.String(), "refresh_token")
+
+	mockDB.On("GetMagicLogin", stored.BrowserHash, mock.Anything).Return((*models.MagicLogin)(nil), errors.New("no pending login")).Once()
+	req = httptest.NewRequest(http.MethodPost, "/login/magic/verify", strings.NewReader(`{"code":"`+code+`"}`))
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+// TestMagicLogin_OtherBrowser tests that the link does not work in another browser.
+func TestMagicLogin_OtherBrowser(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, outbox := magicTestApp(mockDB)
+	_, _, link, _ := requestMagicLogin(t, app, mockDB, outbox)
+
+	linkURL, _ := url.Parse(link)
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, linkURL.RequestURI(), nil))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	mockDB.On("GetMagicLogin", utils.HashToken("other-browser"), mock.Anything).Return((*models.MagicLogin)(nil), errors.New("no pending login"))
+	req := httptest.NewRequest(http.MethodGet, linkURL.RequestURI(), nil)
+	req.AddCookie(&http.Cookie{Name: magicCookieName, Value: "other-browser"})
+	rr = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	mockDB.AssertNotCalled(t, "ConsumeMagicLogin", mock.Anything)
+}
+
+// TestMagicLogin_WrongCode tests that wrong codes and forged links count as attempts.
+func TestMagicLogin_WrongCode(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, outbox := magicTestApp(mockDB)
+	stored, cookie, link, code := requestMagicLogin(t, app, mockDB, outbox)
+
+	mockDB.On("GetMagicLogin", stored.BrowserHash, mock.Anything).Return(stored, nil)
+	mockDB.On("FailMagicLogin", 3, magicLoginMaxAttempts).Return(nil)
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "000001"
+	}
+	token, _ := url.Parse(link)
+	forged := strings.SplitN(token.Query().Get("token"), ".", 2)[0] + ".forged"
+
+	for _, body := range []string{`{"code":"` + wrong + `"}`, `{"token":"` + forged + `"}`} {
+		req := httptest.NewRequest(http.MethodPost, "/login/magic/verify", strings.NewReader(body))
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		app.Routes().ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, body)
+	}
+
+	mockDB.AssertNumberOfCalls(t, "FailMagicLogin", 2)
+	mockDB.AssertNotCalled(t, "ConsumeMagicLogin", mock.Anything)
+}
+
+// TestMagicLogin_UnknownEmail tests that an unknown email gets the same answer and no email.
+func TestMagicLogin_UnknownEmail(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("GetUserByEmail", "nobody@example.com").Return((*models.User)(nil), errors.New("no user"))
+	app, outbox := magicTestApp(mockDB)
+
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/login/magic", strings.NewReader(`{"email":"nobody@example.com"}`)))
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Contains(t, rr.Body.String(), magicLoginSent)
+	assert.Empty(t, outbox.Messages())
+	mockDB.AssertNotCalled(t, "InsertMagicLogin", mock.Anything)
+}
+
+// TestMagicLogin_RateLimited tests that a user cannot be sent too many emails.
+func TestMagicLogin_RateLimited(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("GetUserByEmail", "user@example.com").Return(&models.User{ID: 1, Email: "user@example.com", Active: true}, nil)
+	mockDB.On("CountMagicLogins", 1, mock.Anything).Return(magicLoginsPerWindow, nil)
+	app, outbox := magicTestApp(mockDB)
+
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/login/magic", strings.NewReader(`{"email":"user@example.com"}`)))
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "900", rr.Header().Get("Retry-After"))
+	assert.Empty(t, outbox.Messages())
+}
+
+// TestMagicLogin_Disabled tests the endpoint without a mailer.
+func TestMagicLogin_Disabled(t *testing.T) {
+	app := &AuthServerApp{DB: new(dbrepo.MockDBRepo)}
+
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/login/magic", strings.NewReader(`{"email":"user@example.com"}`)))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -2,6 +2,12 @@
 package api
 
 import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/csrf"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -49,6 +55,26 @@ func (app *AuthServerApp) EnableCORS(h http.Handler) http.Handler {
 		}
 	})
 }
+
+// contextKey is the type of the keys the middleware stores in the request context.
+type contextKey string
+
+// claimsKey holds the verified token claims of the request.
+const claimsKey contextKey = "claims"
+
+// personalAccessTokenKey holds the personal access token the request was authenticated with, if any.
+const personalAccessTokenKey contextKey = "personal_access_token"
+
+// claimsFromContext returns the claims stored by authRequired.
+// The second value is false when the request did not go through authRequired.
+func claimsFromContext(ctx context.Context) (*auth.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*auth.Claims)
+	return claims, ok && claims != nil
+}
+
+// authRequired verifies the bearer token of the request and stores its claims in the request context,
+// so the handlers know which user is calling. A certificate-bound token is only accepted over a
+// connection authenticated with its certificate, the token of an impersonation while it is active.
 func (app *AuthServerApp) authRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// inspecting the front-end request
@@ -56,12 +82,113 @@ func (app *AuthServerApp) authRequired(next http.Handler) http.Handler {
 		// log.Printf("Headers: %v", r.Header)
 		// log.Printf("Body: %v", r.Body)
 
-		_, _, err := app.Auth.GetTokenFromHeaderAndVerify(w, r)
+		ctx := r.Context()
+		var claims *auth.Claims
+		var err error
+		if token := bearerToken(r); strings.HasPrefix(token, personalAccessTokenPrefix) {
+			var pat *models.PersonalAccessToken
+			claims, pat, err = app.verifyPersonalAccessToken(token)
+			ctx = context.WithValue(ctx, personalAccessTokenKey, pat)
+		} else {
+			_, claims, err = app.Auth.GetTokenFromHeaderAndVerify(w, r)
+			if err == nil {
+				err = checkCertificateBinding(r, claims)
+			}
+			if err == nil {
+				err = app.checkClaims(claims)
+			}
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte(fmt.Sprintf("El usuario no está autorizado: %d", http.StatusUnauthorized)))
 			return
 		}
+		ctx = context.WithValue(ctx, claimsKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// csrfRequired refuses the state-changing requests carrying the refresh token cookie
+// without its CSRF token in the X-CSRF-Token header. Requests without the cookie go through,
+// they are not authenticated by it. It guards every route a browser session calls that reads
+// or sets an authentication cookie: the refresh, the logout, the forward-auth session,
+// the trusted devices and the step-up.
+func (app *AuthServerApp) csrfRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if csrf.SafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := r.Cookie(app.Auth.CookieName)
+		if err != nil || cookie.Value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := csrf.Check(r, app.JWTSecret, cookie.Value); err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, err, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bearerToken returns the token of the Authorization header, empty when there is none.
+func bearerToken(r *http.Request) string {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return ""
+	}
+	return token
+}
+
+// personalAccessTokenFromContext returns the personal access token stored by authRequired.
+// The second value is false when the request was authenticated with a session token.
+func personalAccessTokenFromContext(ctx context.Context) (*models.PersonalAccessToken, bool) {
+	pat, ok := ctx.Value(personalAccessTokenKey).(*models.PersonalAccessToken)
+	return pat, ok && pat != nil
+}
+
+// scopeRequired refuses the requests authenticated with a personal access token without the scope.
+// Session tokens are not scoped, they go through. It must run after authRequired.
+func (app *AuthServerApp) scopeRequired(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if pat, ok := personalAccessTokenFromContext(r.Context()); ok && !pat.HasScope(scope) {
+				utils.JSONResponse{}.ErrorJSON(w, fmt.Errorf("the token does not have the %s scope", scope), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// adminRequired refuses the requests of users who are not active admins, see AdminProfiles.
+// It must run after authRequired.
+func (app *AuthServerApp) adminRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := claimsFromContext(r.Context())
+		if !ok {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+			return
+		}
+		user, err := app.DB.GetUserByID(claims.UserID)
+		if err != nil || user == nil || !user.Active || !app.isAdmin(user) {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("only admins can do this"), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionRequired refuses the requests authenticated with a personal access token,
+// for the routes only a logged in user may call, like the management of the tokens themselves.
+// It must run after authRequired.
+func (app *AuthServerApp) sessionRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := personalAccessTokenFromContext(r.Context()); ok {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("personal access tokens cannot be used here, log in"), http.StatusForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -1,8 +1,13 @@
 package api
 
 import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/csrf"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -63,6 +68,46 @@ func TestEnableCORS(t *testing.T) {
 	assert.Equal(t, "Accept, Content-Type, X-CSRF-Token, Authorization", respOptions.Header.Get("Access-Control-Allow-Headers"))
 }
 
+// TestCSRFRequired tests that the state-changing requests carrying the refresh cookie need its CSRF token.
+func TestCSRFRequired(t *testing.T) {
+	app := &AuthServerApp{
+		Auth:      auth.Auth{Audience: "example.com", CookieName: "refresh_token"},
+		JWTSecret: "test_secret",
+	}
+	handler := app.csrfRequired(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	cookie := &http.Cookie{Name: "refresh_token", Value: "session"}
+
+	tests := []struct {
+		name   string
+		method string
+		cookie bool
+		token  string
+		status int
+	}{
+		{"safe method", http.MethodGet, true, "", http.StatusOK},
+		{"no cookie", http.MethodPost, false, "", http.StatusOK},
+		{"missing token", http.MethodPost, true, "", http.StatusForbidden},
+		{"token of another session", http.MethodPost, true, csrf.Token("test_secret", "other"), http.StatusForbidden},
+		{"valid token", http.MethodPost, true, csrf.Token("test_secret", "session"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/refresh", nil)
+			if tt.cookie {
+				req.AddCookie(cookie)
+			}
+			if tt.token != "" {
+				req.Header.Set(csrf.HeaderName, tt.token)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.status, rr.Code)
+		})
+	}
+}
+
 // Test for Authentication Middleware
 // func TestAuthRequired(t *testing.T) {
 // 	// Create the mock auth instance
@@ -105,3 +150,41 @@ func TestEnableCORS(t *testing.T) {
 // 	// Assert the response for the unauthorized request
 // 	assert.Equal(t, http.StatusUnauthorized, recorderUnauthorized.Code)
 // }
+
+// assertAdminOnly tests that the routes, given as "METHOD /path", answer 403 to a session of a user who
+// is not an admin and to one of an inactive admin, without reaching their handler.
+func assertAdminOnly(t *testing.T, routes ...string) {
+	t.Helper()
+	for _, user := range []*models.User{
+		{ID: 1, Email: "user@example.com", ProfileId: 3, Active: true},
+		{ID: 1, Email: "user@example.com", ProfileId: 1},
+	} {
+		mockDB := new(dbrepo.MockDBRepo)
+		app := sessionsApp(mockDB)
+		app.AdminProfiles = []int{1}
+		mockDB.On("GetUserByID", 1).Return(user, nil)
+		handler := app.Routes()
+		token := sessionTokens(t, app, 5).Token
+
+		for _, route := range routes {
+			method, path, _ := strings.Cut(route, " ")
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusForbidden, rr.Code, "%s, profile %d, active %t", route, user.ProfileId, user.Active)
+		}
+	}
+}
+
+// TestAdminRequired tests that only admins manage the sessions and trusted devices of other users.
+func TestAdminRequired(t *testing.T) {
+	assertAdminOnly(t,
+		"GET /admin/users/2/sessions",
+		"DELETE /admin/users/2/sessions/8",
+		"DELETE /admin/users/2/sessions",
+		"GET /admin/users/2/trusted-devices",
+		"DELETE /admin/users/2/trusted-devices/4",
+		"DELETE /admin/users/2/trusted-devices",
+	)
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/mtls"
+	"authserver-backend/internal/utils"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// certificateUser returns the local user a client certificate belongs to.
+func (app *AuthServerApp) certificateUser(cert *x509.Certificate) (*models.User, error) {
+	userID, err := app.ClientCertificates.UserID(cert)
+	if err == nil {
+		return app.DB.GetUserByID(userID)
+	}
+	if app.ClientCertificates.MatchEmail {
+		for _, email := range cert.EmailAddresses {
+			if user, err := app.DB.GetUserByEmail(email); err == nil {
+				return user, nil
+			}
+		}
+	}
+	return nil, mtls.ErrUnmapped
+}
+
+// CertificateAuthenticate authenticates a client with the certificate it gave during the TLS handshake
+// and returns an access token bound to that certificate: authRequired only accepts the token on a
+// connection authenticated with the same certificate. There is no refresh token, the client
+// authenticates again once the token expires. The certificates of deactivated users are refused.
+func (app *AuthServerApp) CertificateAuthenticate(w http.ResponseWriter, r *http.Request) {
+	if app.ClientCertificates == nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("certificate authentication is not enabled"), http.StatusNotFound)
+		return
+	}
+
+	cert := mtls.PeerCertificate(r.TLS)
+	if cert == nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("no client certificate"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.certificateUser(cert)
+	if err != nil {
+		app.recordLogin(r, nil, cert.Subject.String(), auth.AMRProofOfPossession, reasonUnmapped)
+		utils.JSONResponse{}.ErrorJSON(w, mtls.ErrUnmapped, http.StatusForbidden)
+		return
+	}
+	if err := activeUser(user); err != nil {
+		app.recordLogin(r, user, "", auth.AMRProofOfPossession, reasonInactive)
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	u := &auth.JWTUser{
+		ID:       user.ID,
+		Email:    user.Email,
+		AMR:      []string{auth.AMRProofOfPossession},
+		AuthTime: time.Now().Unix(),
+	}
+	token, err := app.Auth.GenerateCertificateBoundToken(u, mtls.Thumbprint(cert))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	app.recordLogin(r, user, "", auth.AMRProofOfPossession, "")
+
+	response := struct {
+		Token     string `json:"access_token"`
+		TokenType string `json:"token_type"`
+		ExpiresIn int    `json:"expires_in"`
+	}{token, "Bearer", int(app.Auth.TokenExpiry.Seconds())}
+	utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, response)
+}
+
+// checkCertificateBinding refuses a certificate-bound token presented without the certificate
+// it is bound to (RFC 8705). Tokens without a binding are accepted.
+func checkCertificateBinding(r *http.Request, claims *auth.Claims) error {
+	if claims.Confirmation == nil || claims.Confirmation.X5tS256 == "" {
+		return nil
+	}
+	cert := mtls.PeerCertificate(r.TLS)
+	if cert == nil {
+		return errors.New("the token is bound to a client certificate")
+	}
+	if subtle.ConstantTimeCompare([]byte(mtls.Thumbprint(cert)), []byte(claims.Confirmation.X5tS256)) != 1 {
+		return errors.New("the token is bound to another client certificate")
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/mtls"
+	"authserver-backend/internal/mtls/mtlstest"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// mtlsTestApp returns an app mapping the billing service certificates to user 10.
+func mtlsTestApp(mockDB *dbrepo.MockDBRepo) *AuthServerApp {
+	allowLoginEvents(mockDB)
+	return &AuthServerApp{
+		DB: mockDB,
+		ClientCertificates: &mtls.Config{
+			Rules:      []mtls.Rule{{Subject: "CN=billing,O=Acme", UserID: 10}},
+			MatchEmail: true,
+		},
+		Auth: auth.Auth{
+			Issuer:      "example.com",
+			Audience:    "example.com",
+			JWTSecret:   "test_secret",
+			TokenExpiry: time.Minute * 15,
+		},
+	}
+}
+
+// certificateLogin calls CertificateAuthenticate over a connection authenticated with the certificate.
+func certificateLogin(app *AuthServerApp, state *tls.ConnectionState) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/authenticate/certificate", nil)
+	req.TLS = state
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+	return rr
+}
+
+// TestCertificateAuthenticate tests that a mapped certificate gets a token bound to it,
+// which authRequired only accepts with that certificate.
+func TestCertificateAuthenticate(t *testing.T) {
+	ca, _ := mtlstest.NewCA("clients")
+	billing, _ := ca.Issue(mtlstest.Names{Subject: pkix.Name{CommonName: "billing", Organization: []string{"Acme"}}})
+	other, _ := ca.Issue(mtlstest.Names{Subject: pkix.Name{CommonName: "billing", Organization: []string{"Acme"}}})
+
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("GetUserByID", 10).Return(&models.User{ID: 10, Email: "billing@services.example.com", Active: true}, nil)
+	mockDB.On("ListPersonalAccessTokens", 10).Return([]*models.PersonalAccessToken{}, nil)
+	app := mtlsTestApp(mockDB)
+
+	rr := certificateLogin(app, ca.ConnectionState(billing))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		Token     string `json:"access_token"`
+		TokenType string `json:"token_type"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &response)
+	assert.Equal(t, "Bearer", response.TokenType)
+
+	claims, err := app.Auth.VerifyToken(response.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 10, claims.UserID)
+	assert.Equal(t, mtls.Thumbprint(billing.Leaf), claims.Confirmation.X5tS256)
+
+	call := func(state *tls.ConnectionState) int {
+		req := httptest.NewRequest(http.MethodGet, "/tokens", nil)
+		req.Header.Set("Authorization", "Bearer "+response.Token)
+		req.TLS = state
+		rr := httptest.NewRecorder()
+		app.Routes().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusOK, call(ca.ConnectionState(billing)))
+	assert.Equal(t, http.StatusUnauthorized, call(nil))
+	assert.Equal(t, http.StatusUnauthorized, call(ca.ConnectionState(other)))
+}
+
+// TestCertificateAuthenticate_Email tests a personal certificate matched to its user by email.
+func TestCertificateAuthenticate_Email(t *testing.T) {
+	ca, _ := mtlstest.NewCA("clients")
+	jane, _ := ca.Issue(mtlstest.Names{Subject: pkix.Name{CommonName: "Jane Doe"}, Emails: []string{"jane@example.com"}})
+	unknown, _ := ca.Issue(mtlstest.Names{Subject: pkix.Name{CommonName: "John Doe"}, Emails: []string{"john@example.com"}})
+
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("GetUserByEmail", "jane@example.com").Return(&models.User{ID: 3, Email: "jane@example.com", Active: true}, nil)
+	mockDB.On("GetUserByEmail", "john@example.com").Return((*models.User)(nil), errors.New("no user"))
+	app := mtlsTestApp(mockDB)
+
+	assert.Equal(t, http.StatusAccepted, certificateLogin(app, ca.ConnectionState(jane)).Code)
+	assert.Equal(t, http.StatusForbidden, certificateLogin(app, ca.ConnectionState(unknown)).Code)
+
+	app.ClientCertificates.MatchEmail = false
+	assert.Equal(t, http.StatusForbidden, certificateLogin(app, ca.ConnectionState(jane)).Code)
+}
+
+// TestCertificateAuthenticate_Inactive tests that the certificates of deactivated users get no token, and that the reason is recorded.
+func TestCertificateAuthenticate_Inactive(t *testing.T) {
+	ca, _ := mtlstest.NewCA("clients")
+	billing, _ := ca.Issue(mtlstest.Names{Subject: pkix.Name{CommonName: "billing", Organization: []string{"Acme"}}})
+	jane, _ := ca.Issue(mtlstest.Names{Subject: pkix.Name{CommonName: "Jane Doe"}, Emails: []string{"jane@example.com"}})
+
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("GetUserByID", 10).Return(&models.User{ID: 10, Email: "billing@services.example.com"}, nil)
+	mockDB.On("GetUserByEmail", "jane@example.com").Return(&models.User{ID: 3, Email: "jane@example.com"}, nil)
+	app := mtlsTestApp(mockDB)
+
+	for _, cert := range []tls.Certificate{billing, jane} {
+		rr := certificateLogin(app, ca.ConnectionState(cert))
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.NotContains(t, rr.Body.String(), "access_token")
+	}
+	mockDB.AssertCalled(t, "InsertLoginEvent", mock.MatchedBy(func(e models.LoginEvent) bool {
+		return e.UserID == 3 && !e.Success && e.Method == auth.AMRProofOfPossession && e.Reason == reasonInactive
+	}))
+}
+
+// TestCertificateAuthenticate_Refused tests the requests without a certificate and without the feature.
+func TestCertificateAuthenticate_Refused(t *testing.T) {
+	app := mtlsTestApp(new(dbrepo.MockDBRepo))
+
+	// a connection where the client gave no certificate
+	assert.Equal(t, http.StatusUnauthorized, certificateLogin(app, &tls.ConnectionState{HandshakeComplete: true}).Code)
+	assert.Equal(t, http.StatusUnauthorized, certificateLogin(app, nil).Code)
+
+	app.ClientCertificates = nil
+	assert.Equal(t, http.StatusNotFound, certificateLogin(app, nil).Code)
+}
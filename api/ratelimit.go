@@ -0,0 +1,164 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/ratelimit"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLimitAccountBodySize is how much of a login body is read to find its account.
+const rateLimitAccountBodySize = 1 << 16
+
+// rateLimits returns the configured policies, or the default ones.
+func (app *AuthServerApp) rateLimits() ratelimit.Config {
+	if app.RateLimits.Routes != nil {
+		return app.RateLimits
+	}
+	return ratelimit.DefaultConfig()
+}
+
+// rateLimited limits the requests of a route with its policy in RateLimits. The account of a request
+// is given by the account function, nil or an empty account only applies the IP and global limits.
+// Every limited request gets RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers for
+// its most restrictive bucket, and a refused one a 429 with Retry-After. Nothing is limited when
+// RateLimitStore is not set, and the requests go through when the store fails.
+func (app *AuthServerApp) rateLimited(route string, account func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if app.RateLimitStore == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			id := ""
+			if account != nil {
+				id = account(r)
+			}
+			policy := app.rateLimits().Policy(route)
+			result, err := policy.Take(r.Context(), app.RateLimitStore, route, clientIP(r), id, time.Now())
+			if err != nil {
+				logerror.LogError(err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if result.Limit.Requests == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit.Requests))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", ceilSeconds(result.Reset))
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", result.Limit.Requests, ceilSeconds(result.Limit.Period)))
+			if !result.Allowed {
+				// a refusal for an account is a lockout of that account, refusals of anonymous
+				// floods are not recorded
+				if id != "" {
+					app.recordLoginEvent(r, models.LoginEvent{Login: id, Event: models.LoginEventLockout, Reason: reasonRateLimited + ":" + route})
+				}
+				w.Header().Set("Retry-After", ceilSeconds(result.RetryAfter))
+				utils.JSONResponse{}.ErrorJSON(w, errors.New("too many requests, try again later"), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ceilSeconds returns a duration in whole seconds, rounded up so clients do not come back too early.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// clientIP returns the address of the client, without its port. Behind a reverse proxy it is the
+// address of the proxy, unless a middleware like chi's RealIP sets RemoteAddr from its headers.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginAccount returns the email or username of a login body, leaving the body for the handler.
+func loginAccount(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, rateLimitAccountBodySize))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		return ""
+	}
+
+	var payload struct {
+		Email    string `json:"email"`
+		UserName string `json:"username"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	login := payload.Email
+	if login == "" {
+		login = payload.UserName
+	}
+	return strings.ToLower(strings.TrimSpace(login))
+}
+
+// refreshAccount returns the user of the refresh token cookie.
+func (app *AuthServerApp) refreshAccount(r *http.Request) string {
+	return claimsAccount(app.refreshClaims(r))
+}
+
+// bearerAccount returns the user of the bearer token.
+func (app *AuthServerApp) bearerAccount(r *http.Request) string {
+	token := bearerToken(r)
+	if token == "" {
+		return ""
+	}
+	return claimsAccount(app.tokenClaims(token))
+}
+
+// claimsAccount returns the account of the claims of a valid token, so forged tokens cannot use up
+// the limits of another user.
+func claimsAccount(claims *auth.Claims) string {
+	if claims == nil || claims.UserID == 0 {
+		return ""
+	}
+	return "user:" + strconv.Itoa(claims.UserID)
+}
+
+// refreshClaims returns the claims of the refresh token cookie, nil when it is missing or invalid.
+func (app *AuthServerApp) refreshClaims(r *http.Request) *auth.Claims {
+	cookie, err := r.Cookie(app.Auth.CookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	claims, err := app.Auth.VerifyRefreshToken(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	return claims
+}
+
+// tokenClaims returns the claims of a valid token, nil when it is invalid.
+func (app *AuthServerApp) tokenClaims(token string) *auth.Claims {
+	claims, err := app.Auth.VerifyToken(token)
+	if err != nil {
+		return nil
+	}
+	return claims
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/ratelimit"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// rateLimitTestApp returns an app limiting /authenticate to 3 requests per IP and 2 per account,
+// and /validatesession to 2 requests per account.
+func rateLimitTestApp(store ratelimit.Store) (*AuthServerApp, *dbrepo.MockDBRepo) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowLoginEvents(mockDB)
+	allowSessions(mockDB)
+	app := &AuthServerApp{
+		DB: mockDB,
+		Auth: auth.Auth{
+			Audience:    "example.com",
+			Secret:      "test_secret",
+			JWTSecret:   "test_secret",
+			CookieName:  "refresh_token",
+			TokenExpiry: time.Minute,
+		},
+		JWTSecret:      "test_secret",
+		RateLimitStore: store,
+		RateLimits: ratelimit.Config{Routes: map[string]ratelimit.Policy{
+			"authenticate": {
+				IP:      ratelimit.Limit{Requests: 3, Period: time.Minute},
+				Account: ratelimit.Limit{Requests: 2, Period: time.Minute},
+			},
+			"validatesession": {
+				Account: ratelimit.Limit{Requests: 2, Period: time.Minute},
+			},
+		}},
+	}
+	return app, mockDB
+}
+
+func authenticateFrom(handler http.Handler, ip, email string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/authenticate",
+		strings.NewReader(fmt.Sprintf(`{"email":%q,"password":"password123"}`, email)))
+	req.RemoteAddr = ip + ":40000"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// TestRateLimited_Authenticate tests the account and IP limits of /authenticate and their headers.
+func TestRateLimited_Authenticate(t *testing.T) {
+	app, mockDB := rateLimitTestApp(ratelimit.NewMemory())
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	for _, email := range []string{"user@example.com", "USER@example.com", "other@example.com", "third@example.com"} {
+		mockDB.On("GetUserByEmail", email).Return(&models.User{ID: 1, Email: email, Password: string(hash), Active: true}, nil)
+	}
+	handler := app.Routes()
+
+	// the handler still reads the body after the middleware looked for the account
+	rr := authenticateFrom(handler, "10.0.0.1", "user@example.com")
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", rr.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "2;w=60", rr.Header().Get("RateLimit-Policy"))
+
+	rr = authenticateFrom(handler, "10.0.0.2", "USER@example.com")
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	// the account is limited from any address
+	rr = authenticateFrom(handler, "10.0.0.3", "user@example.com")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
+	assert.Contains(t, rr.Body.String(), "too many requests")
+
+	// the address is limited for any account
+	assert.Equal(t, http.StatusAccepted, authenticateFrom(handler, "10.0.0.1", "other@example.com").Code)
+	assert.Equal(t, http.StatusAccepted, authenticateFrom(handler, "10.0.0.1", "third@example.com").Code)
+	rr = authenticateFrom(handler, "10.0.0.1", "third@example.com")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "3", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "20", rr.Header().Get("Retry-After"))
+}
+
+// TestRateLimited_Redis tests the limits of /validatesession per user, shared by two servers through Redis.
+func TestRateLimited_Redis(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	store := ratelimit.Redis{Client: client, Prefix: "ratelimit:"}
+
+	first, _ := rateLimitTestApp(store)
+	second, _ := rateLimitTestApp(store)
+
+	tokens, err := first.Auth.GenerateTokenPair(&auth.JWTUser{ID: 7})
+	assert.NoError(t, err)
+	token := tokens.Token
+
+	validate := func(app *AuthServerApp, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/validatesession", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		app.Routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, validate(first, token).Code)
+	assert.Equal(t, http.StatusOK, validate(second, token).Code)
+	rr := validate(first, token)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	assert.True(t, server.Exists("ratelimit:validatesession:account:user:7"))
+
+	// invalid tokens are not counted against a user
+	rr = validate(second, "forged")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Empty(t, rr.Header().Get("RateLimit-Limit"))
+}
+
+// TestRateLimited_NoStore tests that nothing is limited without a store.
+func TestRateLimited_NoStore(t *testing.T) {
+	app, _ := rateLimitTestApp(nil)
+	handler := app.rateLimited("authenticate", loginAccount)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for i := 0; i < 5; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/authenticate", strings.NewReader(`{"email":"a@b.c"}`)))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Empty(t, rr.Header().Get("RateLimit-Limit"))
+	}
+}
@@ -14,18 +14,99 @@ import (
 // The following endpoints are registered:
 //   - GET    /                  : Home
 //   - POST   /authenticate      : Authenticate user and issue JWT
-//   - GET    /refresh           : Refresh JWT token
-//   - GET    /logout            : Log out user
+//   - POST   /authenticate/certificate : Authenticate with a TLS client certificate and issue a bound JWT
+//   - POST   /refresh           : Refresh JWT token (CSRF token required)
+//   - POST   /logout            : Log out user (CSRF token required)
 //   - POST   /validatesession   : Validate JWT session
+//   - POST   /login/magic       : Email a passwordless login link and code
+//   - GET    /login/magic/verify : Log in with the emailed link
+//   - POST   /login/magic/verify : Log in with the emailed code or link token
+//   - POST   /login/stepup      : Email a step-up verification code (authenticated)
+//   - POST   /login/stepup/verify : Step up the session with the emailed code, trusting the browser on demand (authenticated, CSRF token required)
+//   - DELETE /impersonation     : Stop the impersonation of the token (impersonated)
+//   - GET    /session/context   : The company, database and app the token works in (authenticated)
+//   - POST   /session/context   : Switch the company, database or app, reissuing the tokens (authenticated)
+//   - GET    /login/{provider}  : Log in with an upstream OpenID Connect provider
+//   - GET    /login/{provider}/callback : Callback of the upstream provider
 //   - GET    /apps              : List apps
 //   - GET    /apps/{id}         : Get app by ID
+//   - POST   /apps/{id}/launch  : Mint a launch code for an app (authenticated)
+//   - POST   /apps/launch/exchange : Exchange a launch code for an app-scoped token (app client credentials)
+//   - POST   /apps/token/refresh   : Exchange the refresh token of an app for new app-scoped tokens (app client credentials)
+//   - *      /forward-auth      : Check a request forwarded by a reverse proxy
+//   - POST   /forward-auth/session : Store a session token for the bearer token in the forward-auth session cookie (CSRF token required)
+//   - DELETE /forward-auth/session : Remove the forward-auth session cookie (CSRF token required)
+//   - GET    /saml/metadata     : SAML identity provider metadata
+//   - GET    /saml/sso          : SAML single sign-on, HTTP-Redirect binding
+//   - POST   /saml/sso          : SAML single sign-on, HTTP-POST binding (answered over HTTP-Redirect after a login)
+//   - GET    /saml/apps/{id}    : IdP-initiated SAML login to an app
 //
-// The /admin subrouter is protected by authentication middleware and provides:
+// The /tokens subrouter is protected by authentication middleware, it cannot be called
+// with a personal access token, and provides:
+//   - GET    /tokens                  : List the personal access tokens of the user
+//   - POST   /tokens                  : Create a personal access token
+//   - DELETE /tokens/{id}             : Revoke a personal access token
+//
+// The /sessions subrouter is protected by authentication middleware, it cannot be called
+// with a personal access token, and provides:
+//   - GET    /sessions                : List the active sessions of the user, with their device
+//   - DELETE /sessions/{id}           : Revoke a session of the user
+//   - DELETE /sessions                : Revoke every session of the user, but the current one with keep_current=true
+//
+// The /trusted-devices subrouter is protected by authentication middleware, it cannot be called
+// with a personal access token, its revocations need the CSRF token, and it provides:
+//   - GET    /trusted-devices         : List the browsers of the user that skip the second factor
+//   - DELETE /trusted-devices/{id}    : Revoke a trusted device of the user
+//   - DELETE /trusted-devices         : Revoke every trusted device of the user
+//
+// Personal access tokens are accepted wherever authentication is required, but only
+// on the routes of their scopes: apps for the launch route, dbs for /dbs and admin for /admin.
+//
+// The /dbs subrouter is protected by authentication middleware and provides:
+//   - POST   /dbs/{id}/credentials    : Create temporary database credentials
+//
+// The /admin subrouter is protected by authentication middleware, only active users of the
+// AdminProfiles can call it, and it provides:
 //   - GET    /admin/apps              : List all apps (admin)
 //   - GET    /admin/apps/{id}         : Get app for editing (admin)
 //   - POST   /admin/apps/0            : Insert new app (admin)
 //   - PATCH  /admin/apps/{id}         : Update app (admin)
-//   - DELETE /admin/apps/{id}         : Delete app (admin)
+//   - DELETE /admin/apps/{id}         : Delete app (admin, step-up)
+//   - GET    /admin/apps/{id}/saml    : Get the SAML service provider of an app (admin)
+//   - PUT    /admin/apps/{id}/saml    : Register the SAML service provider of an app (admin, step-up)
+//   - DELETE /admin/apps/{id}/saml    : Remove the SAML service provider of an app (admin, step-up)
+//   - GET    /admin/apps/{id}/tokens  : Get the token settings of an app (admin)
+//   - PUT    /admin/apps/{id}/tokens  : Set the token lifetimes, audience and claims of an app (admin, step-up)
+//   - POST   /admin/apps/{id}/secret  : Rotate the client secret of an app (admin, step-up)
+//   - GET    /admin/tokens            : List the personal access tokens of all users (admin)
+//   - POST   /admin/users/{id}/impersonate : Log in as a user, answering a short-lived token (admin, step-up)
+//   - GET    /admin/users/{id}/sessions : List the active sessions of a user (admin)
+//   - DELETE /admin/users/{id}/sessions/{sid} : Revoke a session of a user (admin)
+//   - DELETE /admin/users/{id}/sessions : Revoke every session of a user (admin)
+//   - GET    /admin/users/{id}/trusted-devices : List the trusted devices of a user (admin)
+//   - DELETE /admin/users/{id}/trusted-devices/{did} : Revoke a trusted device of a user (admin)
+//   - DELETE /admin/users/{id}/trusted-devices : Revoke every trusted device of a user (admin)
+//   - GET    /admin/audit/logins      : Query the login audit trail (admin)
+//   - GET    /admin/audit             : Search or export the admin audit log (admin)
+//   - GET    /admin/audit/verify      : Verify the hash chains of the audit logs (admin)
+//   - GET    /admin/webhooks          : List the security event webhooks (admin)
+//   - POST   /admin/webhooks          : Add a webhook, answering its signing secret (admin, step-up)
+//   - DELETE /admin/webhooks/{id}     : Delete a webhook (admin, step-up)
+//   - GET    /admin/webhooks/{id}/deliveries : Delivery history of a webhook (admin)
+//   - GET    /admin/webhooks/dead-letters    : Deliveries that failed every attempt (admin)
+//   - POST   /admin/webhooks/dead-letters/{id}/retry : Retry a dead delivery (admin)
+//
+// Impersonated sessions, the tokens of an admin logged in as a user, cannot call /tokens, /sessions,
+// /trusted-devices, /session/context, /dbs, /admin or the step-up routes: they cannot change or issue credentials of the user.
+//
+// The step-up routes need a multi-factor authentication within StepUpMaxAge, otherwise they answer
+// with a challenge and the frontend steps the session up through /login/stepup.
+//
+// The logins follow the SessionPolicies of the users: past their session limit, the oldest session is
+// revoked or the login answers 403, and the tokens of a session idle for too long are refused.
+//
+// /authenticate, /refresh and /validatesession are rate limited per client IP, per account and
+// globally, with the policies of RateLimits, and answer 429 once a limit is reached.
 
 func (app *AuthServerApp) Routes() http.Handler {
 	// create a router mux
@@ -36,21 +117,103 @@ func (app *AuthServerApp) Routes() http.Handler {
 
 	mux.Get("/", app.Home)
 
-	mux.Post("/authenticate", app.Authenticate)
-	mux.Get("/refresh", app.RefreshToken)
-	mux.Get("/logout", app.Logout)
-	mux.Post("/validatesession", app.ValidateSession)
+	mux.With(app.rateLimited("authenticate", loginAccount)).Post("/authenticate", app.Authenticate)
+	mux.Post("/authenticate/certificate", app.CertificateAuthenticate)
+	mux.With(app.rateLimited("refresh", app.refreshAccount), app.csrfRequired).Post("/refresh", app.RefreshToken)
+	mux.With(app.csrfRequired).Post("/logout", app.Logout)
+	mux.With(app.rateLimited("validatesession", app.bearerAccount)).Post("/validatesession", app.ValidateSession)
+	mux.Post("/login/magic", app.MagicLogin)
+	mux.Get("/login/magic/verify", app.MagicLinkVerify)
+	mux.Post("/login/magic/verify", app.MagicLoginVerify)
+	mux.With(app.authRequired, app.sessionRequired, app.impersonationRefused).Post("/login/stepup", app.StepUp)
+	mux.With(app.csrfRequired, app.authRequired, app.sessionRequired, app.impersonationRefused).Post("/login/stepup/verify", app.StepUpVerify)
+	mux.With(app.authRequired).Delete("/impersonation", app.StopImpersonation)
+	mux.With(app.authRequired, app.sessionRequired, app.impersonationRefused).Get("/session/context", app.SessionContext)
+	mux.With(app.authRequired, app.sessionRequired, app.impersonationRefused).Post("/session/context", app.SwitchSessionContext)
+	mux.Get("/login/{provider}", app.FederatedLogin)
+	mux.Get("/login/{provider}/callback", app.FederatedCallback)
 	mux.Get("/apps", app.Apps)
 	mux.Get("/apps/{id}", app.GetApp)
+	mux.With(app.authRequired, app.scopeRequired("apps")).Post("/apps/{id}/launch", app.LaunchApp)
+	mux.Post("/apps/launch/exchange", app.ExchangeLaunchCode)
+	mux.Post("/apps/token/refresh", app.RefreshAppToken)
+	mux.HandleFunc("/forward-auth", app.ForwardAuth)
+	mux.With(app.csrfRequired).Post("/forward-auth/session", app.ForwardAuthSession)
+	mux.With(app.csrfRequired).Delete("/forward-auth/session", app.ForwardAuthLogout)
+	mux.Get("/saml/metadata", app.SAMLMetadata)
+	mux.Get("/saml/sso", app.SAMLSSO)
+	mux.Post("/saml/sso", app.SAMLSSO)
+	mux.Get("/saml/apps/{id}", app.SAMLLaunch)
 	mux.Get("/releases", app.GetReleases) // Assuming app is your AuthServerApp instance
+	mux.Route("/tokens", func(mux chi.Router) {
+		mux.Use(app.authRequired)
+		mux.Use(app.sessionRequired)
+		mux.Use(app.impersonationRefused)
+
+		mux.Get("/", app.PersonalAccessTokens)
+		mux.Post("/", app.CreatePersonalAccessToken)
+		mux.Delete("/{id}", app.RevokePersonalAccessToken)
+	})
+	mux.Route("/sessions", func(mux chi.Router) {
+		mux.Use(app.authRequired)
+		mux.Use(app.sessionRequired)
+		mux.Use(app.impersonationRefused)
+
+		mux.Get("/", app.Sessions)
+		mux.Delete("/", app.RevokeSessions)
+		mux.Delete("/{id}", app.RevokeSession)
+	})
+	mux.Route("/trusted-devices", func(mux chi.Router) {
+		mux.Use(app.csrfRequired)
+		mux.Use(app.authRequired)
+		mux.Use(app.sessionRequired)
+		mux.Use(app.impersonationRefused)
+
+		mux.Get("/", app.TrustedDevices)
+		mux.Delete("/", app.RevokeTrustedDevices)
+		mux.Delete("/{id}", app.RevokeTrustedDevice)
+	})
+	mux.Route("/dbs", func(mux chi.Router) {
+		mux.Use(app.authRequired)
+		mux.Use(app.scopeRequired("dbs"))
+		mux.Use(app.impersonationRefused)
+
+		mux.Post("/{id}/credentials", app.CreateDBCredential)
+	})
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.authRequired)
+		mux.Use(app.scopeRequired("admin"))
+		mux.Use(app.impersonationRefused)
+		mux.Use(app.adminRequired)
 
 		mux.Get("/apps", app.AppsCatalogue)
 		mux.Get("/apps/{id}", app.ThisAppForEdit)
 		mux.Post("/apps/0", app.InsertApp)
 		mux.Patch("/apps/{id}", app.UpdateApp)
-		mux.Delete("/apps/{id}", app.DeleteApp)
+		mux.With(app.stepUpRequired).Delete("/apps/{id}", app.DeleteApp)
+		mux.Get("/apps/{id}/saml", app.GetSAMLServiceProvider)
+		mux.With(app.stepUpRequired).Put("/apps/{id}/saml", app.RegisterSAMLServiceProvider)
+		mux.With(app.stepUpRequired).Delete("/apps/{id}/saml", app.DeleteSAMLServiceProvider)
+		mux.Get("/apps/{id}/tokens", app.GetAppTokenSettings)
+		mux.With(app.stepUpRequired).Put("/apps/{id}/tokens", app.UpdateAppTokenSettings)
+		mux.With(app.stepUpRequired).Post("/apps/{id}/secret", app.RotateAppClientSecret)
+		mux.Get("/tokens", app.AllPersonalAccessTokens)
+		mux.With(app.stepUpRequired).Post("/users/{id}/impersonate", app.StartImpersonation)
+		mux.Get("/users/{id}/sessions", app.UserSessions)
+		mux.Delete("/users/{id}/sessions/{sid}", app.RevokeUserSession)
+		mux.Delete("/users/{id}/sessions", app.RevokeUserSessions)
+		mux.Get("/users/{id}/trusted-devices", app.UserTrustedDevices)
+		mux.Delete("/users/{id}/trusted-devices/{did}", app.RevokeUserTrustedDevice)
+		mux.Delete("/users/{id}/trusted-devices", app.RevokeUserTrustedDevices)
+		mux.Get("/audit", app.AdminEvents)
+		mux.Get("/audit/verify", app.VerifyAuditLogs)
+		mux.Get("/audit/logins", app.LoginEvents)
+		mux.Get("/webhooks", app.Webhooks)
+		mux.With(app.stepUpRequired).Post("/webhooks", app.CreateWebhook)
+		mux.With(app.stepUpRequired).Delete("/webhooks/{id}", app.DeleteWebhook)
+		mux.Get("/webhooks/{id}/deliveries", app.WebhookDeliveries)
+		mux.Get("/webhooks/dead-letters", app.WebhookDeadLetters)
+		mux.Post("/webhooks/dead-letters/{id}/retry", app.RetryWebhookDeadLetter)
 
 	})
 
@@ -2,18 +2,23 @@ package api_test
 
 import (
 	"authserver-backend/api"
+	"authserver-backend/auth"
+	"authserver-backend/internal/csrf"
+	"authserver-backend/internal/dbrepo"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 // TestRoutes verifies the routing and middleware for the AuthServerApp
 func TestRoutes(t *testing.T) {
-	// mockDB := new(repository.MockDBRepo)
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("InsertLoginEvent", mock.Anything).Return(1, nil).Maybe()
 
-	app := api.AuthServerApp{}
+	app := api.AuthServerApp{DB: mockDB}
 
 	// Create a test server using the routes
 	ts := httptest.NewServer(app.Routes())
@@ -32,19 +37,24 @@ func TestRoutes(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
 
 	// Test the Refresh Token route
-	req, err = http.NewRequest("GET", ts.URL+"/refresh", nil)
+	req, err = http.NewRequest("POST", ts.URL+"/refresh", nil)
 	assert.NoError(t, err)
 	res, err = http.DefaultClient.Do(req)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
 
 	// Test the Logout route
-	req, err = http.NewRequest("GET", ts.URL+"/logout", nil)
+	req, err = http.NewRequest("POST", ts.URL+"/logout", nil)
 	assert.NoError(t, err)
 	res, err = http.DefaultClient.Do(req)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusAccepted, res.StatusCode)
 
+	// The refresh and logout routes are no longer GETs
+	res, err = http.Get(ts.URL + "/refresh")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
 	// Test the Admin route with authentication (would require a valid token here)
 	// Assuming you need to set up a mock for the authentication to test these routes.
 	// Let's create a test for accessing secure routes.
@@ -59,3 +69,41 @@ func TestRoutes(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusUnauthorized, res.StatusCode) // or whatever your auth check returns for invalid token
 }
+
+// TestRoutes_CSRF verifies that the state-changing routes reading or setting an authentication cookie
+// refuse a browser session without its CSRF token.
+func TestRoutes_CSRF(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("InsertLoginEvent", mock.Anything).Return(1, nil).Maybe()
+	app := api.AuthServerApp{
+		DB:        mockDB,
+		JWTSecret: "test_secret",
+		Auth:      auth.Auth{Audience: "example.com", JWTSecret: "test_secret", CookieName: "refresh_token"},
+	}
+	routes := app.Routes()
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPost, "/refresh"},
+		{http.MethodPost, "/logout"},
+		{http.MethodPost, "/forward-auth/session"},
+		{http.MethodDelete, "/forward-auth/session"},
+		{http.MethodPost, "/login/stepup/verify"},
+		{http.MethodDelete, "/trusted-devices"},
+		{http.MethodDelete, "/trusted-devices/4"},
+	} {
+		call := func(token string) int {
+			req := httptest.NewRequest(route.method, route.path, nil)
+			req.AddCookie(&http.Cookie{Name: "refresh_token", Value: "session"})
+			if token != "" {
+				req.Header.Set(csrf.HeaderName, token)
+			}
+			rr := httptest.NewRecorder()
+			routes.ServeHTTP(rr, req)
+			return rr.Code
+		}
+
+		assert.Equal(t, http.StatusForbidden, call(""), route.method+" "+route.path)
+		assert.Equal(t, http.StatusForbidden, call(csrf.Token("test_secret", "other")), route.method+" "+route.path)
+		assert.NotEqual(t, http.StatusForbidden, call(csrf.Token("test_secret", "session")), route.method+" "+route.path)
+	}
+}
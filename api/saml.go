@@ -0,0 +1,270 @@
+package api
+
+import (
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/samlidp"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/go-chi/chi/v5"
+)
+
+// samlServiceProviderKey is the context key of the service provider of an IdP-initiated login,
+// which crewjam/saml only looks up after asking for the session.
+const samlServiceProviderKey contextKey = "saml_service_provider"
+
+// errSAMLNotConfigured is returned by the SAML endpoints when the server has no signing key.
+var errSAMLNotConfigured = errors.New("SAML is not configured")
+
+// EnableSAML makes the server a SAML identity provider reachable at baseURL,
+// signing its assertions with the given certificate and key.
+func (app *AuthServerApp) EnableSAML(baseURL url.URL, cert *x509.Certificate, key crypto.Signer) {
+	app.SAML = samlidp.New(baseURL, cert, key, samlServiceProviders{app}, samlSessions{app})
+}
+
+// samlServiceProviders finds the metadata of the service providers registered for the apps.
+type samlServiceProviders struct {
+	app *AuthServerApp
+}
+
+// GetServiceProvider implements saml.ServiceProviderProvider.
+func (s samlServiceProviders) GetServiceProvider(r *http.Request, entityID string) (*saml.EntityDescriptor, error) {
+	sp, err := s.app.DB.GetSAMLServiceProvider(entityID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return samlidp.ParseMetadata([]byte(sp.Metadata))
+}
+
+// samlSessions gives the identity provider the user of a request, authenticated like for ForwardAuth
+// by the bearer token or the session cookie.
+type samlSessions struct {
+	app *AuthServerApp
+}
+
+// GetSession implements saml.SessionProvider. Browsers without a session are sent to the login page
+// and come back to the same SSO request afterwards, over the HTTP-Redirect binding, see samlRequestURL.
+// Users without a grant to the app, or deactivated, are refused.
+func (s samlSessions) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	app := s.app
+
+	claims, err := app.forwardAuthToken(r)
+	if err != nil {
+		app.forwardAuthUnauthenticated(w, r, app.samlRequestURL(r, req))
+		return nil
+	}
+
+	sp, ok := r.Context().Value(samlServiceProviderKey).(*models.SAMLServiceProvider)
+	if !ok {
+		sp, err = app.DB.GetSAMLServiceProvider(req.ServiceProviderMetadata.EntityID)
+		if err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("unknown service provider"), http.StatusNotFound)
+			return nil
+		}
+	}
+
+	if _, err := app.DB.GetAppGrant(claims.UserID, sp.AppID); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("user has no access to this app"), http.StatusForbidden)
+		return nil
+	}
+
+	user, err := app.DB.GetUserByID(claims.UserID)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusUnauthorized)
+		return nil
+	}
+	if err := activeUser(user); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusForbidden)
+		return nil
+	}
+
+	sessionID, err := utils.RandomToken(16)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return nil
+	}
+
+	// the assertion tells when the user logged in, not when the token was refreshed
+	authTime := time.Now()
+	if claims.AuthTime > 0 {
+		authTime = time.Unix(claims.AuthTime, 0)
+	}
+	session, err := samlidp.Session(user, sp, authTime, sessionID)
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("invalid SAML attribute mapping"), http.StatusInternalServerError)
+		return nil
+	}
+	return session
+}
+
+// samlRequestURL returns the address the browser comes back to after the login to answer an
+// authentication request. A request of the HTTP-POST binding is turned into its HTTP-Redirect one:
+// the session cookie is not sent with the cross-site POST of the service provider, and the login page
+// can only send the browser back with a GET. It is nil when the request cannot be encoded.
+func (app *AuthServerApp) samlRequestURL(r *http.Request, req *saml.IdpAuthnRequest) *url.URL {
+	if r.Method == http.MethodGet {
+		return app.SAML.SSOURL.ResolveReference(&url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery})
+	}
+
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		return nil
+	}
+	if _, err := fw.Write(req.RequestBuffer); err != nil {
+		return nil
+	}
+	if err := fw.Close(); err != nil {
+		return nil
+	}
+	query := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(compressed.Bytes())}}
+	if req.RelayState != "" {
+		query.Set("RelayState", req.RelayState)
+	}
+	return app.SAML.SSOURL.ResolveReference(&url.URL{Path: r.URL.Path, RawQuery: query.Encode()})
+}
+
+// SAMLMetadata serves the metadata of the identity provider, to be registered in the service providers.
+func (app *AuthServerApp) SAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	if app.SAML == nil {
+		utils.JSONResponse{}.ErrorJSON(w, errSAMLNotConfigured, http.StatusNotFound)
+		return
+	}
+	app.SAML.ServeMetadata(w, r)
+}
+
+// SAMLSSO handles the authentication requests of the service providers (SP-initiated login)
+// and posts the signed assertion back to the app.
+func (app *AuthServerApp) SAMLSSO(w http.ResponseWriter, r *http.Request) {
+	if app.SAML == nil {
+		utils.JSONResponse{}.ErrorJSON(w, errSAMLNotConfigured, http.StatusNotFound)
+		return
+	}
+	app.SAML.ServeSSO(w, r)
+}
+
+// SAMLLaunch posts a signed assertion to the app given in the URL without a request from it
+// (IdP-initiated login), so users can open SAML apps from the catalogue.
+// The RelayState query parameter is passed on to the app.
+func (app *AuthServerApp) SAMLLaunch(w http.ResponseWriter, r *http.Request) {
+	if app.SAML == nil {
+		utils.JSONResponse{}.ErrorJSON(w, errSAMLNotConfigured, http.StatusNotFound)
+		return
+	}
+
+	appID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	sp, err := app.DB.GetSAMLServiceProviderByApp(appID)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("app has no SAML service provider"), http.StatusNotFound)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), samlServiceProviderKey, sp)
+	app.SAML.ServeIDPInitiated(w, r.WithContext(ctx), sp.EntityID, r.URL.Query().Get("RelayState"))
+}
+
+// GetSAMLServiceProvider returns the SAML service provider registered for an app.
+func (app *AuthServerApp) GetSAMLServiceProvider(w http.ResponseWriter, r *http.Request) {
+	appID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	sp, err := app.DB.GetSAMLServiceProviderByApp(appID)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, sp)
+}
+
+// RegisterSAMLServiceProvider registers the SAML service provider of an app from its metadata,
+// with the user field sent as NameID and the attribute mapping, replacing the one registered before.
+func (app *AuthServerApp) RegisterSAMLServiceProvider(w http.ResponseWriter, r *http.Request) {
+	appID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	var payload models.SAMLServiceProvider
+	if err := (utils.JSONResponse{}).ReadJSON(w, r, &payload); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	metadata, err := samlidp.ParseMetadata([]byte(payload.Metadata))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	// check the mapping before storing it, not at the first login
+	if _, err := samlidp.Session(&models.User{}, &payload, time.Now(), ""); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	payload.AppID = appID
+	payload.EntityID = metadata.EntityID
+	before, err := app.DB.GetSAMLServiceProviderByApp(appID)
+	if err != nil {
+		before = nil
+	}
+	payload.ID, err = app.DB.UpsertSAMLServiceProvider(payload)
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not register the service provider"), http.StatusInternalServerError)
+		return
+	}
+	action := models.AdminActionUpdate
+	if before == nil {
+		action = models.AdminActionCreate
+	}
+	app.recordAdminEvent(r, action, auditEntitySAML, appID, before, payload)
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, payload)
+}
+
+// DeleteSAMLServiceProvider removes the SAML service provider of an app.
+func (app *AuthServerApp) DeleteSAMLServiceProvider(w http.ResponseWriter, r *http.Request) {
+	appID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	before, err := app.DB.GetSAMLServiceProviderByApp(appID)
+	if err != nil {
+		before = nil
+	}
+	if err := app.DB.DeleteSAMLServiceProvider(appID); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	app.recordAdminEvent(r, models.AdminActionDelete, auditEntitySAML, appID, before, nil)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,323 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/samlidp/samlidptest"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// samlTestApp returns an app acting as SAML identity provider at https://auth.example.com,
+// a service provider registered for app 4, and an access token of user 1.
+func samlTestApp(t *testing.T, mockDB *dbrepo.MockDBRepo) (*AuthServerApp, *samlidptest.ServiceProvider, string) {
+	app := &AuthServerApp{
+		DB:     mockDB,
+		Domain: "example.com",
+		Auth: auth.Auth{
+			Issuer:        "example.com",
+			Audience:      "example.com",
+			JWTSecret:     "test_secret",
+			TokenExpiry:   time.Minute * 15,
+			RefreshExpiry: time.Hour,
+		},
+	}
+
+	cert, key, err := samlidptest.KeyPair("auth.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse("https://auth.example.com")
+	app.EnableSAML(*base, cert, key)
+
+	sp, err := samlidptest.NewServiceProvider("https://sp.example.com", app.SAML.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := sp.MetadataXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registered := &models.SAMLServiceProvider{
+		ID:         1,
+		AppID:      4,
+		EntityID:   sp.EntityID,
+		Metadata:   metadata,
+		Attributes: map[string]string{"companyId": "company_id"},
+	}
+	mockDB.On("GetSAMLServiceProvider", sp.EntityID).Return(registered, nil).Maybe()
+	mockDB.On("GetSAMLServiceProviderByApp", 4).Return(registered, nil).Maybe()
+	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, UserName: "jdoe", Email: "jdoe@example.com", CompanyId: 3, Active: true}, nil).Maybe()
+
+	tokens, err := app.Auth.GenerateTokenPair(&auth.JWTUser{ID: 1, Email: "jdoe@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app, sp, tokens.Token
+}
+
+// TestSAML_SPInitiated tests a login started by the app: the assertion is signed, answers the request,
+// and carries the NameID and the mapped attributes.
+func TestSAML_SPInitiated(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, sp, token := samlTestApp(t, mockDB)
+	mockDB.On("GetAppGrant", 1, 4).Return(&models.AppGrant{UserID: 1, AppID: 4}, nil)
+
+	authnURL, requestID, err := sp.AuthnRequestURL("/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, authnURL.String(), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	assertion, relayState, err := sp.ParseForm(rr.Body.String(), requestID)
+	if err != nil {
+		t.Fatalf("the service provider refused the assertion: %v", err)
+	}
+	assert.Equal(t, "/dashboard", relayState)
+	assert.Equal(t, "jdoe@example.com", assertion.Subject.NameID.Value)
+	assert.Equal(t, "3", samlidptest.Attribute(assertion, "companyId"))
+}
+
+// TestSAML_AuthTime tests that the assertion tells when the user logged in, not when their token was issued.
+func TestSAML_AuthTime(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, sp, _ := samlTestApp(t, mockDB)
+	sp.AllowIDPInitiated = true
+	mockDB.On("GetAppGrant", 1, 4).Return(&models.AppGrant{UserID: 1, AppID: 4}, nil)
+	loggedIn := time.Now().Add(-time.Hour * 3).Truncate(time.Second)
+	tokens, err := app.Auth.GenerateTokenPair(&auth.JWTUser{ID: 1, Email: "jdoe@example.com",
+		AMR: []string{auth.AMRPassword}, AuthTime: loggedIn.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/saml/apps/4", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Token)
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assertion, _, err := sp.ParseForm(rr.Body.String())
+	if err != nil {
+		t.Fatalf("the service provider refused the assertion: %v", err)
+	}
+	if assert.Len(t, assertion.AuthnStatements, 1) {
+		assert.True(t, loggedIn.Equal(assertion.AuthnStatements[0].AuthnInstant))
+	}
+}
+
+// TestSAML_IdPInitiated tests opening a SAML app from the catalogue.
+func TestSAML_IdPInitiated(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, sp, token := samlTestApp(t, mockDB)
+	sp.AllowIDPInitiated = true
+	mockDB.On("GetAppGrant", 1, 4).Return(&models.AppGrant{UserID: 1, AppID: 4}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/saml/apps/4?RelayState=%2Freports", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	assertion, relayState, err := sp.ParseForm(rr.Body.String())
+	if err != nil {
+		t.Fatalf("the service provider refused the assertion: %v", err)
+	}
+	assert.Equal(t, "/reports", relayState)
+	assert.Equal(t, "jdoe@example.com", assertion.Subject.NameID.Value)
+}
+
+// TestSAML_NoGrant tests that users without access to the app get no assertion.
+func TestSAML_NoGrant(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, _, token := samlTestApp(t, mockDB)
+	mockDB.On("GetAppGrant", 1, 4).Return((*models.AppGrant)(nil), errors.New("no grant"))
+
+	req := httptest.NewRequest(http.MethodGet, "/saml/apps/4", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "SAMLResponse")
+}
+
+// TestSAML_Inactive tests that a deactivated user gets no assertion, even with a token issued before.
+func TestSAML_Inactive(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, _, _ := samlTestApp(t, mockDB)
+	mockDB.On("GetAppGrant", 2, 4).Return(&models.AppGrant{UserID: 2, AppID: 4}, nil)
+	mockDB.On("GetUserByID", 2).Return(&models.User{ID: 2, Email: "gone@example.com"}, nil)
+	tokens, err := app.Auth.GenerateTokenPair(&auth.JWTUser{ID: 2, Email: "gone@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/saml/apps/4", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Token)
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "SAMLResponse")
+}
+
+// TestSAML_LoginRedirect tests that a browser without a session is sent to the login page
+// and brought back to the same authentication request.
+func TestSAML_LoginRedirect(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, sp, _ := samlTestApp(t, mockDB)
+	app.ForwardAuthLoginURL = "https://apps.example.com/login"
+
+	authnURL, _, err := sp.AuthnRequestURL("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, authnURL.String(), nil)
+	req.Header.Set("Accept", "text/html")
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusFound, rr.Code)
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "apps.example.com", location.Host)
+	assert.Equal(t, authnURL.String(), location.Query().Get("rd"))
+}
+
+// TestSAML_PostBinding tests a login started by the app with the HTTP-POST binding: the browser,
+// whose session cookie is not sent with the cross-site POST, is sent to the login page and brought back
+// to the same request over the HTTP-Redirect binding, which is answered once it has a session.
+func TestSAML_PostBinding(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, sp, token := samlTestApp(t, mockDB)
+	app.ForwardAuthLoginURL = "https://apps.example.com/login"
+	mockDB.On("GetAppGrant", 1, 4).Return(&models.AppGrant{UserID: 1, AppID: 4}, nil)
+
+	form, location, requestID, err := sp.AuthnRequestForm("/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://auth.example.com/saml/sso", location)
+
+	req := httptest.NewRequest(http.MethodPost, location, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "text/html")
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusFound, rr.Code)
+	login, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "apps.example.com", login.Host)
+	back, err := url.Parse(login.Query().Get("rd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, location, back.Scheme+"://"+back.Host+back.Path)
+	assert.Equal(t, "/dashboard", back.Query().Get("RelayState"))
+
+	// back from the login page, with a session
+	req = httptest.NewRequest(http.MethodGet, back.String(), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assertion, relayState, err := sp.ParseForm(rr.Body.String(), requestID)
+	if err != nil {
+		t.Fatalf("the service provider refused the assertion: %v", err)
+	}
+	assert.Equal(t, "/dashboard", relayState)
+	assert.Equal(t, "jdoe@example.com", assertion.Subject.NameID.Value)
+}
+
+// TestSAMLMetadata tests the published metadata, and that the endpoints are off without a signing key.
+func TestSAMLMetadata(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app, _, _ := samlTestApp(t, mockDB)
+
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/saml/metadata", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `entityID="https://auth.example.com/saml/metadata"`)
+
+	app.SAML = nil
+	rr = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/saml/metadata", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// TestRegisterSAMLServiceProvider tests registering the service provider of an app from its metadata.
+func TestRegisterSAMLServiceProvider(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowAdminEvents(mockDB)
+	app, sp, _ := samlTestApp(t, mockDB)
+	metadata, _ := sp.MetadataXML()
+
+	mockDB.On("UpsertSAMLServiceProvider", mock.MatchedBy(func(registered models.SAMLServiceProvider) bool {
+		return registered.AppID == 4 && registered.EntityID == "https://sp.example.com/saml/metadata" &&
+			registered.NameIDField == "username" && registered.Attributes["mail"] == "email"
+	})).Return(2, nil)
+
+	r := chi.NewRouter()
+	r.Put("/admin/apps/{id}/saml", app.RegisterSAMLServiceProvider)
+
+	body, _ := json.Marshal(map[string]any{
+		"metadata":   metadata,
+		"name_id":    "username",
+		"attributes": map[string]string{"mail": "email"},
+	})
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/admin/apps/4/saml", bytes.NewReader(body)))
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	var registered models.SAMLServiceProvider
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&registered))
+	assert.Equal(t, 2, registered.ID)
+	mockDB.AssertExpectations(t)
+
+	// a mapping to a field that cannot be sent is refused
+	body, _ = json.Marshal(map[string]any{
+		"metadata":   metadata,
+		"attributes": map[string]string{"pw": "password"},
+	})
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/admin/apps/4/saml", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/admin/apps/4/saml", strings.NewReader(`{"metadata":"<nope/>"}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	mockDB.AssertNumberOfCalls(t, "UpsertSAMLServiceProvider", 1)
+}
+
+// TestSAMLServiceProvider_AdminOnly tests that only admins read, register and remove the SAML service providers.
+func TestSAMLServiceProvider_AdminOnly(t *testing.T) {
+	assertAdminOnly(t, "GET /admin/apps/7/saml", "PUT /admin/apps/7/saml", "DELETE /admin/apps/7/saml")
+}
@@ -0,0 +1,329 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mileusna/useragent"
+)
+
+// defaultSessionLifetime is how long a session lasts without refresh when Auth.RefreshExpiry is not set.
+const defaultSessionLifetime = time.Hour * 24
+
+// sessionTouchInterval is how stale the last seen time of a session may get, so the requests
+// of a session do not all write to the database.
+const sessionTouchInterval = time.Minute
+
+// auditEntitySession is the entity type of the sessions in the admin audit log.
+const auditEntitySession = "session"
+
+// errSessionRevoked refuses the tokens of a revoked, expired or idle session.
+var errSessionRevoked = errors.New("the session has been revoked")
+
+// errSessionLimit refuses a login past the session limit of the user, when the policy denies it.
+var errSessionLimit = errors.New("too many active sessions, log out of another device first")
+
+func (app *AuthServerApp) sessionLifetime() time.Duration {
+	if app.Auth.RefreshExpiry > 0 {
+		return app.Auth.RefreshExpiry
+	}
+	return defaultSessionLifetime
+}
+
+// deviceName names the browser and the operating system of a user agent, like "Chrome 120 on macOS".
+func deviceName(userAgent string) string {
+	ua := useragent.Parse(userAgent)
+	if ua.Name == "" {
+		return "Unknown device"
+	}
+	name := ua.Name
+	if major, _, _ := strings.Cut(ua.Version, "."); major != "" {
+		name += " " + major
+	}
+	if ua.OS != "" {
+		name += " on " + ua.OS
+	}
+	if ua.Device != "" {
+		name += " (" + ua.Device + ")"
+	}
+	return name
+}
+
+// startSession records a new session for a user logging in from the device of the request, under the
+// session policy of the user: past the session limit, the oldest sessions are revoked or the login is
+// refused with errSessionLimit.
+func (app *AuthServerApp) startSession(r *http.Request, user *models.User) (int, error) {
+	now := time.Now()
+	policy := app.SessionPolicies.For(user)
+	if policy.MaxSessions > 0 {
+		sessions, err := app.DB.UserSessions(user.ID, now.Unix())
+		if err != nil {
+			return 0, err
+		}
+		evicted, ok := policy.Admit(sessions)
+		if !ok {
+			return 0, errSessionLimit
+		}
+		for _, s := range evicted {
+			if err := app.DB.RevokeSession(s.ID, user.ID, now.Unix()); err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return 0, err
+			}
+		}
+	}
+
+	id, err := app.DB.InsertSession(models.Session{
+		UserID:      user.ID,
+		UserAgent:   r.UserAgent(),
+		Device:      deviceName(r.UserAgent()),
+		IP:          clientIP(r),
+		Created:     now.Unix(),
+		LastSeen:    now.Unix(),
+		ExpiresAt:   now.Add(app.sessionLifetime()).Unix(),
+		IdleTimeout: int64(time.Duration(policy.IdleTimeout).Seconds()),
+	})
+	if err != nil {
+		return 0, err
+	}
+	app.Activity.Seen(0, user.ID, now.Unix())
+	return id, nil
+}
+
+// tokenPairStatus is the status answering an error of issueTokenPair.
+func tokenPairStatus(err error) int {
+	if errors.Is(err, errSessionLimit) || errors.Is(err, errInactiveUser) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// activeSession returns a session that was neither revoked, expired nor idle. Its last seen time
+// includes the activity not yet written by the tracker.
+func (app *AuthServerApp) activeSession(id int) (*models.Session, error) {
+	s, err := app.DB.GetSession(id)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			logerror.LogError(err)
+		}
+		return nil, errSessionRevoked
+	}
+	if seen := app.Activity.LastSeen(id); seen > s.LastSeen {
+		s.LastSeen = seen
+	}
+	if !s.Active(time.Now().Unix()) {
+		return nil, errSessionRevoked
+	}
+	return s, nil
+}
+
+// checkSession refuses the token of a session that was revoked, expired or idle, and records that the
+// session was seen. The tokens issued before the sessions were tracked carry none, they go through.
+func (app *AuthServerApp) checkSession(claims *auth.Claims) error {
+	if claims.SessionID == 0 {
+		return nil
+	}
+	s, err := app.activeSession(claims.SessionID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if app.Activity != nil {
+		app.Activity.Seen(s.ID, s.UserID, now.Unix())
+		return nil
+	}
+	if now.Sub(time.Unix(s.LastSeen, 0)) > sessionTouchInterval {
+		if err := app.DB.TouchSession(s.ID, now.Unix(), 0); err != nil {
+			logerror.LogError(err)
+		}
+	}
+	return nil
+}
+
+// checkClaims refuses the token of a session or an impersonation that has ended.
+func (app *AuthServerApp) checkClaims(claims *auth.Claims) error {
+	if err := app.checkImpersonation(claims); err != nil {
+		return err
+	}
+	return app.checkSession(claims)
+}
+
+// sessionList is the answer listing sessions, Current is the session of the request.
+type sessionList struct {
+	Sessions []*models.Session `json:"sessions"`
+	Current  int               `json:"current,omitempty"`
+}
+
+// Sessions lists the active sessions of the user, the last seen first, with the one of the request.
+func (app *AuthServerApp) Sessions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	app.writeSessions(w, claims.UserID, claims.SessionID)
+}
+
+// RevokeSession revokes a session of the user, its tokens are refused from now on.
+func (app *AuthServerApp) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	if !app.revokeSession(w, id, claims.UserID) {
+		return
+	}
+	if id == claims.SessionID {
+		app.clearRefreshCookies(w)
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "session revoked",
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// RevokeSessions revokes every session of the user, the one of the request included unless
+// the keep_current query parameter is true: it logs the user out of the other devices.
+func (app *AuthServerApp) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	keep := 0
+	if current, _ := strconv.ParseBool(r.URL.Query().Get("keep_current")); current {
+		keep = claims.SessionID
+	}
+	if _, ok := app.revokeSessions(w, claims.UserID, keep); !ok {
+		return
+	}
+	if keep == 0 {
+		app.clearRefreshCookies(w)
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "sessions revoked",
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// UserSessions lists the active sessions of the user of the URL, for the admins.
+func (app *AuthServerApp) UserSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	app.writeSessions(w, userID, 0)
+}
+
+// RevokeUserSession revokes a session of the user of the URL. The revocation is recorded in the admin audit log.
+func (app *AuthServerApp) RevokeUserSession(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "sid"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	before, err := app.DB.GetSession(id)
+	if err != nil || before.UserID != userID {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("session not found"), http.StatusNotFound)
+		return
+	}
+	if !app.revokeSession(w, id, userID) {
+		return
+	}
+	after := *before
+	after.Revoked = time.Now().Unix()
+	app.recordAdminEvent(r, models.AdminActionRevokeSessions, auditEntitySession, id, before, after)
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "session revoked",
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// RevokeUserSessions revokes every session of the user of the URL, logging them out of all their devices.
+// The revocation is recorded in the admin audit log.
+func (app *AuthServerApp) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	revoked, ok := app.revokeSessions(w, userID, 0)
+	if !ok {
+		return
+	}
+	app.recordAdminEvent(r, models.AdminActionRevokeSessions, auditEntityUser, userID, nil, struct {
+		RevokedSessions int `json:"revoked_sessions"`
+	}{revoked})
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "sessions revoked",
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// writeSessions answers the active sessions of a user.
+func (app *AuthServerApp) writeSessions(w http.ResponseWriter, userID, current int) {
+	sessions, err := app.DB.UserSessions(userID, time.Now().Unix())
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not list the sessions"), http.StatusInternalServerError)
+		return
+	}
+	if sessions == nil {
+		sessions = []*models.Session{}
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, sessionList{Sessions: sessions, Current: current})
+}
+
+// revokeSession revokes a session of a user, answering the error when it cannot.
+func (app *AuthServerApp) revokeSession(w http.ResponseWriter, id, userID int) bool {
+	err := app.DB.RevokeSession(id, userID, time.Now().Unix())
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("session not found"), http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not revoke the session"), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// revokeSessions revokes the sessions of a user but keep and returns how many, answering the error when it cannot.
+func (app *AuthServerApp) revokeSessions(w http.ResponseWriter, userID, keep int) (int, bool) {
+	revoked, err := app.DB.RevokeUserSessions(userID, keep, time.Now().Unix())
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not revoke the sessions"), http.StatusInternalServerError)
+		return 0, false
+	}
+	return revoked, true
+}
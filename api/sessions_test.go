@@ -0,0 +1,273 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/sessionpolicy"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// allowSessions lets the login handlers start session 5 in a mock database, and keeps it active.
+func allowSessions(mockDB *dbrepo.MockDBRepo) {
+	mockDB.On("InsertSession", mock.Anything).Return(5, nil).Maybe()
+	mockDB.On("GetSession", 5).Return(&models.Session{ID: 5, UserID: 1, LastSeen: time.Now().Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix()}, nil).Maybe()
+	mockDB.On("TouchSession", mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+}
+
+// sessionsApp returns an app signing real tokens, with session 5 of user 1 active.
+func sessionsApp(mockDB *dbrepo.MockDBRepo) *AuthServerApp {
+	allowLoginEvents(mockDB)
+	allowSessions(mockDB)
+	return &AuthServerApp{
+		DB: mockDB,
+		Auth: auth.Auth{
+			Issuer:        "example.com",
+			Audience:      "example.com",
+			JWTSecret:     "test_secret",
+			TokenExpiry:   time.Minute * 15,
+			RefreshExpiry: time.Hour,
+			CookieName:    "refresh_token",
+		},
+		JWTSecret: "test_secret",
+	}
+}
+
+// sessionTokens returns the tokens of user 1 in a session.
+func sessionTokens(t *testing.T, app *AuthServerApp, sessionID int) auth.TokenPairs {
+	tokens, err := app.Auth.GenerateTokenPair(&auth.JWTUser{ID: 1, Email: "user@example.com", AuthTime: time.Now().Unix(), SessionID: sessionID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestDeviceName(t *testing.T) {
+	for userAgent, device := range map[string]string{
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36":                   "Chrome 120 on macOS",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0":                                                                  "Firefox 121 on Linux",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1": "Safari 17 on iOS (iPhone)",
+		"": "Unknown device",
+	} {
+		assert.Equal(t, device, deviceName(userAgent), userAgent)
+	}
+}
+
+// TestIssueTokenPair_Session tests that a login starts a session for the device of the request
+// and that its tokens carry it.
+func TestIssueTokenPair_Session(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("InsertSession", mock.MatchedBy(func(s models.Session) bool {
+		return s.UserID == 1 && s.IP == "10.0.0.1" && s.Device == "Firefox 121 on Linux" && s.ExpiresAt-s.Created == 3600
+	})).Return(7, nil)
+	app := sessionsApp(mockDB)
+
+	req := httptest.NewRequest(http.MethodPost, "/authenticate", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0")
+	tokens, err := app.issueTokenPair(httptest.NewRecorder(), req, &models.User{ID: 1, Email: "user@example.com", Active: true}, auth.AMRPassword)
+	assert.NoError(t, err)
+
+	claims, err := app.Auth.VerifyToken(tokens.Token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 7, claims.SessionID)
+	}
+}
+
+// TestRefreshToken_Session tests that the refreshed tokens stay in their session, which is extended,
+// and that a revoked session cannot be refreshed.
+func TestRefreshToken_Session(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := sessionsApp(mockDB)
+	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, Email: "user@example.com", Active: true}, nil)
+	mockDB.On("GetSession", 6).Return(&models.Session{ID: 6, UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix(), Revoked: time.Now().Unix()}, nil)
+
+	refresh := func(sessionID int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+		req.AddCookie(&http.Cookie{Name: app.Auth.CookieName, Value: sessionTokens(t, app, sessionID).RefreshToken})
+		rr := httptest.NewRecorder()
+		app.RefreshToken(rr, req)
+		return rr
+	}
+
+	rr := refresh(5)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var tokens auth.TokenPairs
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&tokens))
+	claims, err := app.Auth.VerifyToken(tokens.Token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 5, claims.SessionID)
+	}
+	mockDB.AssertCalled(t, "TouchSession", 5, mock.AnythingOfType("int64"), mock.MatchedBy(func(expiresAt int64) bool {
+		return expiresAt > time.Now().Add(time.Minute*59).Unix()
+	}))
+
+	assert.Equal(t, http.StatusUnauthorized, refresh(6).Code)
+}
+
+// TestLogout_Session tests that logging out revokes the session of the refresh token.
+func TestLogout_Session(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := sessionsApp(mockDB)
+	mockDB.On("RevokeSession", 5, 1, mock.AnythingOfType("int64")).Return(nil).Once()
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.AddCookie(&http.Cookie{Name: app.Auth.CookieName, Value: sessionTokens(t, app, 5).RefreshToken})
+	rr := httptest.NewRecorder()
+	app.Logout(rr, req)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	mockDB.AssertExpectations(t)
+}
+
+// TestSessions tests the listing of the sessions of the user, and that the tokens of a revoked session are refused.
+func TestSessions(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := sessionsApp(mockDB)
+	mockDB.On("GetSession", 6).Return((*models.Session)(nil), fmt.Errorf("session 6 not found: %w", sql.ErrNoRows))
+	mockDB.On("UserSessions", 1, mock.AnythingOfType("int64")).Return([]*models.Session{
+		{ID: 5, UserID: 1, Device: "Chrome 120 on macOS", IP: "10.0.0.1"},
+		{ID: 8, UserID: 1, Device: "Safari 17 on iOS (iPhone)", IP: "10.0.0.2"},
+	}, nil)
+	routes := app.Routes()
+
+	list := func(sessionID int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+		req.Header.Set("Authorization", "Bearer "+sessionTokens(t, app, sessionID).Token)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := list(5)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resp sessionList
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, 5, resp.Current)
+	assert.Len(t, resp.Sessions, 2)
+	assert.Equal(t, "Safari 17 on iOS (iPhone)", resp.Sessions[1].Device)
+
+	assert.Equal(t, http.StatusUnauthorized, list(6).Code)
+}
+
+// TestRevokeSessions tests that users revoke their own sessions only, and can keep the current one.
+func TestRevokeSessions(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := sessionsApp(mockDB)
+	mockDB.On("RevokeSession", 8, 1, mock.AnythingOfType("int64")).Return(nil)
+	mockDB.On("RevokeSession", 9, 1, mock.AnythingOfType("int64")).Return(fmt.Errorf("session 9 not found: %w", sql.ErrNoRows))
+	mockDB.On("RevokeUserSessions", 1, 5, mock.AnythingOfType("int64")).Return(2, nil).Once()
+	routes := app.Routes()
+	token := sessionTokens(t, app, 5).Token
+
+	revoke := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := revoke("/sessions/8")
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Empty(t, rr.Result().Cookies(), "another session keeps the cookies of this one")
+	assert.Equal(t, http.StatusNotFound, revoke("/sessions/9").Code, "the session of another user")
+	assert.Equal(t, http.StatusAccepted, revoke("/sessions?keep_current=true").Code)
+	mockDB.AssertExpectations(t)
+}
+
+// TestRevokeUserSession tests that the admins revoke the sessions of a user, and that it is audited.
+func TestRevokeUserSession(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := sessionsApp(mockDB)
+	mockDB.On("GetSession", 8).Return(&models.Session{ID: 8, UserID: 2, ExpiresAt: time.Now().Add(time.Hour).Unix()}, nil)
+	mockDB.On("RevokeSession", 8, 2, mock.AnythingOfType("int64")).Return(nil)
+	mockDB.On("RevokeUserSessions", 2, 0, mock.AnythingOfType("int64")).Return(3, nil)
+	mockDB.On("InsertAdminEvent", mock.Anything).Return(1, nil)
+	r := chi.NewRouter()
+	r.Delete("/admin/users/{id}/sessions/{sid}", app.RevokeUserSession)
+	r.Delete("/admin/users/{id}/sessions", app.RevokeUserSessions)
+
+	revoke := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, withClaims(req, &auth.Claims{UserID: 1, Email: "admin@example.com"}))
+		return rr
+	}
+
+	assert.Equal(t, http.StatusAccepted, revoke("/admin/users/2/sessions/8").Code)
+	mockDB.AssertCalled(t, "InsertAdminEvent", mock.MatchedBy(func(e models.AdminEvent) bool {
+		return e.ActorID == 1 && e.Action == models.AdminActionRevokeSessions && e.EntityType == auditEntitySession &&
+			e.EntityID == 8 && strings.Contains(string(e.Diff), "revoked")
+	}))
+	assert.Equal(t, http.StatusNotFound, revoke("/admin/users/3/sessions/8").Code, "the session of another user")
+
+	assert.Equal(t, http.StatusAccepted, revoke("/admin/users/2/sessions").Code)
+	mockDB.AssertCalled(t, "InsertAdminEvent", mock.MatchedBy(func(e models.AdminEvent) bool {
+		return e.EntityType == auditEntityUser && e.EntityID == 2 && strings.Contains(string(e.Diff), "revoked_sessions")
+	}))
+}
+
+// TestStartSession_Limit tests that a login past the session limit of the user revokes their oldest
+// session, or is refused and recorded when the policy denies it.
+func TestStartSession_Limit(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := sessionsApp(mockDB)
+	app.SessionPolicies = sessionpolicy.Config{
+		Default:   sessionpolicy.Policy{MaxSessions: 2, IdleTimeout: sessionpolicy.Duration(time.Minute * 30)},
+		Companies: map[int]sessionpolicy.Policy{3: {MaxSessions: 2, OnLimit: sessionpolicy.OnLimitDeny}},
+	}
+	mockDB.On("UserSessions", 1, mock.AnythingOfType("int64")).Return([]*models.Session{{ID: 6, Created: 200}, {ID: 4, Created: 100}}, nil)
+	mockDB.On("RevokeSession", 4, 1, mock.AnythingOfType("int64")).Return(nil).Once()
+	req := httptest.NewRequest(http.MethodPost, "/authenticate", nil)
+
+	id, err := app.startSession(req, &models.User{ID: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, id)
+	mockDB.AssertCalled(t, "InsertSession", mock.MatchedBy(func(s models.Session) bool { return s.IdleTimeout == 1800 }))
+
+	tokens, err := app.issueTokenPair(httptest.NewRecorder(), req, &models.User{ID: 1, CompanyId: 3, Active: true}, auth.AMRPassword)
+	assert.ErrorIs(t, err, errSessionLimit)
+	assert.Empty(t, tokens.Token)
+	assert.Equal(t, http.StatusForbidden, tokenPairStatus(err))
+	mockDB.AssertExpectations(t)
+	mockDB.AssertCalled(t, "InsertLoginEvent", mock.MatchedBy(func(e models.LoginEvent) bool {
+		return e.UserID == 1 && !e.Success && e.Reason == reasonSessionLimit
+	}))
+}
+
+// TestSession_Idle tests that the tokens of an idle session are refused, that its refresh token cannot
+// be refreshed, and that the batched activity keeps a session in use alive.
+func TestSession_Idle(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := sessionsApp(mockDB)
+	app.Activity = sessionpolicy.NewTracker(mockDB)
+	lastSeen := time.Now().Add(-time.Minute * 31).Unix()
+	mockDB.On("GetSession", 6).Return(&models.Session{ID: 6, UserID: 1, LastSeen: lastSeen, ExpiresAt: time.Now().Add(time.Hour).Unix(), IdleTimeout: 1800}, nil)
+	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, Email: "user@example.com", Active: true}, nil)
+
+	claims := &auth.Claims{UserID: 1, SessionID: 6}
+	assert.ErrorIs(t, app.checkSession(claims), errSessionRevoked)
+
+	req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: app.Auth.CookieName, Value: sessionTokens(t, app, 6).RefreshToken})
+	rr := httptest.NewRecorder()
+	app.RefreshToken(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// the activity not yet written counts
+	app.Activity.Seen(6, 1, time.Now().Add(-time.Minute).Unix())
+	assert.NoError(t, app.checkSession(claims))
+	assert.Equal(t, time.Now().Unix(), app.Activity.LastSeen(6))
+	mockDB.AssertNotCalled(t, "TouchSession", 6, mock.Anything, mock.Anything)
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// defaultStepUpMaxAge is used when AuthServerApp.StepUpMaxAge is not set.
+const defaultStepUpMaxAge = time.Minute * 5
+
+// stepUpChallenge tells the frontend which authentication a route needs, following the
+// OAuth 2.0 step-up authentication challenge (RFC 9470): the acr to reach, within max_age seconds,
+// and where to start the step-up.
+type stepUpChallenge struct {
+	Error     string `json:"error"`
+	ACRValues string `json:"acr_values"`
+	MaxAge    int    `json:"max_age"`
+	StepUpURL string `json:"step_up_url"`
+}
+
+func (app *AuthServerApp) stepUpMaxAge() time.Duration {
+	if app.StepUpMaxAge > 0 {
+		return app.StepUpMaxAge
+	}
+	return defaultStepUpMaxAge
+}
+
+// stepUpRequired refuses the requests of users who did not authenticate with several factors
+// within StepUpMaxAge, with a challenge the frontend answers by stepping up through StepUp.
+// A password login from a trusted device passes while the browser of the request is still trusted:
+// the device stands for the second factor. It must run after authRequired.
+func (app *AuthServerApp) stepUpRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := claimsFromContext(r.Context())
+		if !ok {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+			return
+		}
+
+		maxAge := app.stepUpMaxAge()
+		recent := time.Since(time.Unix(claims.AuthTime, 0)) <= maxAge
+		multiFactor := claims.ACR == auth.ACRMultiFactor && slices.Contains(claims.AMR, auth.AMRMultiFactor)
+		if !multiFactor && slices.Contains(claims.AMR, auth.AMRTrustedDevice) {
+			user, err := app.DB.GetUserByID(claims.UserID)
+			multiFactor = err == nil && user != nil && app.trustedDevice(r, user) != nil
+		}
+		if multiFactor && recent {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		message := "this action needs a multi-factor authentication"
+		if multiFactor {
+			message = "this action needs a recent multi-factor authentication"
+		}
+		challenge := stepUpChallenge{
+			Error:     "insufficient_user_authentication",
+			ACRValues: auth.ACRMultiFactor,
+			MaxAge:    int(maxAge.Seconds()),
+			StepUpURL: "/login/stepup",
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error=%q, error_description=%q, acr_values=%q, max_age=%d`,
+			challenge.Error, message, challenge.ACRValues, challenge.MaxAge))
+		_ = utils.JSONResponse{}.WriteJSON(w, http.StatusUnauthorized, utils.JSONResponse{
+			Error:   true,
+			Message: message,
+			Data:    challenge,
+		})
+	})
+}
+
+// stepUpAMR returns the methods of a session after a step-up with an emailed code.
+func stepUpAMR(amr []string) []string {
+	stepped := []string{}
+	for _, method := range amr {
+		if method != auth.AMROneTimePassword && method != auth.AMRMultiFactor {
+			stepped = append(stepped, method)
+		}
+	}
+	stepped = append(stepped, auth.AMROneTimePassword)
+	if auth.ACR(stepped) == auth.ACRMultiFactor {
+		stepped = append(stepped, auth.AMRMultiFactor)
+	}
+	return stepped
+}
+
+// StepUp emails a verification code to the authenticated user, the second factor of a step-up.
+// Like a passwordless login it is bound to the browser and rate limited.
+func (app *AuthServerApp) StepUp(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	if app.Mailer == nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("step-up authentication is not enabled"), http.StatusNotFound)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(claims.UserID)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
+		return
+	}
+
+	if status, err := app.sendMagicLogin(w, r, user, false); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, status)
+		return
+	}
+	utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, utils.JSONResponse{Message: "a verification code was sent to your email"})
+}
+
+// StepUpVerify checks the emailed code and issues a new token pair for the session, adding the code
+// to its authentication methods: after a password login, the user then reaches multi-factor.
+// With remember_device, the browser becomes a trusted device: its next password logins skip the code.
+func (app *AuthServerApp) StepUpVerify(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	var requestPayload struct {
+		Code           string `json:"code"`
+		RememberDevice bool   `json:"remember_device"`
+	}
+	if err := (utils.JSONResponse{}).ReadJSON(w, r, &requestPayload); err != nil || requestPayload.Code == "" {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("code is required"), http.StatusBadRequest)
+		return
+	}
+
+	event := models.LoginEvent{UserID: claims.UserID, Login: claims.Email, Event: models.LoginEventMFA, Method: auth.AMROneTimePassword}
+	user, status, err := app.magicLoginUser(w, r, "", requestPayload.Code)
+	if err != nil {
+		event.Reason = reasonInvalidCode
+		app.recordLoginEvent(r, event)
+		utils.JSONResponse{}.ErrorJSON(w, err, status)
+		return
+	}
+	if user.ID != claims.UserID {
+		event.Reason = reasonInvalidCode
+		app.recordLoginEvent(r, event)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("the code was sent to another user"), http.StatusForbidden)
+		return
+	}
+
+	tokens, err := app.issueTokenPair(w, r, user, stepUpAMR(claims.AMR)...)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, tokenPairStatus(err))
+		return
+	}
+	if requestPayload.RememberDevice {
+		if err := app.trustDevice(w, r, user); err != nil {
+			logerror.LogError(err)
+		}
+	}
+	event.Success = true
+	app.recordLoginEvent(r, event)
+	utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, tokens)
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// accessToken returns an access token of user 1 authenticated with amr at authTime.
+func accessToken(t *testing.T, app *AuthServerApp, authTime time.Time, amr ...string) string {
+	tokens, err := app.Auth.GenerateTokenPair(&auth.JWTUser{ID: 1, Email: "user@example.com", AMR: amr, AuthTime: authTime.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens.Token
+}
+
+// deleteApp calls DELETE /admin/apps/5 with the token.
+func deleteApp(app *AuthServerApp, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodDelete, "/admin/apps/5", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+	return rr
+}
+
+// TestStepUpRequired tests that deleting an app needs a recent multi-factor authentication
+// and that the refusal is a challenge.
+func TestStepUpRequired(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowAdminEvents(mockDB)
+	mockDB.On("ThisApp", 5, "").Return(&models.ThisApp{ID: 5}, nil)
+	mockDB.On("DeleteApp", 5).Return(nil)
+	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, Email: "user@example.com", ProfileId: 1, Active: true}, nil)
+	app, _ := magicTestApp(mockDB)
+	app.AdminProfiles = []int{1}
+
+	rr := deleteApp(app, accessToken(t, app, time.Now(), auth.AMRPassword))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `error="insufficient_user_authentication"`)
+	assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `acr_values="aal2", max_age=300`)
+
+	var response struct {
+		Error bool            `json:"error"`
+		Data  stepUpChallenge `json:"data"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &response)
+	assert.True(t, response.Error)
+	assert.Equal(t, stepUpChallenge{
+		Error:     "insufficient_user_authentication",
+		ACRValues: auth.ACRMultiFactor,
+		MaxAge:    300,
+		StepUpURL: "/login/stepup",
+	}, response.Data)
+
+	// multi-factor, but too long ago
+	rr = deleteApp(app, accessToken(t, app, time.Now().Add(-time.Minute*10), auth.AMRPassword, auth.AMROneTimePassword, auth.AMRMultiFactor))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "recent multi-factor")
+	mockDB.AssertNotCalled(t, "DeleteApp", mock.Anything)
+
+	rr = deleteApp(app, accessToken(t, app, time.Now(), auth.AMRPassword, auth.AMROneTimePassword, auth.AMRMultiFactor))
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	mockDB.AssertCalled(t, "DeleteApp", 5)
+
+	// reading the catalogue does not need it
+	mockDB.On("AllApps").Return([]*models.ThisApp{}, nil)
+	req := httptest.NewRequest(http.MethodGet, "/admin/apps", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken(t, app, time.Now().Add(-time.Hour), auth.AMRPassword))
+	rr = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+// TestStepUp tests stepping a password session up with an emailed code, trusting the browser, then deleting an app.
+func TestStepUp(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowSessions(mockDB)
+	allowAdminEvents(mockDB)
+	user := &models.User{ID: 1, Email: "user@example.com", ProfileId: 1, Active: true}
+	mockDB.On("GetUserByID", 1).Return(user, nil)
+	mockDB.On("CountMagicLogins", 1, mock.Anything).Return(0, nil)
+	var stored models.MagicLogin
+	mockDB.On("InsertMagicLogin", mock.MatchedBy(func(l models.MagicLogin) bool {
+		stored = l
+		stored.ID = 3
+		return l.UserID == 1
+	})).Return(3, nil)
+	mockDB.On("ConsumeMagicLogin", 3).Return(1, nil)
+	mockDB.On("ThisApp", 5, "").Return(&models.ThisApp{ID: 5}, nil)
+	mockDB.On("DeleteApp", 5).Return(nil)
+	app, outbox := magicTestApp(mockDB)
+	app.AdminProfiles = []int{1}
+	token := accessToken(t, app, time.Now().Add(-time.Hour), auth.AMRPassword)
+
+	req := httptest.NewRequest(http.MethodPost, "/login/stepup", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	cookie := rr.Result().Cookies()[0]
+
+	email, _ := outbox.Last()
+	assert.Equal(t, "Your verification code", email.Subject)
+	assert.NotContains(t, email.Body, "https://")
+	code := regexp.MustCompile(`\b\d{6}\b`).FindString(email.Body)
+
+	mockDB.On("GetMagicLogin", stored.BrowserHash, mock.Anything).Return(&stored, nil)
+	mockDB.On("InsertTrustedDevice", mock.MatchedBy(func(d models.TrustedDevice) bool { return d.UserID == 1 })).Return(4, nil)
+	req = httptest.NewRequest(http.MethodPost, "/login/stepup/verify", strings.NewReader(`{"code":"`+code+`","remember_device":true}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var tokens auth.TokenPairs
+	_ = json.Unmarshal(rr.Body.Bytes(), &tokens)
+	claims, err := app.Auth.VerifyToken(tokens.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{auth.AMRPassword, auth.AMROneTimePassword, auth.AMRMultiFactor}, claims.AMR)
+	assert.Equal(t, auth.ACRMultiFactor, claims.ACR)
+	assert.InDelta(t, time.Now().Unix(), claims.AuthTime, 5)
+	mockDB.AssertCalled(t, "InsertTrustedDevice", mock.Anything)
+	var trusted bool
+	for _, c := range rr.Result().Cookies() {
+		trusted = trusted || c.Name == defaultTrustedDeviceCookieName
+	}
+	assert.True(t, trusted, "the browser is trusted")
+
+	assert.Equal(t, http.StatusAccepted, deleteApp(app, tokens.Token).Code)
+}
+
+// TestStepUpAMR tests the methods of a stepped up session.
+func TestStepUpAMR(t *testing.T) {
+	assert.Equal(t, []string{auth.AMRPassword, auth.AMROneTimePassword, auth.AMRMultiFactor}, stepUpAMR([]string{auth.AMRPassword}))
+	assert.Equal(t, []string{auth.AMRFederated, auth.AMROneTimePassword, auth.AMRMultiFactor}, stepUpAMR([]string{auth.AMRFederated, auth.AMROneTimePassword}))
+	// an emailed code does not add a factor to a session opened with an emailed code
+	assert.Equal(t, []string{auth.AMROneTimePassword}, stepUpAMR([]string{auth.AMROneTimePassword}))
+}
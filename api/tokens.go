@@ -0,0 +1,239 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// personalAccessTokenPrefix starts every personal access token, so authRequired tells them from
+// session tokens and leaked ones are easy to find by secret scanners.
+const personalAccessTokenPrefix = "asp_"
+
+// personalAccessTokenPrefixLen is how many characters of a token are kept to recognise it.
+const personalAccessTokenPrefixLen = len(personalAccessTokenPrefix) + 8
+
+// Default lifetimes of the personal access tokens.
+// They are used when AuthServerApp.PersonalAccessTokenTTL or PersonalAccessTokenMaxTTL are not set.
+const (
+	defaultPersonalAccessTokenTTL    = time.Hour * 24 * 90
+	defaultPersonalAccessTokenMaxTTL = time.Hour * 24 * 365
+)
+
+// personalAccessTokenScopes are the scopes a personal access token can be given, each one opens
+// a group of routes to it: apps to launch catalogue apps, dbs to create temporary database
+// credentials and admin for the /admin routes, which only admins can give and use.
+var personalAccessTokenScopes = map[string]bool{
+	"apps":  true,
+	"dbs":   true,
+	"admin": true,
+}
+
+// personalAccessTokenTTL returns the lifetime requested by the client in seconds,
+// falling back to the configured default and capped to the configured maximum.
+func (app *AuthServerApp) personalAccessTokenTTL(requested int) time.Duration {
+	ttl := app.PersonalAccessTokenTTL
+	if ttl <= 0 {
+		ttl = defaultPersonalAccessTokenTTL
+	}
+	maxTTL := app.PersonalAccessTokenMaxTTL
+	if maxTTL <= 0 {
+		maxTTL = defaultPersonalAccessTokenMaxTTL
+	}
+	if requested > 0 {
+		ttl = time.Duration(requested) * time.Second
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+// verifyPersonalAccessToken checks a personal access token and returns the claims of its user,
+// as if the user had sent a session token, along with the token. Its last use is recorded.
+// The tokens of inactive users are refused, and those with the admin scope once their user
+// is no longer an admin.
+func (app *AuthServerApp) verifyPersonalAccessToken(token string) (*auth.Claims, *models.PersonalAccessToken, error) {
+	pat, err := app.DB.GetPersonalAccessToken(utils.HashToken(token))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now().Unix()
+	if pat.ExpiresAt <= now {
+		return nil, nil, errors.New("token expired")
+	}
+
+	user, err := app.DB.GetUserByID(pat.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.Active {
+		return nil, nil, errors.New("user is not active")
+	}
+	if pat.HasScope("admin") && !app.isAdmin(user) {
+		return nil, nil, errors.New("user is not an admin")
+	}
+	if err := app.DB.TouchPersonalAccessToken(pat.ID, now); err != nil {
+		logerror.LogError(err)
+	}
+
+	claims := &auth.Claims{
+		UserID: user.ID,
+		Email:  user.Email,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    app.Auth.Issuer,
+			Subject:   fmt.Sprint(user.ID),
+			ExpiresAt: pat.ExpiresAt,
+		},
+	}
+	return claims, pat, nil
+}
+
+// PersonalAccessTokens lists the personal access tokens of the authenticated user, revoked ones included.
+func (app *AuthServerApp) PersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := app.DB.ListPersonalAccessTokens(claims.UserID)
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not list tokens"), http.StatusInternalServerError)
+		return
+	}
+	if tokens == nil {
+		tokens = []*models.PersonalAccessToken{}
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, tokens)
+}
+
+// CreatePersonalAccessToken creates a named personal access token for the authenticated user.
+// The body holds its name, its scopes and optionally its lifetime in seconds:
+// {"name": "ci", "scopes": ["dbs"], "ttl": 2592000}.
+// The token is returned only in this response, the server only keeps its hash.
+// Only admins can ask for the admin scope.
+func (app *AuthServerApp) CreatePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	var payload struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		TTL    int      `json:"ttl"`
+	}
+	if err := (utils.JSONResponse{}).ReadJSON(w, r, &payload); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	if payload.Name == "" {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("name is required"))
+		return
+	}
+	for _, scope := range payload.Scopes {
+		if !personalAccessTokenScopes[scope] {
+			utils.JSONResponse{}.ErrorJSON(w, fmt.Errorf("unknown scope %q", scope))
+			return
+		}
+	}
+	if slices.Contains(payload.Scopes, "admin") {
+		user, err := app.DB.GetUserByID(claims.UserID)
+		if err != nil {
+			logerror.LogError(err)
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("could not create token"), http.StatusInternalServerError)
+			return
+		}
+		if !app.isAdmin(user) {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("only admins can use the admin scope"), http.StatusForbidden)
+			return
+		}
+	}
+
+	random, err := utils.RandomToken(32)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	token := personalAccessTokenPrefix + random
+
+	pat := models.PersonalAccessToken{
+		UserID:    claims.UserID,
+		Name:      payload.Name,
+		Prefix:    token[:personalAccessTokenPrefixLen],
+		TokenHash: utils.HashToken(token),
+		Scopes:    pq.StringArray(payload.Scopes),
+		ExpiresAt: time.Now().Add(app.personalAccessTokenTTL(payload.TTL)).Unix(),
+	}
+	if pat.Scopes == nil {
+		pat.Scopes = pq.StringArray{}
+	}
+	pat.ID, err = app.DB.InsertPersonalAccessToken(pat)
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not create token"), http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		*models.PersonalAccessToken
+		Token string `json:"token"`
+	}{&pat, token}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, response)
+}
+
+// RevokePersonalAccessToken revokes a personal access token of the authenticated user.
+func (app *AuthServerApp) RevokePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	if err := app.DB.RevokePersonalAccessToken(id, claims.UserID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.JSONResponse{}.ErrorJSON(w, errors.New("token not found"), http.StatusNotFound)
+			return
+		}
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not revoke token"), http.StatusInternalServerError)
+		return
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, utils.JSONResponse{Message: "token revoked"})
+}
+
+// AllPersonalAccessTokens lists the personal access tokens of every user, for auditing.
+// This is for admin use only.
+func (app *AuthServerApp) AllPersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := app.DB.AllPersonalAccessTokens()
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not list tokens"), http.StatusInternalServerError)
+		return
+	}
+	if tokens == nil {
+		tokens = []*models.PersonalAccessToken{}
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, tokens)
+}
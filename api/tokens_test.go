@@ -0,0 +1,188 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestCreatePersonalAccessToken tests that the token is returned once, with its prefix, and stored hashed.
+func TestCreatePersonalAccessToken(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := &AuthServerApp{DB: mockDB, PersonalAccessTokenMaxTTL: time.Hour * 24}
+
+	var stored models.PersonalAccessToken
+	mockDB.On("InsertPersonalAccessToken", mock.MatchedBy(func(p models.PersonalAccessToken) bool {
+		stored = p
+		return p.UserID == 1 && p.Name == "ci" && len(p.Scopes) == 1 && p.Scopes[0] == "dbs"
+	})).Return(4, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(`{"name":"ci","scopes":["dbs"],"ttl":604800}`))
+	req = withClaims(req, &auth.Claims{UserID: 1})
+	rr := httptest.NewRecorder()
+	app.CreatePersonalAccessToken(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		ID        int    `json:"id"`
+		Token     string `json:"token"`
+		Prefix    string `json:"prefix"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &response)
+
+	assert.Equal(t, 4, response.ID)
+	assert.True(t, strings.HasPrefix(response.Token, personalAccessTokenPrefix))
+	assert.Equal(t, response.Token[:personalAccessTokenPrefixLen], response.Prefix)
+	assert.Equal(t, utils.HashToken(response.Token), stored.TokenHash)
+	// the requested lifetime is capped to the maximum
+	assert.InDelta(t, time.Now().Add(time.Hour*24).Unix(), response.ExpiresAt, 5)
+	assert.NotContains(t, rr.Body.String(), stored.TokenHash)
+}
+
+// TestCreatePersonalAccessToken_Invalid tests the refused payloads.
+func TestCreatePersonalAccessToken_Invalid(t *testing.T) {
+	app := &AuthServerApp{DB: new(dbrepo.MockDBRepo)}
+
+	for _, body := range []string{`{"scopes":["dbs"]}`, `{"name":"ci","scopes":["root"]}`} {
+		req := withClaims(httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(body)), &auth.Claims{UserID: 1})
+		rr := httptest.NewRecorder()
+		app.CreatePersonalAccessToken(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+}
+
+// TestCreatePersonalAccessToken_Admin tests that only admins can give the admin scope to their tokens.
+func TestCreatePersonalAccessToken_Admin(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, ProfileId: 1, Active: true}, nil)
+	mockDB.On("GetUserByID", 2).Return(&models.User{ID: 2, ProfileId: 3, Active: true}, nil)
+	mockDB.On("InsertPersonalAccessToken", mock.MatchedBy(func(p models.PersonalAccessToken) bool {
+		return p.UserID == 1 && p.HasScope("admin")
+	})).Return(4, nil)
+	app := &AuthServerApp{DB: mockDB, AdminProfiles: []int{1}}
+
+	create := func(userID int) int {
+		req := httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(`{"name":"ops","scopes":["admin"]}`))
+		rr := httptest.NewRecorder()
+		app.CreatePersonalAccessToken(rr, withClaims(req, &auth.Claims{UserID: userID}))
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusAccepted, create(1))
+	assert.Equal(t, http.StatusForbidden, create(2))
+	mockDB.AssertNumberOfCalls(t, "InsertPersonalAccessToken", 1)
+}
+
+// TestRevokePersonalAccessToken tests revoking an own token and someone else's.
+func TestRevokePersonalAccessToken(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("RevokePersonalAccessToken", 4, 1).Return(nil)
+	mockDB.On("RevokePersonalAccessToken", 5, 1).Return(fmt.Errorf("token 5 not found: %w", sql.ErrNoRows))
+	app := &AuthServerApp{DB: mockDB}
+
+	for id, status := range map[string]int{"4": http.StatusAccepted, "5": http.StatusNotFound} {
+		req := httptest.NewRequest(http.MethodDelete, "/tokens/"+id, nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", id)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		req = withClaims(req, &auth.Claims{UserID: 1})
+
+		rr := httptest.NewRecorder()
+		app.RevokePersonalAccessToken(rr, req)
+		assert.Equal(t, status, rr.Code, id)
+	}
+}
+
+// TestPersonalAccessTokens tests the list of a user's tokens, which never holds the hashes.
+func TestPersonalAccessTokens(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("ListPersonalAccessTokens", 1).Return([]*models.PersonalAccessToken{
+		{ID: 4, UserID: 1, Name: "ci", Prefix: "asp_abcdefgh", TokenHash: "secret-hash", Scopes: pq.StringArray{"dbs"}},
+	}, nil)
+	app := &AuthServerApp{DB: mockDB}
+
+	rr := httptest.NewRecorder()
+	app.PersonalAccessTokens(rr, withClaims(httptest.NewRequest(http.MethodGet, "/tokens", nil), &auth.Claims{UserID: 1}))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"prefix":"asp_abcdefgh"`)
+	assert.NotContains(t, rr.Body.String(), "secret-hash")
+}
+
+// TestAllPersonalAccessTokens_AdminOnly tests that only admins list the tokens of all users.
+func TestAllPersonalAccessTokens_AdminOnly(t *testing.T) {
+	assertAdminOnly(t, "GET /admin/tokens")
+}
+
+// TestAuthRequired_PersonalAccessToken tests personal access tokens as bearer credentials:
+// they act as their user on the routes of their scopes only, and cannot manage tokens.
+// Those of inactive users are refused, and the admin ones of users who are no longer admins.
+func TestAuthRequired_PersonalAccessToken(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	token := personalAccessTokenPrefix + "admin-token"
+	mockDB.On("GetPersonalAccessToken", utils.HashToken(token)).Return(&models.PersonalAccessToken{
+		ID: 4, UserID: 1, Scopes: pq.StringArray{"admin"}, ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}, nil)
+	mockDB.On("GetUserByID", 1).Return(&models.User{ID: 1, Email: "user@example.com", ProfileId: 1, Active: true}, nil)
+	mockDB.On("TouchPersonalAccessToken", 4, mock.Anything).Return(nil)
+	mockDB.On("AllPersonalAccessTokens").Return([]*models.PersonalAccessToken{}, nil)
+	app := &AuthServerApp{DB: mockDB, AdminProfiles: []int{1}}
+
+	call := func(method, path, bearer string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rr := httptest.NewRecorder()
+		app.Routes().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, call(http.MethodGet, "/admin/tokens", token))
+	assert.Equal(t, http.StatusForbidden, call(http.MethodPost, "/dbs/3/credentials", token))
+	assert.Equal(t, http.StatusForbidden, call(http.MethodGet, "/tokens", token))
+	mockDB.AssertCalled(t, "TouchPersonalAccessToken", 4, mock.Anything)
+
+	expired := personalAccessTokenPrefix + "expired-token"
+	mockDB.On("GetPersonalAccessToken", utils.HashToken(expired)).Return(&models.PersonalAccessToken{
+		ID: 5, UserID: 1, Scopes: pq.StringArray{"admin"}, ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+	}, nil)
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/admin/tokens", expired))
+
+	revoked := personalAccessTokenPrefix + "revoked-token"
+	mockDB.On("GetPersonalAccessToken", utils.HashToken(revoked)).Return((*models.PersonalAccessToken)(nil), errors.New("unknown or revoked token"))
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/admin/tokens", revoked))
+
+	inactive := personalAccessTokenPrefix + "inactive-token"
+	mockDB.On("GetPersonalAccessToken", utils.HashToken(inactive)).Return(&models.PersonalAccessToken{
+		ID: 6, UserID: 2, Scopes: pq.StringArray{"dbs"}, ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}, nil)
+	mockDB.On("GetUserByID", 2).Return(&models.User{ID: 2, Email: "gone@example.com"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodPost, "/dbs/3/credentials", inactive))
+
+	demoted := personalAccessTokenPrefix + "demoted-token"
+	mockDB.On("GetPersonalAccessToken", utils.HashToken(demoted)).Return(&models.PersonalAccessToken{
+		ID: 7, UserID: 3, Scopes: pq.StringArray{"admin"}, ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}, nil)
+	mockDB.On("GetUserByID", 3).Return(&models.User{ID: 3, Email: "former@example.com", ProfileId: 3, Active: true}, nil)
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/admin/tokens", demoted))
+	mockDB.AssertNotCalled(t, "TouchPersonalAccessToken", 6, mock.Anything)
+	mockDB.AssertNotCalled(t, "TouchPersonalAccessToken", 7, mock.Anything)
+}
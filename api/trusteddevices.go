@@ -0,0 +1,331 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/events"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"authserver-backend/logerror"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// defaultTrustedDeviceTTL is used when AuthServerApp.TrustedDeviceTTL is not set.
+const defaultTrustedDeviceTTL = time.Hour * 24 * 30
+
+// defaultTrustedDeviceCookieName is used when AuthServerApp.TrustedDeviceCookieName is not set.
+const defaultTrustedDeviceCookieName = "__Host-trusted_device"
+
+// auditEntityTrustedDevice is the entity type of the trusted devices in the admin audit log.
+const auditEntityTrustedDevice = "trusted_device"
+
+func (app *AuthServerApp) trustedDeviceTTL() time.Duration {
+	if app.TrustedDeviceTTL > 0 {
+		return app.TrustedDeviceTTL
+	}
+	return defaultTrustedDeviceTTL
+}
+
+func (app *AuthServerApp) trustedDeviceCookieName() string {
+	if app.TrustedDeviceCookieName != "" {
+		return app.TrustedDeviceCookieName
+	}
+	return defaultTrustedDeviceCookieName
+}
+
+// passwordFingerprint derives from the password hash of a user the fingerprint their trusted devices
+// are bound to, so a new password ends the trust. The hash itself is not stored with the devices.
+// Directory users have no local password, the LDAP authenticator revokes their devices instead.
+func (app *AuthServerApp) passwordFingerprint(user *models.User) string {
+	mac := hmac.New(sha256.New, []byte(app.JWTSecret))
+	mac.Write([]byte("password:" + user.Password))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signDeviceToken appends to the token of a trusted device its HMAC with the JWT secret for the user,
+// so the cookie is only accepted for the user it was set for and forged ones are refused before
+// the database is asked.
+func (app *AuthServerApp) signDeviceToken(userID int, token string) string {
+	mac := hmac.New(sha256.New, []byte(app.JWTSecret))
+	mac.Write([]byte(fmt.Sprintf("device:%d:%s", userID, token)))
+	return token + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// trustDevice remembers the browser of the request for the user, who just authenticated with several
+// factors: it records the device and sets its cookie, its logins skip the second factor for TrustedDeviceTTL.
+func (app *AuthServerApp) trustDevice(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expires := now.Add(app.trustedDeviceTTL())
+	_, err = app.DB.InsertTrustedDevice(models.TrustedDevice{
+		UserID:              user.ID,
+		TokenHash:           utils.HashToken(token),
+		PasswordFingerprint: app.passwordFingerprint(user),
+		UserAgent:           r.UserAgent(),
+		Device:              deviceName(r.UserAgent()),
+		IP:                  clientIP(r),
+		Created:             now.Unix(),
+		LastUsed:            now.Unix(),
+		ExpiresAt:           expires.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	app.publishMFAChanged(r, user.ID, user.Email, events.MFADeviceTrusted, 1)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     app.trustedDeviceCookieName(),
+		Path:     "/",
+		Value:    app.signDeviceToken(user.ID, token),
+		Expires:  expires,
+		MaxAge:   int(app.trustedDeviceTTL().Seconds()),
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+		Secure:   true,
+	})
+	return nil
+}
+
+// trustedDevice returns the trusted device of the request for a user logging in, nil when the browser
+// is not trusted: it has no cookie or one of another user, or the device was revoked, has expired, or
+// the password of the user changed since it was trusted. The login it skips the second factor of is recorded.
+func (app *AuthServerApp) trustedDevice(r *http.Request, user *models.User) *models.TrustedDevice {
+	cookie, err := r.Cookie(app.trustedDeviceCookieName())
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	token, _, found := strings.Cut(cookie.Value, ".")
+	if !found || !hmac.Equal([]byte(app.signDeviceToken(user.ID, token)), []byte(cookie.Value)) {
+		return nil
+	}
+
+	device, err := app.DB.GetTrustedDevice(utils.HashToken(token))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			logerror.LogError(err)
+		}
+		return nil
+	}
+	now := time.Now().Unix()
+	if device.UserID != user.ID || !device.Trusted(now, app.passwordFingerprint(user)) {
+		return nil
+	}
+	if err := app.DB.TouchTrustedDevice(device.ID, now); err != nil {
+		logerror.LogError(err)
+	}
+	return device
+}
+
+// clearTrustedDeviceCookie removes the trusted device cookie of the browser.
+func (app *AuthServerApp) clearTrustedDeviceCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     app.trustedDeviceCookieName(),
+		Path:     "/",
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+		Secure:   true,
+	})
+}
+
+// publishMFAChanged publishes the trust or the revocation of devices of a user as a security event.
+func (app *AuthServerApp) publishMFAChanged(r *http.Request, userID int, login, change string, devices int) {
+	app.publish(r, events.Event{
+		Type:   events.TypeMFAChanged,
+		UserID: userID,
+		Login:  login,
+		Data:   map[string]any{"change": change, "devices": devices},
+	})
+}
+
+// passwordAMR returns the methods of a password login, with the trusted device of the request when
+// there is one. The device does not raise the acr of the tokens: stepUpRequired lets it stand for
+// the second factor while the browser is still trusted.
+func (app *AuthServerApp) passwordAMR(r *http.Request, user *models.User) []string {
+	if app.trustedDevice(r, user) == nil {
+		return []string{auth.AMRPassword}
+	}
+	return []string{auth.AMRPassword, auth.AMRTrustedDevice}
+}
+
+// TrustedDevices lists the trusted devices of the user, the last used first.
+func (app *AuthServerApp) TrustedDevices(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	app.writeTrustedDevices(w, claims.UserID)
+}
+
+// RevokeTrustedDevice revokes a trusted device of the user, its next login asks for the second factor again.
+func (app *AuthServerApp) RevokeTrustedDevice(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	if !app.revokeTrustedDevice(w, r, id, claims.UserID) {
+		return
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "trusted device revoked",
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// RevokeTrustedDevices revokes every trusted device of the user, the browser of the request included.
+func (app *AuthServerApp) RevokeTrustedDevices(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	if _, ok := app.revokeTrustedDevices(w, r, claims.UserID); !ok {
+		return
+	}
+	app.clearTrustedDeviceCookie(w)
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "trusted devices revoked",
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// UserTrustedDevices lists the trusted devices of the user of the URL, for the admins.
+func (app *AuthServerApp) UserTrustedDevices(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	app.writeTrustedDevices(w, userID)
+}
+
+// RevokeUserTrustedDevice revokes a trusted device of the user of the URL. The revocation is recorded in the admin audit log.
+func (app *AuthServerApp) RevokeUserTrustedDevice(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "did"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	if !app.revokeTrustedDevice(w, r, id, userID) {
+		return
+	}
+	app.recordAdminEvent(r, models.AdminActionRevokeTrustedDevices, auditEntityTrustedDevice, id, nil, struct {
+		UserID  int   `json:"user_id"`
+		Revoked int64 `json:"revoked"`
+	}{userID, time.Now().Unix()})
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "trusted device revoked",
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// RevokeUserTrustedDevices revokes every trusted device of the user of the URL. The revocation is recorded
+// in the admin audit log.
+func (app *AuthServerApp) RevokeUserTrustedDevices(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	revoked, ok := app.revokeTrustedDevices(w, r, userID)
+	if !ok {
+		return
+	}
+	app.recordAdminEvent(r, models.AdminActionRevokeTrustedDevices, auditEntityUser, userID, nil, struct {
+		RevokedTrustedDevices int `json:"revoked_trusted_devices"`
+	}{revoked})
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "trusted devices revoked",
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// writeTrustedDevices answers the trusted devices of a user, leaving out the ones trusted before
+// the last change of their password.
+func (app *AuthServerApp) writeTrustedDevices(w http.ResponseWriter, userID int) {
+	user, err := app.DB.GetUserByID(userID)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unknown user"), http.StatusNotFound)
+		return
+	}
+	devices, err := app.DB.UserTrustedDevices(userID, time.Now().Unix())
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not list the trusted devices"), http.StatusInternalServerError)
+		return
+	}
+
+	fingerprint := app.passwordFingerprint(user)
+	trusted := []*models.TrustedDevice{}
+	for _, d := range devices {
+		if d.PasswordFingerprint == fingerprint {
+			trusted = append(trusted, d)
+		}
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, trusted)
+}
+
+// revokeTrustedDevice revokes a trusted device of a user, answering the error when it cannot.
+func (app *AuthServerApp) revokeTrustedDevice(w http.ResponseWriter, r *http.Request, id, userID int) bool {
+	err := app.DB.RevokeTrustedDevice(id, userID, time.Now().Unix())
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("trusted device not found"), http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not revoke the trusted device"), http.StatusInternalServerError)
+		return false
+	}
+	app.publishMFAChanged(r, userID, "", events.MFADeviceRevoked, 1)
+	return true
+}
+
+// revokeTrustedDevices revokes the trusted devices of a user and returns how many, answering the error when it cannot.
+func (app *AuthServerApp) revokeTrustedDevices(w http.ResponseWriter, r *http.Request, userID int) (int, bool) {
+	revoked, err := app.DB.RevokeUserTrustedDevices(userID, time.Now().Unix())
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not revoke the trusted devices"), http.StatusInternalServerError)
+		return 0, false
+	}
+	if revoked > 0 {
+		app.publishMFAChanged(r, userID, "", events.MFADeviceRevoked, revoked)
+	}
+	return revoked, true
+}
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/events"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// trustedDeviceLogin logs user@example.com in with a password, with the cookie when there is one,
+// and returns the claims of the access token.
+func trustedDeviceLogin(t *testing.T, app *AuthServerApp, cookie *http.Cookie) *auth.Claims {
+	req := httptest.NewRequest(http.MethodPost, "/authenticate",
+		strings.NewReader(`{"email":"user@example.com","password":"password123"}`))
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	app.Authenticate(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		Token string `json:"access_token"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &response)
+	claims, err := app.Auth.VerifyToken(response.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+// TestTrustedDevice_Login tests that the password logins of a trusted browser skip the second factor
+// of the step-up routes, until the device is revoked or the password changes, and only for the user
+// it was trusted for, without their tokens reaching multi-factor.
+func TestTrustedDevice_Login(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := sessionsApp(mockDB)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	user := &models.User{ID: 1, Email: "user@example.com", Password: string(hash), Active: true}
+	mockDB.On("GetUserByEmail", "user@example.com").Return(user, nil)
+
+	var stored models.TrustedDevice
+	mockDB.On("InsertTrustedDevice", mock.MatchedBy(func(d models.TrustedDevice) bool {
+		stored = d
+		stored.ID = 4
+		return d.UserID == 1 && d.Device == "Firefox 121 on Linux"
+	})).Return(4, nil)
+	req := httptest.NewRequest(http.MethodPost, "/login/stepup/verify", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0")
+	rr := httptest.NewRecorder()
+	app.Events = &events.Bus{}
+	var published []events.Event
+	app.Events.Subscribe(func(e events.Event) { published = append(published, e) })
+	assert.NoError(t, app.trustDevice(rr, req, user))
+	if assert.Len(t, published, 1) {
+		assert.Equal(t, events.TypeMFAChanged, published[0].Type)
+		assert.Equal(t, "user@example.com", published[0].Login)
+		assert.Equal(t, events.MFADeviceTrusted, published[0].Data["change"])
+	}
+	app.Events = nil
+	cookie := rr.Result().Cookies()[0]
+	assert.Equal(t, defaultTrustedDeviceCookieName, cookie.Name)
+	assert.True(t, cookie.HttpOnly && cookie.Secure)
+	assert.InDelta(t, time.Now().Add(defaultTrustedDeviceTTL).Unix(), stored.ExpiresAt, 5)
+	assert.NotContains(t, cookie.Value, stored.TokenHash)
+
+	token, _, _ := strings.Cut(cookie.Value, ".")
+	mockDB.On("GetTrustedDevice", utils.HashToken(token)).Return(&stored, nil)
+	mockDB.On("TouchTrustedDevice", 4, mock.AnythingOfType("int64")).Return(nil)
+
+	claims := trustedDeviceLogin(t, app, cookie)
+	assert.Equal(t, []string{auth.AMRPassword, auth.AMRTrustedDevice}, claims.AMR)
+	assert.Equal(t, auth.ACRSingleFactor, claims.ACR, "the device alone is no second factor")
+	mockDB.AssertCalled(t, "TouchTrustedDevice", 4, mock.AnythingOfType("int64"))
+
+	mockDB.On("GetUserByID", 1).Return(user, nil)
+	stepUp := func(claims *auth.Claims, cookie *http.Cookie) int {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/apps/1", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		app.stepUpRequired(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})).ServeHTTP(rr, withClaims(req, claims))
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusNoContent, stepUp(claims, cookie), "the trusted device skips the second factor")
+	assert.Equal(t, http.StatusUnauthorized, stepUp(claims, nil), "the token used from another browser")
+	stale := *claims
+	stale.AuthTime = time.Now().Add(-time.Hour).Unix()
+	assert.Equal(t, http.StatusUnauthorized, stepUp(&stale, cookie), "an old login")
+	assert.Equal(t, append(claims.AMR, auth.AMROneTimePassword, auth.AMRMultiFactor), stepUpAMR(claims.AMR))
+
+	assert.Equal(t, []string{auth.AMRPassword}, trustedDeviceLogin(t, app, nil).AMR)
+
+	// the cookie of another user
+	forged := &http.Cookie{Name: cookie.Name, Value: app.signDeviceToken(2, token)}
+	assert.Equal(t, []string{auth.AMRPassword}, trustedDeviceLogin(t, app, forged).AMR)
+
+	// a new password ends the trust
+	stored.PasswordFingerprint = app.passwordFingerprint(&models.User{Password: "old hash"})
+	assert.Equal(t, []string{auth.AMRPassword}, trustedDeviceLogin(t, app, cookie).AMR)
+	assert.Equal(t, http.StatusUnauthorized, stepUp(claims, cookie))
+
+	stored.PasswordFingerprint = app.passwordFingerprint(user)
+	stored.Revoked = time.Now().Unix()
+	assert.Equal(t, []string{auth.AMRPassword}, trustedDeviceLogin(t, app, cookie).AMR)
+	assert.Equal(t, http.StatusUnauthorized, stepUp(claims, cookie), "the revoked device")
+}
+
+// TestTrustedDevices tests that users list and revoke their own trusted devices only,
+// the devices trusted before the last password change being left out, and that the revocations are published.
+func TestTrustedDevices(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := sessionsApp(mockDB)
+	app.Events = &events.Bus{}
+	var published []events.Event
+	app.Events.Subscribe(func(e events.Event) {
+		if e.Type == events.TypeMFAChanged {
+			published = append(published, e)
+		}
+	})
+	user := &models.User{ID: 1, Email: "user@example.com", Password: "hash"}
+	mockDB.On("GetUserByID", 1).Return(user, nil)
+	mockDB.On("UserTrustedDevices", 1, mock.AnythingOfType("int64")).Return([]*models.TrustedDevice{
+		{ID: 4, UserID: 1, Device: "Firefox 121 on Linux", PasswordFingerprint: app.passwordFingerprint(user)},
+		{ID: 3, UserID: 1, Device: "Chrome 120 on macOS", PasswordFingerprint: "before the password change"},
+	}, nil)
+	mockDB.On("RevokeTrustedDevice", 4, 1, mock.AnythingOfType("int64")).Return(nil)
+	mockDB.On("RevokeTrustedDevice", 9, 1, mock.AnythingOfType("int64")).Return(fmt.Errorf("trusted device 9 not found: %w", sql.ErrNoRows))
+	mockDB.On("RevokeUserTrustedDevices", 1, mock.AnythingOfType("int64")).Return(2, nil)
+	routes := app.Routes()
+	token := sessionTokens(t, app, 5).Token
+
+	call := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := call(http.MethodGet, "/trusted-devices")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var devices []models.TrustedDevice
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&devices))
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "Firefox 121 on Linux", devices[0].Device)
+	assert.NotContains(t, rr.Body.String(), "fingerprint")
+
+	assert.Equal(t, http.StatusAccepted, call(http.MethodDelete, "/trusted-devices/4").Code)
+	assert.Equal(t, http.StatusNotFound, call(http.MethodDelete, "/trusted-devices/9").Code, "the device of another user")
+
+	rr = call(http.MethodDelete, "/trusted-devices")
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Equal(t, -1, rr.Result().Cookies()[0].MaxAge, "the browser forgets its cookie")
+	mockDB.AssertExpectations(t)
+
+	if assert.Len(t, published, 2) {
+		assert.Equal(t, map[string]any{"change": events.MFADeviceRevoked, "devices": 1}, published[0].Data)
+		assert.Equal(t, map[string]any{"change": events.MFADeviceRevoked, "devices": 2}, published[1].Data)
+		assert.Equal(t, 1, published[1].UserID)
+	}
+}
+
+// TestRevokeUserTrustedDevice tests that the admins revoke the trusted devices of a user, and that it is audited.
+func TestRevokeUserTrustedDevice(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	app := sessionsApp(mockDB)
+	mockDB.On("RevokeTrustedDevice", 4, 2, mock.AnythingOfType("int64")).Return(nil)
+	mockDB.On("RevokeTrustedDevice", 4, 3, mock.AnythingOfType("int64")).Return(fmt.Errorf("trusted device 4 not found: %w", sql.ErrNoRows))
+	mockDB.On("RevokeUserTrustedDevices", 2, mock.AnythingOfType("int64")).Return(3, nil)
+	mockDB.On("InsertAdminEvent", mock.Anything).Return(1, nil)
+	r := chi.NewRouter()
+	r.Delete("/admin/users/{id}/trusted-devices/{did}", app.RevokeUserTrustedDevice)
+	r.Delete("/admin/users/{id}/trusted-devices", app.RevokeUserTrustedDevices)
+
+	revoke := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, withClaims(req, &auth.Claims{UserID: 1, Email: "admin@example.com"}))
+		return rr
+	}
+
+	assert.Equal(t, http.StatusAccepted, revoke("/admin/users/2/trusted-devices/4").Code)
+	mockDB.AssertCalled(t, "InsertAdminEvent", mock.MatchedBy(func(e models.AdminEvent) bool {
+		return e.ActorID == 1 && e.Action == models.AdminActionRevokeTrustedDevices && e.EntityType == auditEntityTrustedDevice &&
+			e.EntityID == 4 && strings.Contains(string(e.Diff), "revoked")
+	}))
+	assert.Equal(t, http.StatusNotFound, revoke("/admin/users/3/trusted-devices/4").Code, "the device of another user")
+
+	assert.Equal(t, http.StatusAccepted, revoke("/admin/users/2/trusted-devices").Code)
+	mockDB.AssertCalled(t, "InsertAdminEvent", mock.MatchedBy(func(e models.AdminEvent) bool {
+		return e.EntityType == auditEntityUser && e.EntityID == 2 && strings.Contains(string(e.Diff), "revoked_trusted_devices")
+	}))
+}
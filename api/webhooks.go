@@ -0,0 +1,235 @@
+package api
+
+import (
+	"authserver-backend/internal/events"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"authserver-backend/internal/webhook"
+	"authserver-backend/logerror"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// auditEntityWebhook is the entity type of the webhooks in the admin audit log.
+const auditEntityWebhook = "webhook"
+
+// publish hands a security event, with the address of the request, to the subscribers of the event bus.
+func (app *AuthServerApp) publish(r *http.Request, e events.Event) {
+	if app.Events == nil {
+		return
+	}
+	e.IP = clientIP(r)
+	app.Events.Publish(e)
+}
+
+// Webhooks lists the webhooks, without their secrets.
+func (app *AuthServerApp) Webhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.DB.Webhooks()
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not list the webhooks"), http.StatusInternalServerError)
+		return
+	}
+	if webhooks == nil {
+		webhooks = []*models.Webhook{}
+	}
+	for _, webhook := range webhooks {
+		webhook.Secret = ""
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, webhooks)
+}
+
+// CreateWebhook adds a webhook posting the security events of the event_types patterns (all of them
+// when there are none) to an http or https url, on a public address unless AllowPrivateWebhooks is set.
+// The answer holds the secret signing the deliveries, it is not shown again.
+func (app *AuthServerApp) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	claims, ok := claimsFromContext(r.Context())
+	if !ok {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	var payload struct {
+		URL        string   `json:"url"`
+		EventTypes []string `json:"event_types"`
+	}
+	if err := (utils.JSONResponse{}).ReadJSON(w, r, &payload); err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	target, err := url.Parse(payload.URL)
+	if err != nil || (target.Scheme != "https" && target.Scheme != "http") || target.Host == "" {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("url must be an http or https URL"))
+		return
+	}
+	if !app.AllowPrivateWebhooks {
+		if err := webhook.CheckHost(target.Hostname()); err != nil {
+			utils.JSONResponse{}.ErrorJSON(w, err)
+			return
+		}
+	}
+	for _, pattern := range payload.EventTypes {
+		if pattern == "" || strings.Contains(strings.TrimSuffix(pattern, "*"), "*") {
+			utils.JSONResponse{}.ErrorJSON(w, fmt.Errorf("invalid event type %q", pattern))
+			return
+		}
+	}
+
+	secret, err := utils.RandomToken(32)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	webhook := models.Webhook{
+		URL:        target.String(),
+		Secret:     secret,
+		EventTypes: pq.StringArray(payload.EventTypes),
+		CreatedBy:  claims.UserID,
+		Created:    time.Now().Unix(),
+	}
+	if webhook.EventTypes == nil {
+		webhook.EventTypes = pq.StringArray{}
+	}
+	webhook.ID, err = app.DB.InsertWebhook(webhook)
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not create the webhook"), http.StatusInternalServerError)
+		return
+	}
+
+	// the secret is not kept in the audit log
+	audited := webhook
+	audited.Secret = ""
+	app.recordAdminEvent(r, models.AdminActionCreate, auditEntityWebhook, webhook.ID, nil, audited)
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusCreated, webhook)
+}
+
+// DeleteWebhook deletes a webhook with its delivery history.
+func (app *AuthServerApp) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	before, err := app.DB.GetWebhook(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("webhook not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not delete the webhook"), http.StatusInternalServerError)
+		return
+	}
+	if err := app.DB.DeleteWebhook(id); err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not delete the webhook"), http.StatusInternalServerError)
+		return
+	}
+	before.Secret = ""
+	app.recordAdminEvent(r, models.AdminActionDelete, auditEntityWebhook, id, before, nil)
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "webhook deleted",
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// WebhookDeliveries returns a page of the delivery history of a webhook, newest first,
+// paged like LoginEvents.
+func (app *AuthServerApp) WebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+	page, perPage, err := auditPage(r)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	deliveries, total, err := app.DB.WebhookDeliveries(id, perPage, (page-1)*perPage)
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not query the deliveries"), http.StatusInternalServerError)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*models.WebhookDelivery{}
+	}
+
+	response := struct {
+		Deliveries []*models.WebhookDelivery `json:"deliveries"`
+		Total      int                       `json:"total"`
+		Page       int                       `json:"page"`
+		PerPage    int                       `json:"per_page"`
+	}{deliveries, total, page, perPage}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, response)
+}
+
+// WebhookDeadLetters returns a page of the deliveries that failed every attempt, newest first,
+// paged like LoginEvents.
+func (app *AuthServerApp) WebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	page, perPage, err := auditPage(r)
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	letters, total, err := app.DB.WebhookDeadLetters(perPage, (page-1)*perPage)
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not query the dead letters"), http.StatusInternalServerError)
+		return
+	}
+	if letters == nil {
+		letters = []*models.WebhookDeadLetter{}
+	}
+
+	response := struct {
+		DeadLetters []*models.WebhookDeadLetter `json:"dead_letters"`
+		Total       int                         `json:"total"`
+		Page        int                         `json:"page"`
+		PerPage     int                         `json:"per_page"`
+	}{letters, total, page, perPage}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusOK, response)
+}
+
+// RetryWebhookDeadLetter makes the delivery of a dead letter pending again, with all its attempts,
+// for the next round of retries.
+func (app *AuthServerApp) RetryWebhookDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.JSONResponse{}.ErrorJSON(w, err)
+		return
+	}
+
+	deliveryID, err := app.DB.RetryWebhookDeadLetter(id, time.Now().Unix())
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("dead letter not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logerror.LogError(err)
+		utils.JSONResponse{}.ErrorJSON(w, errors.New("could not retry the delivery"), http.StatusInternalServerError)
+		return
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "delivery " + strconv.Itoa(deliveryID) + " will be retried",
+	}
+	_ = utils.JSONResponse{}.WriteJSON(w, http.StatusAccepted, resp)
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"authserver-backend/auth"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/events"
+	"authserver-backend/internal/models"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestPublishSecurityEvents tests the security events published for the lockouts, the failed
+// multi-factor authentications and the admin changes, and the authentication events.
+func TestPublishSecurityEvents(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowLoginEvents(mockDB)
+	allowAdminEvents(mockDB)
+	var published []events.Event
+	app := &AuthServerApp{DB: mockDB, Events: &events.Bus{}}
+	var authentication []events.Event
+	app.Events.Subscribe(func(e events.Event) {
+		if strings.HasPrefix(e.Type, events.AuthPrefix) {
+			authentication = append(authentication, e)
+			return
+		}
+		published = append(published, e)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/authenticate", nil)
+	req.RemoteAddr = "10.0.0.1:40000"
+	app.recordLoginEvent(req, models.LoginEvent{Login: "user@example.com", Event: models.LoginEventLockout, Reason: "rate_limited:authenticate"})
+	app.recordLoginEvent(req, models.LoginEvent{UserID: 1, Event: models.LoginEventMFA, Method: auth.AMROneTimePassword, Reason: reasonInvalidCode})
+	app.recordLoginEvent(req, models.LoginEvent{UserID: 1, Event: models.LoginEventMFA, Success: true})
+	app.recordLoginEvent(req, models.LoginEvent{UserID: 1, Event: models.LoginEventLogin, Reason: reasonInvalidPassword})
+	app.recordAdminEvent(withClaims(req, &auth.Claims{UserID: 2, Email: "admin@example.com"}),
+		models.AdminActionDelete, auditEntityApp, 7, &models.ThisApp{ID: 7}, nil)
+
+	if assert.Len(t, published, 3) {
+		assert.Equal(t, events.TypeLockout, published[0].Type)
+		assert.Equal(t, "user@example.com", published[0].Login)
+		assert.Equal(t, "10.0.0.1", published[0].IP)
+		assert.Equal(t, events.TypeMFAFailed, published[1].Type)
+		assert.Equal(t, auth.AMROneTimePassword, published[1].Data["method"])
+		assert.Equal(t, events.TypeAdminChange, published[2].Type)
+		assert.Equal(t, 2, published[2].UserID)
+		assert.Equal(t, models.AdminActionDelete, published[2].Data["action"])
+		assert.Equal(t, 7, published[2].Data["entity_id"])
+	}
+
+	// every event of the login audit trail is an authentication event
+	if assert.Len(t, authentication, 4) {
+		assert.Equal(t, events.AuthPrefix+models.LoginEventLockout, authentication[0].Type)
+		assert.Equal(t, events.AuthPrefix+models.LoginEventMFA, authentication[2].Type)
+		assert.Equal(t, true, authentication[2].Data["success"])
+		assert.Equal(t, events.AuthPrefix+models.LoginEventLogin, authentication[3].Type)
+		assert.Equal(t, false, authentication[3].Data["success"])
+		assert.Equal(t, reasonInvalidPassword, authentication[3].Data["reason"])
+	}
+}
+
+// TestCreateWebhook tests that the secret is only answered, not audited, and that bad webhooks are refused.
+func TestCreateWebhook(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("InsertWebhook", mock.MatchedBy(func(w models.Webhook) bool {
+		return w.URL == "https://soc.example.com/hooks" && len(w.Secret) > 32 && w.CreatedBy == 1 &&
+			len(w.EventTypes) == 2 && w.Created > 0
+	})).Return(4, nil)
+	mockDB.On("InsertAdminEvent", mock.Anything).Return(1, nil)
+	app := &AuthServerApp{DB: mockDB}
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/webhooks", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		app.CreateWebhook(rr, withClaims(req, &auth.Claims{UserID: 1, Email: "admin@example.com"}))
+		return rr
+	}
+
+	rr := create(`{"url":"https://soc.example.com/hooks","event_types":["account.lockout","admin.*"]}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var webhook models.Webhook
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&webhook))
+	assert.Equal(t, 4, webhook.ID)
+	assert.NotEmpty(t, webhook.Secret)
+	mockDB.AssertCalled(t, "InsertAdminEvent", mock.MatchedBy(func(e models.AdminEvent) bool {
+		return e.EntityType == auditEntityWebhook && e.EntityID == 4 && !strings.Contains(string(e.Diff), webhook.Secret)
+	}))
+
+	for _, body := range []string{
+		`{"url":"ftp://soc.example.com"}`,
+		`{"url":"/hooks"}`,
+		`{"url":"https://soc.example.com","event_types":["adm*n.change"]}`,
+		`{"url":"https://soc.example.com","event_types":[""]}`,
+		`{"url":"http://localhost:8080/hooks"}`,
+		`{"url":"http://127.0.0.1/hooks"}`,
+		`{"url":"http://169.254.169.254/latest/meta-data"}`,
+		`{"url":"https://[::1]/hooks"}`,
+		`{"url":"https://10.0.0.5/hooks"}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, create(body).Code, body)
+	}
+	mockDB.AssertNumberOfCalls(t, "InsertWebhook", 1)
+
+	// the private targets are an explicit opt-in
+	mockDB.On("InsertWebhook", mock.MatchedBy(func(w models.Webhook) bool {
+		return w.URL == "https://10.0.0.5/hooks"
+	})).Return(5, nil)
+	app.AllowPrivateWebhooks = true
+	assert.Equal(t, http.StatusCreated, create(`{"url":"https://10.0.0.5/hooks"}`).Code)
+}
+
+// TestWebhooks_AdminOnly tests that only admins manage the webhooks and their deliveries.
+func TestWebhooks_AdminOnly(t *testing.T) {
+	assertAdminOnly(t,
+		"GET /admin/webhooks",
+		"POST /admin/webhooks",
+		"DELETE /admin/webhooks/4",
+		"GET /admin/webhooks/4/deliveries",
+		"GET /admin/webhooks/dead-letters",
+		"POST /admin/webhooks/dead-letters/6/retry",
+	)
+}
+
+// TestWebhooks tests that the secrets are not listed.
+func TestWebhooks(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("Webhooks").Return([]*models.Webhook{{ID: 4, URL: "https://soc.example.com/hooks", Secret: "s4"}}, nil)
+	app := &AuthServerApp{DB: mockDB}
+
+	rr := httptest.NewRecorder()
+	app.Webhooks(rr, httptest.NewRequest(http.MethodGet, "/admin/webhooks", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"url":"https://soc.example.com/hooks"`)
+	assert.NotContains(t, rr.Body.String(), "s4")
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	allowAdminEvents(mockDB)
+	mockDB.On("GetWebhook", 4).Return(&models.Webhook{ID: 4, Secret: "s4"}, nil)
+	mockDB.On("GetWebhook", 5).Return((*models.Webhook)(nil), fmt.Errorf("webhook 5 not found: %w", sql.ErrNoRows))
+	mockDB.On("DeleteWebhook", 4).Return(nil)
+	app := &AuthServerApp{DB: mockDB}
+	r := chi.NewRouter()
+	r.Delete("/admin/webhooks/{id}", app.DeleteWebhook)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/admin/webhooks/4", nil))
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	mockDB.AssertCalled(t, "DeleteWebhook", 4)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/admin/webhooks/5", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// TestWebhookDeliveries tests the pages of the delivery history and of the dead letters, and the retry of a dead letter.
+func TestWebhookDeliveries(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("WebhookDeliveries", 4, 10, 10).Return([]*models.WebhookDelivery{
+		{ID: 9, WebhookID: 4, Status: models.WebhookDeliveryDead, Attempts: 8, Payload: json.RawMessage(`{}`)},
+	}, 11, nil)
+	mockDB.On("WebhookDeadLetters", defaultAuditPageSize, 0).Return([]*models.WebhookDeadLetter(nil), 0, nil)
+	mockDB.On("RetryWebhookDeadLetter", 3, mock.Anything).Return(9, nil)
+	mockDB.On("RetryWebhookDeadLetter", 8, mock.Anything).Return(0, fmt.Errorf("dead letter 8 not found: %w", sql.ErrNoRows))
+	app := &AuthServerApp{DB: mockDB}
+	r := chi.NewRouter()
+	r.Get("/admin/webhooks/{id}/deliveries", app.WebhookDeliveries)
+	r.Get("/admin/webhooks/dead-letters", app.WebhookDeadLetters)
+	r.Post("/admin/webhooks/dead-letters/{id}/retry", app.RetryWebhookDeadLetter)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/webhooks/4/deliveries?page=2&per_page=10", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"status":"dead"`)
+	assert.Contains(t, rr.Body.String(), `"total":11`)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/webhooks/dead-letters", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"dead_letters":[]`)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/webhooks/dead-letters/3/retry", nil))
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Contains(t, rr.Body.String(), "delivery 9 will be retried")
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/webhooks/dead-letters/8/retry", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -20,9 +20,13 @@ import (
 // The struct also includes methods for generating refresh tokens
 // and setting refresh tokens in HTTP cookies. The tokens expire after a configurable duration.
 // The struct also includes methods for mocking tokens for testing purposes.
+// Audience is the audience of the tokens it issues, Audiences the other ones it accepts, no token is
+// accepted without one, and Leeway the clock skew tolerated when checking their times, see VerifyToken.
 type Auth struct {
 	Issuer           string
 	Audience         string
+	Audiences        []string
+	Leeway           time.Duration
 	Secret           string
 	MockToken        string
 	MockRefreshToken string
@@ -42,9 +46,126 @@ type AuthInterface interface {
 	GetTokenFromHeaderAndVerify(w http.ResponseWriter, r *http.Request) (string, *Claims, error)
 }
 
+// JWTUser is the user a token is generated for. AMR lists the methods the user authenticated with
+// and AuthTime is when, they are carried by the tokens and kept when they are refreshed.
+// SessionID is the login session the tokens belong to, Context what the user is working in,
+// Impersonation is set when an admin acts as the user.
 type JWTUser struct {
-	ID    int
-	Email string
+	ID            int
+	Email         string
+	AMR           []string
+	AuthTime      int64
+	SessionID     int
+	Context       *ActiveContext
+	Impersonation *Impersonation
+}
+
+// ActiveContext is the company, database and app a user is working in, among the ones they
+// are entitled to. A zero field is not chosen.
+type ActiveContext struct {
+	CompanyID int `json:"company_id,omitempty"`
+	DbID      int `json:"db_id,omitempty"`
+	AppID     int `json:"app_id,omitempty"`
+}
+
+// UserAttributes are the attributes of the user an app can have added to its tokens, with the claim
+// template of its token settings. A zero field is not in the template.
+type UserAttributes struct {
+	GroupID   int    `json:"group_id,omitempty"`
+	ProfileID int    `json:"profile_id,omitempty"`
+	CompanyID int    `json:"company_id,omitempty"`
+	Lan       string `json:"lan,omitempty"`
+}
+
+// AppTokenOptions are the token settings of an app. Audience is the aud claim of its tokens,
+// Expiry the lifetime of its access tokens, TokenExpiry when 0, and RefreshExpiry the one of its
+// refresh tokens. Attributes are the user attributes its access tokens carry.
+type AppTokenOptions struct {
+	Audience      string
+	Expiry        time.Duration
+	RefreshExpiry time.Duration
+	Attributes    UserAttributes
+}
+
+// The token_use claim tells what a token is for: TokenUseAccess is the access tokens of the users
+// and of the apps, TokenUseRefresh their refresh tokens, only exchanged for new tokens, and
+// TokenUseForwardAuth the forward-auth session tokens of the browsers, see GenerateForwardAuthToken.
+const (
+	TokenUseAccess      = "access"
+	TokenUseRefresh     = "refresh"
+	TokenUseForwardAuth = "forward_auth"
+)
+
+// Impersonation is an admin logged in as a user. ID is the impersonation session, the tokens
+// issued for it are refused once it is stopped, and they do not outlive Expires.
+type Impersonation struct {
+	ID         int
+	ActorID    int
+	ActorEmail string
+	Expires    int64
+}
+
+// Authentication method references (RFC 8176) of the amr claim. AMRTrustedDevice is not registered:
+// it is a login from a browser the user trusted after a multi-factor authentication. ACR does not count
+// it, the routes asking for a second factor check that the device is still trusted instead.
+const (
+	AMRPassword          = "pwd"
+	AMROneTimePassword   = "otp"
+	AMRFederated         = "fed"
+	AMRProofOfPossession = "pop"
+	AMRMultiFactor       = "mfa"
+	AMRTrustedDevice     = "device"
+)
+
+// Authentication context classes of the acr claim, the NIST authenticator assurance levels:
+// ACRSingleFactor after a single authentication method, ACRMultiFactor after two different ones.
+const (
+	ACRSingleFactor = "aal1"
+	ACRMultiFactor  = "aal2"
+)
+
+// ACR returns the authentication context class reached with the methods of amr,
+// empty when there is none. A trusted device is not counted: alone, it makes no second factor.
+func ACR(amr []string) string {
+	methods := map[string]bool{}
+	for _, method := range amr {
+		if method != AMRMultiFactor && method != AMRTrustedDevice {
+			methods[method] = true
+		}
+	}
+	switch {
+	case len(methods) == 0:
+		return ""
+	case len(methods) == 1:
+		return ACRSingleFactor
+	}
+	return ACRMultiFactor
+}
+
+// authenticationClaims fills the amr, acr, auth_time, session_id and ctx claims of the user in claims.
+func (user *JWTUser) authenticationClaims(claims *Claims) {
+	claims.AMR = user.AMR
+	claims.ACR = ACR(user.AMR)
+	claims.AuthTime = user.AuthTime
+	claims.SessionID = user.SessionID
+	if user.Context != nil && *user.Context != (ActiveContext{}) {
+		claims.Context = user.Context
+	}
+}
+
+// impersonationClaims fills the act, impersonated and impersonation_id claims when the user is
+// impersonated, and caps the expiry of claims to the end of the impersonation.
+func (user *JWTUser) impersonationClaims(claims *Claims) {
+	imp := user.Impersonation
+	if imp == nil {
+		return
+	}
+	claims.Actor = &Actor{Subject: fmt.Sprint(imp.ActorID), Email: imp.ActorEmail}
+	claims.Impersonated = true
+	claims.ImpersonationID = imp.ID
+	if claims.ExpiresAt > imp.Expires {
+		claims.ExpiresAt = imp.Expires
+	}
 }
 
 type MockAuth struct {
@@ -55,28 +176,65 @@ type MockAuth struct {
 // TokenPairs holds the access and refresh tokens. It is used to return both tokens together.
 // In this case, both tokens are strings with the access token being the main JWT token used for authentication
 // and the refresh token being used to obtain a new access token when the original expires.
+// CSRFToken is set when the refresh token is handed out in a cookie, it must be sent back
+// with the requests that cookie authenticates.
 type TokenPairs struct {
 	Token        string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
+	CSRFToken    string `json:"csrf_token,omitempty"`
 }
 
 // Claims defines the custom JWT claims used in the tokens. It includes user ID and email,
 // along with standard claims like issuer, issued at, and expiry time.
+// TokenUse is what the token is for, see VerifyAccessToken and VerifyRefreshToken.
+// AppID is only set in app-scoped tokens, the ones a catalogue app gets for a launch code, along with
+// the UserAttributes of the claim template of the app.
+// Confirmation is only set in certificate-bound tokens. AMR, ACR and AuthTime tell how and when
+// the user authenticated (OpenID Connect Core, section 2), SessionID the login session the
+// tokens were issued in, so they can be revoked with it, and Context the company, database and app
+// the user is working in. Actor, Impersonated and ImpersonationID
+// are only set in the tokens of an admin impersonating the user: Impersonated is the flag the
+// frontends show a banner for.
 type Claims struct {
-	UserID int    `json:"user_id"`
-	Email  string `json:"email"`
+	UserID          int            `json:"user_id"`
+	Email           string         `json:"email"`
+	AppID           int            `json:"app_id,omitempty"`
+	TokenUse        string         `json:"token_use,omitempty"`
+	Confirmation    *Confirmation  `json:"cnf,omitempty"`
+	AMR             []string       `json:"amr,omitempty"`
+	ACR             string         `json:"acr,omitempty"`
+	AuthTime        int64          `json:"auth_time,omitempty"`
+	SessionID       int            `json:"session_id,omitempty"`
+	Context         *ActiveContext `json:"ctx,omitempty"`
+	Actor           *Actor         `json:"act,omitempty"`
+	Impersonated    bool           `json:"impersonated,omitempty"`
+	ImpersonationID int            `json:"impersonation_id,omitempty"`
+	UserAttributes
 	jwt.StandardClaims
 }
 
+// Actor is the act claim of RFC 8693: the party acting as the subject of the token,
+// here the admin impersonating the user.
+type Actor struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+}
+
+// Confirmation is the cnf claim of RFC 7800. X5tS256 binds the token to a client certificate
+// (RFC 8705): the token is only valid when presented over a TLS connection authenticated
+// with the certificate of that SHA-256 thumbprint.
+type Confirmation struct {
+	X5tS256 string `json:"x5t#S256,omitempty"`
+}
+
 func (j *Auth) GenerateRefreshToken(user *JWTUser) (string, error) {
 	claims := Claims{
-		UserID: user.ID,
-		Email:  user.Email,
-		StandardClaims: jwt.StandardClaims{
-			Issuer:    j.Issuer,
-			ExpiresAt: time.Now().Add(24 * time.Hour).Unix(),
-		},
+		UserID:         user.ID,
+		Email:          user.Email,
+		TokenUse:       TokenUseRefresh,
+		StandardClaims: j.standardClaims(user, j.refreshExpiry()),
 	}
+	user.authenticationClaims(&claims)
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(j.JWTSecret))
@@ -84,13 +242,12 @@ func (j *Auth) GenerateRefreshToken(user *JWTUser) (string, error) {
 
 func (j *Auth) GenerateTokenPair(user *JWTUser) (TokenPairs, error) {
 	accessClaims := Claims{
-		UserID: user.ID,
-		Email:  user.Email,
-		StandardClaims: jwt.StandardClaims{
-			Issuer:    j.Issuer,
-			ExpiresAt: time.Now().Add(j.TokenExpiry).Unix(), // Используем TokenExpiry
-		},
+		UserID:         user.ID,
+		Email:          user.Email,
+		TokenUse:       TokenUseAccess,
+		StandardClaims: j.standardClaims(user, j.TokenExpiry),
 	}
+	user.authenticationClaims(&accessClaims)
 	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
 	accessTokenString, err := accessToken.SignedString([]byte(j.JWTSecret))
 	if err != nil {
@@ -108,6 +265,119 @@ func (j *Auth) GenerateTokenPair(user *JWTUser) (TokenPairs, error) {
 	}, nil
 }
 
+// GenerateAppToken generates an access token scoped to a single catalogue app, minted with the token
+// settings of the app. The audience is set to the app, so the token is not accepted by other apps that check it.
+// The token of an impersonated user carries the impersonation, like GenerateImpersonationToken.
+func (j *Auth) GenerateAppToken(user *JWTUser, appID int, opts AppTokenOptions) (string, error) {
+	expiry := opts.Expiry
+	if expiry <= 0 {
+		expiry = j.TokenExpiry
+	}
+	claims := Claims{
+		UserID:         user.ID,
+		Email:          user.Email,
+		AppID:          appID,
+		TokenUse:       TokenUseAccess,
+		UserAttributes: opts.Attributes,
+		StandardClaims: j.standardClaims(user, expiry),
+	}
+	claims.Audience = opts.Audience
+	user.impersonationClaims(&claims)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(j.JWTSecret))
+}
+
+// GenerateAppRefreshToken generates the refresh token of a catalogue app, lasting the RefreshExpiry of its settings.
+// It carries no user attributes, they are read again when it is exchanged. An impersonated user gets none,
+// the app has to launch again once the token of the impersonation expires.
+func (j *Auth) GenerateAppRefreshToken(user *JWTUser, appID int, opts AppTokenOptions) (string, error) {
+	if user.Impersonation != nil {
+		return "", errors.New("the tokens of an impersonation cannot be refreshed")
+	}
+	if opts.RefreshExpiry <= 0 {
+		return "", errors.New("the app does not refresh its tokens")
+	}
+	claims := Claims{
+		UserID:         user.ID,
+		Email:          user.Email,
+		AppID:          appID,
+		TokenUse:       TokenUseRefresh,
+		StandardClaims: j.standardClaims(user, opts.RefreshExpiry),
+	}
+	claims.Audience = opts.Audience
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(j.JWTSecret))
+}
+
+// GenerateImpersonationToken generates an access token for an admin impersonating a user, the user
+// has to have an Impersonation. It expires with the impersonation, or after TokenExpiry when that is
+// sooner, and there is no refresh token: the admin starts another impersonation when it expires.
+func (j *Auth) GenerateImpersonationToken(user *JWTUser) (string, error) {
+	if user.Impersonation == nil {
+		return "", errors.New("the user is not impersonated")
+	}
+	claims := Claims{
+		UserID:         user.ID,
+		Email:          user.Email,
+		TokenUse:       TokenUseAccess,
+		StandardClaims: j.standardClaims(user, j.TokenExpiry),
+	}
+	user.impersonationClaims(&claims)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(j.JWTSecret))
+}
+
+// GenerateCertificateBoundToken generates an access token bound to the client certificate
+// of the given thumbprint. There is no refresh token, the client authenticates with its certificate again
+// once the token expires.
+func (j *Auth) GenerateCertificateBoundToken(user *JWTUser, thumbprint string) (string, error) {
+	claims := Claims{
+		UserID:         user.ID,
+		Email:          user.Email,
+		TokenUse:       TokenUseAccess,
+		Confirmation:   &Confirmation{X5tS256: thumbprint},
+		StandardClaims: j.standardClaims(user, j.TokenExpiry),
+	}
+	user.authenticationClaims(&claims)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(j.JWTSecret))
+}
+
+// GenerateForwardAuthToken generates the forward-auth session token of a browser from the claims of its access token,
+// for audience and expiring with it. The apps behind the reverse proxy receive the cookie it is stored in,
+// so it is not an access token: only VerifyForwardAuthToken accepts it. It keeps the user, how they authenticated,
+// their session and the impersonation, a certificate-bound token has none.
+func (j *Auth) GenerateForwardAuthToken(access *Claims, audience string) (string, error) {
+	if audience == "" {
+		return "", ErrNoAudience
+	}
+	if access.Confirmation != nil {
+		return "", errors.New("a certificate-bound token has no forward-auth session")
+	}
+	claims := Claims{
+		UserID:          access.UserID,
+		Email:           access.Email,
+		TokenUse:        TokenUseForwardAuth,
+		AMR:             access.AMR,
+		ACR:             access.ACR,
+		AuthTime:        access.AuthTime,
+		SessionID:       access.SessionID,
+		Actor:           access.Actor,
+		Impersonated:    access.Impersonated,
+		ImpersonationID: access.ImpersonationID,
+		StandardClaims:  j.standardClaims(&JWTUser{ID: access.UserID}, 0),
+	}
+	claims.Audience = audience
+	claims.ExpiresAt = access.ExpiresAt
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(j.JWTSecret))
+}
+
 // GetRefreshCookie creates an HTTP cookie to store the refresh token securely.
 func (j *Auth) GetRefreshCookie(refreshToken string) *http.Cookie {
 	return &http.Cookie{
@@ -160,26 +430,10 @@ func (j *Auth) GetTokenFromHeaderAndVerify(w http.ResponseWriter, r *http.Reques
 	// that comes as parameter to this function
 	token := headerParts[1]
 
-	// declare an empty claims
-	claims := &Claims{}
-
-	// parse the token
-	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(j.JWTSecret), nil
-	})
-
+	claims, err := j.VerifyAccessToken(token)
 	if err != nil {
-		if strings.HasPrefix(err.Error(), "token is expired by") {
-			return "", nil, errors.New("expired token")
-		}
 		return "", nil, err
 	}
-	if claims.Issuer != j.Issuer {
-		return "", nil, errors.New("invalid issuer")
-	}
 	return token, claims, nil
 }
 
@@ -33,6 +33,170 @@ func TestGenerateTokenPair(t *testing.T) {
 	}
 }
 
+// TestGenerateTokenPair_Authentication tests that both tokens carry how and when the user authenticated.
+func TestGenerateTokenPair_Authentication(t *testing.T) {
+	authService := auth.Auth{
+		Issuer:      "testIssuer",
+		Audience:    "example.com",
+		JWTSecret:   "testSecret",
+		TokenExpiry: time.Minute,
+	}
+
+	user := &auth.JWTUser{ID: 1, Email: "admin@example.com", AMR: []string{auth.AMRPassword, auth.AMROneTimePassword, auth.AMRMultiFactor}, AuthTime: 1700000000,
+		SessionID: 5, Context: &auth.ActiveContext{CompanyID: 3, DbID: 6}}
+	tokens, err := authService.GenerateTokenPair(user)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// the refresh token carries them too, so the refreshed tokens keep them
+	for _, token := range []string{tokens.Token, tokens.RefreshToken} {
+		claims, err := authService.VerifyToken(token)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if claims.ACR != auth.ACRMultiFactor || claims.AuthTime != 1700000000 || len(claims.AMR) != 3 {
+			t.Fatalf("Unexpected claims: %+v", claims)
+		}
+		if claims.SessionID != 5 || claims.Context == nil || *claims.Context != (auth.ActiveContext{CompanyID: 3, DbID: 6}) {
+			t.Fatalf("Unexpected session claims: %+v", claims)
+		}
+	}
+}
+
+// TestACR tests the authentication context class of the methods used.
+func TestACR(t *testing.T) {
+	cases := []struct {
+		amr  []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{auth.AMRPassword}, auth.ACRSingleFactor},
+		{[]string{auth.AMROneTimePassword, auth.AMROneTimePassword, auth.AMRMultiFactor}, auth.ACRSingleFactor},
+		{[]string{auth.AMRPassword, auth.AMROneTimePassword}, auth.ACRMultiFactor},
+		{[]string{auth.AMRPassword, auth.AMRTrustedDevice}, auth.ACRSingleFactor},
+		{[]string{auth.AMRPassword, auth.AMRTrustedDevice, auth.AMROneTimePassword, auth.AMRMultiFactor}, auth.ACRMultiFactor},
+	}
+	for _, c := range cases {
+		if got := auth.ACR(c.amr); got != c.want {
+			t.Errorf("ACR(%v) = %q, want %q", c.amr, got, c.want)
+		}
+	}
+}
+
+// TestGenerateAppToken tests that app-scoped tokens carry the app and its audience.
+func TestGenerateAppToken(t *testing.T) {
+	authService := auth.Auth{
+		Issuer:      "testIssuer",
+		Audience:    "example.com",
+		JWTSecret:   "testSecret",
+		TokenExpiry: time.Minute,
+	}
+
+	token, err := authService.GenerateAppToken(&auth.JWTUser{ID: 1, Email: "admin@example.com"}, 7, auth.AppTokenOptions{Audience: "https://app7.example.com"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	claims, err := authService.VerifyAppToken(token, "https://app7.example.com")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// the server does not accept the tokens of the apps
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if _, _, err := authService.GetTokenFromHeaderAndVerify(httptest.NewRecorder(), req); err == nil {
+		t.Fatal("Expected the app token to be refused as an access token of the server")
+	}
+
+	if claims.AppID != 7 || claims.Audience != "https://app7.example.com" || claims.UserID != 1 {
+		t.Fatalf("Unexpected claims: %+v", claims)
+	}
+}
+
+// TestGenerateAppToken_Settings tests that app tokens are minted with the lifetimes and claim template
+// of the app, and that its refresh token is not accepted as an access token.
+func TestGenerateAppToken_Settings(t *testing.T) {
+	authService := auth.Auth{
+		Issuer:      "testIssuer",
+		Audience:    "example.com",
+		JWTSecret:   "testSecret",
+		TokenExpiry: time.Minute,
+	}
+	opts := auth.AppTokenOptions{
+		Audience:      "billing",
+		Expiry:        time.Hour,
+		RefreshExpiry: time.Hour * 24,
+		Attributes:    auth.UserAttributes{GroupID: 3, Lan: "es"},
+	}
+	user := &auth.JWTUser{ID: 1, Email: "admin@example.com"}
+
+	token, err := authService.GenerateAppToken(user, 7, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	claims, err := authService.VerifyAppToken(token, "billing")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if claims.Audience != "billing" || claims.GroupID != 3 || claims.Lan != "es" || claims.ProfileID != 0 {
+		t.Fatalf("Unexpected claims: %+v", claims)
+	}
+	if expiry := time.Until(time.Unix(claims.ExpiresAt, 0)); expiry < 59*time.Minute {
+		t.Fatalf("Expected the token to last an hour, it lasts %v", expiry)
+	}
+
+	refresh, err := authService.GenerateAppRefreshToken(user, 7, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	claims, err = authService.VerifyAppToken(refresh, "billing")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if claims.TokenUse != auth.TokenUseRefresh || claims.AppID != 7 || claims.GroupID != 0 {
+		t.Fatalf("Unexpected claims: %+v", claims)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+refresh)
+	if _, _, err := authService.GetTokenFromHeaderAndVerify(httptest.NewRecorder(), req); err == nil {
+		t.Fatal("Expected the refresh token to be refused as an access token")
+	}
+
+	// the tokens of an impersonation and of the apps without a refresh lifetime cannot be refreshed
+	if _, err := authService.GenerateAppRefreshToken(user, 7, auth.AppTokenOptions{}); err == nil {
+		t.Fatal("Expected an error without a refresh lifetime")
+	}
+	user.Impersonation = &auth.Impersonation{ID: 1, ActorID: 2, Expires: time.Now().Add(time.Hour).Unix()}
+	if _, err := authService.GenerateAppRefreshToken(user, 7, opts); err == nil {
+		t.Fatal("Expected an error for an impersonated user")
+	}
+}
+
+// TestGenerateCertificateBoundToken tests that bound tokens carry the certificate thumbprint.
+func TestGenerateCertificateBoundToken(t *testing.T) {
+	authService := auth.Auth{
+		Issuer:      "testIssuer",
+		Audience:    "example.com",
+		JWTSecret:   "testSecret",
+		TokenExpiry: time.Minute,
+	}
+
+	token, err := authService.GenerateCertificateBoundToken(&auth.JWTUser{ID: 2, Email: "svc@example.com"}, "thumbprint")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	claims, err := authService.VerifyToken(token)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if claims.Confirmation == nil || claims.Confirmation.X5tS256 != "thumbprint" || claims.UserID != 2 {
+		t.Fatalf("Unexpected claims: %+v", claims)
+	}
+}
+
 // Instead of using a static token, we generate one for testing
 func TestGetTokenFromHeaderAndVerify(t *testing.T) {
 
@@ -82,6 +246,7 @@ func TestGetTokenFromHeaderAndVerify(t *testing.T) {
 // TestGetRefreshCookie tests the GetRefreshCookie method of the Auth struct.
 func TestGetRefreshCookie(t *testing.T) {
 	auth := &auth.Auth{
+		Audience:      "example.com",
 		CookieName:    "refresh_token",
 		CookiePath:    "/",
 		CookieDomain:  "localhost",
@@ -103,6 +268,7 @@ func TestGetRefreshCookie(t *testing.T) {
 // TestGetExpiredRefreshCookie tests the GetExpiredRefreshCookie method of the Auth struct.
 func TestGetExpiredRefreshCookie(t *testing.T) {
 	auth := &auth.Auth{
+		Audience:     "example.com",
 		CookieName:   "refresh_token",
 		CookiePath:   "/",
 		CookieDomain: "localhost",
@@ -147,6 +313,7 @@ func TestGetTokenFromHeaderInvalidFormat(t *testing.T) {
 // TestGetTokenFromHeaderNoAuth tests the GetTokenFromHeaderAndVerify method with no Authorization header.
 func TestGetTokenFromHeaderNoAuth(t *testing.T) {
 	authService := &auth.Auth{
+		Audience:      "example.com",
 		JWTSecret:     "testSecret",
 		CookieName:    "refresh_token",
 		CookiePath:    "/",
@@ -164,3 +331,33 @@ func TestGetTokenFromHeaderNoAuth(t *testing.T) {
 		t.Fatalf("Expected no auth header error, got %v", err)
 	}
 }
+
+// TestGenerateImpersonationToken tests the act claim and the banner flag of an impersonation token,
+// and that it does not outlive the impersonation.
+func TestGenerateImpersonationToken(t *testing.T) {
+	authService := auth.Auth{
+		Issuer:      "testIssuer",
+		Audience:    "example.com",
+		JWTSecret:   "testSecret",
+		TokenExpiry: time.Minute * 15,
+	}
+
+	if _, err := authService.GenerateImpersonationToken(&auth.JWTUser{ID: 2}); err == nil {
+		t.Fatal("Expected an error for a user who is not impersonated")
+	}
+
+	expires := time.Now().Add(time.Minute * 5).Unix()
+	token, err := authService.GenerateImpersonationToken(&auth.JWTUser{ID: 2, Email: "user@example.com",
+		Impersonation: &auth.Impersonation{ID: 3, ActorID: 1, ActorEmail: "admin@example.com", Expires: expires}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	claims, err := authService.VerifyToken(token)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if claims.Subject != "2" || claims.Actor == nil || claims.Actor.Subject != "1" || !claims.Impersonated ||
+		claims.ImpersonationID != 3 || claims.ExpiresAt != expires {
+		t.Fatalf("Unexpected claims: %+v", claims)
+	}
+}
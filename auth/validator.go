@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// defaultRefreshExpiry is the lifetime of the refresh tokens when RefreshExpiry is not set.
+const defaultRefreshExpiry = time.Hour * 24
+
+// Errors of the validation of the standard claims.
+var (
+	ErrTokenExpired     = errors.New("expired token")
+	ErrTokenNotValidYet = errors.New("token is not valid yet")
+	ErrInvalidIssuer    = errors.New("invalid issuer")
+	ErrInvalidAudience  = errors.New("invalid audience")
+	ErrMissingClaims    = errors.New("token is missing the exp, iat or jti claim")
+	ErrNoAudience       = errors.New("no accepted audience is configured")
+	ErrInvalidTokenUse  = errors.New("invalid token use")
+)
+
+func (j *Auth) refreshExpiry() time.Duration {
+	if j.RefreshExpiry > 0 {
+		return j.RefreshExpiry
+	}
+	return defaultRefreshExpiry
+}
+
+// newTokenID returns a random jti claim, so every token can be told apart.
+func newTokenID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// standardClaims returns the registered claims of a token of the user issued now and lasting expiry:
+// the issuer and audience of j, the subject, a new token ID, and the iat, nbf and exp times.
+func (j *Auth) standardClaims(user *JWTUser, expiry time.Duration) jwt.StandardClaims {
+	now := time.Now()
+	return jwt.StandardClaims{
+		Issuer:    j.Issuer,
+		Audience:  j.Audience,
+		Subject:   fmt.Sprint(user.ID),
+		Id:        newTokenID(),
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(expiry).Unix(),
+	}
+}
+
+// AcceptedAudiences returns Audience and Audiences, the audiences of the tokens j accepts.
+func (j *Auth) AcceptedAudiences() []string {
+	audiences := slices.Clone(j.Audiences)
+	if j.Audience != "" {
+		audiences = append(audiences, j.Audience)
+	}
+	return audiences
+}
+
+// VerifyToken is the validator of the tokens issued by j, wherever they come from: the Authorization
+// header, a cookie or a request body. It checks the signature and the standard claims of the token and
+// returns its claims. The issuer must be Issuer and the audience one of Audience and Audiences, no token
+// is accepted when there is none. The token must carry exp, iat and jti: it must not be expired, nor issued
+// or valid only in the future, within Leeway for the clocks of the servers.
+// VerifyAccessToken and VerifyRefreshToken check what the token is for as well.
+func (j *Auth) VerifyToken(token string) (*Claims, error) {
+	return j.verify(token, j.AcceptedAudiences())
+}
+
+// VerifyAccessToken is VerifyToken for the access tokens of the users, the bearer tokens of the routes
+// of the server: refresh tokens and the tokens of the catalogue apps are refused.
+func (j *Auth) VerifyAccessToken(token string) (*Claims, error) {
+	return j.verifyUse(token, TokenUseAccess)
+}
+
+// VerifyRefreshToken is VerifyToken for the refresh tokens of the users, only exchanged for new tokens.
+func (j *Auth) VerifyRefreshToken(token string) (*Claims, error) {
+	return j.verifyUse(token, TokenUseRefresh)
+}
+
+func (j *Auth) verifyUse(token, use string) (*Claims, error) {
+	claims, err := j.VerifyToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.TokenUse != use || claims.AppID != 0 {
+		return nil, ErrInvalidTokenUse
+	}
+	return claims, nil
+}
+
+// VerifyForwardAuthToken is VerifyToken for the forward-auth session tokens, of audience.
+func (j *Auth) VerifyForwardAuthToken(token, audience string) (*Claims, error) {
+	if audience == "" {
+		return nil, ErrNoAudience
+	}
+	claims, err := j.verify(token, []string{audience})
+	if err != nil {
+		return nil, err
+	}
+	if claims.TokenUse != TokenUseForwardAuth || claims.AppID != 0 {
+		return nil, ErrInvalidTokenUse
+	}
+	return claims, nil
+}
+
+// VerifyAppToken is VerifyToken for the tokens of a catalogue app, the audience must be the one of the app.
+func (j *Auth) VerifyAppToken(token, audience string) (*Claims, error) {
+	if audience == "" {
+		return nil, ErrNoAudience
+	}
+	return j.verify(token, []string{audience})
+}
+
+func (j *Auth) verify(token string, audiences []string) (*Claims, error) {
+	// a token of any audience would be accepted
+	if len(audiences) == 0 {
+		return nil, ErrNoAudience
+	}
+	claims := &Claims{}
+
+	// the times are checked below, with the leeway jwt-go does not have
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(token, claims, func(token *jwt.Token) (any, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(j.JWTSecret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt == 0 || claims.IssuedAt == 0 || claims.Id == "" {
+		return nil, ErrMissingClaims
+	}
+	now := time.Now().Unix()
+	leeway := int64(j.Leeway / time.Second)
+	if now > claims.ExpiresAt+leeway {
+		return nil, ErrTokenExpired
+	}
+	if now+leeway < claims.IssuedAt || now+leeway < claims.NotBefore {
+		return nil, ErrTokenNotValidYet
+	}
+	if claims.Issuer != j.Issuer {
+		return nil, ErrInvalidIssuer
+	}
+	if !slices.Contains(audiences, claims.Audience) {
+		return nil, ErrInvalidAudience
+	}
+	return claims, nil
+}
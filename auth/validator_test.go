@@ -0,0 +1,161 @@
+package auth_test
+
+import (
+	"authserver-backend/auth"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// sign signs claims the way Auth does, to build tokens it would not issue.
+func sign(t *testing.T, claims auth.Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("testSecret"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return token
+}
+
+// TestVerifyToken_StandardClaims tests that the issued tokens carry aud, iat, nbf and jti,
+// and that the validator enforces the issuer and the accepted audiences.
+func TestVerifyToken_StandardClaims(t *testing.T) {
+	issuer := auth.Auth{
+		Issuer:      "testIssuer",
+		Audience:    "api.example.com",
+		JWTSecret:   "testSecret",
+		TokenExpiry: time.Minute,
+	}
+	pair, err := issuer.GenerateTokenPair(&auth.JWTUser{ID: 1, Email: "admin@example.com"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	claims, err := issuer.VerifyToken(pair.Token)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if claims.Audience != "api.example.com" || claims.IssuedAt == 0 || claims.NotBefore == 0 || claims.Id == "" {
+		t.Fatalf("Unexpected claims: %+v", claims)
+	}
+	refresh, err := issuer.VerifyToken(pair.RefreshToken)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if refresh.Id == claims.Id {
+		t.Fatal("Expected every token to have its own jti")
+	}
+
+	// another service accepts the tokens of its own audience and of the ones it is configured with
+	other := auth.Auth{Issuer: "testIssuer", Audience: "admin.example.com", JWTSecret: "testSecret"}
+	if _, err := other.VerifyToken(pair.Token); !errors.Is(err, auth.ErrInvalidAudience) {
+		t.Fatalf("Expected %v, got %v", auth.ErrInvalidAudience, err)
+	}
+	other.Audiences = []string{"api.example.com"}
+	if _, err := other.VerifyToken(pair.Token); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	other.Issuer = "otherIssuer"
+	if _, err := other.VerifyToken(pair.Token); !errors.Is(err, auth.ErrInvalidIssuer) {
+		t.Fatalf("Expected %v, got %v", auth.ErrInvalidIssuer, err)
+	}
+
+	// the tokens of an app are only valid for its audience
+	appToken, err := issuer.GenerateAppToken(&auth.JWTUser{ID: 1}, 7, auth.AppTokenOptions{Audience: "https://app7.example.com"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := issuer.VerifyToken(appToken); !errors.Is(err, auth.ErrInvalidAudience) {
+		t.Fatalf("Expected %v, got %v", auth.ErrInvalidAudience, err)
+	}
+	if _, err := issuer.VerifyAppToken(appToken, "https://app7.example.com"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+// TestVerifyToken_Leeway tests that the times of the tokens are checked within the leeway,
+// and that the tokens without exp, iat or jti are refused.
+func TestVerifyToken_Leeway(t *testing.T) {
+	validator := auth.Auth{Issuer: "testIssuer", Audience: "api.example.com", JWTSecret: "testSecret"}
+	now := time.Now()
+	claims := func(iat, nbf, exp time.Time) auth.Claims {
+		return auth.Claims{UserID: 1, StandardClaims: jwt.StandardClaims{
+			Issuer:    "testIssuer",
+			Audience:  "api.example.com",
+			Id:        "token-1",
+			IssuedAt:  iat.Unix(),
+			NotBefore: nbf.Unix(),
+			ExpiresAt: exp.Unix(),
+		}}
+	}
+
+	expired := sign(t, claims(now.Add(-time.Hour), now.Add(-time.Hour), now.Add(-10*time.Second)))
+	early := sign(t, claims(now.Add(10*time.Second), now.Add(10*time.Second), now.Add(time.Hour)))
+
+	if _, err := validator.VerifyToken(expired); !errors.Is(err, auth.ErrTokenExpired) {
+		t.Fatalf("Expected %v, got %v", auth.ErrTokenExpired, err)
+	}
+	if _, err := validator.VerifyToken(early); !errors.Is(err, auth.ErrTokenNotValidYet) {
+		t.Fatalf("Expected %v, got %v", auth.ErrTokenNotValidYet, err)
+	}
+
+	// the clocks of the servers may be a few seconds apart
+	validator.Leeway = 30 * time.Second
+	if _, err := validator.VerifyToken(expired); err != nil {
+		t.Fatalf("Expected no error within the leeway, got %v", err)
+	}
+	if _, err := validator.VerifyToken(early); err != nil {
+		t.Fatalf("Expected no error within the leeway, got %v", err)
+	}
+
+	noID := claims(now, now, now.Add(time.Hour))
+	noID.Id = ""
+	if _, err := validator.VerifyToken(sign(t, noID)); !errors.Is(err, auth.ErrMissingClaims) {
+		t.Fatalf("Expected %v, got %v", auth.ErrMissingClaims, err)
+	}
+}
+
+// TestVerifyToken_Use tests that the access and refresh tokens of the users are not accepted for one another,
+// and that no token is accepted without a configured audience.
+func TestVerifyToken_Use(t *testing.T) {
+	validator := auth.Auth{Issuer: "testIssuer", Audience: "api.example.com", JWTSecret: "testSecret", TokenExpiry: time.Minute}
+	pair, err := validator.GenerateTokenPair(&auth.JWTUser{ID: 1, Email: "admin@example.com"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if _, err := validator.VerifyAccessToken(pair.Token); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := validator.VerifyAccessToken(pair.RefreshToken); !errors.Is(err, auth.ErrInvalidTokenUse) {
+		t.Fatalf("Expected %v, got %v", auth.ErrInvalidTokenUse, err)
+	}
+	if _, err := validator.VerifyRefreshToken(pair.RefreshToken); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := validator.VerifyRefreshToken(pair.Token); !errors.Is(err, auth.ErrInvalidTokenUse) {
+		t.Fatalf("Expected %v, got %v", auth.ErrInvalidTokenUse, err)
+	}
+
+	// a token without token_use, issued before it was set
+	legacy := sign(t, auth.Claims{UserID: 1, StandardClaims: jwt.StandardClaims{
+		Issuer:    "testIssuer",
+		Audience:  "api.example.com",
+		Id:        "token-1",
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	}})
+	if _, err := validator.VerifyAccessToken(legacy); !errors.Is(err, auth.ErrInvalidTokenUse) {
+		t.Fatalf("Expected %v, got %v", auth.ErrInvalidTokenUse, err)
+	}
+
+	validator.Audience = ""
+	if _, err := validator.VerifyToken(pair.Token); !errors.Is(err, auth.ErrNoAudience) {
+		t.Fatalf("Expected %v, got %v", auth.ErrNoAudience, err)
+	}
+	if _, err := validator.VerifyAppToken(pair.Token, ""); !errors.Is(err, auth.ErrNoAudience) {
+		t.Fatalf("Expected %v, got %v", auth.ErrNoAudience, err)
+	}
+}
@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"authserver-backend/internal/models"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// unhashed are the fields of a record left out of its hash: its id, only known once it is stored,
+// and the chain itself.
+var unhashed = []string{"id", "prev_hash", "hash"}
+
+// Hash returns the hash of an audit record chained to the hash of the previous record of its log,
+// empty for the first one. It is the hex SHA-256 of the previous hash and of the canonical JSON form
+// of the record, with sorted keys, so a record read back from the database hashes the same
+// whatever the database did to the layout of its JSON columns.
+func Hash(prev string, record any) (string, error) {
+	content, err := canonical(record)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write([]byte{'\n'})
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// canonical returns the JSON form of a record without its unhashed fields, with sorted keys.
+func canonical(record any) ([]byte, error) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var fields map[string]any
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("an audit record must be a JSON object: %w", err)
+	}
+	for _, name := range unhashed {
+		delete(fields, name)
+	}
+	return json.Marshal(fields)
+}
+
+// Record is an audit record as the verification walks it.
+type Record struct {
+	ID       int
+	PrevHash string
+	Hash     string
+	// Content is the record itself, hashed like by Hash.
+	Content any
+}
+
+// Records returns the records of a log after an id, in id order, at most limit of them.
+type Records func(afterID, limit int) ([]Record, error)
+
+// Break is the first broken link of a log.
+type Break struct {
+	EventID int    `json:"event_id"`
+	Reason  string `json:"reason"`
+}
+
+// Report is the outcome of the verification of a log. Head is the hash of its last record.
+type Report struct {
+	Log         string `json:"log"`
+	Records     int    `json:"records"`
+	Checkpoints int    `json:"checkpoints"`
+	Head        string `json:"head"`
+	Valid       bool   `json:"valid"`
+	Break       *Break `json:"break,omitempty"`
+}
+
+// verifyBatch is how many records the verification reads at a time.
+const verifyBatch = 1000
+
+// Verify walks the chain of a log and reports its first broken link: a record whose previous hash is not
+// the hash of the record before it, because records were removed or inserted, a record whose hash does not
+// match its contents, because it was edited, or a checkpoint that does not match the chain or whose
+// signature is invalid, because the chain was rewritten after it. The checkpoint signatures are not
+// checked when key is nil. The checkpoints are in the order of their records. Records from before
+// the chain, with no hash, are skipped until the first chained one. A removal of the records after
+// the last checkpoint cannot be detected.
+func Verify(log string, records Records, checkpoints []*models.AuditCheckpoint, key ed25519.PublicKey) (Report, error) {
+	report := Report{Log: log, Checkpoints: len(checkpoints)}
+
+	pending := checkpoints
+	broken := func(id int, reason string, args ...any) (Report, error) {
+		report.Break = &Break{EventID: id, Reason: fmt.Sprintf(reason, args...)}
+		return report, nil
+	}
+
+	for _, cp := range checkpoints {
+		if key != nil && !VerifyCheckpoint(key, *cp) {
+			return broken(cp.EventID, "checkpoint %d has an invalid signature", cp.ID)
+		}
+	}
+
+	prev, chained, afterID := "", false, 0
+	for {
+		batch, err := records(afterID, verifyBatch)
+		if err != nil {
+			return report, err
+		}
+		for _, r := range batch {
+			afterID = r.ID
+			if !chained && r.Hash == "" {
+				continue
+			}
+			chained = true
+			report.Records++
+
+			if r.PrevHash != prev {
+				return broken(r.ID, "the previous hash does not match the record before it")
+			}
+			hash, err := Hash(prev, r.Content)
+			if err != nil {
+				return report, err
+			}
+			if hash != r.Hash {
+				return broken(r.ID, "the hash does not match the contents of the record")
+			}
+			prev = hash
+
+			for len(pending) > 0 && pending[0].EventID <= r.ID {
+				cp := pending[0]
+				pending = pending[1:]
+				if cp.EventID != r.ID {
+					return broken(cp.EventID, "the record of checkpoint %d is missing", cp.ID)
+				}
+				if cp.Hash != hash {
+					return broken(r.ID, "the chain does not match checkpoint %d", cp.ID)
+				}
+			}
+		}
+		if len(batch) < verifyBatch {
+			break
+		}
+	}
+	if len(pending) > 0 {
+		return broken(pending[0].EventID, "the record of checkpoint %d is missing", pending[0].ID)
+	}
+
+	report.Head = prev
+	report.Valid = true
+	return report, nil
+}
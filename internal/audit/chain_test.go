@@ -0,0 +1,148 @@
+package audit_test
+
+import (
+	"authserver-backend/internal/audit"
+	"authserver-backend/internal/models"
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chain builds a log of n admin events chained like the repository does.
+func chain(t *testing.T, n int) []audit.Record {
+	var records []audit.Record
+	prev := ""
+	for id := 1; id <= n; id++ {
+		event := &models.AdminEvent{ID: id, ActorID: 1, Action: "update", EntityType: "app", EntityID: id,
+			Diff: json.RawMessage(`{"title":{"old":"a","new":"b"}}`), Created: int64(1700000000 + id)}
+		hash, err := audit.Hash(prev, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event.PrevHash, event.Hash = prev, hash
+		records = append(records, audit.Record{ID: id, PrevHash: prev, Hash: hash, Content: event})
+		prev = hash
+	}
+	return records
+}
+
+// source serves the records like the repository, in batches after an id.
+func source(records []audit.Record) audit.Records {
+	return func(afterID, limit int) ([]audit.Record, error) {
+		var batch []audit.Record
+		for _, r := range records {
+			if r.ID > afterID && len(batch) < limit {
+				batch = append(batch, r)
+			}
+		}
+		return batch, nil
+	}
+}
+
+func TestHash(t *testing.T) {
+	event := models.AdminEvent{ID: 1, Action: "update", Diff: json.RawMessage(`{"title":{"old":"a","new":"b"}}`)}
+	hash, err := audit.Hash("", event)
+	assert.NoError(t, err)
+	assert.Len(t, hash, 64)
+
+	// the id and the chain are not hashed, and jsonb reorders and spaces the keys of the diff
+	stored := event
+	stored.ID, stored.Hash = 9, hash
+	stored.Diff = json.RawMessage(`{"title": {"new": "b", "old": "a"}}`)
+	again, err := audit.Hash("", stored)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, again)
+
+	chained, _ := audit.Hash("prev", event)
+	assert.NotEqual(t, hash, chained)
+	stored.Action = "delete"
+	edited, _ := audit.Hash("", stored)
+	assert.NotEqual(t, hash, edited)
+}
+
+func TestVerify(t *testing.T) {
+	records := chain(t, 2500)
+	report, err := audit.Verify("admin", source(records), nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Nil(t, report.Break)
+	assert.Equal(t, 2500, report.Records)
+	assert.Equal(t, records[2499].Hash, report.Head)
+}
+
+// TestVerify_Tampered tests the first broken link reported for an edited, a removed and an inserted record.
+func TestVerify_Tampered(t *testing.T) {
+	records := chain(t, 5)
+	edited := *records[2].Content.(*models.AdminEvent)
+	edited.EntityID = 99
+	records[2].Content = &edited
+	report, err := audit.Verify("admin", source(records), nil, nil)
+	assert.NoError(t, err)
+	assert.False(t, report.Valid)
+	assert.Equal(t, &audit.Break{EventID: 3, Reason: "the hash does not match the contents of the record"}, report.Break)
+
+	records = chain(t, 5)
+	records = append(records[:1], records[2:]...)
+	report, _ = audit.Verify("admin", source(records), nil, nil)
+	assert.Equal(t, 3, report.Break.EventID)
+	assert.Equal(t, "the previous hash does not match the record before it", report.Break.Reason)
+
+	records = chain(t, 5)
+	records[3].PrevHash = records[1].Hash
+	report, _ = audit.Verify("admin", source(records), nil, nil)
+	assert.Equal(t, 4, report.Break.EventID)
+}
+
+// TestVerify_Unchained tests that the records from before the chain are skipped.
+func TestVerify_Unchained(t *testing.T) {
+	records := chain(t, 3)
+	for i := range records {
+		records[i].ID++ // the ids are not hashed
+	}
+	records = append([]audit.Record{{ID: 1, Content: &models.AdminEvent{ID: 1}}}, records...)
+	report, err := audit.Verify("admin", source(records), nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Equal(t, 3, report.Records)
+}
+
+// TestVerify_Checkpoints tests that a rewritten chain does not match the signed checkpoints.
+func TestVerify_Checkpoints(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	records := chain(t, 5)
+	cp := &models.AuditCheckpoint{ID: 1, Log: "admin", EventID: 3, Hash: records[2].Hash, Created: 1700000010}
+	audit.SignCheckpoint(private, cp)
+
+	report, err := audit.Verify("admin", source(records), []*models.AuditCheckpoint{cp}, public)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Equal(t, 1, report.Checkpoints)
+
+	// an edited record with the whole chain recomputed after it
+	rewritten := chain(t, 5)
+	prev := rewritten[0].Hash
+	for i := 1; i < 5; i++ {
+		event := *rewritten[i].Content.(*models.AdminEvent)
+		if i == 1 {
+			event.EntityID = 99
+		}
+		hash, _ := audit.Hash(prev, &event)
+		rewritten[i] = audit.Record{ID: event.ID, PrevHash: prev, Hash: hash, Content: &event}
+		prev = hash
+	}
+	report, _ = audit.Verify("admin", source(rewritten), []*models.AuditCheckpoint{cp}, public)
+	assert.False(t, report.Valid)
+	assert.Equal(t, &audit.Break{EventID: 3, Reason: "the chain does not match checkpoint 1"}, report.Break)
+
+	// a checkpoint moved to the rewritten chain without the signing key
+	forged := *cp
+	forged.Hash = rewritten[2].Hash
+	report, _ = audit.Verify("admin", source(rewritten), []*models.AuditCheckpoint{&forged}, public)
+	assert.Equal(t, &audit.Break{EventID: 3, Reason: "checkpoint 1 has an invalid signature"}, report.Break)
+
+	// the records of the checkpoint removed from the end of the log
+	report, _ = audit.Verify("admin", source(records[:2]), []*models.AuditCheckpoint{cp}, public)
+	assert.Equal(t, &audit.Break{EventID: 3, Reason: "the record of checkpoint 1 is missing"}, report.Break)
+}
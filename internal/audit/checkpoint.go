@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"authserver-backend/internal/models"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// checkpointMessage is what the signature of a checkpoint covers.
+func checkpointMessage(cp models.AuditCheckpoint) []byte {
+	return []byte("audit-checkpoint\n" + cp.Log + "\n" + strconv.Itoa(cp.EventID) + "\n" + cp.Hash + "\n" +
+		strconv.FormatInt(cp.Created, 10))
+}
+
+// SignCheckpoint signs a checkpoint: the hash of a record of a log at a time.
+func SignCheckpoint(key ed25519.PrivateKey, cp *models.AuditCheckpoint) {
+	cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, checkpointMessage(*cp)))
+}
+
+// VerifyCheckpoint reports whether the signature of a checkpoint is valid.
+func VerifyCheckpoint(key ed25519.PublicKey, cp models.AuditCheckpoint) bool {
+	signature, err := base64.StdEncoding.DecodeString(cp.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, checkpointMessage(cp), signature)
+}
+
+// LoadSigningKey reads the PEM encoded PKCS #8 Ed25519 private key that signs the checkpoints.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM block", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("the audit signing key must be an Ed25519 key")
+	}
+	return signer, nil
+}
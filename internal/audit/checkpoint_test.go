@@ -0,0 +1,55 @@
+package audit_test
+
+import (
+	"authserver-backend/internal/audit"
+	"authserver-backend/internal/models"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignCheckpoint(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	cp := models.AuditCheckpoint{Log: "logins", EventID: 42, Hash: "abc", Created: 1700000000}
+	audit.SignCheckpoint(private, &cp)
+	assert.NotEmpty(t, cp.Signature)
+	assert.True(t, audit.VerifyCheckpoint(public, cp))
+
+	moved := cp
+	moved.EventID = 41
+	assert.False(t, audit.VerifyCheckpoint(public, moved))
+	other, _, _ := ed25519.GenerateKey(nil)
+	assert.False(t, audit.VerifyCheckpoint(other, cp))
+	cp.Signature = "not base64"
+	assert.False(t, audit.VerifyCheckpoint(public, cp))
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	dir := t.TempDir()
+	_, private, _ := ed25519.GenerateKey(nil)
+	der, _ := x509.MarshalPKCS8PrivateKey(private)
+	keyFile := filepath.Join(dir, "audit.key")
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+
+	key, err := audit.LoadSigningKey(keyFile)
+	assert.NoError(t, err)
+	assert.True(t, private.Equal(key))
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ = x509.MarshalPKCS8PrivateKey(ecKey)
+	ecFile := filepath.Join(dir, "ec.key")
+	_ = os.WriteFile(ecFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	_, err = audit.LoadSigningKey(ecFile)
+	assert.EqualError(t, err, "the audit signing key must be an Ed25519 key")
+
+	_, err = audit.LoadSigningKey(filepath.Join(dir, "missing.key"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,57 @@
+// Package audit holds what the audit logs of the server share: the diffs of the entities changed
+// by the admin actions, and the hash chain and signed checkpoints that make the logs tamper-evident.
+package audit
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Change is the old and new value of a field. Old is absent for a created entity
+// and New for a deleted one.
+type Change struct {
+	Old any `json:"old,omitempty"`
+	New any `json:"new,omitempty"`
+}
+
+// Diff compares the JSON forms of an entity before and after a change, and returns the changed fields
+// by JSON name. A nil before is a creation and a nil after a deletion, every field is then in the diff.
+func Diff(before, after any) (map[string]Change, error) {
+	old, err := fields(before)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := fields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]Change)
+	for name, value := range old {
+		if v, ok := updated[name]; !ok || !reflect.DeepEqual(value, v) {
+			changes[name] = Change{Old: value, New: v}
+		}
+	}
+	for name, value := range updated {
+		if _, ok := old[name]; !ok {
+			changes[name] = Change{New: value}
+		}
+	}
+	return changes, nil
+}
+
+// fields returns the JSON object of an entity as a map, nil for a nil entity.
+func fields(entity any) (map[string]any, error) {
+	if entity == nil || (reflect.ValueOf(entity).Kind() == reflect.Pointer && reflect.ValueOf(entity).IsNil()) {
+		return nil, nil
+	}
+	data, err := json.Marshal(entity)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
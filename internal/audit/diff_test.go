@@ -0,0 +1,43 @@
+package audit_test
+
+import (
+	"authserver-backend/internal/audit"
+	"authserver-backend/internal/models"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	before := models.ThisApp{ID: 1, NewApp: models.NewApp{Name: "billing", Title: "Billing", Platform: pq.StringArray{"web"}}}
+	after := before
+	after.Title = "Billing 2"
+	after.Platform = pq.StringArray{"web", "ios"}
+
+	changes, err := audit.Diff(before, after)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]audit.Change{
+		"title":    {Old: "Billing", New: "Billing 2"},
+		"platform": {Old: []any{"web"}, New: []any{"web", "ios"}},
+	}, changes)
+
+	changes, err = audit.Diff(before, before)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+// TestDiff_CreateDelete tests that a creation or a deletion holds every field.
+func TestDiff_CreateDelete(t *testing.T) {
+	app := &models.ThisApp{ID: 1, NewApp: models.NewApp{Name: "billing"}}
+
+	changes, err := audit.Diff(nil, app)
+	assert.NoError(t, err)
+	assert.Equal(t, audit.Change{New: "billing"}, changes["name"])
+	assert.Equal(t, audit.Change{New: float64(1)}, changes["id"])
+
+	var none *models.ThisApp
+	changes, err = audit.Diff(app, none)
+	assert.NoError(t, err)
+	assert.Equal(t, audit.Change{Old: "billing"}, changes["name"])
+}
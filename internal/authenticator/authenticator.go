@@ -0,0 +1,88 @@
+// Package authenticator checks the credentials given to /authenticate. Each way of checking them,
+// the bcrypt hash stored in Postgres or a bind to an LDAP directory, is an Authenticator,
+// and a Chain tries them in turn until one accepts the login.
+package authenticator
+
+import (
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"context"
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrUnknownUser is returned by an Authenticator that does not know the login.
+	ErrUnknownUser = errors.New("user not found")
+	// ErrInvalidCredentials is returned by an Authenticator that knows the login but not the password.
+	ErrInvalidCredentials = errors.New("invalid password")
+)
+
+// Authenticator checks a login and a password and returns the local user they belong to.
+// It returns ErrUnknownUser or ErrInvalidCredentials when the credentials are refused,
+// any other error means the check could not be done.
+type Authenticator interface {
+	Name() string
+	Authenticate(ctx context.Context, login, password string) (*models.User, error)
+}
+
+// Chain tries each authenticator in order and returns the user of the first one accepting the credentials.
+// A refusal by one authenticator does not stop the others: a user provisioned from a directory
+// has no usable local password, so the local authenticator refuses it before the directory is asked.
+type Chain []Authenticator
+
+// Name implements Authenticator.
+func (c Chain) Name() string {
+	names := make([]string, len(c))
+	for i, a := range c {
+		names[i] = a.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Authenticate implements Authenticator. When every authenticator refuses the credentials,
+// ErrInvalidCredentials is returned if any of them knew the login, ErrUnknownUser otherwise.
+func (c Chain) Authenticate(ctx context.Context, login, password string) (*models.User, error) {
+	refusal := ErrUnknownUser
+	for _, a := range c {
+		user, err := a.Authenticate(ctx, login, password)
+		switch {
+		case err == nil:
+			return user, nil
+		case errors.Is(err, ErrInvalidCredentials):
+			refusal = ErrInvalidCredentials
+		case errors.Is(err, ErrUnknownUser):
+		default:
+			return nil, err
+		}
+	}
+	return nil, refusal
+}
+
+// Local checks the password against the bcrypt hash of the user stored in the database,
+// the login being the email of the user.
+type Local struct {
+	DB dbrepo.DatabaseRepo
+}
+
+// Name implements Authenticator.
+func (l Local) Name() string {
+	return "local"
+}
+
+// Authenticate implements Authenticator.
+func (l Local) Authenticate(_ context.Context, login, password string) (*models.User, error) {
+	user, err := l.DB.GetUserByEmail(login)
+	if err != nil {
+		return nil, ErrUnknownUser
+	}
+
+	valid, err := user.PasswordMatches(password, user.Password)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
@@ -0,0 +1,68 @@
+package authenticator_test
+
+import (
+	"authserver-backend/internal/authenticator"
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// stubAuthenticator answers every login with the same user or error.
+type stubAuthenticator struct {
+	user *models.User
+	err  error
+}
+
+func (s stubAuthenticator) Name() string { return "stub" }
+
+func (s stubAuthenticator) Authenticate(context.Context, string, string) (*models.User, error) {
+	return s.user, s.err
+}
+
+// TestLocal tests the bcrypt check of the local users.
+func TestLocal(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("GetUserByEmail", "user@example.com").Return(&models.User{ID: 1, Email: "user@example.com", Password: string(hash)}, nil)
+	mockDB.On("GetUserByEmail", "other@example.com").Return((*models.User)(nil), errors.New("no user"))
+
+	local := authenticator.Local{DB: mockDB}
+
+	user, err := local.Authenticate(context.Background(), "user@example.com", "password123")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, user.ID)
+
+	_, err = local.Authenticate(context.Background(), "user@example.com", "wrong")
+	assert.ErrorIs(t, err, authenticator.ErrInvalidCredentials)
+
+	_, err = local.Authenticate(context.Background(), "other@example.com", "password123")
+	assert.ErrorIs(t, err, authenticator.ErrUnknownUser)
+}
+
+// TestChain tests the order the authenticators are tried in and the error reported when all refuse.
+func TestChain(t *testing.T) {
+	user := &models.User{ID: 3}
+	unknown := stubAuthenticator{err: authenticator.ErrUnknownUser}
+	invalid := stubAuthenticator{err: authenticator.ErrInvalidCredentials}
+	down := stubAuthenticator{err: errors.New("directory down")}
+	accepts := stubAuthenticator{user: user}
+
+	got, err := authenticator.Chain{invalid, unknown, accepts}.Authenticate(context.Background(), "u", "p")
+	assert.NoError(t, err)
+	assert.Equal(t, user, got)
+
+	_, err = authenticator.Chain{unknown, unknown}.Authenticate(context.Background(), "u", "p")
+	assert.ErrorIs(t, err, authenticator.ErrUnknownUser)
+
+	_, err = authenticator.Chain{unknown, invalid}.Authenticate(context.Background(), "u", "p")
+	assert.ErrorIs(t, err, authenticator.ErrInvalidCredentials)
+
+	// a failure stops the chain, the next authenticator is not asked
+	_, err = authenticator.Chain{down, accepts}.Authenticate(context.Background(), "u", "p")
+	assert.EqualError(t, err, "directory down")
+}
@@ -0,0 +1,452 @@
+package authenticator
+
+import (
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/utils"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// defaultLDAPTimeout is used when LDAPConfig.Timeout is not set.
+const defaultLDAPTimeout = time.Second * 5
+
+// LDAPAttributes names the directory attributes copied to the local user.
+type LDAPAttributes struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Lan      string `json:"lan"`
+	Groups   string `json:"groups"`
+}
+
+// LDAPGroup maps the members of a directory group, given by its DN, to a local group.
+type LDAPGroup struct {
+	DN      string `json:"dn"`
+	GroupID int    `json:"group_id"`
+}
+
+// LDAPConfig describes a directory users can log in with.
+//
+// With BindDN set the authenticator searches then binds: it binds with the service account
+// BindDN/BindPassword, looks the user up under BaseDN with UserFilter and binds as the entry found.
+// Otherwise it binds directly as UserDN, a template like "uid=%s,ou=people,dc=example,dc=com"
+// or "%s@corp.example.com" for Active Directory, then reads the user's entry with UserFilter,
+// or the bound DN itself when there is no filter. In both templates %s is the escaped login.
+//
+// Groups are read from Attributes.Groups (memberOf by default); the first of Groups the user
+// is a member of gives its GroupId. With Provision set a first login creates the local user
+// with CompanyID and ProfileID, otherwise only users already known by email can log in.
+// The username, language and group of the local user follow the directory on every login.
+//
+// DisabledFilter matches the entries of disabled accounts, like
+// "(userAccountControl:1.2.840.113556.1.4.803:=2)" for Active Directory; it is checked with the
+// service account. The local user of an account found disabled, or no longer found by a search,
+// is deactivated when it tries to log in.
+type LDAPConfig struct {
+	Name               string         `json:"name"`
+	URL                string         `json:"url"`
+	StartTLS           bool           `json:"start_tls"`
+	InsecureSkipVerify bool           `json:"insecure_skip_verify"`
+	Timeout            Duration       `json:"timeout"`
+	BindDN             string         `json:"bind_dn"`
+	BindPassword       string         `json:"bind_password"`
+	BaseDN             string         `json:"base_dn"`
+	UserFilter         string         `json:"user_filter"`
+	UserDN             string         `json:"user_dn"`
+	DisabledFilter     string         `json:"disabled_filter"`
+	Attributes         LDAPAttributes `json:"attributes"`
+	Groups             []LDAPGroup    `json:"groups"`
+	Provision          bool           `json:"provision"`
+	CompanyID          int            `json:"company_id"`
+	ProfileID          int            `json:"profile_id"`
+}
+
+// Duration reads a time.Duration from a JSON string like "5s".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadLDAPConfig reads a directory configuration from a JSON file.
+func LoadLDAPConfig(path string) (LDAPConfig, error) {
+	var cfg LDAPConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("invalid LDAP configuration %s: %w", path, err)
+	}
+	if cfg.URL == "" || (cfg.BindDN == "" && cfg.UserDN == "") {
+		return cfg, fmt.Errorf("invalid LDAP configuration %s: url and either bind_dn or user_dn are required", path)
+	}
+	return cfg, nil
+}
+
+// LDAPEntry is the user as read from the directory.
+type LDAPEntry struct {
+	DN       string
+	Username string
+	Email    string
+	Lan      string
+	Groups   []string
+}
+
+// LDAP authenticates users against a directory and creates or updates their local user.
+type LDAP struct {
+	Config LDAPConfig
+	DB     dbrepo.DatabaseRepo
+}
+
+// Name implements Authenticator.
+func (l LDAP) Name() string {
+	if l.Config.Name != "" {
+		return l.Config.Name
+	}
+	return "ldap"
+}
+
+// ErrDisabledAccount is returned by Bind, along with the entry, for the accounts matching DisabledFilter.
+var ErrDisabledAccount = errors.New("the directory account is disabled")
+
+// Authenticate implements Authenticator. The local user of an account gone from the directory,
+// or disabled in it, is deactivated; inactive users are refused.
+func (l LDAP) Authenticate(ctx context.Context, login, password string) (*models.User, error) {
+	entry, err := l.Bind(ctx, login, password)
+	switch {
+	case errors.Is(err, ErrDisabledAccount):
+		if err := l.deactivate(entry.Email); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidCredentials
+	case errors.Is(err, ErrUnknownUser):
+		if err := l.deactivate(login); err != nil {
+			return nil, err
+		}
+		return nil, ErrUnknownUser
+	case err != nil:
+		return nil, err
+	}
+
+	user, err := l.localUser(entry)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.passwordChanged(user, password); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// deactivate deactivates the local user, matched by email, of a directory account that is gone
+// or disabled, and revokes its sessions. Only the users who logged in with the directory are,
+// a local user sharing the email is left alone.
+func (l LDAP) deactivate(email string) error {
+	if email == "" {
+		return nil
+	}
+	user, err := l.DB.GetUserByEmail(email)
+	if err != nil || !user.Active {
+		return nil
+	}
+	stored, err := l.DB.GetDirectoryPasswordHash(user.ID)
+	if err != nil || stored == "" {
+		return err
+	}
+
+	if err := l.DB.DeactivateUser(user.ID); err != nil {
+		return err
+	}
+	_, err = l.DB.RevokeUserSessions(user.ID, 0, time.Now().Unix())
+	return err
+}
+
+// passwordChanged revokes the trusted devices of a user whose directory password is not the one
+// they last logged in with, as a new local password does, and keeps the hash of the new one.
+// The hash is stored apart from the local password, which must never match.
+func (l LDAP) passwordChanged(user *models.User, password string) error {
+	stored, err := l.DB.GetDirectoryPasswordHash(user.ID)
+	if err != nil {
+		return err
+	}
+	if stored != "" && bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil {
+		return nil
+	}
+
+	if _, err := l.DB.RevokeUserTrustedDevices(user.ID, time.Now().Unix()); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return l.DB.SetDirectoryPasswordHash(user.ID, string(hash))
+}
+
+func (l LDAP) attributes() LDAPAttributes {
+	attrs := l.Config.Attributes
+	if attrs.Username == "" {
+		attrs.Username = "uid"
+	}
+	if attrs.Email == "" {
+		attrs.Email = "mail"
+	}
+	if attrs.Groups == "" {
+		attrs.Groups = "memberOf"
+	}
+	return attrs
+}
+
+// dial connects to the directory, upgrading the connection with StartTLS when configured.
+func (l LDAP) dial(ctx context.Context) (*ldap.Conn, error) {
+	timeout := time.Duration(l.Config.Timeout)
+	if timeout <= 0 {
+		timeout = defaultLDAPTimeout
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: l.Config.InsecureSkipVerify}
+	conn, err := ldap.DialURL(l.Config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		ldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+
+	if l.Config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Bind checks the password of a login against the directory and returns the user's entry.
+func (l LDAP) Bind(ctx context.Context, login, password string) (*LDAPEntry, error) {
+	// an empty password would be an unauthenticated bind, which directories accept
+	if login == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := l.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach the directory: %w", err)
+	}
+	defer conn.Close()
+
+	var entry *ldap.Entry
+	if l.Config.BindDN != "" {
+		if err := conn.Bind(l.Config.BindDN, l.Config.BindPassword); err != nil {
+			return nil, fmt.Errorf("directory service account bind failed: %w", err)
+		}
+		entry, err = l.search(conn, ldap.ScopeWholeSubtree, l.Config.BaseDN, login)
+		if err != nil {
+			return nil, err
+		}
+		// a disabled account is refused before its password is tried
+		if l.Config.DisabledFilter != "" {
+			disabled, err := l.disabled(conn, entry.DN)
+			if err != nil {
+				return nil, err
+			}
+			if disabled {
+				return l.entry(entry), ErrDisabledAccount
+			}
+		}
+		if err := conn.Bind(entry.DN, password); err != nil {
+			return nil, bindError(err)
+		}
+	} else {
+		userDN := strings.ReplaceAll(l.Config.UserDN, "%s", ldap.EscapeDN(login))
+		if err := conn.Bind(userDN, password); err != nil {
+			return nil, bindError(err)
+		}
+		if l.Config.UserFilter != "" {
+			entry, err = l.search(conn, ldap.ScopeWholeSubtree, l.Config.BaseDN, login)
+		} else {
+			entry, err = l.search(conn, ldap.ScopeBaseObject, userDN, "")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l.entry(entry), nil
+}
+
+// entry reads the mapped attributes of a directory entry.
+func (l LDAP) entry(entry *ldap.Entry) *LDAPEntry {
+	attrs := l.attributes()
+	return &LDAPEntry{
+		DN:       entry.DN,
+		Username: entry.GetAttributeValue(attrs.Username),
+		Email:    entry.GetAttributeValue(attrs.Email),
+		Lan:      entry.GetAttributeValue(attrs.Lan),
+		Groups:   entry.GetAttributeValues(attrs.Groups),
+	}
+}
+
+// disabled tells whether the entry of dn matches DisabledFilter.
+func (l LDAP) disabled(conn *ldap.Conn, dn string) (bool, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(
+		dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false, l.Config.DisabledFilter, []string{"dn"}, nil,
+	))
+	if err != nil {
+		return false, fmt.Errorf("directory search failed: %w", err)
+	}
+	return len(result.Entries) > 0, nil
+}
+
+// search returns the only entry matching the user filter under base, or base itself
+// when login is empty.
+func (l LDAP) search(conn *ldap.Conn, scope int, base, login string) (*ldap.Entry, error) {
+	filter := "(objectClass=*)"
+	if login != "" {
+		filter = strings.ReplaceAll(l.Config.UserFilter, "%s", ldap.EscapeFilter(login))
+	}
+
+	attrs := l.attributes()
+	names := []string{attrs.Username, attrs.Email, attrs.Groups}
+	if attrs.Lan != "" {
+		names = append(names, attrs.Lan)
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		base, scope, ldap.NeverDerefAliases, 2, 0, false, filter, names, nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, ErrUnknownUser
+		}
+		return nil, fmt.Errorf("directory search failed: %w", err)
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, ErrUnknownUser
+	case 1:
+		return result.Entries[0], nil
+	}
+	return nil, fmt.Errorf("the directory has several entries for %s", login)
+}
+
+// bindError tells a refused password from a directory failure.
+func bindError(err error) error {
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	return fmt.Errorf("directory bind failed: %w", err)
+}
+
+// groupID returns the local group of the first configured group the entry is a member of.
+func (l LDAP) groupID(entry *LDAPEntry) (int, bool) {
+	for _, group := range l.Config.Groups {
+		for _, member := range entry.Groups {
+			if strings.EqualFold(group.DN, member) {
+				return group.GroupID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// applyEntry sets the mapped attributes of a directory entry on its local user and tells whether
+// any of them changed. The attributes missing from the entry are left alone.
+func (l LDAP) applyEntry(user *models.User, entry *LDAPEntry) bool {
+	changed := false
+	if entry.Username != "" && entry.Username != user.UserName {
+		user.UserName = entry.Username
+		changed = true
+	}
+	if entry.Lan != "" && entry.Lan != user.Lan {
+		user.Lan = entry.Lan
+		changed = true
+	}
+	if groupID, mapped := l.groupID(entry); mapped && groupID != user.GroupId {
+		user.GroupId = groupID
+		changed = true
+	}
+	return changed
+}
+
+// localUser returns the local user of a directory entry, matched by email. A known user gets
+// the username, language and group of its entry, an unknown one is created when provisioning is enabled.
+// Inactive users are refused.
+func (l LDAP) localUser(entry *LDAPEntry) (*models.User, error) {
+	if entry.Email == "" {
+		return nil, fmt.Errorf("the directory entry %s has no email", entry.DN)
+	}
+
+	user, err := l.DB.GetUserByEmail(entry.Email)
+	if err == nil {
+		if !user.Active {
+			return nil, ErrInvalidCredentials
+		}
+		if l.applyEntry(user, entry) {
+			if err := l.DB.UpdateDirectoryUser(user.ID, user.UserName, user.Lan, user.GroupId); err != nil {
+				return nil, err
+			}
+		}
+		return user, nil
+	}
+
+	if !l.Config.Provision {
+		return nil, ErrUnknownUser
+	}
+	groupID, _ := l.groupID(entry)
+
+	// the password is checked by the directory, the local one must never match
+	random, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(random), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	userName := entry.Username
+	if userName == "" {
+		userName = entry.Email
+	}
+	newUser := models.User{
+		UserName:       userName,
+		Password:       string(hash),
+		Active:         true,
+		Email:          entry.Email,
+		Lan:            entry.Lan,
+		GroupId:        groupID,
+		CompanyId:      l.Config.CompanyID,
+		ProfileId:      l.Config.ProfileID,
+		ActivationTime: time.Now().Unix(),
+	}
+	newUser.ID, err = l.DB.InsertUser(newUser)
+	if err != nil {
+		return nil, err
+	}
+	return &newUser, nil
+}
@@ -0,0 +1,281 @@
+// Package ldaptest provides an in-process LDAP directory to test the LDAP authenticator.
+// It only speaks the part of LDAPv3 the authenticator uses: simple binds, searches with
+// and, or, not, equality and presence filters, and unbinds.
+package ldaptest
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// LDAP protocol operations, as application tags.
+const (
+	opBindRequest      = 0
+	opBindResponse     = 1
+	opUnbindRequest    = 2
+	opSearchRequest    = 3
+	opSearchResultItem = 4
+	opSearchResultDone = 5
+)
+
+// LDAP result codes.
+const (
+	resultSuccess            = 0
+	resultProtocolError      = 2
+	resultNoSuchObject       = 32
+	resultInvalidCredentials = 49
+	resultInsufficientAccess = 50
+)
+
+// Search scopes.
+const (
+	scopeBaseObject   = 0
+	scopeSingleLevel  = 1
+	scopeWholeSubtree = 2
+)
+
+// Search filter choices, as context tags.
+const (
+	filterAnd           = 0
+	filterOr            = 1
+	filterNot           = 2
+	filterEqualityMatch = 3
+	filterPresent       = 7
+)
+
+// Entry is an entry of the directory. Password is the userPassword of the entry,
+// entries without one cannot bind.
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Server is a directory listening on a local port.
+type Server struct {
+	listener net.Listener
+	entries  []Entry
+
+	mu    sync.Mutex
+	binds []string
+}
+
+// NewServer starts a directory holding the given entries.
+func NewServer(entries ...Entry) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{listener: listener, entries: entries}
+	go s.serve()
+	return s, nil
+}
+
+// URL returns the ldap:// address of the directory.
+func (s *Server) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// Close stops the directory.
+func (s *Server) Close() {
+	s.listener.Close()
+}
+
+// Binds returns the DNs of the successful binds, in order.
+func (s *Server) Binds() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.binds...)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle answers the requests of one connection until it is unbound or closed.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	bound := false
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case opBindRequest:
+			code := s.bind(op)
+			bound = code == resultSuccess && len(op.Children) > 2 && op.Children[2].Data.Len() > 0
+			s.reply(conn, messageID, result(opBindResponse, code))
+		case opSearchRequest:
+			if !bound {
+				s.reply(conn, messageID, result(opSearchResultDone, resultInsufficientAccess))
+				continue
+			}
+			s.search(conn, messageID, op)
+		case opUnbindRequest:
+			return
+		default:
+			s.reply(conn, messageID, result(opSearchResultDone, resultProtocolError))
+		}
+	}
+}
+
+// bind checks a simple bind. An empty password is an anonymous bind, which succeeds
+// like in most directories, but gives no right to search.
+func (s *Server) bind(op *ber.Packet) int {
+	if len(op.Children) < 3 {
+		return resultProtocolError
+	}
+	dn, _ := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+	if password == "" {
+		return resultSuccess
+	}
+
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.DN, dn) && entry.Password != "" && entry.Password == password {
+			s.mu.Lock()
+			s.binds = append(s.binds, entry.DN)
+			s.mu.Unlock()
+			return resultSuccess
+		}
+	}
+	return resultInvalidCredentials
+}
+
+// search sends the entries under the base object matching the filter.
+func (s *Server) search(conn net.Conn, messageID any, op *ber.Packet) {
+	if len(op.Children) < 8 {
+		s.reply(conn, messageID, result(opSearchResultDone, resultProtocolError))
+		return
+	}
+	base, _ := op.Children[0].Value.(string)
+	scope, _ := op.Children[1].Value.(int64)
+	filter := op.Children[6]
+
+	// the base exists when an entry is at or under it, the directory holds no entries for the containers
+	baseFound := base == ""
+	var matches []Entry
+	for _, entry := range s.entries {
+		if inScope(entry.DN, base, scopeWholeSubtree) {
+			baseFound = true
+		}
+		if !inScope(entry.DN, base, scope) || !matchFilter(entry, filter) {
+			continue
+		}
+		matches = append(matches, entry)
+	}
+	if !baseFound {
+		s.reply(conn, messageID, result(opSearchResultDone, resultNoSuchObject))
+		return
+	}
+
+	for _, entry := range matches {
+		item := ber.Encode(ber.ClassApplication, ber.TypeConstructed, opSearchResultItem, nil, "Search Result Entry")
+		item.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "DN"))
+		attributes := ber.NewSequence("Attributes")
+		for name, values := range entry.Attributes {
+			attribute := ber.NewSequence("Attribute")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, value := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+			}
+			attribute.AppendChild(set)
+			attributes.AppendChild(attribute)
+		}
+		item.AppendChild(attributes)
+		s.reply(conn, messageID, item)
+	}
+	s.reply(conn, messageID, result(opSearchResultDone, resultSuccess))
+}
+
+// inScope tells whether dn is in the scope of a search from base.
+func inScope(dn, base string, scope int64) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+	switch scope {
+	case scopeBaseObject:
+		return dn == base
+	case scopeSingleLevel:
+		parent := dn[strings.Index(dn, ",")+1:]
+		return parent == base
+	}
+	return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+}
+
+// matchFilter evaluates a search filter against an entry.
+func matchFilter(entry Entry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case filterAnd:
+		for _, child := range filter.Children {
+			if !matchFilter(entry, child) {
+				return false
+			}
+		}
+		return true
+	case filterOr:
+		for _, child := range filter.Children {
+			if matchFilter(entry, child) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return len(filter.Children) == 1 && !matchFilter(entry, filter.Children[0])
+	case filterEqualityMatch:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		name := filter.Children[0].Data.String()
+		value := filter.Children[1].Data.String()
+		for _, v := range attributeValues(entry, name) {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+	case filterPresent:
+		name := filter.Data.String()
+		return strings.EqualFold(name, "objectClass") || len(attributeValues(entry, name)) > 0
+	}
+	return false
+}
+
+func attributeValues(entry Entry, name string) []string {
+	for attribute, values := range entry.Attributes {
+		if strings.EqualFold(attribute, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// result builds an LDAPResult of the given operation.
+func result(op ber.Tag, code int) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, op, nil, "Result")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return packet
+}
+
+// reply sends an operation in an LDAP message answering messageID.
+func (s *Server) reply(conn net.Conn, messageID any, op *ber.Packet) {
+	message := ber.NewSequence("LDAP Response")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	message.AppendChild(op)
+	_, _ = conn.Write(message.Bytes())
+}
@@ -0,0 +1,55 @@
+// Package csrf protects the endpoints authenticated by a cookie against cross-site request forgery.
+// The token is derived from the session cookie with an HMAC, a signed double-submit token:
+// the server hands it out at login, in the answer and in a cookie the frontend can read, and the
+// frontend sends it back in the X-CSRF-Token header, which a page of another site cannot do.
+// The token changes with the session cookie, so it does not outlive the session.
+package csrf
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// HeaderName is the header the frontend sends the token in.
+const HeaderName = "X-CSRF-Token"
+
+// CookieName is the cookie the frontend reads the token from.
+const CookieName = "csrf_token"
+
+var (
+	// ErrMissing is returned for a request without a token.
+	ErrMissing = errors.New("missing CSRF token")
+	// ErrInvalid is returned for a request with a token of another session.
+	ErrInvalid = errors.New("invalid CSRF token")
+)
+
+// Token returns the CSRF token of a session.
+func Token(secret, session string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("csrf:" + session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Check verifies the token sent with a request of a session.
+func Check(r *http.Request, secret, session string) error {
+	token := r.Header.Get(HeaderName)
+	if token == "" {
+		return ErrMissing
+	}
+	if !hmac.Equal([]byte(token), []byte(Token(secret, session))) {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// SafeMethod tells whether a method does not change state, those requests are not checked.
+func SafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+package csrf_test
+
+import (
+	"authserver-backend/internal/csrf"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCheck tests the tokens accepted for a session.
+func TestCheck(t *testing.T) {
+	token := csrf.Token("secret", "session-a")
+	assert.NotEqual(t, token, csrf.Token("secret", "session-b"))
+	assert.NotEqual(t, token, csrf.Token("other-secret", "session-a"))
+
+	req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	assert.ErrorIs(t, csrf.Check(req, "secret", "session-a"), csrf.ErrMissing)
+
+	req.Header.Set(csrf.HeaderName, token)
+	assert.NoError(t, csrf.Check(req, "secret", "session-a"))
+	assert.ErrorIs(t, csrf.Check(req, "secret", "session-b"), csrf.ErrInvalid)
+}
+
+// TestSafeMethod tests the methods that are not checked.
+func TestSafeMethod(t *testing.T) {
+	assert.True(t, csrf.SafeMethod(http.MethodGet))
+	assert.True(t, csrf.SafeMethod(http.MethodOptions))
+	assert.False(t, csrf.SafeMethod(http.MethodPost))
+	assert.False(t, csrf.SafeMethod(http.MethodDelete))
+}
@@ -0,0 +1,38 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// The entitlements of the users to the catalogue apps are stored in:
+//
+//	app_grants(id, user_id, app_id, roles text[], created, updated)
+
+// GetAppGrant returns the grant a user has on a catalogue app.
+func (m *PostgresDBRepo) GetAppGrant(userID, appID int) (*models.AppGrant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, app_id, roles, created, updated
+    from app_grants where user_id = $1 and app_id = $2`
+
+	var grant models.AppGrant
+	err := m.DB.QueryRowContext(ctx, query, userID, appID).Scan(
+		&grant.ID,
+		&grant.UserID,
+		&grant.AppID,
+		&grant.Roles,
+		&grant.Created,
+		&grant.Updated,
+	)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("user %d has no grant on app %d", userID, appID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
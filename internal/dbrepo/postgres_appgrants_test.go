@@ -0,0 +1,45 @@
+package dbrepo_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetAppGrant(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	now := 160000000 // Simulated timestamp for testing
+	row := sqlmock.NewRows([]string{
+		"id", "user_id", "app_id", "roles", "created", "updated",
+	}).AddRow(
+		1, 2, 7, "{viewer,editor}", now, now,
+	)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`select id, user_id, app_id, roles, created, updated
+	from app_grants where user_id = $1 and app_id = $2`)).
+		WithArgs(2, 7).WillReturnRows(row)
+
+	grant, err := repo.GetAppGrant(2, 7)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if grant.AppID != 7 || len(grant.Roles) != 2 || grant.Roles[1] != "editor" {
+		t.Errorf("unexpected grant data: %+v", grant)
+	}
+}
+
+func TestGetAppGrant_NotFound(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery("select(.|\\s)*from app_grants").
+		WithArgs(2, 8).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	_, err := repo.GetAppGrant(2, 8)
+	if err == nil {
+		t.Error("expected error for missing grant, got nil")
+	}
+}
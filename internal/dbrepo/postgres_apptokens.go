@@ -0,0 +1,63 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The token settings and client secrets of the catalogue apps are stored with them, in:
+//
+//	apps.token_settings jsonb
+//	apps.client_secret_hash text
+//
+// client_secret_hash is the hash of the secret an app authenticates with on the server-to-server
+// routes, null until an admin sets one.
+
+// UpdateAppTokenSettings replaces the token settings of an app. An unknown app is reported as a wrapped sql.ErrNoRows.
+func (m *PostgresDBRepo) UpdateAppTokenSettings(appID int, settings models.AppTokenSettings) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update apps set token_settings = $1, updated = $2 where id = $3`
+	result, err := m.DB.ExecContext(ctx, stmt, settings, time.Now().Unix(), appID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("app %d not found: %w", appID, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// SetAppClientSecret replaces the hash of the client secret of an app. An unknown app is reported as a wrapped sql.ErrNoRows.
+func (m *PostgresDBRepo) SetAppClientSecret(appID int, secretHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update apps set client_secret_hash = $1, updated = $2 where id = $3`
+	result, err := m.DB.ExecContext(ctx, stmt, secretHash, time.Now().Unix(), appID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("app %d not found: %w", appID, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// GetAppClientSecret returns the hash of the client secret of an app, empty when it has none.
+func (m *PostgresDBRepo) GetAppClientSecret(appID int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `select coalesce(client_secret_hash, '') from apps where id = $1`
+
+	var secretHash string
+	if err := m.DB.QueryRowContext(ctx, stmt, appID).Scan(&secretHash); err != nil {
+		return "", err
+	}
+	return secretHash, nil
+}
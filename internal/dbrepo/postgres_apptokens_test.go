@@ -0,0 +1,59 @@
+package dbrepo_test
+
+import (
+	"authserver-backend/internal/models"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUpdateAppTokenSettings(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	stmt := regexp.QuoteMeta(`update apps set token_settings = $1, updated = $2 where id = $3`)
+	settings := models.AppTokenSettings{AccessExpiry: 300, Claims: []string{models.AppClaimLan}}
+	mock.ExpectExec(stmt).WithArgs(`{"access_expiry":300,"claims":["lan"]}`, sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(stmt).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 8).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := repo.UpdateAppTokenSettings(7, settings); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.UpdateAppTokenSettings(8, settings); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected sql.ErrNoRows for an unknown app, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestAppClientSecret(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`update apps set client_secret_hash = $1, updated = $2 where id = $3`)).
+		WithArgs("hash", sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`select coalesce(client_secret_hash, '') from apps where id = $1`)).
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"client_secret_hash"}).AddRow("hash"))
+
+	if err := repo.SetAppClientSecret(7, "hash"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secretHash, err := repo.GetAppClientSecret(7)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secretHash != "hash" {
+		t.Errorf("expected the stored hash, got %q", secretHash)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,371 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/audit"
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// The authentication events are appended to:
+//
+//	login_events(id serial primary key, user_id, login, event, success, method, reason,
+//	             ip, user_agent, created, prev_hash text not null default '', hash text not null default '')
+//
+// with indexes on (user_id, created), (login, created) and (created), and the admin actions to:
+//
+//	admin_events(id serial primary key, actor_id, actor_email, action, entity_type, entity_id,
+//	             diff jsonb, ip, created, prev_hash text not null default '', hash text not null default '')
+//
+// with indexes on (actor_id, created), (entity_type, entity_id) and (created). Both are hash chains,
+// whose signed checkpoints are kept in:
+//
+//	audit_checkpoints(id serial primary key, log, event_id, hash, signature, created)
+
+const loginEventColumns = `id, user_id, login, event, success, method, reason, ip, user_agent, created, prev_hash, hash`
+
+const adminEventColumns = `id, actor_id, actor_email, action, entity_type, entity_id, diff, ip, created, prev_hash, hash`
+
+// auditTables are the tables of the hash-chained audit logs.
+var auditTables = map[string]string{
+	models.AuditLogLogins: "login_events",
+	models.AuditLogAdmin:  "admin_events",
+}
+
+// auditTable returns the table of an audit log.
+func auditTable(log string) (string, error) {
+	table, ok := auditTables[log]
+	if !ok {
+		return "", fmt.Errorf("unknown audit log %q", log)
+	}
+	return table, nil
+}
+
+// whereClause builds the where clause of a query from optional conditions,
+// each condition holding a %d for the number of its argument.
+type whereClause struct {
+	conditions []string
+	args       []any
+}
+
+func (w *whereClause) add(condition string, arg any) {
+	w.args = append(w.args, arg)
+	w.conditions = append(w.conditions, fmt.Sprintf(condition, len(w.args)))
+}
+
+// String returns the where clause, empty without conditions.
+func (w *whereClause) String() string {
+	if len(w.conditions) == 0 {
+		return ""
+	}
+	return " where " + strings.Join(w.conditions, " and ")
+}
+
+// insertChained appends a record to a hash-chained table in one transaction. The head of the chain is
+// locked against concurrent appends with a transaction-level advisory lock, so the record is chained to
+// the last one without blocking the readers of the table, and insert stores the record with the hash of
+// the last one and its own.
+func (m *PostgresDBRepo) insertChained(table string, record any, insert func(ctx context.Context, tx *sql.Tx, prevHash, hash string) (int, error)) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock(hashtext($1))`, "audit_chain:"+table); err != nil {
+		return 0, err
+	}
+	var prevHash string
+	err = tx.QueryRowContext(ctx, `select hash from `+table+` order by id desc limit 1`).Scan(&prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	hash, err := audit.Hash(prevHash, record)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := insert(ctx, tx, prevHash, hash)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// InsertLoginEvent appends an event to the login audit trail and returns its id.
+func (m *PostgresDBRepo) InsertLoginEvent(event models.LoginEvent) (int, error) {
+	return m.insertChained("login_events", event, func(ctx context.Context, tx *sql.Tx, prevHash, hash string) (int, error) {
+		stmt := `insert into login_events (user_id, login, event, success, method, reason, ip, user_agent, created, prev_hash, hash)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`
+
+		var id int
+		err := tx.QueryRowContext(ctx, stmt, event.UserID, event.Login, event.Event, event.Success,
+			event.Method, event.Reason, event.IP, event.UserAgent, event.Created, prevHash, hash).Scan(&id)
+		return id, err
+	})
+}
+
+// LoginEvents returns a page of the login events selected by the filter, newest first,
+// and how many events the filter selects in all.
+func (m *PostgresDBRepo) LoginEvents(filter models.LoginEventFilter) ([]*models.LoginEvent, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var where whereClause
+	if filter.UserID != 0 {
+		where.add("user_id = $%d", filter.UserID)
+	}
+	if filter.Login != "" {
+		where.add("lower(login) = lower($%d)", filter.Login)
+	}
+	if filter.Event != "" {
+		where.add("event = $%d", filter.Event)
+	}
+	if filter.Success != nil {
+		where.add("success = $%d", *filter.Success)
+	}
+	if filter.IP != "" {
+		where.add("ip = $%d", filter.IP)
+	}
+	if filter.Since != 0 {
+		where.add("created >= $%d", filter.Since)
+	}
+	if filter.Until != 0 {
+		where.add("created <= $%d", filter.Until)
+	}
+	clause, args := where.String(), where.args
+
+	var total int
+	if err := m.DB.QueryRowContext(ctx, `select count(*) from login_events`+clause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `select ` + loginEventColumns + ` from login_events` + clause +
+		fmt.Sprintf(` order by created desc, id desc limit $%d offset $%d`, len(args)+1, len(args)+2)
+	rows, err := m.DB.QueryContext(ctx, query, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	events, err := scanLoginEvents(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+// LoginEventsAfter returns the login events after an id, in id order, at most limit of them.
+func (m *PostgresDBRepo) LoginEventsAfter(afterID, limit int) ([]*models.LoginEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + loginEventColumns + ` from login_events where id > $1 order by id limit $2`
+	rows, err := m.DB.QueryContext(ctx, query, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanLoginEvents(rows)
+}
+
+func scanLoginEvents(rows *sql.Rows) ([]*models.LoginEvent, error) {
+	var events []*models.LoginEvent
+	for rows.Next() {
+		var event models.LoginEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.UserID,
+			&event.Login,
+			&event.Event,
+			&event.Success,
+			&event.Method,
+			&event.Reason,
+			&event.IP,
+			&event.UserAgent,
+			&event.Created,
+			&event.PrevHash,
+			&event.Hash,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, rows.Err()
+}
+
+// InsertAdminEvent appends an admin action to the admin audit log and returns its id.
+func (m *PostgresDBRepo) InsertAdminEvent(event models.AdminEvent) (int, error) {
+	return m.insertChained("admin_events", event, func(ctx context.Context, tx *sql.Tx, prevHash, hash string) (int, error) {
+		stmt := `insert into admin_events (actor_id, actor_email, action, entity_type, entity_id, diff, ip, created, prev_hash, hash)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id`
+
+		var id int
+		err := tx.QueryRowContext(ctx, stmt, event.ActorID, event.ActorEmail, event.Action, event.EntityType,
+			event.EntityID, []byte(event.Diff), event.IP, event.Created, prevHash, hash).Scan(&id)
+		return id, err
+	})
+}
+
+// AdminEvents returns the admin actions selected by the filter, newest first, a page of them when
+// filter.Limit is set, and how many actions the filter selects in all.
+func (m *PostgresDBRepo) AdminEvents(filter models.AdminEventFilter) ([]*models.AdminEvent, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var where whereClause
+	if filter.ActorID != 0 {
+		where.add("actor_id = $%d", filter.ActorID)
+	}
+	if filter.Action != "" {
+		where.add("action = $%d", filter.Action)
+	}
+	if filter.EntityType != "" {
+		where.add("entity_type = $%d", filter.EntityType)
+	}
+	if filter.EntityID != 0 {
+		where.add("entity_id = $%d", filter.EntityID)
+	}
+	if filter.Since != 0 {
+		where.add("created >= $%d", filter.Since)
+	}
+	if filter.Until != 0 {
+		where.add("created <= $%d", filter.Until)
+	}
+	clause, args := where.String(), where.args
+
+	var total int
+	if err := m.DB.QueryRowContext(ctx, `select count(*) from admin_events`+clause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `select ` + adminEventColumns + ` from admin_events` + clause + ` order by created desc, id desc`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(` limit $%d offset $%d`, len(args)+1, len(args)+2)
+		args = append(args, filter.Limit, filter.Offset)
+	}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	events, err := scanAdminEvents(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+// AdminEventsAfter returns the admin actions after an id, in id order, at most limit of them.
+func (m *PostgresDBRepo) AdminEventsAfter(afterID, limit int) ([]*models.AdminEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + adminEventColumns + ` from admin_events where id > $1 order by id limit $2`
+	rows, err := m.DB.QueryContext(ctx, query, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAdminEvents(rows)
+}
+
+func scanAdminEvents(rows *sql.Rows) ([]*models.AdminEvent, error) {
+	var events []*models.AdminEvent
+	for rows.Next() {
+		var event models.AdminEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.ActorID,
+			&event.ActorEmail,
+			&event.Action,
+			&event.EntityType,
+			&event.EntityID,
+			&event.Diff,
+			&event.IP,
+			&event.Created,
+			&event.PrevHash,
+			&event.Hash,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, rows.Err()
+}
+
+// AuditHead returns the id and the hash of the last record of an audit log, 0 and an empty hash
+// when the log is empty.
+func (m *PostgresDBRepo) AuditHead(log string) (int, string, error) {
+	table, err := auditTable(log)
+	if err != nil {
+		return 0, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var id int
+	var hash string
+	err = m.DB.QueryRowContext(ctx, `select id, hash from `+table+` order by id desc limit 1`).Scan(&id, &hash)
+	if err == sql.ErrNoRows {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	return id, hash, nil
+}
+
+// InsertAuditCheckpoint stores a signed checkpoint of an audit log and returns its id.
+func (m *PostgresDBRepo) InsertAuditCheckpoint(cp models.AuditCheckpoint) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into audit_checkpoints (log, event_id, hash, signature, created)
+		values ($1, $2, $3, $4, $5) returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt, cp.Log, cp.EventID, cp.Hash, cp.Signature, cp.Created).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// AuditCheckpoints returns the checkpoints of an audit log in the order of their records.
+func (m *PostgresDBRepo) AuditCheckpoints(log string) ([]*models.AuditCheckpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, log, event_id, hash, signature, created from audit_checkpoints
+		where log = $1 order by event_id, id`
+	rows, err := m.DB.QueryContext(ctx, query, log)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkpoints []*models.AuditCheckpoint
+	for rows.Next() {
+		var cp models.AuditCheckpoint
+		if err := rows.Scan(&cp.ID, &cp.Log, &cp.EventID, &cp.Hash, &cp.Signature, &cp.Created); err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, &cp)
+	}
+	return checkpoints, rows.Err()
+}
@@ -0,0 +1,248 @@
+package dbrepo_test
+
+import (
+	"authserver-backend/internal/audit"
+	"authserver-backend/internal/models"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var loginEventRow = []string{
+	"id", "user_id", "login", "event", "success", "method", "reason", "ip", "user_agent", "created", "prev_hash", "hash",
+}
+
+// TestInsertLoginEvent tests that an event is chained to the last one of the trail.
+func TestInsertLoginEvent(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	event := models.LoginEvent{
+		UserID:    1,
+		Login:     "user@example.com",
+		Event:     models.LoginEventLogin,
+		Method:    "pwd",
+		Reason:    "invalid_password",
+		IP:        "10.0.0.1",
+		UserAgent: "curl/8.0",
+		Created:   170000000,
+	}
+	hash, _ := audit.Hash("prev", event)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`select pg_advisory_xact_lock(hashtext($1))`)).WithArgs("audit_chain:login_events").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`select hash from login_events order by id desc limit 1`)).
+		WillReturnRows(sqlmock.NewRows([]string{"hash"}).AddRow("prev"))
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into login_events (user_id, login, event, success, method, reason, ip, user_agent, created, prev_hash, hash)`)).
+		WithArgs(1, "user@example.com", "login", false, "pwd", "invalid_password", "10.0.0.1", "curl/8.0", int64(170000000), "prev", hash).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+	mock.ExpectCommit()
+
+	id, err := repo.InsertLoginEvent(event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != 9 {
+		t.Errorf("expected id 9, got %d", id)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoginEvents(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	failed := false
+	mock.ExpectQuery(regexp.QuoteMeta(`select count(*) from login_events where user_id = $1 and success = $2 and created >= $3`)).
+		WithArgs(1, false, int64(160000000)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(regexp.QuoteMeta(`from login_events where user_id = $1 and success = $2 and created >= $3 order by created desc, id desc limit $4 offset $5`)).
+		WithArgs(1, false, int64(160000000), 2, 2).
+		WillReturnRows(sqlmock.NewRows(loginEventRow).
+			AddRow(4, 1, "user@example.com", "login", false, "pwd", "invalid_password", "10.0.0.1", "curl/8.0", 170000000, "", "h4"))
+
+	events, total, err := repo.LoginEvents(models.LoginEventFilter{UserID: 1, Success: &failed, Since: 160000000, Limit: 2, Offset: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total != 3 || len(events) != 1 || events[0].Reason != "invalid_password" {
+		t.Errorf("unexpected events: %d %+v", total, events)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoginEvents_NoFilter(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`select count(*) from login_events`)).WithArgs().
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(regexp.QuoteMeta(`from login_events order by created desc, id desc limit $1 offset $2`)).
+		WithArgs(50, 0).
+		WillReturnRows(sqlmock.NewRows(loginEventRow))
+
+	events, total, err := repo.LoginEvents(models.LoginEventFilter{Limit: 50})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total != 0 || len(events) != 0 {
+		t.Errorf("unexpected events: %d %+v", total, events)
+	}
+}
+
+var adminEventRow = []string{
+	"id", "actor_id", "actor_email", "action", "entity_type", "entity_id", "diff", "ip", "created", "prev_hash", "hash",
+}
+
+// TestInsertAdminEvent tests that the first action of the log is chained to an empty hash.
+func TestInsertAdminEvent(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	diff := []byte(`{"title":{"old":"Billing","new":"Billing 2"}}`)
+	event := models.AdminEvent{
+		ActorID:    1,
+		ActorEmail: "admin@example.com",
+		Action:     models.AdminActionUpdate,
+		EntityType: "app",
+		EntityID:   7,
+		Diff:       diff,
+		IP:         "10.0.0.1",
+		Created:    170000000,
+	}
+	hash, _ := audit.Hash("", event)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`select pg_advisory_xact_lock(hashtext($1))`)).WithArgs("audit_chain:admin_events").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`select hash from admin_events order by id desc limit 1`)).
+		WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into admin_events (actor_id, actor_email, action, entity_type, entity_id, diff, ip, created, prev_hash, hash)`)).
+		WithArgs(1, "admin@example.com", "update", "app", 7, diff, "10.0.0.1", int64(170000000), "", hash).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectCommit()
+
+	id, err := repo.InsertAdminEvent(event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != 3 {
+		t.Errorf("expected id 3, got %d", id)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAdminEvents(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`select count(*) from admin_events where entity_type = $1 and entity_id = $2`)).
+		WithArgs("app", 7).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta(`from admin_events where entity_type = $1 and entity_id = $2 order by created desc, id desc limit $3 offset $4`)).
+		WithArgs("app", 7, 50, 0).
+		WillReturnRows(sqlmock.NewRows(adminEventRow).
+			AddRow(3, 1, "admin@example.com", "delete", "app", 7, []byte(`{"name":{"old":"billing"}}`), "10.0.0.1", 170000000, "", "h3"))
+
+	events, total, err := repo.AdminEvents(models.AdminEventFilter{EntityType: "app", EntityID: 7, Limit: 50})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total != 1 || len(events) != 1 || string(events[0].Diff) != `{"name":{"old":"billing"}}` {
+		t.Errorf("unexpected events: %d %+v", total, events)
+	}
+}
+
+// TestAdminEvents_All tests that every action is selected without a limit, for the exports.
+func TestAdminEvents_All(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`select count(*) from admin_events where actor_id = $1`)).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(regexp.QuoteMeta(`from admin_events where actor_id = $1 order by created desc, id desc`)).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(adminEventRow))
+
+	if _, _, err := repo.AdminEvents(models.AdminEventFilter{ActorID: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoginEventsAfter(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`from login_events where id > $1 order by id limit $2`)).
+		WithArgs(4, 1000).
+		WillReturnRows(sqlmock.NewRows(loginEventRow).
+			AddRow(5, 1, "user@example.com", "login", true, "pwd", "", "10.0.0.1", "curl/8.0", 170000000, "h4", "h5"))
+
+	events, err := repo.LoginEventsAfter(4, 1000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 1 || events[0].PrevHash != "h4" || events[0].Hash != "h5" {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
+
+func TestAuditHead(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`select id, hash from admin_events order by id desc limit 1`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hash"}).AddRow(12, "h12"))
+	mock.ExpectQuery(regexp.QuoteMeta(`select id, hash from login_events order by id desc limit 1`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hash"}))
+
+	id, hash, err := repo.AuditHead(models.AuditLogAdmin)
+	if err != nil || id != 12 || hash != "h12" {
+		t.Errorf("unexpected head: %d %q %v", id, hash, err)
+	}
+	id, hash, err = repo.AuditHead(models.AuditLogLogins)
+	if err != nil || id != 0 || hash != "" {
+		t.Errorf("unexpected head of an empty log: %d %q %v", id, hash, err)
+	}
+	if _, _, err := repo.AuditHead("users"); err == nil {
+		t.Error("expected an error for an unknown log")
+	}
+}
+
+func TestAuditCheckpoints(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into audit_checkpoints (log, event_id, hash, signature, created)`)).
+		WithArgs("admin", 12, "h12", "c2ln", int64(170000000)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectQuery(regexp.QuoteMeta(`from audit_checkpoints
+		where log = $1 order by event_id, id`)).
+		WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "log", "event_id", "hash", "signature", "created"}).
+			AddRow(2, "admin", 12, "h12", "c2ln", 170000000))
+
+	id, err := repo.InsertAuditCheckpoint(models.AuditCheckpoint{Log: "admin", EventID: 12, Hash: "h12", Signature: "c2ln", Created: 170000000})
+	if err != nil || id != 2 {
+		t.Fatalf("unexpected result: %d %v", id, err)
+	}
+	checkpoints, err := repo.AuditCheckpoints(models.AuditLogAdmin)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(checkpoints) != 1 || checkpoints[0].EventID != 12 {
+		t.Errorf("unexpected checkpoints: %+v", checkpoints)
+	}
+}
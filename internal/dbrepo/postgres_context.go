@@ -0,0 +1,33 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+)
+
+// The companies a user belongs to besides users.company_id are stored in:
+//
+//	user_companies(user_id, company_id, primary key (user_id, company_id))
+
+// UserInCompany tells whether a user belongs to a company, their own or one of user_companies.
+func (m *PostgresDBRepo) UserInCompany(userID, companyID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select exists (select 1 from users where id = $1 and company_id = $2)
+		or exists (select 1 from user_companies where user_id = $1 and company_id = $2)`
+
+	var member bool
+	err := m.DB.QueryRowContext(ctx, query, userID, companyID).Scan(&member)
+	return member, err
+}
+
+// UpdateUserContext records the database and app a user last worked in, for their next login.
+func (m *PostgresDBRepo) UpdateUserContext(userID, lastDb, lastApp int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set last_db = $1, last_app = $2, updated = $3 where id = $4`
+	_, err := m.DB.ExecContext(ctx, stmt, lastDb, lastApp, time.Now().Unix(), userID)
+	return err
+}
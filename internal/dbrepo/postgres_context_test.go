@@ -0,0 +1,41 @@
+package dbrepo_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUserInCompany(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	query := regexp.QuoteMeta(`or exists (select 1 from user_companies where user_id = $1 and company_id = $2)`)
+	mock.ExpectQuery(query).WithArgs(2, 3).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(query).WithArgs(2, 4).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	member, err := repo.UserInCompany(2, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !member {
+		t.Error("expected user 2 to belong to company 3")
+	}
+	if member, _ := repo.UserInCompany(2, 4); member {
+		t.Error("expected user 2 not to belong to company 4")
+	}
+}
+
+func TestUpdateUserContext(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`update users set last_db = $1, last_app = $2, updated = $3 where id = $4`)).
+		WithArgs(5, 7, sqlmock.AnyArg(), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := repo.UpdateUserContext(2, 5, 7); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The dynamic credentials use two tables:
+//
+//	db_grants(id, user_id, db_id, db_name, schema_name, privileges text[], created, updated)
+//	db_credentials(id, user_id, grant_id, db_name, schema_name, role_name, expires_at, created)
+//
+// db_grants is maintained by the admins, db_credentials is only written by the server.
+// The roles themselves are created in the database the server is connected to,
+// so the table privileges of a grant apply to the schema of that database.
+
+// quoteIdent quotes a Postgres identifier (role, schema or database name).
+// DDL statements do not accept bind parameters, so identifiers have to be quoted by hand.
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// quoteLiteral quotes a Postgres string literal, like a role password.
+func quoteLiteral(s string) string {
+	return `'` + strings.ReplaceAll(s, `'`, `''`) + `'`
+}
+
+// ErrNoDBGrant is returned by GetDBGrant when the user has no grant on the database. It wraps sql.ErrNoRows.
+var ErrNoDBGrant = fmt.Errorf("no grant on the database: %w", sql.ErrNoRows)
+
+// GetDBGrant returns the grant a user has on a database, ErrNoDBGrant when there is none.
+func (m *PostgresDBRepo) GetDBGrant(userID, dbID int) (*models.DBGrant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, db_id, db_name, schema_name, privileges, created, updated
+    from db_grants where user_id = $1 and db_id = $2`
+
+	var grant models.DBGrant
+	err := m.DB.QueryRowContext(ctx, query, userID, dbID).Scan(
+		&grant.ID,
+		&grant.UserID,
+		&grant.DbID,
+		&grant.DbName,
+		&grant.Schema,
+		&grant.Privileges,
+		&grant.Created,
+		&grant.Updated,
+	)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("user %d has no grant on database %d: %w", userID, dbID, ErrNoDBGrant)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+// CreateDBCredential creates a login role with the privileges of the grant and records it,
+// so the reaper can drop it once it expires. The role is created with VALID UNTIL,
+// so Postgres itself refuses the password after expiresAt even if the reaper is late.
+// Everything runs in one transaction, a failing GRANT leaves no role behind.
+func (m *PostgresDBRepo) CreateDBCredential(grant models.DBGrant, role, password string, expiresAt int64) (*models.DBCredential, error) {
+	privileges, err := grant.TablePrivileges()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	validUntil := time.Unix(expiresAt, 0).UTC().Format(time.RFC3339)
+	stmts := []string{
+		`create role ` + quoteIdent(role) + ` with login password ` + quoteLiteral(password) + ` valid until ` + quoteLiteral(validUntil),
+		`grant connect on database ` + quoteIdent(grant.DbName) + ` to ` + quoteIdent(role),
+		`grant usage on schema ` + quoteIdent(grant.Schema) + ` to ` + quoteIdent(role),
+		`grant ` + strings.Join(privileges, ", ") + ` on all tables in schema ` + quoteIdent(grant.Schema) + ` to ` + quoteIdent(role),
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	cred := models.DBCredential{
+		UserID:    grant.UserID,
+		GrantID:   grant.ID,
+		DbName:    grant.DbName,
+		Schema:    grant.Schema,
+		Role:      role,
+		Password:  password,
+		ExpiresAt: expiresAt,
+		Created:   time.Now().Unix(),
+	}
+
+	stmt := `insert into db_credentials (user_id, grant_id, db_name, schema_name, role_name, expires_at, created)
+    values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	err = tx.QueryRowContext(ctx, stmt,
+		cred.UserID,
+		cred.GrantID,
+		cred.DbName,
+		cred.Schema,
+		cred.Role,
+		cred.ExpiresAt,
+		cred.Created,
+	).Scan(&cred.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+// ExpiredDBCredentials returns the dynamic credentials that expired at or before now.
+func (m *PostgresDBRepo) ExpiredDBCredentials(now int64) ([]*models.DBCredential, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, grant_id, db_name, schema_name, role_name, expires_at, created
+    from db_credentials where expires_at <= $1 order by expires_at`
+
+	rows, err := m.DB.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var creds []*models.DBCredential
+	for rows.Next() {
+		var cred models.DBCredential
+		err := rows.Scan(
+			&cred.ID,
+			&cred.UserID,
+			&cred.GrantID,
+			&cred.DbName,
+			&cred.Schema,
+			&cred.Role,
+			&cred.ExpiresAt,
+			&cred.Created,
+		)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, &cred)
+	}
+	return creds, rows.Err()
+}
+
+// RevokeDBCredential drops the role of a dynamic credential together with its privileges
+// and removes the credential record.
+func (m *PostgresDBRepo) RevokeDBCredential(cred models.DBCredential) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the role may have been dropped by hand already, then only the record is left to remove
+	var exists bool
+	err = tx.QueryRowContext(ctx, `select exists(select 1 from pg_roles where rolname = $1)`, cred.Role).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		stmts := []string{
+			`revoke all on all tables in schema ` + quoteIdent(cred.Schema) + ` from ` + quoteIdent(cred.Role),
+			`revoke usage on schema ` + quoteIdent(cred.Schema) + ` from ` + quoteIdent(cred.Role),
+			`revoke connect on database ` + quoteIdent(cred.DbName) + ` from ` + quoteIdent(cred.Role),
+			`drop role ` + quoteIdent(cred.Role),
+		}
+		for _, stmt := range stmts {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `delete from db_credentials where id = $1`, cred.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,196 @@
+package dbrepo_test
+
+import (
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/models"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestGetDBGrant(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	now := 160000000 // Simulated timestamp for testing
+	row := sqlmock.NewRows([]string{
+		"id", "user_id", "db_id", "db_name", "schema_name", "privileges", "created", "updated",
+	}).AddRow(
+		1, 2, 3, "sales", "public", "{SELECT,INSERT}", now, now,
+	)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`select id, user_id, db_id, db_name, schema_name, privileges, created, updated
+	from db_grants where user_id = $1 and db_id = $2`)).
+		WithArgs(2, 3).WillReturnRows(row)
+
+	grant, err := repo.GetDBGrant(2, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if grant.DbName != "sales" || len(grant.Privileges) != 2 {
+		t.Errorf("unexpected grant data: %+v", grant)
+	}
+}
+
+func TestGetDBGrant_NotFound(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery("select(.|\\s)*from db_grants").
+		WithArgs(2, 3).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	_, err := repo.GetDBGrant(2, 3)
+	if !errors.Is(err, dbrepo.ErrNoDBGrant) {
+		t.Errorf("expected ErrNoDBGrant for missing grant, got %v", err)
+	}
+}
+
+func TestCreateDBCredential(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	grant := models.DBGrant{ID: 1, UserID: 2, DbID: 3, DbName: "sales", Schema: "public", Privileges: pq.StringArray{"select", "insert"}}
+	expiresAt := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC).Unix()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`create role "dyn_2_abc" with login password 'pa''ss' valid until '2030-01-01T12:00:00Z'`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`grant connect on database "sales" to "dyn_2_abc"`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`grant usage on schema "public" to "dyn_2_abc"`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`grant SELECT, INSERT on all tables in schema "public" to "dyn_2_abc"`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into db_credentials (user_id, grant_id, db_name, schema_name, role_name, expires_at, created)
+	values ($1, $2, $3, $4, $5, $6, $7) returning id`)).
+		WithArgs(2, 1, "sales", "public", "dyn_2_abc", expiresAt, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectCommit()
+
+	cred, err := repo.CreateDBCredential(grant, "dyn_2_abc", "pa'ss", expiresAt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cred.ID != 7 || cred.Role != "dyn_2_abc" || cred.Password != "pa'ss" {
+		t.Errorf("unexpected credential data: %+v", cred)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestCreateDBCredential_GrantFails(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	grant := models.DBGrant{ID: 1, UserID: 2, DbName: "sales", Schema: "public", Privileges: pq.StringArray{"SELECT"}}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("create role").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("grant connect").WillReturnError(errors.New("database does not exist"))
+	mock.ExpectRollback()
+
+	_, err := repo.CreateDBCredential(grant, "dyn_2_abc", "secret", time.Now().Add(time.Hour).Unix())
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestCreateDBCredential_InvalidPrivilege(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	grant := models.DBGrant{ID: 1, UserID: 2, DbName: "sales", Schema: "public", Privileges: pq.StringArray{"SUPERUSER"}}
+
+	_, err := repo.CreateDBCredential(grant, "dyn_2_abc", "secret", time.Now().Add(time.Hour).Unix())
+	if err == nil {
+		t.Fatal("expected error for invalid privilege, got nil")
+	}
+	// nothing should have reached the database
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unexpected database calls: %v", err)
+	}
+}
+
+func TestExpiredDBCredentials(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	now := int64(160000000)
+	rows := sqlmock.NewRows([]string{
+		"id", "user_id", "grant_id", "db_name", "schema_name", "role_name", "expires_at", "created",
+	}).AddRow(
+		1, 2, 1, "sales", "public", "dyn_2_abc", now-10, now-3600,
+	).AddRow(
+		2, 3, 4, "hr", "public", "dyn_3_def", now, now-3600,
+	)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`select id, user_id, grant_id, db_name, schema_name, role_name, expires_at, created
+	from db_credentials where expires_at <= $1 order by expires_at`)).
+		WithArgs(now).WillReturnRows(rows)
+
+	creds, err := repo.ExpiredDBCredentials(now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(creds) != 2 || creds[1].Role != "dyn_3_def" {
+		t.Errorf("unexpected credentials: %+v", creds)
+	}
+}
+
+func TestRevokeDBCredential(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	cred := models.DBCredential{ID: 7, DbName: "sales", Schema: "public", Role: "dyn_2_abc"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`select exists(select 1 from pg_roles where rolname = $1)`)).
+		WithArgs("dyn_2_abc").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec(regexp.QuoteMeta(`revoke all on all tables in schema "public" from "dyn_2_abc"`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`revoke usage on schema "public" from "dyn_2_abc"`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`revoke connect on database "sales" from "dyn_2_abc"`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`drop role "dyn_2_abc"`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`delete from db_credentials where id = $1`)).
+		WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := repo.RevokeDBCredential(cred); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestRevokeDBCredential_RoleAlreadyDropped(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	cred := models.DBCredential{ID: 7, DbName: "sales", Schema: "public", Role: "dyn_2_abc"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("select exists").
+		WithArgs("dyn_2_abc").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(regexp.QuoteMeta(`delete from db_credentials where id = $1`)).
+		WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := repo.RevokeDBCredential(cred); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -86,7 +86,8 @@ const fields = `
     analyticsTools,
     keyMetrics,
     url,
-    landingPage
+    landingPage,
+    token_settings
 `
 
 // NewDatabase initializes a new database connection using the provided DSN (Data Source Name) and the PostgresDBRepo struct.
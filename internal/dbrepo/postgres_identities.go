@@ -0,0 +1,67 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The links between local users and upstream identity providers are stored in:
+//
+//	user_identities(id, user_id, provider, subject, email, created, updated), unique (provider, subject)
+
+// GetUserIdentity returns the link of an upstream account to a local user.
+func (m *PostgresDBRepo) GetUserIdentity(provider, subject string) (*models.UserIdentity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, provider, subject, email, created, updated
+    from user_identities where provider = $1 and subject = $2`
+
+	var identity models.UserIdentity
+	err := m.DB.QueryRowContext(ctx, query, provider, subject).Scan(
+		&identity.ID,
+		&identity.UserID,
+		&identity.Provider,
+		&identity.Subject,
+		&identity.Email,
+		&identity.Created,
+		&identity.Updated,
+	)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no user is linked to %s account %s", provider, subject)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// LinkUserIdentity links an upstream account to a local user. Linking the same account again
+// only refreshes its email, an upstream account is never linked to two users.
+func (m *PostgresDBRepo) LinkUserIdentity(identity models.UserIdentity) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now().Unix()
+	stmt := `insert into user_identities (user_id, provider, subject, email, created, updated)
+    values ($1, $2, $3, $4, $5, $6)
+    on conflict (provider, subject) do update set email = excluded.email, updated = excluded.updated
+    returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt,
+		identity.UserID,
+		identity.Provider,
+		identity.Subject,
+		identity.Email,
+		now,
+		now,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
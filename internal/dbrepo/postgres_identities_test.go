@@ -0,0 +1,66 @@
+package dbrepo_test
+
+import (
+	"authserver-backend/internal/models"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetUserIdentity(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	now := 160000000 // Simulated timestamp for testing
+	row := sqlmock.NewRows([]string{
+		"id", "user_id", "provider", "subject", "email", "created", "updated",
+	}).AddRow(
+		1, 2, "google", "10769150350006150715113082367", "user@example.com", now, now,
+	)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`select id, user_id, provider, subject, email, created, updated
+	from user_identities where provider = $1 and subject = $2`)).
+		WithArgs("google", "10769150350006150715113082367").WillReturnRows(row)
+
+	identity, err := repo.GetUserIdentity("google", "10769150350006150715113082367")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if identity.UserID != 2 {
+		t.Errorf("unexpected identity data: %+v", identity)
+	}
+}
+
+func TestGetUserIdentity_NotLinked(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery("select(.|\\s)*from user_identities").
+		WithArgs("google", "unknown").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	_, err := repo.GetUserIdentity("google", "unknown")
+	if err == nil {
+		t.Error("expected error for unlinked account, got nil")
+	}
+}
+
+func TestLinkUserIdentity(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into user_identities (user_id, provider, subject, email, created, updated)
+	values ($1, $2, $3, $4, $5, $6)
+	on conflict (provider, subject) do update set email = excluded.email, updated = excluded.updated
+	returning id`)).
+		WithArgs(2, "google", "sub", "user@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+
+	id, err := repo.LinkUserIdentity(models.UserIdentity{UserID: 2, Provider: "google", Subject: "sub", Email: "user@example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != 5 {
+		t.Errorf("expected id 5, got %d", id)
+	}
+}
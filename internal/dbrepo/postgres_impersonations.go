@@ -0,0 +1,70 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// The impersonations of users by the admins are stored in:
+//
+//	impersonations(id serial primary key, admin_id, admin_email, user_id, reason, started, expires, ended)
+
+// InsertImpersonation stores a new impersonation and returns its id.
+func (m *PostgresDBRepo) InsertImpersonation(imp models.Impersonation) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into impersonations (admin_id, admin_email, user_id, reason, started, expires, ended)
+		values ($1, $2, $3, $4, $5, $6, 0) returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt, imp.AdminID, imp.AdminEmail, imp.UserID, imp.Reason, imp.Started, imp.Expires).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetImpersonation returns an impersonation, stopped or not.
+func (m *PostgresDBRepo) GetImpersonation(id int) (*models.Impersonation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, admin_id, admin_email, user_id, reason, started, expires, ended from impersonations where id = $1`
+
+	var imp models.Impersonation
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&imp.ID,
+		&imp.AdminID,
+		&imp.AdminEmail,
+		&imp.UserID,
+		&imp.Reason,
+		&imp.Started,
+		&imp.Expires,
+		&imp.Ended,
+	)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("impersonation %d not found: %w", id, sql.ErrNoRows)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &imp, nil
+}
+
+// EndImpersonation stops an impersonation that was not stopped yet.
+func (m *PostgresDBRepo) EndImpersonation(id int, ended int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `update impersonations set ended = $1 where id = $2 and ended = 0`, ended, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("impersonation %d not found: %w", id, sql.ErrNoRows)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package dbrepo_test
+
+import (
+	"authserver-backend/internal/models"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestInsertImpersonation(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into impersonations (admin_id, admin_email, user_id, reason, started, expires, ended)`)).
+		WithArgs(1, "admin@example.com", 2, "ticket 42", int64(170000000), int64(170000900)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+
+	id, err := repo.InsertImpersonation(models.Impersonation{
+		AdminID:    1,
+		AdminEmail: "admin@example.com",
+		UserID:     2,
+		Reason:     "ticket 42",
+		Started:    170000000,
+		Expires:    170000900,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != 3 {
+		t.Errorf("expected id 3, got %d", id)
+	}
+}
+
+func TestGetImpersonation(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	columns := []string{"id", "admin_id", "admin_email", "user_id", "reason", "started", "expires", "ended"}
+	mock.ExpectQuery(regexp.QuoteMeta(`from impersonations where id = $1`)).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(3, 1, "admin@example.com", 2, "ticket 42", 170000000, 170000900, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`from impersonations where id = $1`)).
+		WithArgs(4).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	imp, err := repo.GetImpersonation(3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if imp.UserID != 2 || !imp.Active(170000000) || imp.Active(170000900) {
+		t.Errorf("unexpected impersonation: %+v", imp)
+	}
+	if _, err := repo.GetImpersonation(4); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+// TestEndImpersonation tests that an impersonation is only stopped once.
+func TestEndImpersonation(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	stmt := regexp.QuoteMeta(`update impersonations set ended = $1 where id = $2 and ended = 0`)
+	mock.ExpectExec(stmt).WithArgs(int64(170000100), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(stmt).WithArgs(int64(170000200), 3).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := repo.EndImpersonation(3, 170000100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.EndImpersonation(3, 170000200); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The launch codes are stored hashed in:
+//
+//	launch_codes(code_hash text primary key, user_id, app_id, impersonation_id, expires_at, created)
+//
+// impersonation_id is the impersonation the code was minted in, 0 when the user launched the app.
+
+// InsertLaunchCode stores a new launch code for a user and an app.
+// Codes that already expired are removed at the same time, so the table does not grow.
+func (m *PostgresDBRepo) InsertLaunchCode(codeHash string, userID, appID, impersonationID int, expiresAt int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now().Unix()
+	if _, err := m.DB.ExecContext(ctx, `delete from launch_codes where expires_at <= $1`, now); err != nil {
+		return err
+	}
+
+	stmt := `insert into launch_codes (code_hash, user_id, app_id, impersonation_id, expires_at, created) values ($1, $2, $3, $4, $5, $6)`
+	_, err := m.DB.ExecContext(ctx, stmt, codeHash, userID, appID, impersonationID, expiresAt, now)
+	return err
+}
+
+// ConsumeLaunchCode deletes a launch code and returns the user and the impersonation it was minted for.
+// The code is only accepted once, for the app it was minted for and before it expires.
+func (m *PostgresDBRepo) ConsumeLaunchCode(codeHash string, appID int, now int64) (int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from launch_codes where code_hash = $1 and app_id = $2 and expires_at > $3 returning user_id, impersonation_id`
+
+	var userID, impersonationID int
+	err := m.DB.QueryRowContext(ctx, stmt, codeHash, appID, now).Scan(&userID, &impersonationID)
+	if err == sql.ErrNoRows {
+		return 0, 0, errors.New("invalid or expired launch code")
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return userID, impersonationID, nil
+}
+
+// UpdateUserLastApp records the app a user launched last.
+func (m *PostgresDBRepo) UpdateUserLastApp(userID, appID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set last_app = $1, updated = $2 where id = $3`
+	_, err := m.DB.ExecContext(ctx, stmt, appID, time.Now().Unix(), userID)
+	return err
+}
@@ -0,0 +1,67 @@
+package dbrepo_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestInsertLaunchCode(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`delete from launch_codes where expires_at <= $1`)).
+		WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`insert into launch_codes (code_hash, user_id, app_id, impersonation_id, expires_at, created) values ($1, $2, $3, $4, $5, $6)`)).
+		WithArgs("hash", 1, 7, 0, int64(160000060), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := repo.InsertLaunchCode("hash", 1, 7, 0, 160000060); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestConsumeLaunchCode(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`delete from launch_codes where code_hash = $1 and app_id = $2 and expires_at > $3 returning user_id, impersonation_id`)).
+		WithArgs("hash", 7, int64(160000000)).WillReturnRows(sqlmock.NewRows([]string{"user_id", "impersonation_id"}).AddRow(1, 3))
+
+	userID, impersonationID, err := repo.ConsumeLaunchCode("hash", 7, 160000000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if userID != 1 || impersonationID != 3 {
+		t.Errorf("expected user 1 and impersonation 3, got %d and %d", userID, impersonationID)
+	}
+}
+
+func TestConsumeLaunchCode_Invalid(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	// a used, expired or foreign code matches no row
+	mock.ExpectQuery("delete from launch_codes").
+		WithArgs("hash", 8, int64(160000000)).WillReturnRows(sqlmock.NewRows([]string{"user_id", "impersonation_id"}))
+
+	_, _, err := repo.ConsumeLaunchCode("hash", 8, 160000000)
+	if err == nil {
+		t.Error("expected error for invalid code, got nil")
+	}
+}
+
+func TestUpdateUserLastApp(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`update users set last_app = $1, updated = $2 where id = $3`)).
+		WithArgs(7, sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := repo.UpdateUserLastApp(1, 7); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The pending passwordless logins are stored in:
+//
+//	magic_logins(id serial primary key, user_id, token_hash text unique, code_hash, browser_hash,
+//	             attempts int default 0, expires_at, created)
+
+// InsertMagicLogin stores a new passwordless login. It replaces the pending login of the same browser,
+// and the logins that already expired are removed at the same time, so the table does not grow.
+func (m *PostgresDBRepo) InsertMagicLogin(login models.MagicLogin) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now().Unix()
+	if _, err := m.DB.ExecContext(ctx, `delete from magic_logins where expires_at <= $1 or browser_hash = $2`, now, login.BrowserHash); err != nil {
+		return 0, err
+	}
+
+	stmt := `insert into magic_logins (user_id, token_hash, code_hash, browser_hash, attempts, expires_at, created)
+		values ($1, $2, $3, $4, 0, $5, $6) returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt, login.UserID, login.TokenHash, login.CodeHash, login.BrowserHash,
+		login.ExpiresAt, now).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// CountMagicLogins returns how many passwordless logins were asked for a user since a time.
+func (m *PostgresDBRepo) CountMagicLogins(userID int, since int64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, `select count(*) from magic_logins where user_id = $1 and created >= $2`,
+		userID, since).Scan(&count)
+	return count, err
+}
+
+// GetMagicLogin returns the pending passwordless login of a browser, if it has not expired.
+func (m *PostgresDBRepo) GetMagicLogin(browserHash string, now int64) (*models.MagicLogin, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, token_hash, code_hash, browser_hash, attempts, expires_at, created
+		from magic_logins where browser_hash = $1 and expires_at > $2`
+
+	var login models.MagicLogin
+	err := m.DB.QueryRowContext(ctx, query, browserHash, now).Scan(
+		&login.ID,
+		&login.UserID,
+		&login.TokenHash,
+		&login.CodeHash,
+		&login.BrowserHash,
+		&login.Attempts,
+		&login.ExpiresAt,
+		&login.Created,
+	)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no pending login for this browser")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
+
+// ConsumeMagicLogin deletes a passwordless login and returns its user. Only one caller
+// can consume a login, the others get an error.
+func (m *PostgresDBRepo) ConsumeMagicLogin(id int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var userID int
+	err := m.DB.QueryRowContext(ctx, `delete from magic_logins where id = $1 returning user_id`, id).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errors.New("login already used")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// FailMagicLogin counts a wrong link or code given for a passwordless login,
+// and deletes the login once maxAttempts is reached.
+func (m *PostgresDBRepo) FailMagicLogin(id, maxAttempts int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	if _, err := m.DB.ExecContext(ctx, `update magic_logins set attempts = attempts + 1 where id = $1`, id); err != nil {
+		return err
+	}
+	_, err := m.DB.ExecContext(ctx, `delete from magic_logins where id = $1 and attempts >= $2`, id, maxAttempts)
+	return err
+}
@@ -0,0 +1,124 @@
+package dbrepo_test
+
+import (
+	"authserver-backend/internal/models"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestInsertMagicLogin(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`delete from magic_logins where expires_at <= $1 or browser_hash = $2`)).
+		WithArgs(sqlmock.AnyArg(), "browser").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into magic_logins (user_id, token_hash, code_hash, browser_hash, attempts, expires_at, created)`)).
+		WithArgs(1, "token", "code", "browser", int64(160000900), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+
+	id, err := repo.InsertMagicLogin(models.MagicLogin{
+		UserID:      1,
+		TokenHash:   "token",
+		CodeHash:    "code",
+		BrowserHash: "browser",
+		ExpiresAt:   160000900,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != 3 {
+		t.Errorf("expected id 3, got %d", id)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestCountMagicLogins(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`select count(*) from magic_logins where user_id = $1 and created >= $2`)).
+		WithArgs(1, int64(160000000)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	count, err := repo.CountMagicLogins(1, 160000000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 logins, got %d", count)
+	}
+}
+
+func TestGetMagicLogin(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	row := sqlmock.NewRows([]string{
+		"id", "user_id", "token_hash", "code_hash", "browser_hash", "attempts", "expires_at", "created",
+	}).AddRow(3, 1, "token", "code", "browser", 1, 160000900, 160000000)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`from magic_logins where browser_hash = $1 and expires_at > $2`)).
+		WithArgs("browser", int64(160000100)).WillReturnRows(row)
+
+	login, err := repo.GetMagicLogin("browser", 160000100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if login.ID != 3 || login.UserID != 1 || login.Attempts != 1 || login.TokenHash != "token" {
+		t.Errorf("unexpected login data: %+v", login)
+	}
+}
+
+func TestGetMagicLogin_Expired(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery("from magic_logins").
+		WithArgs("browser", int64(160001000)).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	if _, err := repo.GetMagicLogin("browser", 160001000); err == nil {
+		t.Error("expected error for expired login, got nil")
+	}
+}
+
+func TestConsumeMagicLogin(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`delete from magic_logins where id = $1 returning user_id`)).
+		WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+	// the second call finds the login gone
+	mock.ExpectQuery(regexp.QuoteMeta(`delete from magic_logins where id = $1 returning user_id`)).
+		WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+
+	userID, err := repo.ConsumeMagicLogin(3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if userID != 1 {
+		t.Errorf("expected user 1, got %d", userID)
+	}
+	if _, err := repo.ConsumeMagicLogin(3); err == nil {
+		t.Error("expected error for a used login, got nil")
+	}
+}
+
+func TestFailMagicLogin(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`update magic_logins set attempts = attempts + 1 where id = $1`)).
+		WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`delete from magic_logins where id = $1 and attempts >= $2`)).
+		WithArgs(3, 5).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := repo.FailMagicLogin(3, 5); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The users of a directory keep the hash of the last directory password they logged in with in:
+//
+//	users.directory_password_hash text
+//
+// It is apart from users.password, which the local authenticator checks, so the directory password
+// is never accepted locally; it only tells when the directory password changed.
+
+// InsertUser creates a user, as done by the just-in-time provisioning of federated logins,
+// and returns its id.
+func (m *PostgresDBRepo) InsertUser(user models.User) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now().Unix()
+	stmt := `insert into users (username, password, code, active, last_login, last_session, blocked,
+    tries, last_try, email, profile_id, group_id, dbsauth_id, activation_time, last_action,
+    last_app, last_db, lan, company_id, created, updated)
+    values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+    returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt,
+		user.UserName,
+		user.Password,
+		user.Code,
+		user.Active,
+		user.LastLogin,
+		user.LastSession,
+		user.Blocked,
+		user.Tries,
+		user.LastTry,
+		user.Email,
+		user.ProfileId,
+		user.GroupId,
+		user.DbsAuth,
+		user.ActivationTime,
+		user.LastAction,
+		user.LastApp,
+		user.LastDb,
+		user.Lan,
+		user.CompanyId,
+		now,
+		now,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// UpdateUserAttributes sets the company, group and profile of a user.
+func (m *PostgresDBRepo) UpdateUserAttributes(userID, companyID, groupID, profileID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set company_id = $1, group_id = $2, profile_id = $3, updated = $4 where id = $5`
+
+	_, err := m.DB.ExecContext(ctx, stmt, companyID, groupID, profileID, time.Now().Unix(), userID)
+	return err
+}
+
+// UpdateDirectoryUser sets the username, language and group a user has in its directory.
+// An unknown user is reported as a wrapped sql.ErrNoRows.
+func (m *PostgresDBRepo) UpdateDirectoryUser(userID int, userName, lan string, groupID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set username = $1, lan = $2, group_id = $3, updated = $4 where id = $5`
+	result, err := m.DB.ExecContext(ctx, stmt, userName, lan, groupID, time.Now().Unix(), userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("user %d not found: %w", userID, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// DeactivateUser deactivates a user, as done when its directory account is gone or disabled.
+// An unknown user is reported as a wrapped sql.ErrNoRows.
+func (m *PostgresDBRepo) DeactivateUser(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set active = false, updated = $1 where id = $2`
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now().Unix(), userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("user %d not found: %w", userID, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// GetDirectoryPasswordHash returns the hash of the last directory password of a user, empty when there is none.
+func (m *PostgresDBRepo) GetDirectoryPasswordHash(userID int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `select coalesce(directory_password_hash, '') from users where id = $1`
+
+	var hash string
+	if err := m.DB.QueryRowContext(ctx, stmt, userID).Scan(&hash); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// SetDirectoryPasswordHash replaces the hash of the last directory password of a user. An unknown user is reported as a wrapped sql.ErrNoRows.
+func (m *PostgresDBRepo) SetDirectoryPasswordHash(userID int, hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set directory_password_hash = $1, updated = $2 where id = $3`
+	result, err := m.DB.ExecContext(ctx, stmt, hash, time.Now().Unix(), userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("user %d not found: %w", userID, sql.ErrNoRows)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package dbrepo_test
+
+import (
+	"authserver-backend/internal/models"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestInsertUser(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into users (username, password, code, active, last_login, last_session, blocked,
+	tries, last_try, email, profile_id, group_id, dbsauth_id, activation_time, last_action,
+	last_app, last_db, lan, company_id, created, updated)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+	returning id`)).
+		WithArgs("jdoe", "hash", "", true, 0, "", false, 0, int64(0), "jdoe@example.com", 3, 2, 0, int64(0), "",
+			0, 0, "en", 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+
+	id, err := repo.InsertUser(models.User{
+		UserName:  "jdoe",
+		Password:  "hash",
+		Active:    true,
+		Email:     "jdoe@example.com",
+		ProfileId: 3,
+		GroupId:   2,
+		Lan:       "en",
+		CompanyId: 1,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != 9 {
+		t.Errorf("expected id 9, got %d", id)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUpdateUserAttributes(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`update users set company_id = $1, group_id = $2, profile_id = $3, updated = $4 where id = $5`)).
+		WithArgs(1, 2, 3, sqlmock.AnyArg(), 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := repo.UpdateUserAttributes(9, 1, 2, 3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDirectoryPasswordHash(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`update users set directory_password_hash = $1, updated = $2 where id = $3`)).
+		WithArgs("hash", sqlmock.AnyArg(), 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`select coalesce(directory_password_hash, '') from users where id = $1`)).
+		WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"directory_password_hash"}).AddRow("hash"))
+	mock.ExpectExec(regexp.QuoteMeta(`update users set directory_password_hash = $1, updated = $2 where id = $3`)).
+		WithArgs("hash", sqlmock.AnyArg(), 10).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := repo.SetDirectoryPasswordHash(9, "hash"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hash, err := repo.GetDirectoryPasswordHash(9)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hash != "hash" {
+		t.Errorf("expected the stored hash, got %q", hash)
+	}
+	if err := repo.SetDirectoryPasswordHash(10, "hash"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for an unknown user, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUpdateDirectoryUser(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`update users set username = $1, lan = $2, group_id = $3, updated = $4 where id = $5`)).
+		WithArgs("jdoe", "es", 5, sqlmock.AnyArg(), 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`update users set username = $1, lan = $2, group_id = $3, updated = $4 where id = $5`)).
+		WithArgs("jdoe", "es", 5, sqlmock.AnyArg(), 10).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := repo.UpdateDirectoryUser(9, "jdoe", "es", 5); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.UpdateDirectoryUser(10, "jdoe", "es", 5); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for an unknown user, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDeactivateUser(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`update users set active = false, updated = $1 where id = $2`)).
+		WithArgs(sqlmock.AnyArg(), 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`update users set active = false, updated = $1 where id = $2`)).
+		WithArgs(sqlmock.AnyArg(), 10).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := repo.DeactivateUser(9); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.DeactivateUser(10); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows for an unknown user, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
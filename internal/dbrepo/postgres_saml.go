@@ -0,0 +1,105 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The SAML service providers of the catalogue apps are stored in:
+//
+//	saml_service_providers(id, app_id unique, entity_id unique, metadata text, name_id,
+//	    attributes jsonb, created, updated)
+
+const samlServiceProviderColumns = `id, app_id, entity_id, metadata, name_id, attributes, created, updated`
+
+// scanSAMLServiceProvider reads a service provider row. A missing row is reported as a wrapped sql.ErrNoRows.
+func scanSAMLServiceProvider(row *sql.Row, key string) (*models.SAMLServiceProvider, error) {
+	var sp models.SAMLServiceProvider
+	var attributes []byte
+	err := row.Scan(
+		&sp.ID,
+		&sp.AppID,
+		&sp.EntityID,
+		&sp.Metadata,
+		&sp.NameIDField,
+		&attributes,
+		&sp.Created,
+		&sp.Updated,
+	)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no SAML service provider for %s: %w", key, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(attributes) > 0 {
+		if err := json.Unmarshal(attributes, &sp.Attributes); err != nil {
+			return nil, fmt.Errorf("invalid attribute mapping of SAML service provider %s: %w", sp.EntityID, err)
+		}
+	}
+	return &sp, nil
+}
+
+// GetSAMLServiceProvider returns the service provider with the given entity ID.
+func (m *PostgresDBRepo) GetSAMLServiceProvider(entityID string) (*models.SAMLServiceProvider, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + samlServiceProviderColumns + ` from saml_service_providers where entity_id = $1`
+	return scanSAMLServiceProvider(m.DB.QueryRowContext(ctx, query, entityID), entityID)
+}
+
+// GetSAMLServiceProviderByApp returns the service provider registered for an app.
+func (m *PostgresDBRepo) GetSAMLServiceProviderByApp(appID int) (*models.SAMLServiceProvider, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + samlServiceProviderColumns + ` from saml_service_providers where app_id = $1`
+	return scanSAMLServiceProvider(m.DB.QueryRowContext(ctx, query, appID), fmt.Sprintf("app %d", appID))
+}
+
+// UpsertSAMLServiceProvider registers the service provider of an app, replacing the one registered before.
+func (m *PostgresDBRepo) UpsertSAMLServiceProvider(sp models.SAMLServiceProvider) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	attributes, err := json.Marshal(sp.Attributes)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+	stmt := `insert into saml_service_providers (app_id, entity_id, metadata, name_id, attributes, created, updated)
+    values ($1, $2, $3, $4, $5, $6, $7)
+    on conflict (app_id) do update set entity_id = excluded.entity_id, metadata = excluded.metadata,
+    name_id = excluded.name_id, attributes = excluded.attributes, updated = excluded.updated
+    returning id`
+
+	var id int
+	err = m.DB.QueryRowContext(ctx, stmt,
+		sp.AppID,
+		sp.EntityID,
+		sp.Metadata,
+		sp.NameIDField,
+		attributes,
+		now,
+		now,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// DeleteSAMLServiceProvider removes the service provider of an app.
+func (m *PostgresDBRepo) DeleteSAMLServiceProvider(appID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from saml_service_providers where app_id = $1`, appID)
+	return err
+}
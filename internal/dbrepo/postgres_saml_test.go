@@ -0,0 +1,86 @@
+package dbrepo_test
+
+import (
+	"authserver-backend/internal/models"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetSAMLServiceProvider(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	now := 160000000 // Simulated timestamp for testing
+	row := sqlmock.NewRows([]string{
+		"id", "app_id", "entity_id", "metadata", "name_id", "attributes", "created", "updated",
+	}).AddRow(
+		1, 4, "https://sp.example.com/saml/metadata", "<EntityDescriptor/>", "email", []byte(`{"companyId":"company_id"}`), now, now,
+	)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`select id, app_id, entity_id, metadata, name_id, attributes, created, updated from saml_service_providers where entity_id = $1`)).
+		WithArgs("https://sp.example.com/saml/metadata").WillReturnRows(row)
+
+	sp, err := repo.GetSAMLServiceProvider("https://sp.example.com/saml/metadata")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sp.AppID != 4 || sp.Attributes["companyId"] != "company_id" {
+		t.Errorf("unexpected service provider data: %+v", sp)
+	}
+}
+
+func TestGetSAMLServiceProviderByApp_NotFound(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`from saml_service_providers where app_id = $1`)).
+		WithArgs(4).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	_, err := repo.GetSAMLServiceProviderByApp(4)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestUpsertSAMLServiceProvider(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into saml_service_providers (app_id, entity_id, metadata, name_id, attributes, created, updated)
+	values ($1, $2, $3, $4, $5, $6, $7)
+	on conflict (app_id) do update set entity_id = excluded.entity_id, metadata = excluded.metadata,
+	name_id = excluded.name_id, attributes = excluded.attributes, updated = excluded.updated
+	returning id`)).
+		WithArgs(4, "https://sp.example.com/saml/metadata", "<EntityDescriptor/>", "username", []byte(`{"mail":"email"}`), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+
+	id, err := repo.UpsertSAMLServiceProvider(models.SAMLServiceProvider{
+		AppID:       4,
+		EntityID:    "https://sp.example.com/saml/metadata",
+		Metadata:    "<EntityDescriptor/>",
+		NameIDField: "username",
+		Attributes:  map[string]string{"mail": "email"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != 2 {
+		t.Errorf("expected id 2, got %d", id)
+	}
+}
+
+func TestDeleteSAMLServiceProvider(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`delete from saml_service_providers where app_id = $1`)).
+		WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := repo.DeleteSAMLServiceProvider(4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// The login sessions are stored in:
+//
+//	sessions(id serial primary key, user_id, user_agent, device, ip, created, last_seen, expires_at, revoked, idle_timeout)
+//
+// users.last_action holds the Unix time of the last activity of the user, as text.
+
+const sessionColumns = `id, user_id, user_agent, device, ip, created, last_seen, expires_at, revoked, idle_timeout`
+
+func scanSession(row interface{ Scan(...any) error }) (*models.Session, error) {
+	var s models.Session
+	err := row.Scan(
+		&s.ID,
+		&s.UserID,
+		&s.UserAgent,
+		&s.Device,
+		&s.IP,
+		&s.Created,
+		&s.LastSeen,
+		&s.ExpiresAt,
+		&s.Revoked,
+		&s.IdleTimeout,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// InsertSession stores a new session and returns its id.
+func (m *PostgresDBRepo) InsertSession(s models.Session) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into sessions (user_id, user_agent, device, ip, created, last_seen, expires_at, revoked, idle_timeout)
+		values ($1, $2, $3, $4, $5, $6, $7, 0, $8) returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt, s.UserID, s.UserAgent, s.Device, s.IP, s.Created, s.LastSeen, s.ExpiresAt, s.IdleTimeout).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetSession returns a session, revoked and expired ones included.
+func (m *PostgresDBRepo) GetSession(id int) (*models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	s, err := scanSession(m.DB.QueryRowContext(ctx, `select `+sessionColumns+` from sessions where id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("session %d not found: %w", id, sql.ErrNoRows)
+	}
+	return s, err
+}
+
+// UserSessions returns the sessions of a user still active at a time, neither revoked, expired
+// nor idle, the last seen first.
+func (m *PostgresDBRepo) UserSessions(userID int, now int64) ([]*models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + sessionColumns + ` from sessions
+		where user_id = $1 and revoked = 0 and expires_at > $2 and (idle_timeout = 0 or last_seen + idle_timeout > $2)
+		order by last_seen desc, id desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*models.Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchSession records the last time a token of a session was used. expiresAt is the end of
+// the refresh token just issued in the session, the session never ends sooner: 0 keeps the current end.
+func (m *PostgresDBRepo) TouchSession(id int, lastSeen, expiresAt int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update sessions set last_seen = $1, expires_at = greatest(expires_at, $2) where id = $3`
+	_, err := m.DB.ExecContext(ctx, stmt, lastSeen, expiresAt, id)
+	return err
+}
+
+// TouchSessions records the last time the tokens of sessions were used, by session id,
+// in a single statement. A session is never seen earlier than it already was.
+func (m *PostgresDBRepo) TouchSessions(lastSeen map[int]int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	ids, times := activityArrays(lastSeen)
+	stmt := `update sessions set last_seen = greatest(sessions.last_seen, v.last_seen)
+		from unnest($1::int[], $2::bigint[]) as v(id, last_seen) where sessions.id = v.id`
+	_, err := m.DB.ExecContext(ctx, stmt, pq.Array(ids), pq.Array(times))
+	return err
+}
+
+// UpdateLastActions records the last activity of users, by user id, in a single statement.
+func (m *PostgresDBRepo) UpdateLastActions(lastAction map[int]int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	ids, times := activityArrays(lastAction)
+	stmt := `update users set last_action = v.last_action::text
+		from unnest($1::int[], $2::bigint[]) as v(id, last_action) where users.id = v.id`
+	_, err := m.DB.ExecContext(ctx, stmt, pq.Array(ids), pq.Array(times))
+	return err
+}
+
+// activityArrays splits activity times by id into the arrays of the ids and the times, sorted by id.
+func activityArrays(activity map[int]int64) ([]int64, []int64) {
+	ids := make([]int64, 0, len(activity))
+	for id := range activity {
+		ids = append(ids, int64(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	times := make([]int64, len(ids))
+	for i, id := range ids {
+		times[i] = activity[int(id)]
+	}
+	return ids, times
+}
+
+// RevokeSession revokes a session of a user.
+func (m *PostgresDBRepo) RevokeSession(id, userID int, revoked int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update sessions set revoked = $1 where id = $2 and user_id = $3 and revoked = 0`
+	result, err := m.DB.ExecContext(ctx, stmt, revoked, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("session %d not found: %w", id, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// RevokeUserSessions revokes every session of a user but the one of exceptID, 0 to revoke them all,
+// and returns how many were revoked.
+func (m *PostgresDBRepo) RevokeUserSessions(userID, exceptID int, revoked int64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update sessions set revoked = $1 where user_id = $2 and id <> $3 and revoked = 0`
+	result, err := m.DB.ExecContext(ctx, stmt, revoked, userID, exceptID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,149 @@
+package dbrepo_test
+
+import (
+	"authserver-backend/internal/models"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var sessionColumns = []string{"id", "user_id", "user_agent", "device", "ip", "created", "last_seen", "expires_at", "revoked", "idle_timeout"}
+
+func TestInsertSession(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into sessions (user_id, user_agent, device, ip, created, last_seen, expires_at, revoked, idle_timeout)`)).
+		WithArgs(2, "Mozilla/5.0", "Firefox 120 on Linux", "10.0.0.1", int64(170000000), int64(170000000), int64(170086400), int64(1800)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+
+	id, err := repo.InsertSession(models.Session{
+		UserID:      2,
+		UserAgent:   "Mozilla/5.0",
+		Device:      "Firefox 120 on Linux",
+		IP:          "10.0.0.1",
+		Created:     170000000,
+		LastSeen:    170000000,
+		ExpiresAt:   170086400,
+		IdleTimeout: 1800,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != 5 {
+		t.Errorf("expected id 5, got %d", id)
+	}
+}
+
+func TestGetSession(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`from sessions where id = $1`)).
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows(sessionColumns).AddRow(5, 2, "Mozilla/5.0", "Firefox 120 on Linux", "10.0.0.1", 170000000, 170000100, 170086400, 0, 1800))
+	mock.ExpectQuery(regexp.QuoteMeta(`from sessions where id = $1`)).
+		WithArgs(6).
+		WillReturnRows(sqlmock.NewRows(sessionColumns))
+
+	s, err := repo.GetSession(5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the session is idle 30 minutes after it was last seen
+	if s.UserID != 2 || s.Device != "Firefox 120 on Linux" || !s.Active(170000100) || s.Active(170001900) {
+		t.Errorf("unexpected session: %+v", s)
+	}
+	if _, err := repo.GetSession(6); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestUserSessions(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`where user_id = $1 and revoked = 0 and expires_at > $2 and (idle_timeout = 0 or last_seen + idle_timeout > $2)`)).
+		WithArgs(2, int64(170000200)).
+		WillReturnRows(sqlmock.NewRows(sessionColumns).
+			AddRow(6, 2, "curl/8.0", "curl 8", "10.0.0.2", 170000150, 170000190, 170086550, 0, 0).
+			AddRow(5, 2, "Mozilla/5.0", "Firefox 120 on Linux", "10.0.0.1", 170000000, 170000100, 170086400, 0, 1800))
+
+	sessions, err := repo.UserSessions(2, 170000200)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != 6 || sessions[1].IP != "10.0.0.1" {
+		t.Errorf("unexpected sessions: %+v", sessions)
+	}
+}
+
+func TestTouchSession(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`update sessions set last_seen = $1, expires_at = greatest(expires_at, $2) where id = $3`)).
+		WithArgs(int64(170000100), int64(0), 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := repo.TouchSession(5, 170000100, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// TestTouchSessions tests that the activity of several sessions and users is written in one statement each.
+func TestTouchSessions(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`update sessions set last_seen = greatest(sessions.last_seen, v.last_seen)`)).
+		WithArgs("{5,8}", "{170000100,170000200}").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`update users set last_action = v.last_action::text`)).
+		WithArgs("{2}", "{170000200}").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := repo.TouchSessions(map[int]int64{8: 170000200, 5: 170000100}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.UpdateLastActions(map[int]int64{2: 170000200}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// TestRevokeSession tests that a session is only revoked once, and only for its user.
+func TestRevokeSession(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	stmt := regexp.QuoteMeta(`update sessions set revoked = $1 where id = $2 and user_id = $3 and revoked = 0`)
+	mock.ExpectExec(stmt).WithArgs(int64(170000100), 5, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(stmt).WithArgs(int64(170000200), 5, 2).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := repo.RevokeSession(5, 2, 170000100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.RevokeSession(5, 2, 170000200); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestRevokeUserSessions(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`update sessions set revoked = $1 where user_id = $2 and id <> $3 and revoked = 0`)).
+		WithArgs(int64(170000100), 2, 5).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	n, err := repo.RevokeUserSessions(2, 5, 170000100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 revoked sessions, got %d", n)
+	}
+}
@@ -0,0 +1,126 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The personal access tokens are stored hashed in:
+//
+//	personal_access_tokens(id serial primary key, user_id, name, prefix, token_hash text unique,
+//	                       scopes text[], expires_at, last_used, revoked, created)
+
+const personalAccessTokenColumns = `id, user_id, name, prefix, token_hash, scopes, expires_at, last_used, revoked, created`
+
+func scanPersonalAccessToken(row interface{ Scan(...any) error }) (*models.PersonalAccessToken, error) {
+	var token models.PersonalAccessToken
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&token.Prefix,
+		&token.TokenHash,
+		&token.Scopes,
+		&token.ExpiresAt,
+		&token.LastUsed,
+		&token.Revoked,
+		&token.Created,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// InsertPersonalAccessToken stores a new personal access token and returns its id.
+func (m *PostgresDBRepo) InsertPersonalAccessToken(token models.PersonalAccessToken) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into personal_access_tokens (user_id, name, prefix, token_hash, scopes, expires_at, last_used, revoked, created)
+		values ($1, $2, $3, $4, $5, $6, 0, 0, $7) returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt, token.UserID, token.Name, token.Prefix, token.TokenHash,
+		token.Scopes, token.ExpiresAt, time.Now().Unix()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetPersonalAccessToken returns the personal access token of a hash, unless it was revoked.
+// Its expiry is left to the caller.
+func (m *PostgresDBRepo) GetPersonalAccessToken(tokenHash string) (*models.PersonalAccessToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + personalAccessTokenColumns + ` from personal_access_tokens where token_hash = $1 and revoked = 0`
+
+	token, err := scanPersonalAccessToken(m.DB.QueryRowContext(ctx, query, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("unknown or revoked token")
+	}
+	return token, err
+}
+
+// ListPersonalAccessTokens returns the personal access tokens of a user, newest first.
+func (m *PostgresDBRepo) ListPersonalAccessTokens(userID int) ([]*models.PersonalAccessToken, error) {
+	return m.personalAccessTokens(`where user_id = $1 order by created desc`, userID)
+}
+
+// AllPersonalAccessTokens returns the personal access tokens of every user, revoked ones included,
+// newest first.
+func (m *PostgresDBRepo) AllPersonalAccessTokens() ([]*models.PersonalAccessToken, error) {
+	return m.personalAccessTokens(`order by created desc`)
+}
+
+func (m *PostgresDBRepo) personalAccessTokens(where string, args ...any) ([]*models.PersonalAccessToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `select `+personalAccessTokenColumns+` from personal_access_tokens `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*models.PersonalAccessToken
+	for rows.Next() {
+		token, err := scanPersonalAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokePersonalAccessToken revokes a personal access token of a user.
+func (m *PostgresDBRepo) RevokePersonalAccessToken(id, userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update personal_access_tokens set revoked = $1 where id = $2 and user_id = $3 and revoked = 0`
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now().Unix(), id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("token %d not found: %w", id, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// TouchPersonalAccessToken records the last time a personal access token was used.
+func (m *PostgresDBRepo) TouchPersonalAccessToken(id int, usedAt int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update personal_access_tokens set last_used = $1 where id = $2`, usedAt, id)
+	return err
+}
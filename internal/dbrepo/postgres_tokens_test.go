@@ -0,0 +1,135 @@
+package dbrepo_test
+
+import (
+	"authserver-backend/internal/models"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+var personalAccessTokenRow = []string{
+	"id", "user_id", "name", "prefix", "token_hash", "scopes", "expires_at", "last_used", "revoked", "created",
+}
+
+func TestInsertPersonalAccessToken(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into personal_access_tokens (user_id, name, prefix, token_hash, scopes, expires_at, last_used, revoked, created)`)).
+		WithArgs(1, "ci", "asp_abcdefgh", "hash", pq.StringArray{"dbs"}, int64(170000000), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+
+	id, err := repo.InsertPersonalAccessToken(models.PersonalAccessToken{
+		UserID:    1,
+		Name:      "ci",
+		Prefix:    "asp_abcdefgh",
+		TokenHash: "hash",
+		Scopes:    pq.StringArray{"dbs"},
+		ExpiresAt: 170000000,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != 4 {
+		t.Errorf("expected id 4, got %d", id)
+	}
+}
+
+func TestGetPersonalAccessToken(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	row := sqlmock.NewRows(personalAccessTokenRow).
+		AddRow(4, 1, "ci", "asp_abcdefgh", "hash", "{dbs,apps}", 170000000, 0, 0, 160000000)
+	mock.ExpectQuery(regexp.QuoteMeta(`from personal_access_tokens where token_hash = $1 and revoked = 0`)).
+		WithArgs("hash").WillReturnRows(row)
+
+	token, err := repo.GetPersonalAccessToken("hash")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token.ID != 4 || !token.HasScope("apps") || token.HasScope("admin") {
+		t.Errorf("unexpected token data: %+v", token)
+	}
+}
+
+func TestGetPersonalAccessToken_Revoked(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery("from personal_access_tokens").
+		WithArgs("hash").WillReturnRows(sqlmock.NewRows(personalAccessTokenRow))
+
+	if _, err := repo.GetPersonalAccessToken("hash"); err == nil {
+		t.Error("expected error for a revoked token, got nil")
+	}
+}
+
+func TestListPersonalAccessTokens(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	rows := sqlmock.NewRows(personalAccessTokenRow).
+		AddRow(5, 1, "deploy", "asp_ijklmnop", "hash2", "{}", 170000000, 160000500, 0, 160000100).
+		AddRow(4, 1, "ci", "asp_abcdefgh", "hash", "{dbs}", 170000000, 0, 160000200, 160000000)
+	mock.ExpectQuery(regexp.QuoteMeta(`from personal_access_tokens where user_id = $1 order by created desc`)).
+		WithArgs(1).WillReturnRows(rows)
+
+	tokens, err := repo.ListPersonalAccessTokens(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tokens) != 2 || tokens[0].Name != "deploy" || tokens[1].Revoked == 0 {
+		t.Errorf("unexpected tokens: %+v", tokens)
+	}
+}
+
+func TestAllPersonalAccessTokens(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	rows := sqlmock.NewRows(personalAccessTokenRow).
+		AddRow(4, 2, "ci", "asp_abcdefgh", "hash", "{dbs}", 170000000, 0, 0, 160000000)
+	mock.ExpectQuery(regexp.QuoteMeta(`from personal_access_tokens order by created desc`)).WillReturnRows(rows)
+
+	tokens, err := repo.AllPersonalAccessTokens()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].UserID != 2 {
+		t.Errorf("unexpected tokens: %+v", tokens)
+	}
+}
+
+func TestRevokePersonalAccessToken(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	stmt := regexp.QuoteMeta(`update personal_access_tokens set revoked = $1 where id = $2 and user_id = $3 and revoked = 0`)
+	mock.ExpectExec(stmt).WithArgs(sqlmock.AnyArg(), 4, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	// another user's token, or one already revoked, is not found
+	mock.ExpectExec(stmt).WithArgs(sqlmock.AnyArg(), 4, 2).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := repo.RevokePersonalAccessToken(4, 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.RevokePersonalAccessToken(4, 2); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestTouchPersonalAccessToken(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectExec(regexp.QuoteMeta(`update personal_access_tokens set last_used = $1 where id = $2`)).
+		WithArgs(int64(160000000), 4).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := repo.TouchPersonalAccessToken(4, 160000000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
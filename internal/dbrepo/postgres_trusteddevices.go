@@ -0,0 +1,132 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// The trusted devices are stored in:
+//
+//	trusted_devices(id serial primary key, user_id, token_hash unique, password_fingerprint, user_agent, device, ip,
+//	    created, last_used, expires_at, revoked)
+
+const trustedDeviceColumns = `id, user_id, token_hash, password_fingerprint, user_agent, device, ip, created, last_used, expires_at, revoked`
+
+func scanTrustedDevice(row interface{ Scan(...any) error }) (*models.TrustedDevice, error) {
+	var d models.TrustedDevice
+	err := row.Scan(
+		&d.ID,
+		&d.UserID,
+		&d.TokenHash,
+		&d.PasswordFingerprint,
+		&d.UserAgent,
+		&d.Device,
+		&d.IP,
+		&d.Created,
+		&d.LastUsed,
+		&d.ExpiresAt,
+		&d.Revoked,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// InsertTrustedDevice stores a new trusted device and returns its id.
+func (m *PostgresDBRepo) InsertTrustedDevice(d models.TrustedDevice) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into trusted_devices (user_id, token_hash, password_fingerprint, user_agent, device, ip, created, last_used, expires_at, revoked)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, 0) returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt, d.UserID, d.TokenHash, d.PasswordFingerprint, d.UserAgent, d.Device, d.IP,
+		d.Created, d.LastUsed, d.ExpiresAt).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetTrustedDevice returns the trusted device of a token hash, revoked and expired ones included.
+func (m *PostgresDBRepo) GetTrustedDevice(tokenHash string) (*models.TrustedDevice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + trustedDeviceColumns + ` from trusted_devices where token_hash = $1`
+	d, err := scanTrustedDevice(m.DB.QueryRowContext(ctx, query, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("trusted device not found: %w", sql.ErrNoRows)
+	}
+	return d, err
+}
+
+// UserTrustedDevices returns the devices of a user neither revoked nor expired at a time, the last used first.
+func (m *PostgresDBRepo) UserTrustedDevices(userID int, now int64) ([]*models.TrustedDevice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + trustedDeviceColumns + ` from trusted_devices
+		where user_id = $1 and revoked = 0 and expires_at > $2
+		order by last_used desc, id desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []*models.TrustedDevice
+	for rows.Next() {
+		d, err := scanTrustedDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// TouchTrustedDevice records the last login a trusted device skipped the second factor of.
+func (m *PostgresDBRepo) TouchTrustedDevice(id int, lastUsed int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update trusted_devices set last_used = $1 where id = $2`
+	_, err := m.DB.ExecContext(ctx, stmt, lastUsed, id)
+	return err
+}
+
+// RevokeTrustedDevice revokes a trusted device of a user.
+func (m *PostgresDBRepo) RevokeTrustedDevice(id, userID int, revoked int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update trusted_devices set revoked = $1 where id = $2 and user_id = $3 and revoked = 0`
+	result, err := m.DB.ExecContext(ctx, stmt, revoked, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("trusted device %d not found: %w", id, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// RevokeUserTrustedDevices revokes every trusted device of a user and returns how many were revoked.
+func (m *PostgresDBRepo) RevokeUserTrustedDevices(userID int, revoked int64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update trusted_devices set revoked = $1 where user_id = $2 and revoked = 0`
+	result, err := m.DB.ExecContext(ctx, stmt, revoked, userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
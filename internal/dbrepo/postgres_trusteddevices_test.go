@@ -0,0 +1,111 @@
+package dbrepo_test
+
+import (
+	"authserver-backend/internal/models"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var trustedDeviceColumns = []string{"id", "user_id", "token_hash", "password_fingerprint", "user_agent", "device", "ip",
+	"created", "last_used", "expires_at", "revoked"}
+
+func TestInsertTrustedDevice(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into trusted_devices (user_id, token_hash, password_fingerprint, user_agent, device, ip, created, last_used, expires_at, revoked)`)).
+		WithArgs(2, "hash", "fingerprint", "Mozilla/5.0", "Firefox 120 on Linux", "10.0.0.1", int64(170000000), int64(170000000), int64(172592000)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+
+	id, err := repo.InsertTrustedDevice(models.TrustedDevice{
+		UserID:              2,
+		TokenHash:           "hash",
+		PasswordFingerprint: "fingerprint",
+		UserAgent:           "Mozilla/5.0",
+		Device:              "Firefox 120 on Linux",
+		IP:                  "10.0.0.1",
+		Created:             170000000,
+		LastUsed:            170000000,
+		ExpiresAt:           172592000,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != 3 {
+		t.Errorf("expected id 3, got %d", id)
+	}
+}
+
+func TestGetTrustedDevice(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	query := regexp.QuoteMeta(`from trusted_devices where token_hash = $1`)
+	mock.ExpectQuery(query).WithArgs("hash").
+		WillReturnRows(sqlmock.NewRows(trustedDeviceColumns).AddRow(3, 2, "hash", "fingerprint", "Mozilla/5.0", "Firefox 120 on Linux", "10.0.0.1", 170000000, 170000000, 172592000, 0))
+	mock.ExpectQuery(query).WithArgs("unknown").WillReturnRows(sqlmock.NewRows(trustedDeviceColumns))
+
+	d, err := repo.GetTrustedDevice("hash")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// a new password does not match the fingerprint of the device
+	if d.UserID != 2 || !d.Trusted(170000100, "fingerprint") || d.Trusted(170000100, "new password") || d.Trusted(172592000, "fingerprint") {
+		t.Errorf("unexpected device: %+v", d)
+	}
+	if _, err := repo.GetTrustedDevice("unknown"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestUserTrustedDevices(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`where user_id = $1 and revoked = 0 and expires_at > $2`)).
+		WithArgs(2, int64(170000000)).
+		WillReturnRows(sqlmock.NewRows(trustedDeviceColumns).
+			AddRow(4, 2, "hash4", "fingerprint", "Mozilla/5.0", "Safari 17 on iOS", "10.0.0.2", 169000000, 169990000, 172000000, 0).
+			AddRow(3, 2, "hash3", "fingerprint", "Mozilla/5.0", "Firefox 120 on Linux", "10.0.0.1", 168000000, 168000000, 171000000, 0))
+
+	devices, err := repo.UserTrustedDevices(2, 170000000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(devices) != 2 || devices[0].ID != 4 {
+		t.Errorf("unexpected devices: %+v", devices)
+	}
+}
+
+func TestRevokeTrustedDevices(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	revokeOne := regexp.QuoteMeta(`update trusted_devices set revoked = $1 where id = $2 and user_id = $3 and revoked = 0`)
+	mock.ExpectExec(revokeOne).WithArgs(int64(170000000), 3, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(revokeOne).WithArgs(int64(170000000), 3, 9).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`update trusted_devices set revoked = $1 where user_id = $2 and revoked = 0`)).
+		WithArgs(int64(170000000), 2).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err := repo.RevokeTrustedDevice(3, 2, 170000000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the device of another user is not found
+	if err := repo.RevokeTrustedDevice(3, 9, 170000000); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+	revoked, err := repo.RevokeUserTrustedDevices(2, 170000000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if revoked != 2 {
+		t.Errorf("expected 2 devices revoked, got %d", revoked)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
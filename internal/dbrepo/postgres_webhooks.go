@@ -0,0 +1,320 @@
+package dbrepo
+
+import (
+	"authserver-backend/internal/models"
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// The outbound webhooks of the security events and their deliveries are stored in:
+//
+//	webhooks(id serial primary key, url, secret, event_types text[], created_by, created)
+//	webhook_deliveries(id serial primary key, webhook_id references webhooks on delete cascade,
+//	                   event_id, event_type, payload jsonb, status, attempts, response_code, error,
+//	                   next_attempt, created, updated)
+//
+// with an index on (status, next_attempt), and the deliveries that failed every attempt are kept in:
+//
+//	webhook_dead_letters(id serial primary key, webhook_id references webhooks on delete cascade,
+//	                     delivery_id references webhook_deliveries on delete cascade,
+//	                     event_type, payload jsonb, attempts, error, created)
+
+const webhookColumns = `id, url, secret, event_types, created_by, created`
+
+const webhookDeliveryColumns = `id, webhook_id, event_id, event_type, payload, status, attempts, response_code, error,
+	next_attempt, created, updated`
+
+const webhookDeadLetterColumns = `id, webhook_id, delivery_id, event_type, payload, attempts, error, created`
+
+func scanWebhook(row interface{ Scan(...any) error }) (*models.Webhook, error) {
+	var webhook models.Webhook
+	err := row.Scan(
+		&webhook.ID,
+		&webhook.URL,
+		&webhook.Secret,
+		&webhook.EventTypes,
+		&webhook.CreatedBy,
+		&webhook.Created,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func scanWebhookDelivery(row interface{ Scan(...any) error }) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.EventID,
+		&delivery.EventType,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.ResponseCode,
+		&delivery.Error,
+		&delivery.NextAttempt,
+		&delivery.Created,
+		&delivery.Updated,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// InsertWebhook stores a new webhook and returns its id.
+func (m *PostgresDBRepo) InsertWebhook(webhook models.Webhook) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into webhooks (url, secret, event_types, created_by, created)
+		values ($1, $2, $3, $4, $5) returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt, webhook.URL, webhook.Secret, webhook.EventTypes,
+		webhook.CreatedBy, webhook.Created).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetWebhook returns a webhook by id.
+func (m *PostgresDBRepo) GetWebhook(id int) (*models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + webhookColumns + ` from webhooks where id = $1`
+	webhook, err := scanWebhook(m.DB.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("webhook %d not found: %w", id, err)
+	}
+	return webhook, err
+}
+
+// Webhooks returns all the webhooks, oldest first.
+func (m *PostgresDBRepo) Webhooks() ([]*models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `select `+webhookColumns+` from webhooks order by id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []*models.Webhook
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook deletes a webhook with its deliveries.
+func (m *PostgresDBRepo) DeleteWebhook(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `delete from webhooks where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("webhook %d not found: %w", id, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// InsertWebhookDelivery stores a new delivery and returns its id.
+func (m *PostgresDBRepo) InsertWebhookDelivery(delivery models.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into webhook_deliveries (webhook_id, event_id, event_type, payload, status, attempts, response_code,
+		error, next_attempt, created, updated)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt, delivery.WebhookID, delivery.EventID, delivery.EventType, []byte(delivery.Payload),
+		delivery.Status, delivery.Attempts, delivery.ResponseCode, delivery.Error, delivery.NextAttempt,
+		delivery.Created, delivery.Updated).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// UpdateWebhookDelivery records the outcome of an attempt of a delivery.
+func (m *PostgresDBRepo) UpdateWebhookDelivery(delivery models.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update webhook_deliveries set status = $1, attempts = $2, response_code = $3, error = $4,
+		next_attempt = $5, updated = $6 where id = $7`
+	_, err := m.DB.ExecContext(ctx, stmt, delivery.Status, delivery.Attempts, delivery.ResponseCode, delivery.Error,
+		delivery.NextAttempt, delivery.Updated, delivery.ID)
+	return err
+}
+
+// DeadLetterWebhookDelivery records the last failed attempt of a delivery, marks it dead
+// and copies it to the dead letters, in one transaction.
+func (m *PostgresDBRepo) DeadLetterWebhookDelivery(delivery models.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update webhook_deliveries set status = $1, attempts = $2, response_code = $3, error = $4,
+		next_attempt = 0, updated = $5 where id = $6`
+	_, err = tx.ExecContext(ctx, stmt, models.WebhookDeliveryDead, delivery.Attempts, delivery.ResponseCode,
+		delivery.Error, delivery.Updated, delivery.ID)
+	if err != nil {
+		return err
+	}
+
+	stmt = `insert into webhook_dead_letters (webhook_id, delivery_id, event_type, payload, attempts, error, created)
+		values ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = tx.ExecContext(ctx, stmt, delivery.WebhookID, delivery.ID, delivery.EventType, []byte(delivery.Payload),
+		delivery.Attempts, delivery.Error, delivery.Updated)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DueWebhookDeliveries returns the pending deliveries whose next attempt is due, oldest first,
+// at most limit of them.
+func (m *PostgresDBRepo) DueWebhookDeliveries(now int64, limit int) ([]*models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + webhookDeliveryColumns + ` from webhook_deliveries
+		where status = $1 and next_attempt <= $2 order by next_attempt, id limit $3`
+	rows, err := m.DB.QueryContext(ctx, query, models.WebhookDeliveryPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*models.WebhookDelivery
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// WebhookDeliveries returns a page of the deliveries of a webhook, newest first,
+// and how many deliveries it has in all.
+func (m *PostgresDBRepo) WebhookDeliveries(webhookID, limit, offset int) ([]*models.WebhookDelivery, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var total int
+	err := m.DB.QueryRowContext(ctx, `select count(*) from webhook_deliveries where webhook_id = $1`, webhookID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `select ` + webhookDeliveryColumns + ` from webhook_deliveries
+		where webhook_id = $1 order by created desc, id desc limit $2 offset $3`
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var deliveries []*models.WebhookDelivery
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, total, rows.Err()
+}
+
+// WebhookDeadLetters returns a page of the dead letters of all the webhooks, newest first,
+// and how many there are in all.
+func (m *PostgresDBRepo) WebhookDeadLetters(limit, offset int) ([]*models.WebhookDeadLetter, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var total int
+	if err := m.DB.QueryRowContext(ctx, `select count(*) from webhook_dead_letters`).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `select ` + webhookDeadLetterColumns + ` from webhook_dead_letters order by created desc, id desc limit $1 offset $2`
+	rows, err := m.DB.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var letters []*models.WebhookDeadLetter
+	for rows.Next() {
+		var letter models.WebhookDeadLetter
+		err := rows.Scan(
+			&letter.ID,
+			&letter.WebhookID,
+			&letter.DeliveryID,
+			&letter.EventType,
+			&letter.Payload,
+			&letter.Attempts,
+			&letter.Error,
+			&letter.Created,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+		letters = append(letters, &letter)
+	}
+	return letters, total, rows.Err()
+}
+
+// RetryWebhookDeadLetter removes a dead letter and makes its delivery pending again, due at now
+// with its attempts reset. It returns the id of the delivery.
+func (m *PostgresDBRepo) RetryWebhookDeadLetter(id int, now int64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var deliveryID int
+	err = tx.QueryRowContext(ctx, `delete from webhook_dead_letters where id = $1 returning delivery_id`, id).Scan(&deliveryID)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("dead letter %d not found: %w", id, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `update webhook_deliveries set status = $1, attempts = 0, next_attempt = $2, updated = $2 where id = $3`
+	if _, err := tx.ExecContext(ctx, stmt, models.WebhookDeliveryPending, now, deliveryID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return deliveryID, nil
+}
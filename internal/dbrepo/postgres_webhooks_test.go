@@ -0,0 +1,136 @@
+package dbrepo_test
+
+import (
+	"authserver-backend/internal/models"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+var webhookDeliveryRow = []string{
+	"id", "webhook_id", "event_id", "event_type", "payload", "status", "attempts", "response_code", "error",
+	"next_attempt", "created", "updated",
+}
+
+func TestInsertWebhook(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`insert into webhooks (url, secret, event_types, created_by, created)`)).
+		WithArgs("https://soc.example.com/hooks", "secret", pq.StringArray{"account.*"}, 1, int64(170000000)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+
+	id, err := repo.InsertWebhook(models.Webhook{
+		URL:        "https://soc.example.com/hooks",
+		Secret:     "secret",
+		EventTypes: pq.StringArray{"account.*"},
+		CreatedBy:  1,
+		Created:    170000000,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != 4 {
+		t.Errorf("expected id 4, got %d", id)
+	}
+}
+
+func TestGetWebhook_NotFound(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`from webhooks where id = $1`)).
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "url", "secret", "event_types", "created_by", "created"}))
+
+	if _, err := repo.GetWebhook(5); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestDueWebhookDeliveries(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`from webhook_deliveries
+		where status = $1 and next_attempt <= $2 order by next_attempt, id limit $3`)).
+		WithArgs("pending", int64(170000000), 100).
+		WillReturnRows(sqlmock.NewRows(webhookDeliveryRow).
+			AddRow(9, 4, "e1", "account.lockout", []byte(`{"id":"e1"}`), "pending", 2, 500, "unexpected status 500", 169999990, 169999000, 169999000))
+
+	deliveries, err := repo.DueWebhookDeliveries(170000000, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Attempts != 2 || string(deliveries[0].Payload) != `{"id":"e1"}` {
+		t.Errorf("unexpected deliveries: %+v", deliveries)
+	}
+}
+
+// TestDeadLetterWebhookDelivery tests that a dead delivery is marked and copied to the dead letters together.
+func TestDeadLetterWebhookDelivery(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`update webhook_deliveries set status = $1, attempts = $2, response_code = $3, error = $4,
+		next_attempt = 0, updated = $5 where id = $6`)).
+		WithArgs("dead", 8, 0, "connection refused", int64(170000000), 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`insert into webhook_dead_letters (webhook_id, delivery_id, event_type, payload, attempts, error, created)`)).
+		WithArgs(4, 9, "account.lockout", []byte(`{}`), 8, "connection refused", int64(170000000)).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectCommit()
+
+	err := repo.DeadLetterWebhookDelivery(models.WebhookDelivery{
+		ID:        9,
+		WebhookID: 4,
+		EventType: "account.lockout",
+		Payload:   []byte(`{}`),
+		Attempts:  8,
+		Error:     "connection refused",
+		Updated:   170000000,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRetryWebhookDeadLetter(t *testing.T) {
+	repo, mock, closeFn := setupMockDB(t)
+	defer closeFn()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`delete from webhook_dead_letters where id = $1 returning delivery_id`)).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"delivery_id"}).AddRow(9))
+	mock.ExpectExec(regexp.QuoteMeta(`update webhook_deliveries set status = $1, attempts = 0, next_attempt = $2, updated = $2 where id = $3`)).
+		WithArgs("pending", int64(170000000), 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	deliveryID, err := repo.RetryWebhookDeadLetter(3, 170000000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if deliveryID != 9 {
+		t.Errorf("expected delivery 9, got %d", deliveryID)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`delete from webhook_dead_letters where id = $1 returning delivery_id`)).
+		WithArgs(8).
+		WillReturnRows(sqlmock.NewRows([]string{"delivery_id"}))
+	mock.ExpectRollback()
+
+	if _, err := repo.RetryWebhookDeadLetter(8, 170000000); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
@@ -26,6 +26,79 @@ type DatabaseRepo interface {
 	GetUserByEmail(email string) (*models.User, error)
 	GetUserByID(id int) (*models.User, error)
 	GetReleases() ([]map[string]string, error) // Add this
+	GetDBGrant(userID, dbID int) (*models.DBGrant, error)
+	CreateDBCredential(grant models.DBGrant, role, password string, expiresAt int64) (*models.DBCredential, error)
+	ExpiredDBCredentials(now int64) ([]*models.DBCredential, error)
+	RevokeDBCredential(cred models.DBCredential) error
+	InsertLaunchCode(codeHash string, userID, appID, impersonationID int, expiresAt int64) error
+	ConsumeLaunchCode(codeHash string, appID int, now int64) (int, int, error)
+	UpdateUserLastApp(userID, appID int) error
+	GetAppGrant(userID, appID int) (*models.AppGrant, error)
+	GetUserIdentity(provider, subject string) (*models.UserIdentity, error)
+	LinkUserIdentity(identity models.UserIdentity) (int, error)
+	InsertUser(user models.User) (int, error)
+	UpdateUserAttributes(userID, companyID, groupID, profileID int) error
+	GetSAMLServiceProvider(entityID string) (*models.SAMLServiceProvider, error)
+	GetSAMLServiceProviderByApp(appID int) (*models.SAMLServiceProvider, error)
+	UpsertSAMLServiceProvider(sp models.SAMLServiceProvider) (int, error)
+	DeleteSAMLServiceProvider(appID int) error
+	InsertMagicLogin(login models.MagicLogin) (int, error)
+	CountMagicLogins(userID int, since int64) (int, error)
+	GetMagicLogin(browserHash string, now int64) (*models.MagicLogin, error)
+	ConsumeMagicLogin(id int) (int, error)
+	FailMagicLogin(id, maxAttempts int) error
+	InsertPersonalAccessToken(token models.PersonalAccessToken) (int, error)
+	GetPersonalAccessToken(tokenHash string) (*models.PersonalAccessToken, error)
+	ListPersonalAccessTokens(userID int) ([]*models.PersonalAccessToken, error)
+	AllPersonalAccessTokens() ([]*models.PersonalAccessToken, error)
+	RevokePersonalAccessToken(id, userID int) error
+	TouchPersonalAccessToken(id int, usedAt int64) error
+	InsertLoginEvent(event models.LoginEvent) (int, error)
+	LoginEvents(filter models.LoginEventFilter) ([]*models.LoginEvent, int, error)
+	InsertAdminEvent(event models.AdminEvent) (int, error)
+	AdminEvents(filter models.AdminEventFilter) ([]*models.AdminEvent, int, error)
+	LoginEventsAfter(afterID, limit int) ([]*models.LoginEvent, error)
+	AdminEventsAfter(afterID, limit int) ([]*models.AdminEvent, error)
+	AuditHead(log string) (int, string, error)
+	InsertAuditCheckpoint(cp models.AuditCheckpoint) (int, error)
+	AuditCheckpoints(log string) ([]*models.AuditCheckpoint, error)
+	InsertWebhook(webhook models.Webhook) (int, error)
+	GetWebhook(id int) (*models.Webhook, error)
+	Webhooks() ([]*models.Webhook, error)
+	DeleteWebhook(id int) error
+	InsertWebhookDelivery(delivery models.WebhookDelivery) (int, error)
+	UpdateWebhookDelivery(delivery models.WebhookDelivery) error
+	DeadLetterWebhookDelivery(delivery models.WebhookDelivery) error
+	DueWebhookDeliveries(now int64, limit int) ([]*models.WebhookDelivery, error)
+	WebhookDeliveries(webhookID, limit, offset int) ([]*models.WebhookDelivery, int, error)
+	WebhookDeadLetters(limit, offset int) ([]*models.WebhookDeadLetter, int, error)
+	RetryWebhookDeadLetter(id int, now int64) (int, error)
+	InsertImpersonation(imp models.Impersonation) (int, error)
+	GetImpersonation(id int) (*models.Impersonation, error)
+	EndImpersonation(id int, ended int64) error
+	InsertSession(s models.Session) (int, error)
+	GetSession(id int) (*models.Session, error)
+	UserSessions(userID int, now int64) ([]*models.Session, error)
+	TouchSession(id int, lastSeen, expiresAt int64) error
+	TouchSessions(lastSeen map[int]int64) error
+	UpdateLastActions(lastAction map[int]int64) error
+	UserInCompany(userID, companyID int) (bool, error)
+	UpdateUserContext(userID, lastDb, lastApp int) error
+	RevokeSession(id, userID int, revoked int64) error
+	RevokeUserSessions(userID, exceptID int, revoked int64) (int, error)
+	UpdateAppTokenSettings(appID int, settings models.AppTokenSettings) error
+	InsertTrustedDevice(d models.TrustedDevice) (int, error)
+	GetTrustedDevice(tokenHash string) (*models.TrustedDevice, error)
+	UserTrustedDevices(userID int, now int64) ([]*models.TrustedDevice, error)
+	TouchTrustedDevice(id int, lastUsed int64) error
+	RevokeTrustedDevice(id, userID int, revoked int64) error
+	RevokeUserTrustedDevices(userID int, revoked int64) (int, error)
+	SetAppClientSecret(appID int, secretHash string) error
+	GetAppClientSecret(appID int) (string, error)
+	GetDirectoryPasswordHash(userID int) (string, error)
+	SetDirectoryPasswordHash(userID int, hash string) error
+	UpdateDirectoryUser(userID int, userName, lan string, groupID int) error
+	DeactivateUser(userID int) error
 }
 
 // MockDBRepo is a mock implementation of the DatabaseRepo interface for testing purposes.
@@ -89,3 +162,368 @@ func (m *MockDBRepo) GetUserByID(id int) (*models.User, error) {
 	args := m.Called(id)
 	return args.Get(0).(*models.User), args.Error(1)
 }
+
+func (m *MockDBRepo) GetDBGrant(userID, dbID int) (*models.DBGrant, error) {
+	args := m.Called(userID, dbID)
+	return args.Get(0).(*models.DBGrant), args.Error(1)
+}
+
+func (m *MockDBRepo) CreateDBCredential(grant models.DBGrant, role, password string, expiresAt int64) (*models.DBCredential, error) {
+	args := m.Called(grant, role, password, expiresAt)
+	return args.Get(0).(*models.DBCredential), args.Error(1)
+}
+
+func (m *MockDBRepo) ExpiredDBCredentials(now int64) ([]*models.DBCredential, error) {
+	args := m.Called(now)
+	return args.Get(0).([]*models.DBCredential), args.Error(1)
+}
+
+func (m *MockDBRepo) RevokeDBCredential(cred models.DBCredential) error {
+	args := m.Called(cred)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) InsertLaunchCode(codeHash string, userID, appID, impersonationID int, expiresAt int64) error {
+	args := m.Called(codeHash, userID, appID, impersonationID, expiresAt)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) ConsumeLaunchCode(codeHash string, appID int, now int64) (int, int, error) {
+	args := m.Called(codeHash, appID, now)
+	return args.Int(0), args.Int(1), args.Error(2)
+}
+
+func (m *MockDBRepo) UpdateUserLastApp(userID, appID int) error {
+	args := m.Called(userID, appID)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) GetAppGrant(userID, appID int) (*models.AppGrant, error) {
+	args := m.Called(userID, appID)
+	return args.Get(0).(*models.AppGrant), args.Error(1)
+}
+
+func (m *MockDBRepo) GetUserIdentity(provider, subject string) (*models.UserIdentity, error) {
+	args := m.Called(provider, subject)
+	return args.Get(0).(*models.UserIdentity), args.Error(1)
+}
+
+func (m *MockDBRepo) LinkUserIdentity(identity models.UserIdentity) (int, error) {
+	args := m.Called(identity)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) InsertUser(user models.User) (int, error) {
+	args := m.Called(user)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) UpdateUserAttributes(userID, companyID, groupID, profileID int) error {
+	args := m.Called(userID, companyID, groupID, profileID)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) GetSAMLServiceProvider(entityID string) (*models.SAMLServiceProvider, error) {
+	args := m.Called(entityID)
+	return args.Get(0).(*models.SAMLServiceProvider), args.Error(1)
+}
+
+func (m *MockDBRepo) GetSAMLServiceProviderByApp(appID int) (*models.SAMLServiceProvider, error) {
+	args := m.Called(appID)
+	return args.Get(0).(*models.SAMLServiceProvider), args.Error(1)
+}
+
+func (m *MockDBRepo) UpsertSAMLServiceProvider(sp models.SAMLServiceProvider) (int, error) {
+	args := m.Called(sp)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) DeleteSAMLServiceProvider(appID int) error {
+	args := m.Called(appID)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) InsertMagicLogin(login models.MagicLogin) (int, error) {
+	args := m.Called(login)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) CountMagicLogins(userID int, since int64) (int, error) {
+	args := m.Called(userID, since)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) GetMagicLogin(browserHash string, now int64) (*models.MagicLogin, error) {
+	args := m.Called(browserHash, now)
+	return args.Get(0).(*models.MagicLogin), args.Error(1)
+}
+
+func (m *MockDBRepo) ConsumeMagicLogin(id int) (int, error) {
+	args := m.Called(id)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) FailMagicLogin(id, maxAttempts int) error {
+	args := m.Called(id, maxAttempts)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) InsertPersonalAccessToken(token models.PersonalAccessToken) (int, error) {
+	args := m.Called(token)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) GetPersonalAccessToken(tokenHash string) (*models.PersonalAccessToken, error) {
+	args := m.Called(tokenHash)
+	return args.Get(0).(*models.PersonalAccessToken), args.Error(1)
+}
+
+func (m *MockDBRepo) ListPersonalAccessTokens(userID int) ([]*models.PersonalAccessToken, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]*models.PersonalAccessToken), args.Error(1)
+}
+
+func (m *MockDBRepo) AllPersonalAccessTokens() ([]*models.PersonalAccessToken, error) {
+	args := m.Called()
+	return args.Get(0).([]*models.PersonalAccessToken), args.Error(1)
+}
+
+func (m *MockDBRepo) RevokePersonalAccessToken(id, userID int) error {
+	args := m.Called(id, userID)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) TouchPersonalAccessToken(id int, usedAt int64) error {
+	args := m.Called(id, usedAt)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) InsertLoginEvent(event models.LoginEvent) (int, error) {
+	args := m.Called(event)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) LoginEvents(filter models.LoginEventFilter) ([]*models.LoginEvent, int, error) {
+	args := m.Called(filter)
+	return args.Get(0).([]*models.LoginEvent), args.Int(1), args.Error(2)
+}
+
+func (m *MockDBRepo) InsertAdminEvent(event models.AdminEvent) (int, error) {
+	args := m.Called(event)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) AdminEvents(filter models.AdminEventFilter) ([]*models.AdminEvent, int, error) {
+	args := m.Called(filter)
+	return args.Get(0).([]*models.AdminEvent), args.Int(1), args.Error(2)
+}
+
+func (m *MockDBRepo) LoginEventsAfter(afterID, limit int) ([]*models.LoginEvent, error) {
+	args := m.Called(afterID, limit)
+	return args.Get(0).([]*models.LoginEvent), args.Error(1)
+}
+
+func (m *MockDBRepo) AdminEventsAfter(afterID, limit int) ([]*models.AdminEvent, error) {
+	args := m.Called(afterID, limit)
+	return args.Get(0).([]*models.AdminEvent), args.Error(1)
+}
+
+func (m *MockDBRepo) AuditHead(log string) (int, string, error) {
+	args := m.Called(log)
+	return args.Int(0), args.String(1), args.Error(2)
+}
+
+func (m *MockDBRepo) InsertAuditCheckpoint(cp models.AuditCheckpoint) (int, error) {
+	args := m.Called(cp)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) AuditCheckpoints(log string) ([]*models.AuditCheckpoint, error) {
+	args := m.Called(log)
+	return args.Get(0).([]*models.AuditCheckpoint), args.Error(1)
+}
+
+func (m *MockDBRepo) InsertWebhook(webhook models.Webhook) (int, error) {
+	args := m.Called(webhook)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) GetWebhook(id int) (*models.Webhook, error) {
+	args := m.Called(id)
+	return args.Get(0).(*models.Webhook), args.Error(1)
+}
+
+func (m *MockDBRepo) Webhooks() ([]*models.Webhook, error) {
+	args := m.Called()
+	return args.Get(0).([]*models.Webhook), args.Error(1)
+}
+
+func (m *MockDBRepo) DeleteWebhook(id int) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) InsertWebhookDelivery(delivery models.WebhookDelivery) (int, error) {
+	args := m.Called(delivery)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) UpdateWebhookDelivery(delivery models.WebhookDelivery) error {
+	args := m.Called(delivery)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) DeadLetterWebhookDelivery(delivery models.WebhookDelivery) error {
+	args := m.Called(delivery)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) DueWebhookDeliveries(now int64, limit int) ([]*models.WebhookDelivery, error) {
+	args := m.Called(now, limit)
+	return args.Get(0).([]*models.WebhookDelivery), args.Error(1)
+}
+
+func (m *MockDBRepo) WebhookDeliveries(webhookID, limit, offset int) ([]*models.WebhookDelivery, int, error) {
+	args := m.Called(webhookID, limit, offset)
+	return args.Get(0).([]*models.WebhookDelivery), args.Int(1), args.Error(2)
+}
+
+func (m *MockDBRepo) WebhookDeadLetters(limit, offset int) ([]*models.WebhookDeadLetter, int, error) {
+	args := m.Called(limit, offset)
+	return args.Get(0).([]*models.WebhookDeadLetter), args.Int(1), args.Error(2)
+}
+
+func (m *MockDBRepo) RetryWebhookDeadLetter(id int, now int64) (int, error) {
+	args := m.Called(id, now)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) InsertImpersonation(imp models.Impersonation) (int, error) {
+	args := m.Called(imp)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) GetImpersonation(id int) (*models.Impersonation, error) {
+	args := m.Called(id)
+	return args.Get(0).(*models.Impersonation), args.Error(1)
+}
+
+func (m *MockDBRepo) EndImpersonation(id int, ended int64) error {
+	args := m.Called(id, ended)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) InsertSession(s models.Session) (int, error) {
+	args := m.Called(s)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) GetSession(id int) (*models.Session, error) {
+	args := m.Called(id)
+	return args.Get(0).(*models.Session), args.Error(1)
+}
+
+func (m *MockDBRepo) UserSessions(userID int, now int64) ([]*models.Session, error) {
+	args := m.Called(userID, now)
+	return args.Get(0).([]*models.Session), args.Error(1)
+}
+
+func (m *MockDBRepo) TouchSession(id int, lastSeen, expiresAt int64) error {
+	args := m.Called(id, lastSeen, expiresAt)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) RevokeSession(id, userID int, revoked int64) error {
+	args := m.Called(id, userID, revoked)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) RevokeUserSessions(userID, exceptID int, revoked int64) (int, error) {
+	args := m.Called(userID, exceptID, revoked)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) TouchSessions(lastSeen map[int]int64) error {
+	args := m.Called(lastSeen)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) UpdateLastActions(lastAction map[int]int64) error {
+	args := m.Called(lastAction)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) UserInCompany(userID, companyID int) (bool, error) {
+	args := m.Called(userID, companyID)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockDBRepo) UpdateUserContext(userID, lastDb, lastApp int) error {
+	args := m.Called(userID, lastDb, lastApp)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) UpdateAppTokenSettings(appID int, settings models.AppTokenSettings) error {
+	args := m.Called(appID, settings)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) InsertTrustedDevice(d models.TrustedDevice) (int, error) {
+	args := m.Called(d)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) GetTrustedDevice(tokenHash string) (*models.TrustedDevice, error) {
+	args := m.Called(tokenHash)
+	return args.Get(0).(*models.TrustedDevice), args.Error(1)
+}
+
+func (m *MockDBRepo) UserTrustedDevices(userID int, now int64) ([]*models.TrustedDevice, error) {
+	args := m.Called(userID, now)
+	return args.Get(0).([]*models.TrustedDevice), args.Error(1)
+}
+
+func (m *MockDBRepo) TouchTrustedDevice(id int, lastUsed int64) error {
+	args := m.Called(id, lastUsed)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) RevokeTrustedDevice(id, userID int, revoked int64) error {
+	args := m.Called(id, userID, revoked)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) RevokeUserTrustedDevices(userID int, revoked int64) (int, error) {
+	args := m.Called(userID, revoked)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDBRepo) SetAppClientSecret(appID int, secretHash string) error {
+	args := m.Called(appID, secretHash)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) GetAppClientSecret(appID int) (string, error) {
+	args := m.Called(appID)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockDBRepo) GetDirectoryPasswordHash(userID int) (string, error) {
+	args := m.Called(userID)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockDBRepo) SetDirectoryPasswordHash(userID int, hash string) error {
+	args := m.Called(userID, hash)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) UpdateDirectoryUser(userID int, userName, lan string, groupID int) error {
+	args := m.Called(userID, userName, lan, groupID)
+	return args.Error(0)
+}
+
+func (m *MockDBRepo) DeactivateUser(userID int) error {
+	args := m.Called(userID)
+	return args.Error(0)
+}
@@ -0,0 +1,94 @@
+// Package events is the in-process bus of the security events of the server: the lockouts,
+// the failed multi-factor authentications, the changes of the second factors of the users, the admin
+// changes and every event of the login audit trail. The outbound integrations, like the webhooks and
+// the event sinks, subscribe to it. The server has no password reset, so no event is published for one.
+package events
+
+import (
+	"authserver-backend/internal/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The types of the security events. The Data of TypeMFAChanged holds the change, "device_trusted"
+// or "device_revoked", and how many devices it is about.
+const (
+	TypeLockout     = "account.lockout"
+	TypeMFAFailed   = "mfa.failed"
+	TypeMFAChanged  = "mfa.changed"
+	TypeAdminChange = "admin.change"
+)
+
+// The changes of the events of TypeMFAChanged.
+const (
+	MFADeviceTrusted = "device_trusted"
+	MFADeviceRevoked = "device_revoked"
+)
+
+// AuthPrefix prefixes the types of the authentication events, published for every event of
+// the login audit trail: "auth.login", "auth.refresh", "auth.logout", "auth.lockout" and "auth.mfa".
+// Their Data holds success, method, reason and user_agent.
+const AuthPrefix = "auth."
+
+// Event is a security event. UserID and Login are the account it is about, when there is one:
+// the locked out or failing user, or the admin who made a change. Data holds what is specific to its type.
+type Event struct {
+	ID     string         `json:"id"`
+	Type   string         `json:"type"`
+	Time   int64          `json:"time"`
+	UserID int            `json:"user_id,omitempty"`
+	Login  string         `json:"login,omitempty"`
+	IP     string         `json:"ip,omitempty"`
+	Data   map[string]any `json:"data,omitempty"`
+}
+
+// Handler receives the published events. It is called by the publisher, so it must not block:
+// a handler doing I/O queues the event and does it in its own goroutine.
+type Handler func(Event)
+
+// Bus delivers the published events to every subscribed handler. The zero value is ready to use.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+// Subscribe adds a handler of the events published from now on.
+func (b *Bus) Subscribe(h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, h)
+}
+
+// Publish gives an event an id and a time, when it has none, and hands it to the handlers.
+func (b *Bus) Publish(e Event) {
+	if e.ID == "" {
+		e.ID, _ = utils.RandomToken(16)
+	}
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, h := range b.handlers {
+		h(e)
+	}
+}
+
+// Match tells whether an event type is selected by a list of patterns: an exact type, a prefix
+// ending with ".*" like "admin.*", or "*". An empty list selects every type.
+func Match(patterns []string, eventType string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		switch {
+		case p == "*" || p == eventType:
+			return true
+		case strings.HasSuffix(p, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(p, "*")):
+			return true
+		}
+	}
+	return false
+}
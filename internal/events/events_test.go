@@ -0,0 +1,46 @@
+package events_test
+
+import (
+	"authserver-backend/internal/events"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus(t *testing.T) {
+	var bus events.Bus
+	bus.Publish(events.Event{Type: events.TypeLockout}) // no handler yet
+
+	var first, second []events.Event
+	bus.Subscribe(func(e events.Event) { first = append(first, e) })
+	bus.Subscribe(func(e events.Event) { second = append(second, e) })
+	bus.Publish(events.Event{Type: events.TypeLockout, Login: "user@example.com"})
+	bus.Publish(events.Event{ID: "given", Type: events.TypeMFAFailed, Time: 1700000000})
+
+	if assert.Len(t, first, 2) && assert.Len(t, second, 2) {
+		assert.NotEmpty(t, first[0].ID)
+		assert.NotZero(t, first[0].Time)
+		assert.Equal(t, first[0], second[0])
+		assert.Equal(t, "given", first[1].ID)
+		assert.Equal(t, int64(1700000000), first[1].Time)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		patterns  []string
+		eventType string
+		want      bool
+	}{
+		{nil, events.TypeLockout, true},
+		{[]string{"*"}, events.TypeAdminChange, true},
+		{[]string{events.TypeLockout}, events.TypeLockout, true},
+		{[]string{events.TypeLockout}, events.TypeMFAFailed, false},
+		{[]string{"mfa.*"}, events.TypeMFAFailed, true},
+		{[]string{"mfa.*"}, "mfaother.failed", false},
+		{[]string{"account.*", "admin.*"}, events.TypeAdminChange, true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, events.Match(tt.patterns, tt.eventType), "%v %s", tt.patterns, tt.eventType)
+	}
+}
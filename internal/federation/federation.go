@@ -0,0 +1,181 @@
+// Package federation lets users sign in with an upstream OpenID Connect identity provider
+// (Google, Azure AD, Keycloak, ...) instead of a local password.
+// The providers are configured in a JSON file, the server uses the authorization code flow with PKCE
+// and verifies the ID token returned by the provider. Matching the upstream identity
+// to a local user and issuing the server's own tokens is done by the api package.
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ProviderConfig describes an upstream OpenID Connect provider.
+// TrustEmail marks the email of every identity as verified, for providers like Azure AD
+// that only hand out addresses they manage and do not send the email_verified claim.
+// Provisioning holds the rules to create and update local users from the upstream claims.
+type ProviderConfig struct {
+	Name         string             `json:"name"`
+	Issuer       string             `json:"issuer"`
+	ClientID     string             `json:"client_id"`
+	ClientSecret string             `json:"client_secret"`
+	RedirectURL  string             `json:"redirect_url"`
+	Scopes       []string           `json:"scopes"`
+	TrustEmail   bool               `json:"trust_email"`
+	Provisioning ProvisioningConfig `json:"provisioning"`
+}
+
+// Identity is the user as asserted by an upstream provider in its ID token.
+// Claims holds every claim of the token, so other claims can be mapped later on.
+type Identity struct {
+	Provider          string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+	Claims            map[string]any
+}
+
+// Provider is an upstream provider ready to be used in the authorization code flow.
+type Provider struct {
+	Name         string
+	oauth        oauth2.Config
+	verifier     *oidc.IDTokenVerifier
+	trustEmail   bool
+	provisioning ProvisioningConfig
+}
+
+// Providers holds the configured providers by name, the name is used in the login URLs.
+type Providers map[string]*Provider
+
+// LoadConfig reads the provider configurations from a JSON file holding an array of ProviderConfig.
+func LoadConfig(path string) ([]ProviderConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []ProviderConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid provider configuration %s: %w", path, err)
+	}
+	return configs, nil
+}
+
+// NewProvider fetches the discovery document of the provider and prepares the OAuth2 client.
+func NewProvider(ctx context.Context, cfg ProviderConfig) (*Provider, error) {
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, errors.New("provider name, issuer and client_id are required")
+	}
+
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("provider %s: %w", cfg.Name, err)
+	}
+
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"profile", "email"}
+	}
+
+	return &Provider{
+		Name: cfg.Name,
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		},
+		verifier:     provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		trustEmail:   cfg.TrustEmail,
+		provisioning: cfg.Provisioning,
+	}, nil
+}
+
+// NewProviders prepares every configured provider. A provider that cannot be reached is left out
+// and reported in the returned error, so one provider being down does not stop the others.
+func NewProviders(ctx context.Context, configs []ProviderConfig) (Providers, error) {
+	providers := Providers{}
+	var errs []error
+	for _, cfg := range configs {
+		p, err := NewProvider(ctx, cfg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		providers[p.Name] = p
+	}
+	return providers, errors.Join(errs...)
+}
+
+// AuthCodeURL returns the address of the provider's login page.
+// The state, nonce and PKCE verifier have to be kept by the caller until the callback.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	return p.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange trades the authorization code of the callback for the provider's tokens,
+// verifies the ID token and its nonce and returns the identity it asserts.
+func (p *Provider) Exchange(ctx context.Context, code, nonce, verifier string) (*Identity, error) {
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("code exchange failed: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("provider returned no id_token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("invalid id_token nonce")
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	var standard struct {
+		Email             string `json:"email"`
+		EmailVerified     any    `json:"email_verified"`
+		Name              string `json:"name"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	if err := idToken.Claims(&standard); err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Provider:          p.Name,
+		Subject:           idToken.Subject,
+		Email:             standard.Email,
+		EmailVerified:     p.trustEmail || isTrue(standard.EmailVerified),
+		Name:              standard.Name,
+		PreferredUsername: standard.PreferredUsername,
+		Claims:            claims,
+	}, nil
+}
+
+// isTrue reads a boolean claim. Some providers send email_verified as the string "true".
+func isTrue(v any) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case string:
+		return b == "true"
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package federation_test
+
+import (
+	"authserver-backend/internal/federation"
+	"authserver-backend/internal/federation/oidctest"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// newTestProvider starts a mock upstream provider and configures a federation provider for it.
+func newTestProvider(t *testing.T, trustEmail bool) (*oidctest.Provider, *federation.Provider) {
+	upstream := oidctest.NewProvider("authserver", "client-secret")
+	t.Cleanup(upstream.Close)
+
+	provider, err := federation.NewProvider(context.Background(), federation.ProviderConfig{
+		Name:         "keycloak",
+		Issuer:       upstream.Issuer(),
+		ClientID:     "authserver",
+		ClientSecret: "client-secret",
+		RedirectURL:  "https://auth.example.com/login/keycloak/callback",
+		TrustEmail:   trustEmail,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return upstream, provider
+}
+
+// TestExchange tests the whole authorization code flow against the mock provider.
+func TestExchange(t *testing.T) {
+	upstream, provider := newTestProvider(t, false)
+	upstream.Claims = map[string]any{"email": "user@example.com", "email_verified": true, "name": "Test User", "groups": []string{"staff"}}
+
+	verifier := oauth2.GenerateVerifier()
+	callback, err := upstream.Login(provider.AuthCodeURL("the-state", "the-nonce", verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "the-state", callback.Query().Get("state"))
+
+	identity, err := provider.Exchange(context.Background(), callback.Query().Get("code"), "the-nonce", verifier)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	assert.Equal(t, "keycloak", identity.Provider)
+	assert.Equal(t, "upstream-user-1", identity.Subject)
+	assert.Equal(t, "user@example.com", identity.Email)
+	assert.True(t, identity.EmailVerified)
+	assert.Equal(t, "Test User", identity.Name)
+	assert.Equal(t, []any{"staff"}, identity.Claims["groups"])
+}
+
+// TestExchange_WrongNonce tests that an ID token minted for another login is refused.
+func TestExchange_WrongNonce(t *testing.T) {
+	upstream, provider := newTestProvider(t, false)
+
+	verifier := oauth2.GenerateVerifier()
+	callback, err := upstream.Login(provider.AuthCodeURL("the-state", "other-nonce", verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = provider.Exchange(context.Background(), callback.Query().Get("code"), "the-nonce", verifier)
+	assert.Error(t, err)
+}
+
+// TestExchange_WrongVerifier tests that the code cannot be exchanged without the PKCE verifier.
+func TestExchange_WrongVerifier(t *testing.T) {
+	upstream, provider := newTestProvider(t, false)
+
+	callback, err := upstream.Login(provider.AuthCodeURL("the-state", "the-nonce", oauth2.GenerateVerifier()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = provider.Exchange(context.Background(), callback.Query().Get("code"), "the-nonce", oauth2.GenerateVerifier())
+	assert.Error(t, err)
+}
+
+// TestExchange_EmailVerification tests how the email_verified claim is read.
+func TestExchange_EmailVerification(t *testing.T) {
+	upstream, provider := newTestProvider(t, false)
+
+	login := func() *federation.Identity {
+		verifier := oauth2.GenerateVerifier()
+		callback, err := upstream.Login(provider.AuthCodeURL("s", "n", verifier))
+		if err != nil {
+			t.Fatal(err)
+		}
+		identity, err := provider.Exchange(context.Background(), callback.Query().Get("code"), "n", verifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return identity
+	}
+
+	upstream.Claims = map[string]any{"email": "user@example.com"}
+	assert.False(t, login().EmailVerified)
+
+	upstream.Claims = map[string]any{"email": "user@example.com", "email_verified": "true"}
+	assert.True(t, login().EmailVerified)
+
+	// providers trusted for their emails do not need the claim
+	upstream, provider = newTestProvider(t, true)
+	upstream.Claims = map[string]any{"email": "user@example.com"}
+	assert.True(t, login().EmailVerified)
+}
+
+// TestNewProviders tests that an unreachable provider is reported without dropping the others.
+func TestNewProviders(t *testing.T) {
+	upstream := oidctest.NewProvider("authserver", "client-secret")
+	defer upstream.Close()
+
+	providers, err := federation.NewProviders(context.Background(), []federation.ProviderConfig{
+		{Name: "keycloak", Issuer: upstream.Issuer(), ClientID: "authserver"},
+		{Name: "down", Issuer: "http://127.0.0.1:1", ClientID: "authserver"},
+	})
+	assert.Error(t, err)
+	assert.Len(t, providers, 1)
+	assert.NotNil(t, providers["keycloak"])
+}
+
+// TestLoadConfig tests reading the provider configuration file.
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "providers.json")
+	err := os.WriteFile(path, []byte(`[{"name":"google","issuer":"https://accounts.google.com","client_id":"id","client_secret":"secret","redirect_url":"https://auth.example.com/login/google/callback"}]`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configs, err := federation.LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Len(t, configs, 1)
+	assert.Equal(t, "google", configs[0].Name)
+	assert.Equal(t, "secret", configs[0].ClientSecret)
+
+	_, err = federation.LoadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package federation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Attributes are the user attributes the provisioning rules can set.
+// A nil field is left as it is on the local user.
+type Attributes struct {
+	CompanyID *int `json:"company_id,omitempty"`
+	GroupID   *int `json:"group_id,omitempty"`
+	ProfileID *int `json:"profile_id,omitempty"`
+}
+
+// merge copies the fields set in other over a.
+func (a *Attributes) merge(other Attributes) {
+	if other.CompanyID != nil {
+		a.CompanyID = other.CompanyID
+	}
+	if other.GroupID != nil {
+		a.GroupID = other.GroupID
+	}
+	if other.ProfileID != nil {
+		a.ProfileID = other.ProfileID
+	}
+}
+
+// ClaimRule sets attributes when an upstream claim has a given value.
+// For claims holding a list, like groups, it is enough that the list contains the value.
+type ClaimRule struct {
+	Claim  string     `json:"claim"`
+	Equals string     `json:"equals"`
+	Set    Attributes `json:"set"`
+}
+
+// ProvisioningConfig holds the just-in-time provisioning rules of a provider.
+// When Enabled, a first login without a local user creates one, and the attributes
+// of the user are updated from the rules on every login. The rules are applied in order,
+// later ones win: Default, then Domains by the domain of the email, then ClaimRules,
+// then Claims, which maps an attribute (company_id, group_id or profile_id) directly
+// to an upstream claim holding the id.
+type ProvisioningConfig struct {
+	Enabled    bool                  `json:"enabled"`
+	Default    Attributes            `json:"default"`
+	Domains    map[string]Attributes `json:"domains"`
+	ClaimRules []ClaimRule           `json:"claim_rules"`
+	Claims     map[string]string     `json:"claims"`
+}
+
+// Provisioning returns the provisioning rules of the provider.
+func (p *Provider) Provisioning() ProvisioningConfig {
+	return p.provisioning
+}
+
+// Attributes applies the rules to an identity and returns the attributes the local user should have.
+func (c ProvisioningConfig) Attributes(identity *Identity) (Attributes, error) {
+	attrs := Attributes{}
+	attrs.merge(c.Default)
+
+	if at := strings.LastIndex(identity.Email, "@"); at >= 0 {
+		domain := strings.ToLower(identity.Email[at+1:])
+		if domainAttrs, ok := c.Domains[domain]; ok {
+			attrs.merge(domainAttrs)
+		}
+	}
+
+	for _, rule := range c.ClaimRules {
+		if claimHasValue(identity.Claims[rule.Claim], rule.Equals) {
+			attrs.merge(rule.Set)
+		}
+	}
+
+	for attribute, claim := range c.Claims {
+		value, ok := identity.Claims[claim]
+		if !ok {
+			continue
+		}
+		id, err := claimInt(value)
+		if err != nil {
+			return Attributes{}, fmt.Errorf("claim %s mapped to %s: %w", claim, attribute, err)
+		}
+		switch attribute {
+		case "company_id":
+			attrs.CompanyID = &id
+		case "group_id":
+			attrs.GroupID = &id
+		case "profile_id":
+			attrs.ProfileID = &id
+		default:
+			return Attributes{}, fmt.Errorf("unknown attribute %s in claim mapping", attribute)
+		}
+	}
+
+	return attrs, nil
+}
+
+// claimHasValue tells whether a claim equals a value, or contains it when the claim is a list.
+func claimHasValue(claim any, value string) bool {
+	switch c := claim.(type) {
+	case []any:
+		for _, v := range c {
+			if fmt.Sprint(v) == value {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		return fmt.Sprint(c) == value
+	}
+}
+
+// claimInt reads a claim holding an id, sent either as a JSON number or as a string.
+func claimInt(claim any) (int, error) {
+	switch c := claim.(type) {
+	case float64:
+		if c != float64(int(c)) {
+			return 0, fmt.Errorf("%v is not an integer", c)
+		}
+		return int(c), nil
+	case string:
+		return strconv.Atoi(c)
+	}
+	return 0, fmt.Errorf("%v is not an id", claim)
+}
@@ -0,0 +1,63 @@
+package federation_test
+
+import (
+	"authserver-backend/internal/federation"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestProvisioningAttributes tests the order in which the provisioning rules are applied.
+func TestProvisioningAttributes(t *testing.T) {
+	var rules federation.ProvisioningConfig
+	err := json.Unmarshal([]byte(`{
+		"enabled": true,
+		"default": {"company_id": 1, "group_id": 1, "profile_id": 1},
+		"domains": {"partner.com": {"company_id": 2}},
+		"claim_rules": [
+			{"claim": "groups", "equals": "admins", "set": {"profile_id": 5}},
+			{"claim": "department", "equals": "sales", "set": {"group_id": 3}}
+		],
+		"claims": {"company_id": "tenant"}
+	}`), &rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, err := rules.Attributes(&federation.Identity{Email: "someone@gmail.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, *attrs.CompanyID)
+	assert.Equal(t, 1, *attrs.GroupID)
+	assert.Equal(t, 1, *attrs.ProfileID)
+
+	attrs, err = rules.Attributes(&federation.Identity{
+		Email:  "someone@Partner.com",
+		Claims: map[string]any{"groups": []any{"staff", "admins"}, "department": "sales"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, *attrs.CompanyID)
+	assert.Equal(t, 3, *attrs.GroupID)
+	assert.Equal(t, 5, *attrs.ProfileID)
+
+	// a claim holding the id wins over the domain
+	attrs, err = rules.Attributes(&federation.Identity{Email: "someone@partner.com", Claims: map[string]any{"tenant": float64(8)}})
+	assert.NoError(t, err)
+	assert.Equal(t, 8, *attrs.CompanyID)
+
+	attrs, err = rules.Attributes(&federation.Identity{Claims: map[string]any{"tenant": "9"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 9, *attrs.CompanyID)
+
+	_, err = rules.Attributes(&federation.Identity{Claims: map[string]any{"tenant": "acme"}})
+	assert.Error(t, err)
+}
+
+// TestProvisioningAttributes_Unset tests that attributes without a rule are left unset.
+func TestProvisioningAttributes_Unset(t *testing.T) {
+	attrs, err := federation.ProvisioningConfig{Enabled: true}.Attributes(&federation.Identity{Email: "someone@example.com"})
+	assert.NoError(t, err)
+	assert.Nil(t, attrs.CompanyID)
+	assert.Nil(t, attrs.GroupID)
+	assert.Nil(t, attrs.ProfileID)
+}
@@ -0,0 +1,126 @@
+// Package mailer sends the emails of the server, like the magic login links.
+// SMTP sends them for real, Outbox keeps them in memory for the tests
+// and FileOutbox writes them to a directory for development.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// format returns the message as sent on the wire.
+func format(from string, msg Message, date time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// checkHeaders refuses header values that would inject other headers.
+func checkHeaders(values ...string) error {
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid email header value %q", v)
+		}
+	}
+	return nil
+}
+
+// SMTP sends the emails through an SMTP server, with PLAIN authentication when Username is set.
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// Send implements Mailer.
+func (s SMTP) Send(_ context.Context, msg Message) error {
+	if err := checkHeaders(s.From, msg.To, msg.Subject); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	return smtp.SendMail(addr, auth, s.From, []string{msg.To}, format(s.From, msg, time.Now()))
+}
+
+// Outbox keeps the emails in memory.
+type Outbox struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Send implements Mailer.
+func (o *Outbox) Send(_ context.Context, msg Message) error {
+	if err := checkHeaders(msg.To, msg.Subject); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, msg)
+	return nil
+}
+
+// Messages returns the emails sent so far.
+func (o *Outbox) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Message(nil), o.messages...)
+}
+
+// Last returns the last email sent, if any.
+func (o *Outbox) Last() (Message, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.messages) == 0 {
+		return Message{}, false
+	}
+	return o.messages[len(o.messages)-1], true
+}
+
+// FileOutbox writes every email to a file of Dir, named after the time it was sent.
+type FileOutbox struct {
+	Dir  string
+	From string
+}
+
+// Send implements Mailer.
+func (f FileOutbox) Send(_ context.Context, msg Message) error {
+	if err := checkHeaders(f.From, msg.To, msg.Subject); err != nil {
+		return err
+	}
+	now := time.Now()
+	name := filepath.Join(f.Dir, fmt.Sprintf("%d.eml", now.UnixNano()))
+	return os.WriteFile(name, format(f.From, msg, now), 0o600)
+}
@@ -0,0 +1,47 @@
+package mailer_test
+
+import (
+	"authserver-backend/internal/mailer"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	outbox := &mailer.Outbox{}
+
+	_, ok := outbox.Last()
+	assert.False(t, ok)
+
+	err := outbox.Send(context.Background(), mailer.Message{To: "user@example.com", Subject: "Hello", Body: "Hi"})
+	assert.NoError(t, err)
+
+	last, ok := outbox.Last()
+	assert.True(t, ok)
+	assert.Equal(t, "user@example.com", last.To)
+	assert.Len(t, outbox.Messages(), 1)
+
+	// headers cannot be injected through the recipient or the subject
+	err = outbox.Send(context.Background(), mailer.Message{To: "user@example.com\r\nBcc: other@example.com", Subject: "Hello"})
+	assert.Error(t, err)
+	assert.Len(t, outbox.Messages(), 1)
+}
+
+func TestFileOutbox(t *testing.T) {
+	dir := t.TempDir()
+	outbox := mailer.FileOutbox{Dir: dir, From: "auth@example.com"}
+
+	err := outbox.Send(context.Background(), mailer.Message{To: "user@example.com", Subject: "Your code", Body: "123456\nBye"})
+	assert.NoError(t, err)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if assert.Len(t, files, 1) {
+		data, _ := os.ReadFile(files[0])
+		assert.True(t, strings.HasPrefix(string(data), "From: auth@example.com\r\nTo: user@example.com\r\nSubject: Your code\r\n"))
+		assert.True(t, strings.HasSuffix(string(data), "\r\n\r\n123456\r\nBye"))
+	}
+}
@@ -0,0 +1,49 @@
+package models
+
+import "encoding/json"
+
+// The admin actions of the admin audit log.
+const (
+	AdminActionCreate = "create"
+	AdminActionUpdate = "update"
+	AdminActionDelete = "delete"
+	// An admin started or stopped impersonating the user of the entity.
+	AdminActionStartImpersonation = "start_impersonation"
+	AdminActionStopImpersonation  = "stop_impersonation"
+	// An admin revoked a session of a user, or all of them.
+	AdminActionRevokeSessions = "revoke_sessions"
+	// An admin revoked a trusted device of a user, or all of them.
+	AdminActionRevokeTrustedDevices = "revoke_trusted_devices"
+)
+
+// AdminEvent is an entry of the admin audit log: a change an admin made to an entity.
+// The actor is the user of the verified claims of the request, or the admin impersonating them. Diff holds the changed fields
+// of the entity, by JSON name, with their old and new values. Hash chains the event to the one
+// before it, PrevHash, to make the log tamper-evident.
+type AdminEvent struct {
+	ID         int             `json:"id"`
+	ActorID    int             `json:"actor_id"`
+	ActorEmail string          `json:"actor_email"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   int             `json:"entity_id"`
+	Diff       json.RawMessage `json:"diff"`
+	IP         string          `json:"ip"`
+	Created    int64           `json:"created"`
+	PrevHash   string          `json:"prev_hash,omitempty"`
+	Hash       string          `json:"hash,omitempty"`
+}
+
+// AdminEventFilter selects admin events. The zero value of a field does not filter,
+// Since and Until bound the creation time, inclusive. Limit and Offset page the events,
+// all of them are selected when Limit is 0.
+type AdminEventFilter struct {
+	ActorID    int
+	Action     string
+	EntityType string
+	EntityID   int
+	Since      int64
+	Until      int64
+	Limit      int
+	Offset     int
+}
@@ -0,0 +1,15 @@
+package models
+
+import "github.com/lib/pq"
+
+// AppGrant represents the entitlement of a user to a catalogue app.
+// Roles are the app specific roles of the user, they are passed on to the apps
+// that rely on the server for authentication.
+type AppGrant struct {
+	ID      int            `json:"id"`
+	UserID  int            `json:"user_id"`
+	AppID   int            `json:"app_id"`
+	Roles   pq.StringArray `json:"roles"`
+	Created int64          `json:"created"`
+	Updated int64          `json:"updated"`
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// User attributes an app can add to its tokens, named after the claims carrying them.
+const (
+	AppClaimGroup   = "group_id"
+	AppClaimProfile = "profile_id"
+	AppClaimCompany = "company_id"
+	AppClaimLan     = "lan"
+)
+
+// AppClaims are the claims of AppTokenSettings.Claims.
+var AppClaims = []string{AppClaimGroup, AppClaimProfile, AppClaimCompany, AppClaimLan}
+
+// AppTokenSettings is how the tokens of a catalogue app are minted, stored with the app.
+// AccessExpiry and RefreshExpiry are the lifetimes of its access and refresh tokens in seconds:
+// the access tokens last the default lifetime when it is 0, and the app gets no refresh token when
+// RefreshExpiry is 0. Audience is the aud claim of the tokens, the app gets no token without one.
+// Claims is the template of the user attributes the tokens carry, among AppClaims.
+type AppTokenSettings struct {
+	AccessExpiry  int64    `json:"access_expiry,omitempty"`
+	RefreshExpiry int64    `json:"refresh_expiry,omitempty"`
+	Audience      string   `json:"audience,omitempty"`
+	Claims        []string `json:"claims,omitempty"`
+}
+
+// Validate checks the lifetimes are not negative, the claims are known and the audience is valid,
+// see ValidateAudience.
+func (s AppTokenSettings) Validate(reserved []string) error {
+	if s.AccessExpiry < 0 || s.RefreshExpiry < 0 {
+		return fmt.Errorf("token lifetimes cannot be negative")
+	}
+	for _, claim := range s.Claims {
+		if !slices.Contains(AppClaims, claim) {
+			return fmt.Errorf("unknown claim %q, expected one of %v", claim, AppClaims)
+		}
+	}
+	return s.ValidateAudience(reserved)
+}
+
+// ValidateAudience checks the audience is set and is none of reserved, the audiences the server accepts:
+// the tokens of the app would be accepted by the server.
+func (s AppTokenSettings) ValidateAudience(reserved []string) error {
+	if s.Audience == "" {
+		return fmt.Errorf("the audience of the tokens is required")
+	}
+	if slices.Contains(reserved, s.Audience) {
+		return fmt.Errorf("audience %q is reserved for the server", s.Audience)
+	}
+	return nil
+}
+
+// HasClaim tells whether the tokens carry a claim of the template.
+func (s AppTokenSettings) HasClaim(claim string) bool {
+	return slices.Contains(s.Claims, claim)
+}
+
+// Scan implements sql.Scanner for the jsonb column, a null column is no settings.
+func (s *AppTokenSettings) Scan(src any) error {
+	*s = AppTokenSettings{}
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		if len(v) == 0 {
+			return nil
+		}
+		return json.Unmarshal(v, s)
+	case string:
+		if v == "" {
+			return nil
+		}
+		return json.Unmarshal([]byte(v), s)
+	}
+	return fmt.Errorf("cannot scan %T into the token settings", src)
+}
+
+// Value implements driver.Valuer for the jsonb column.
+func (s AppTokenSettings) Value() (driver.Value, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,47 @@
+package models_test
+
+import (
+	"authserver-backend/internal/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAppTokenSettingsValidate tests that only known claims, positive lifetimes and an audience
+// of the app are accepted.
+func TestAppTokenSettingsValidate(t *testing.T) {
+	reserved := []string{"api.example.com"}
+	settings := models.AppTokenSettings{AccessExpiry: 300, RefreshExpiry: 3600, Audience: "billing", Claims: []string{models.AppClaimGroup, models.AppClaimLan}}
+	assert.NoError(t, settings.Validate(reserved))
+	assert.True(t, settings.HasClaim(models.AppClaimLan))
+	assert.False(t, settings.HasClaim(models.AppClaimCompany))
+
+	// A user field that is not in the template cannot be added to the tokens
+	settings.Claims = []string{"password"}
+	assert.Error(t, settings.Validate(reserved))
+
+	settings = models.AppTokenSettings{AccessExpiry: -1, Audience: "billing"}
+	assert.Error(t, settings.Validate(reserved))
+
+	// The tokens of the app would be accepted by the server
+	settings = models.AppTokenSettings{Audience: "api.example.com"}
+	assert.Error(t, settings.Validate(reserved))
+	settings.Audience = ""
+	assert.Error(t, settings.Validate(reserved))
+}
+
+// TestAppTokenSettingsScan tests that the settings go through the jsonb column, a null column being no settings.
+func TestAppTokenSettingsScan(t *testing.T) {
+	settings := models.AppTokenSettings{AccessExpiry: 300, Audience: "billing", Claims: []string{models.AppClaimCompany}}
+	value, err := settings.Value()
+	assert.NoError(t, err)
+
+	var scanned models.AppTokenSettings
+	assert.NoError(t, scanned.Scan([]byte(value.(string))))
+	assert.Equal(t, settings, scanned)
+
+	assert.NoError(t, scanned.Scan(nil))
+	assert.Equal(t, models.AppTokenSettings{}, scanned)
+
+	assert.Error(t, scanned.Scan(42))
+}
@@ -0,0 +1,18 @@
+package models
+
+// The hash-chained audit logs.
+const (
+	AuditLogLogins = "logins"
+	AuditLogAdmin  = "admin"
+)
+
+// AuditCheckpoint is a signed statement that, at Created, the record EventID of an audit log
+// had the hash Hash. Rewriting the chain up to a checkpoint would need its signing key.
+type AuditCheckpoint struct {
+	ID        int    `json:"id"`
+	Log       string `json:"log"`
+	EventID   int    `json:"event_id"`
+	Hash      string `json:"hash"`
+	Signature string `json:"signature"`
+	Created   int64  `json:"created"`
+}
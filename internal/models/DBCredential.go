@@ -0,0 +1,66 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// DBGrant represents the access a user has been given to one of the databases
+// managed by the server. Privileges holds the table privileges (SELECT, INSERT, ...)
+// the user is entitled to on the tables of Schema.
+type DBGrant struct {
+	ID         int            `json:"id"`
+	UserID     int            `json:"user_id"`
+	DbID       int            `json:"db_id"`
+	DbName     string         `json:"db_name"`
+	Schema     string         `json:"schema"`
+	Privileges pq.StringArray `json:"privileges"`
+	Created    int64          `json:"created"`
+	Updated    int64          `json:"updated"`
+}
+
+// DBCredential represents a temporary database role created for a granted user.
+// The password is only known when the credential is created and it is never stored,
+// so it is returned once to the caller and then discarded.
+type DBCredential struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	GrantID   int    `json:"grant_id"`
+	DbName    string `json:"db_name"`
+	Schema    string `json:"schema"`
+	Role      string `json:"username"`
+	Password  string `json:"password,omitempty"`
+	ExpiresAt int64  `json:"expires_at"`
+	Created   int64  `json:"created"`
+}
+
+// tablePrivileges lists the privileges that can be granted on tables.
+// Anything else in a grant is rejected, because privileges end up inside SQL statements.
+var tablePrivileges = map[string]bool{
+	"SELECT":     true,
+	"INSERT":     true,
+	"UPDATE":     true,
+	"DELETE":     true,
+	"TRUNCATE":   true,
+	"REFERENCES": true,
+	"TRIGGER":    true,
+}
+
+// TablePrivileges returns the privileges of the grant normalized to upper case.
+// It returns an error if the grant has no privileges or an unknown one.
+func (g DBGrant) TablePrivileges() ([]string, error) {
+	if len(g.Privileges) == 0 {
+		return nil, fmt.Errorf("grant %d has no privileges", g.ID)
+	}
+	privileges := make([]string, 0, len(g.Privileges))
+	for _, p := range g.Privileges {
+		p = strings.ToUpper(strings.TrimSpace(p))
+		if !tablePrivileges[p] {
+			return nil, fmt.Errorf("grant %d has an invalid privilege: %q", g.ID, p)
+		}
+		privileges = append(privileges, p)
+	}
+	return privileges, nil
+}
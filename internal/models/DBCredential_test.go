@@ -0,0 +1,44 @@
+package models_test
+
+import (
+	"authserver-backend/internal/models"
+	"encoding/json"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTablePrivileges tests that grant privileges are normalized and validated
+// before being used to build GRANT statements.
+func TestTablePrivileges(t *testing.T) {
+	grant := models.DBGrant{ID: 1, Privileges: pq.StringArray{"select", " Insert "}}
+
+	privileges, err := grant.TablePrivileges()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SELECT", "INSERT"}, privileges)
+
+	// A privilege that does not exist must be rejected
+	grant.Privileges = pq.StringArray{"SELECT", "ALL; DROP TABLE users"}
+	_, err = grant.TablePrivileges()
+	assert.Error(t, err)
+
+	// An empty grant gives no access at all
+	grant.Privileges = nil
+	_, err = grant.TablePrivileges()
+	assert.Error(t, err)
+}
+
+// TestDBCredentialJSON tests that the password is left out of the JSON once it has been cleared.
+func TestDBCredentialJSON(t *testing.T) {
+	cred := models.DBCredential{ID: 1, Role: "dyn_1_abc", Password: "secret"}
+
+	data, err := json.Marshal(cred)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"password":"secret"`)
+
+	cred.Password = ""
+	data, err = json.Marshal(cred)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "password")
+}
@@ -0,0 +1,19 @@
+package models
+
+// Impersonation is an admin logged in as a user, to see what the user sees. Its tokens are only
+// valid until Expires, or until it is stopped: Ended is the time it was stopped, 0 until then.
+type Impersonation struct {
+	ID         int    `json:"id"`
+	AdminID    int    `json:"admin_id"`
+	AdminEmail string `json:"admin_email"`
+	UserID     int    `json:"user_id"`
+	Reason     string `json:"reason"`
+	Started    int64  `json:"started"`
+	Expires    int64  `json:"expires"`
+	Ended      int64  `json:"ended"`
+}
+
+// Active tells whether the tokens of the impersonation are still valid at a time.
+func (i *Impersonation) Active(now int64) bool {
+	return i.Ended == 0 && now < i.Expires
+}
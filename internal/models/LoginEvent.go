@@ -0,0 +1,43 @@
+package models
+
+// The kinds of authentication events of the login audit trail.
+const (
+	LoginEventLogin   = "login"
+	LoginEventRefresh = "refresh"
+	LoginEventLogout  = "logout"
+	LoginEventLockout = "lockout"
+	LoginEventMFA     = "mfa"
+)
+
+// LoginEvent is an entry of the login audit trail: an authentication attempt, its outcome and where
+// it came from. UserID is 0 when the attempt matched no user, Login is the identifier it was made
+// with, Method the authentication method (an amr value) and Reason why a failure failed.
+// Hash chains the event to the one before it, PrevHash, to make the trail tamper-evident.
+type LoginEvent struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	Login     string `json:"login"`
+	Event     string `json:"event"`
+	Success   bool   `json:"success"`
+	Method    string `json:"method,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Created   int64  `json:"created"`
+	PrevHash  string `json:"prev_hash,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+}
+
+// LoginEventFilter selects login events. The zero value of a field does not filter,
+// Since and Until bound the creation time, inclusive. Limit and Offset page the events.
+type LoginEventFilter struct {
+	UserID  int
+	Login   string
+	Event   string
+	Success *bool
+	IP      string
+	Since   int64
+	Until   int64
+	Limit   int
+	Offset  int
+}
@@ -0,0 +1,15 @@
+package models
+
+// MagicLogin is a pending passwordless login: the link and the code emailed to a user.
+// Both are stored hashed, with the hash of the secret held by the browser that asked for them,
+// so the login only completes in that browser.
+type MagicLogin struct {
+	ID          int    `json:"id"`
+	UserID      int    `json:"user_id"`
+	TokenHash   string `json:"-"`
+	CodeHash    string `json:"-"`
+	BrowserHash string `json:"-"`
+	Attempts    int    `json:"attempts"`
+	ExpiresAt   int64  `json:"expires_at"`
+	Created     int64  `json:"created"`
+}
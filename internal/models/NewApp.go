@@ -69,6 +69,9 @@ type NewApp struct {
 	KeyMetrics              pq.StringArray `json:"key_metrics"`     // Slice
 	URL                     string         `json:"url"`             // URL
 	LandingPage             string         `json:"landing_page"`    // URL
+
+	// TokenSettings is how the tokens of the app are minted.
+	TokenSettings AppTokenSettings `json:"token_settings"`
 }
 
 // Error implements error.
@@ -131,7 +134,8 @@ func (t NewApp) Error() string {
 		AnalyticsTools: %v,
 		KeyMetrics: %v,
 		URL: %s,
-		LandingPage: %s`,
+		LandingPage: %s,
+		TokenSettings: %+v`,
 		t.Name,
 		t.Release,
 		t.Path,
@@ -189,6 +193,7 @@ func (t NewApp) Error() string {
 		t.KeyMetrics,
 		t.URL,
 		t.LandingPage,
+		t.TokenSettings,
 	)
 }
 
@@ -252,6 +257,7 @@ func (t *NewApp) ScanDest(numFields int) []any {
 		&t.KeyMetrics,
 		&t.URL,
 		&t.LandingPage,
+		&t.TokenSettings,
 	}
 	if numFields <= 0 || numFields >= len(full) {
 		return full
@@ -319,6 +325,7 @@ func (t NewApp) Values(numFields int) []any {
 		t.KeyMetrics,
 		t.URL,
 		t.LandingPage,
+		t.TokenSettings,
 	}
 	if numFields <= 0 || numFields >= len(full) {
 		return full
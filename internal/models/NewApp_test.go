@@ -76,7 +76,7 @@ func TestNewApp(t *testing.T) {
 	data, err := json.Marshal(app)
 	assert.NoError(t, err)
 
-	expectedJSON := `{"name":"TestApp","release":"1.0.0","path":"/test/path","init":"init.sh","web":"http://testapp.com","title":"Test AuthServerApp","created":1660000000,"updated":1660000001,"description":"A test app","positioning_stmt":"Positioning statement","logo":"http://logo.com","category":"Test","platform":["Web"],"developer":"TestDev","license_type":"MIT","size":1024,"compatibility":["v1.0"],"integration_capabilities":["API"],"development_stack":["Go"],"api_documentation":"http://api.com","security_features":["Auth"],"regulatory_compliance":["GDPR"],"revenue_streams":["Subscription"],"customer_segments":["Developers"],"channels":["Web"],"value_proposition":"Value prop","pricing_tiers":["Free","Pro"],"partnerships":["Partner1"],"cost_structure":["Hosting"],"customer_relationships":["Support"],"unfair_advantage":"Unique feature","roadmap":"http://roadmap.com","version_control":"http://git.com","error_rate":0.01,"average_response_time":0.5,"uptime_percentage":99.9,"key_activities":["Development"],"active_users":100,"user_retention_rate":80,"user_acquisition_cost":10,"churn_rate":5,"monthly_recurring_revenue":1000,"user_feedback":["Good"],"backup_recovery_options":["Daily"],"localization_support":["EN","ES"],"accessibility_features":["WCAG"],"team_structure":["Dev","QA"],"data_backup_location":"Cloud","environmental_impact":"Low","social_impact":"Positive","intellectual_property":["Patent"],"fundings_investment":50000,"exit_strategy":"IPO","analytics_tools":["Google Analytics"],"key_metrics":["Users"],"url":"http://app.com","landing_page":"http://landing.com"}`
+	expectedJSON := `{"name":"TestApp","release":"1.0.0","path":"/test/path","init":"init.sh","web":"http://testapp.com","title":"Test AuthServerApp","created":1660000000,"updated":1660000001,"description":"A test app","positioning_stmt":"Positioning statement","logo":"http://logo.com","category":"Test","platform":["Web"],"developer":"TestDev","license_type":"MIT","size":1024,"compatibility":["v1.0"],"integration_capabilities":["API"],"development_stack":["Go"],"api_documentation":"http://api.com","security_features":["Auth"],"regulatory_compliance":["GDPR"],"revenue_streams":["Subscription"],"customer_segments":["Developers"],"channels":["Web"],"value_proposition":"Value prop","pricing_tiers":["Free","Pro"],"partnerships":["Partner1"],"cost_structure":["Hosting"],"customer_relationships":["Support"],"unfair_advantage":"Unique feature","roadmap":"http://roadmap.com","version_control":"http://git.com","error_rate":0.01,"average_response_time":0.5,"uptime_percentage":99.9,"key_activities":["Development"],"active_users":100,"user_retention_rate":80,"user_acquisition_cost":10,"churn_rate":5,"monthly_recurring_revenue":1000,"user_feedback":["Good"],"backup_recovery_options":["Daily"],"localization_support":["EN","ES"],"accessibility_features":["WCAG"],"team_structure":["Dev","QA"],"data_backup_location":"Cloud","environmental_impact":"Low","social_impact":"Positive","intellectual_property":["Patent"],"fundings_investment":50000,"exit_strategy":"IPO","analytics_tools":["Google Analytics"],"key_metrics":["Users"],"url":"http://app.com","landing_page":"http://landing.com","token_settings":{}}`
 	assert.JSONEq(t, expectedJSON, string(data))
 
 	// Test deserialization
@@ -0,0 +1,30 @@
+package models
+
+import "github.com/lib/pq"
+
+// PersonalAccessToken is a long-lived credential a user creates for scripts and CI jobs.
+// The token itself is only shown when it is created, it is stored hashed; Prefix is its
+// first characters, enough for the user to recognise it in a list.
+// Scopes limit the routes the token can call, Revoked is the time it was revoked, 0 while it is valid.
+type PersonalAccessToken struct {
+	ID        int            `json:"id"`
+	UserID    int            `json:"user_id"`
+	Name      string         `json:"name"`
+	Prefix    string         `json:"prefix"`
+	TokenHash string         `json:"-"`
+	Scopes    pq.StringArray `json:"scopes"`
+	ExpiresAt int64          `json:"expires_at"`
+	LastUsed  int64          `json:"last_used"`
+	Revoked   int64          `json:"revoked"`
+	Created   int64          `json:"created"`
+}
+
+// HasScope tells whether the token was given a scope.
+func (t *PersonalAccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+package models
+
+// SAMLServiceProvider is the SAML service provider of a catalogue app.
+// Metadata is the SP metadata XML, EntityID is read from it.
+// NameIDField is the user field sent as the NameID of the assertions, the email by default,
+// and Attributes maps the SAML attribute names sent to the app to user fields.
+type SAMLServiceProvider struct {
+	ID          int               `json:"id"`
+	AppID       int               `json:"app_id"`
+	EntityID    string            `json:"entity_id"`
+	Metadata    string            `json:"metadata"`
+	NameIDField string            `json:"name_id"`
+	Attributes  map[string]string `json:"attributes"`
+	Created     int64             `json:"created"`
+	Updated     int64             `json:"updated"`
+}
@@ -0,0 +1,30 @@
+package models
+
+// Session is a login of a user on a device: the refresh tokens issued from the login on, and the access
+// tokens they are exchanged for, belong to it. Device is the name of the browser and the operating system
+// parsed from UserAgent. LastSeen is the last time a token of the session was used, ExpiresAt the end
+// of its last refresh token and Revoked the time it was revoked, 0 while it is valid. IdleTimeout, in
+// seconds, ends the session when none of its tokens was used for that long, it never does when 0.
+type Session struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	UserAgent string `json:"user_agent"`
+	Device    string `json:"device"`
+	IP        string `json:"ip"`
+	Created   int64  `json:"created"`
+	LastSeen  int64  `json:"last_seen"`
+	ExpiresAt int64  `json:"expires_at"`
+	Revoked   int64  `json:"revoked"`
+	// IdleTimeout is set from the session policy of the user when the session starts.
+	IdleTimeout int64 `json:"idle_timeout,omitempty"`
+}
+
+// Active tells whether the tokens of the session are still valid at a time.
+func (s *Session) Active(now int64) bool {
+	return s.Revoked == 0 && now < s.ExpiresAt && !s.Idle(now)
+}
+
+// Idle tells whether the session has been idle for longer than its idle timeout at a time.
+func (s *Session) Idle(now int64) bool {
+	return s.IdleTimeout > 0 && now >= s.LastSeen+s.IdleTimeout
+}
@@ -0,0 +1,27 @@
+package models
+
+// TrustedDevice is a browser a user chose to remember after a multi-factor authentication: its logins
+// skip the second factor until ExpiresAt. The browser holds a signed cookie with a random token, only
+// its hash is stored in TokenHash. Device is the name of the browser and the operating system parsed
+// from UserAgent, LastUsed the last login it skipped the second factor of and Revoked the time it was
+// revoked, 0 while it is trusted. PasswordFingerprint is derived from the password hash of the user
+// when the device was trusted, a new password no longer matches it and the device is no longer trusted.
+type TrustedDevice struct {
+	ID                  int    `json:"id"`
+	UserID              int    `json:"user_id"`
+	TokenHash           string `json:"-"`
+	PasswordFingerprint string `json:"-"`
+	UserAgent           string `json:"user_agent"`
+	Device              string `json:"device"`
+	IP                  string `json:"ip"`
+	Created             int64  `json:"created"`
+	LastUsed            int64  `json:"last_used"`
+	ExpiresAt           int64  `json:"expires_at"`
+	Revoked             int64  `json:"revoked"`
+}
+
+// Trusted tells whether the device still skips the second factor at a time, for the password
+// fingerprint of the user.
+func (d *TrustedDevice) Trusted(now int64, fingerprint string) bool {
+	return d.Revoked == 0 && now < d.ExpiresAt && d.PasswordFingerprint == fingerprint
+}
@@ -0,0 +1,14 @@
+package models
+
+// UserIdentity links a local user to an account at an upstream identity provider.
+// Subject is the stable identifier the provider uses for the account, the email
+// is kept to show which upstream account the link belongs to.
+type UserIdentity struct {
+	ID       int    `json:"id"`
+	UserID   int    `json:"user_id"`
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+	Email    string `json:"email"`
+	Created  int64  `json:"created"`
+	Updated  int64  `json:"updated"`
+}
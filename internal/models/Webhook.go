@@ -0,0 +1,55 @@
+package models
+
+import (
+	"encoding/json"
+
+	"github.com/lib/pq"
+)
+
+// Webhook is an outbound subscription to the security events. The events whose type matches
+// EventTypes, all of them when it is empty, are posted to URL signed with Secret. The secret is only
+// shown when the webhook is created.
+type Webhook struct {
+	ID         int            `json:"id"`
+	URL        string         `json:"url"`
+	Secret     string         `json:"secret,omitempty"`
+	EventTypes pq.StringArray `json:"event_types"`
+	CreatedBy  int            `json:"created_by"`
+	Created    int64          `json:"created"`
+}
+
+// The states of a webhook delivery.
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryDead      = "dead"
+)
+
+// WebhookDelivery is the delivery of an event to a webhook. A pending delivery is attempted again
+// at NextAttempt. ResponseCode and Error are the outcome of the last attempt.
+type WebhookDelivery struct {
+	ID           int             `json:"id"`
+	WebhookID    int             `json:"webhook_id"`
+	EventID      string          `json:"event_id"`
+	EventType    string          `json:"event_type"`
+	Payload      json.RawMessage `json:"payload"`
+	Status       string          `json:"status"`
+	Attempts     int             `json:"attempts"`
+	ResponseCode int             `json:"response_code"`
+	Error        string          `json:"error,omitempty"`
+	NextAttempt  int64           `json:"next_attempt"`
+	Created      int64           `json:"created"`
+	Updated      int64           `json:"updated"`
+}
+
+// WebhookDeadLetter is a delivery that failed every attempt, kept until an admin retries it.
+type WebhookDeadLetter struct {
+	ID         int             `json:"id"`
+	WebhookID  int             `json:"webhook_id"`
+	DeliveryID int             `json:"delivery_id"`
+	EventType  string          `json:"event_type"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   int             `json:"attempts"`
+	Error      string          `json:"error"`
+	Created    int64           `json:"created"`
+}
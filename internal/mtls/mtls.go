@@ -0,0 +1,145 @@
+// Package mtls authenticates clients with TLS client certificates. It builds the server TLS
+// configuration validating the certificates against a CA bundle, and maps a certificate,
+// by its subject or its subject alternative names, to the local user it belongs to.
+package mtls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadCAPool reads a PEM bundle of the certificate authorities client certificates are issued by.
+func LoadCAPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// ServerConfig returns the TLS configuration of a server asking for client certificates signed
+// by the clientCAs. Giving one is optional, so browsers and the clients using tokens still connect;
+// a certificate given is always verified.
+func ServerConfig(cert tls.Certificate, clientCAs *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// Thumbprint returns the base64url encoded SHA-256 hash of a certificate,
+// the x5t#S256 confirmation of RFC 8705.
+func Thumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// PeerCertificate returns the verified client certificate of a connection, nil when the client
+// did not give one.
+func PeerCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// Rule maps the certificates matching all its non-empty fields to a user. Subject is the
+// distinguished name of the certificate as written by pkix.Name.String, like "CN=billing,O=Acme";
+// DNS, URI and Email are subject alternative names the certificate must hold.
+type Rule struct {
+	Subject string `json:"subject"`
+	DNS     string `json:"dns"`
+	URI     string `json:"uri"`
+	Email   string `json:"email"`
+	UserID  int    `json:"user_id"`
+}
+
+// Matches tells whether a certificate matches the rule.
+func (r Rule) Matches(cert *x509.Certificate) bool {
+	if r.Subject == "" && r.DNS == "" && r.URI == "" && r.Email == "" {
+		return false
+	}
+	if r.Subject != "" && !strings.EqualFold(r.Subject, cert.Subject.String()) {
+		return false
+	}
+	if r.DNS != "" && !containsFold(cert.DNSNames, r.DNS) {
+		return false
+	}
+	if r.URI != "" {
+		found := false
+		for _, uri := range cert.URIs {
+			if uri.String() == r.URI {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.Email != "" && !containsFold(cert.EmailAddresses, r.Email) {
+		return false
+	}
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Config maps client certificates to users. The first matching rule gives the user, usually
+// a service account. With MatchEmail set, a certificate no rule matches belongs to the user
+// of one of its email addresses.
+type Config struct {
+	Rules      []Rule `json:"rules"`
+	MatchEmail bool   `json:"match_email"`
+}
+
+// LoadConfig reads a certificate mapping from a JSON file.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("invalid certificate mapping %s: %w", path, err)
+	}
+	for i, rule := range cfg.Rules {
+		if rule.UserID == 0 {
+			return cfg, fmt.Errorf("invalid certificate mapping %s: rule %d has no user_id", path, i)
+		}
+	}
+	return cfg, nil
+}
+
+// ErrUnmapped is returned for a certificate that does not belong to any user.
+var ErrUnmapped = errors.New("the certificate is not mapped to any user")
+
+// UserID returns the user of the first rule matching the certificate.
+func (c Config) UserID(cert *x509.Certificate) (int, error) {
+	for _, rule := range c.Rules {
+		if rule.Matches(cert) {
+			return rule.UserID, nil
+		}
+	}
+	return 0, ErrUnmapped
+}
@@ -0,0 +1,140 @@
+package mtls_test
+
+import (
+	"authserver-backend/internal/mtls"
+	"authserver-backend/internal/mtls/mtlstest"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestServerConfig tests the handshake with a trusted certificate, an untrusted one and none.
+func TestServerConfig(t *testing.T) {
+	ca, err := mtlstest.NewCA("clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := mtlstest.NewCA("other")
+	serverCert, _ := ca.Issue(mtlstest.Names{Subject: pkix.Name{CommonName: "server"}, IPs: []net.IP{net.ParseIP("127.0.0.1")}})
+	clientCert, _ := ca.Issue(mtlstest.Names{Subject: pkix.Name{CommonName: "billing"}})
+	foreignCert, _ := other.Issue(mtlstest.Names{Subject: pkix.Name{CommonName: "billing"}})
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cert := mtls.PeerCertificate(r.TLS); cert != nil {
+			w.Write([]byte(cert.Subject.CommonName))
+		}
+	}))
+	server.TLS = mtls.ServerConfig(serverCert, ca.Pool())
+	server.StartTLS()
+	defer server.Close()
+
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      ca.Pool(),
+			Certificates: certs,
+		}}}
+	}
+
+	res, err := client(clientCert).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, 16)
+	n, _ := res.Body.Read(body)
+	assert.Equal(t, "billing", string(body[:n]))
+
+	// a certificate is optional
+	res, err = client().Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// but one that does not chain to the bundle is refused; the client would not send it
+	// on its own as it is not issued by an accepted authority, so it is forced
+	forced := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: ca.Pool(),
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &foreignCert, nil
+		},
+	}}}
+	_, err = forced.Get(server.URL)
+	assert.Error(t, err)
+}
+
+// TestConfigUserID tests the mapping of certificates to users.
+func TestConfigUserID(t *testing.T) {
+	ca, _ := mtlstest.NewCA("clients")
+	billing, _ := ca.Issue(mtlstest.Names{
+		Subject: pkix.Name{CommonName: "billing", Organization: []string{"Acme"}},
+		DNS:     []string{"billing.internal"},
+	})
+	spiffe, _ := ca.Issue(mtlstest.Names{
+		Subject: pkix.Name{CommonName: "reports"},
+		URIs:    []string{"spiffe://acme/reports"},
+	})
+	person, _ := ca.Issue(mtlstest.Names{
+		Subject: pkix.Name{CommonName: "Jane Doe"},
+		Emails:  []string{"jane@example.com"},
+	})
+
+	cfg := mtls.Config{Rules: []mtls.Rule{
+		{Subject: "CN=billing,O=Acme", DNS: "billing.internal", UserID: 10},
+		{URI: "spiffe://acme/reports", UserID: 11},
+		// an empty rule would match everything, it matches nothing
+		{UserID: 12},
+	}}
+
+	userID, err := cfg.UserID(billing.Leaf)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, userID)
+
+	userID, err = cfg.UserID(spiffe.Leaf)
+	assert.NoError(t, err)
+	assert.Equal(t, 11, userID)
+
+	_, err = cfg.UserID(person.Leaf)
+	assert.ErrorIs(t, err, mtls.ErrUnmapped)
+
+	// all the fields of a rule must match
+	partial := mtls.Rule{Subject: "CN=billing,O=Acme", DNS: "other.internal", UserID: 10}
+	assert.False(t, partial.Matches(billing.Leaf))
+}
+
+// TestThumbprint tests the x5t#S256 of a certificate.
+func TestThumbprint(t *testing.T) {
+	ca, _ := mtlstest.NewCA("clients")
+	a, _ := ca.Issue(mtlstest.Names{Subject: pkix.Name{CommonName: "a"}})
+	b, _ := ca.Issue(mtlstest.Names{Subject: pkix.Name{CommonName: "a"}})
+
+	assert.Len(t, mtls.Thumbprint(a.Leaf), 43)
+	assert.Equal(t, mtls.Thumbprint(a.Leaf), mtls.Thumbprint(a.Leaf))
+	assert.NotEqual(t, mtls.Thumbprint(a.Leaf), mtls.Thumbprint(b.Leaf))
+	assert.Nil(t, mtls.PeerCertificate(nil))
+	assert.Equal(t, a.Leaf, mtls.PeerCertificate(ca.ConnectionState(a)))
+}
+
+// TestLoadConfig tests reading the mapping file.
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mtls.json")
+	_ = os.WriteFile(path, []byte(`{"rules":[{"subject":"CN=billing","user_id":10}],"match_email":true}`), 0o600)
+
+	cfg, err := mtls.LoadConfig(path)
+	assert.NoError(t, err)
+	assert.True(t, cfg.MatchEmail)
+	assert.Equal(t, 10, cfg.Rules[0].UserID)
+
+	_ = os.WriteFile(path, []byte(`{"rules":[{"subject":"CN=billing"}]}`), 0o600)
+	_, err = mtls.LoadConfig(path)
+	assert.Error(t, err)
+
+	ca, _ := mtlstest.NewCA("clients")
+	_ = os.WriteFile(path, ca.PEM(), 0o600)
+	_, err = mtls.LoadCAPool(path)
+	assert.NoError(t, err)
+}
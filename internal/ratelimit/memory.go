@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the memory store drops the buckets that have refilled.
+const sweepInterval = time.Minute
+
+// Memory keeps the buckets in the memory of the server, the limits are not shared between servers.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	swept   time.Time
+}
+
+type memoryBucket struct {
+	bucket
+	limit Limit
+}
+
+// NewMemory returns an empty memory store.
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]*memoryBucket)}
+}
+
+// Take implements Store.
+func (m *Memory) Take(_ context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.swept) >= sweepInterval {
+		m.sweep(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{bucket: bucket{tokens: float64(limit.Requests), updated: now}}
+		m.buckets[key] = b
+	}
+	b.limit = limit
+	return b.take(limit, now), nil
+}
+
+// sweep drops the buckets that are full again, a new bucket would be the same.
+func (m *Memory) sweep(now time.Time) {
+	for key, b := range m.buckets {
+		if now.Sub(b.updated) >= b.limit.Period {
+			delete(m.buckets, key)
+		}
+	}
+	m.swept = now
+}
+
+// Len returns how many buckets are kept.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.buckets)
+}
@@ -0,0 +1,240 @@
+// Package ratelimit limits the requests to the authentication endpoints with token buckets.
+// Each route has a Policy of up to three limits: one bucket per client IP, one per account
+// identifier (the email of a login, the user of a token) and one shared by every client.
+// The buckets are kept in a Store, in memory for a single server or in Redis when several
+// servers share the limits.
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a token bucket holding up to Requests tokens, refilled with Requests tokens per Period.
+// A request takes a token, so Requests can be sent at once, then Requests per Period.
+// The zero Limit does not limit anything.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseLimit parses a limit written as requests/period, the period being a duration like 15m
+// or a unit alone: s, m, h or d. "10/m" is 10 requests per minute.
+func ParseLimit(s string) (Limit, error) {
+	requests, period, found := strings.Cut(strings.TrimSpace(s), "/")
+	if !found {
+		return Limit{}, fmt.Errorf("invalid limit %q: want requests/period", s)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid limit %q: requests must be a positive number", s)
+	}
+
+	var d time.Duration
+	switch period {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	case "d":
+		d = time.Hour * 24
+	default:
+		if d, err = time.ParseDuration(period); err != nil || d <= 0 {
+			return Limit{}, fmt.Errorf("invalid limit %q: period must be a duration or one of s, m, h, d", s)
+		}
+	}
+	return Limit{Requests: n, Period: d}, nil
+}
+
+// String returns the limit as parsed by ParseLimit.
+func (l Limit) String() string {
+	if l.Requests == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+// UnmarshalJSON reads a limit written like for ParseLimit.
+func (l *Limit) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		*l = Limit{}
+		return nil
+	}
+	limit, err := ParseLimit(s)
+	if err != nil {
+		return err
+	}
+	*l = limit
+	return nil
+}
+
+// MarshalJSON writes a limit like String.
+func (l Limit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+// rate returns the tokens added to the bucket per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// Result is the state of a bucket after a request took a token from it, or failed to.
+// Remaining is how many requests can still be sent at once, Reset how long the bucket takes
+// to be full again and RetryAfter how long a refused request has to wait.
+type Result struct {
+	Allowed    bool
+	Limit      Limit
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets. Take takes a token from the bucket of a key at time now,
+// creating a full bucket for a new key.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+}
+
+// bucket is the state of a token bucket: its tokens when it was last updated.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills the bucket up to now and takes a token from it, if it holds one.
+func (b *bucket) take(limit Limit, now time.Time) Result {
+	capacity := float64(limit.Requests)
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * limit.rate()
+		if b.tokens > capacity {
+			b.tokens = capacity
+		}
+	}
+	if now.After(b.updated) {
+		b.updated = now
+	}
+
+	result := Result{Limit: limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / limit.rate())
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((capacity - b.tokens) / limit.rate())
+	return result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Policy holds the limits of a route. IP limits each client address, Account each account
+// identifier and Global the route as a whole. A zero limit is not applied.
+type Policy struct {
+	IP      Limit `json:"ip"`
+	Account Limit `json:"account"`
+	Global  Limit `json:"global"`
+}
+
+// Take takes a token from each bucket of the policy the request falls in, the account bucket
+// only when an account is given. The result is the one of the most restrictive bucket:
+// a refusal, with the longest wait, or the bucket with the fewest remaining requests.
+// A policy without limits allows every request with a zero Limit.
+func (p Policy) Take(ctx context.Context, store Store, route, ip, account string, now time.Time) (Result, error) {
+	type check struct {
+		limit Limit
+		key   string
+	}
+	checks := []check{
+		{p.IP, route + ":ip:" + ip},
+		{p.Global, route + ":global"},
+	}
+	if account != "" {
+		checks = append(checks, check{p.Account, route + ":account:" + account})
+	}
+
+	final := Result{Allowed: true}
+	for _, c := range checks {
+		if c.limit.Requests <= 0 || c.limit.Period <= 0 {
+			continue
+		}
+		result, err := store.Take(ctx, c.key, c.limit, now)
+		if err != nil {
+			return Result{}, err
+		}
+		switch {
+		case final.Limit.Requests == 0:
+			final = result
+		case !result.Allowed && (final.Allowed || result.RetryAfter > final.RetryAfter):
+			final = result
+		case result.Allowed && final.Allowed && result.Remaining < final.Remaining:
+			final = result
+		}
+	}
+	return final, nil
+}
+
+// Config holds the policies of the routes, by route name.
+type Config struct {
+	Routes map[string]Policy `json:"routes"`
+}
+
+// DefaultConfig returns the policies of the authentication routes used when none are configured.
+func DefaultConfig() Config {
+	return Config{Routes: map[string]Policy{
+		"authenticate": {
+			IP:      Limit{Requests: 20, Period: time.Minute},
+			Account: Limit{Requests: 10, Period: time.Minute},
+			Global:  Limit{Requests: 1000, Period: time.Minute},
+		},
+		"refresh": {
+			IP:      Limit{Requests: 60, Period: time.Minute},
+			Account: Limit{Requests: 30, Period: time.Minute},
+			Global:  Limit{Requests: 5000, Period: time.Minute},
+		},
+		"validatesession": {
+			IP:      Limit{Requests: 300, Period: time.Minute},
+			Account: Limit{Requests: 120, Period: time.Minute},
+			Global:  Limit{Requests: 20000, Period: time.Minute},
+		},
+	}}
+}
+
+// Policy returns the policy of a route, the zero policy when the route has none.
+func (c Config) Policy(route string) Policy {
+	return c.Routes[route]
+}
+
+// LoadConfig reads the policies from a JSON file, for instance:
+//
+//	{"routes": {"authenticate": {"ip": "20/m", "account": "5/15m", "global": "1000/m"}}}
+//
+// The routes the file leaves out keep their default policy.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	var file Config
+	if err := json.Unmarshal(data, &file); err != nil {
+		return cfg, fmt.Errorf("invalid rate limit configuration %s: %w", path, err)
+	}
+	for route, policy := range file.Routes {
+		cfg.Routes[route] = policy
+	}
+	return cfg, nil
+}
@@ -0,0 +1,157 @@
+package ratelimit_test
+
+import (
+	"authserver-backend/internal/ratelimit"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseLimit tests the requests/period notation.
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ratelimit.Limit
+		err  bool
+	}{
+		{"10/m", ratelimit.Limit{Requests: 10, Period: time.Minute}, false},
+		{"5/15m", ratelimit.Limit{Requests: 5, Period: 15 * time.Minute}, false},
+		{"100/d", ratelimit.Limit{Requests: 100, Period: 24 * time.Hour}, false},
+		{"10", ratelimit.Limit{}, true},
+		{"0/m", ratelimit.Limit{}, true},
+		{"10/week", ratelimit.Limit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ratelimit.ParseLimit(tt.in)
+		if tt.err {
+			assert.Error(t, err, tt.in)
+			continue
+		}
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+}
+
+// testStore runs the same checks against each store.
+func testStore(t *testing.T, store ratelimit.Store) {
+	ctx := context.Background()
+	limit := ratelimit.Limit{Requests: 3, Period: 3 * time.Second}
+	now := time.Unix(1700000000, 0)
+
+	// the bucket starts full
+	for i := 2; i >= 0; i-- {
+		result, err := store.Take(ctx, "k", limit, now)
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, i, result.Remaining)
+	}
+
+	result, err := store.Take(ctx, "k", limit, now)
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, time.Second, result.RetryAfter)
+	assert.Equal(t, 3*time.Second, result.Reset)
+
+	// one token is back after a second
+	result, err = store.Take(ctx, "k", limit, now.Add(time.Second))
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	// other keys have their own bucket
+	result, err = store.Take(ctx, "other", limit, now)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 2, result.Remaining)
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, ratelimit.NewMemory())
+}
+
+// TestMemory_Sweep tests that the refilled buckets are dropped.
+func TestMemory_Sweep(t *testing.T) {
+	store := ratelimit.NewMemory()
+	limit := ratelimit.Limit{Requests: 1, Period: time.Second}
+	now := time.Unix(1700000000, 0)
+
+	_, _ = store.Take(context.Background(), "a", limit, now)
+	_, _ = store.Take(context.Background(), "b", limit, now)
+	assert.Equal(t, 2, store.Len())
+
+	_, _ = store.Take(context.Background(), "c", limit, now.Add(2*time.Minute))
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	testStore(t, ratelimit.Redis{Client: client, Prefix: "ratelimit:"})
+
+	assert.True(t, server.Exists("ratelimit:k"))
+	assert.Equal(t, 3*time.Second, server.TTL("ratelimit:k"))
+}
+
+// TestPolicy_Take tests that the most restrictive bucket of a policy decides.
+func TestPolicy_Take(t *testing.T) {
+	ctx := context.Background()
+	store := ratelimit.NewMemory()
+	now := time.Unix(1700000000, 0)
+	policy := ratelimit.Policy{
+		IP:      ratelimit.Limit{Requests: 5, Period: time.Minute},
+		Account: ratelimit.Limit{Requests: 2, Period: time.Minute},
+		Global:  ratelimit.Limit{Requests: 100, Period: time.Minute},
+	}
+
+	result, err := policy.Take(ctx, store, "login", "10.0.0.1", "user@example.com", now)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, policy.Account, result.Limit)
+	assert.Equal(t, 1, result.Remaining)
+
+	_, _ = policy.Take(ctx, store, "login", "10.0.0.1", "user@example.com", now)
+	result, _ = policy.Take(ctx, store, "login", "10.0.0.2", "user@example.com", now)
+	assert.False(t, result.Allowed, "the account is limited from any address")
+	assert.Equal(t, 30*time.Second, result.RetryAfter)
+
+	result, _ = policy.Take(ctx, store, "login", "10.0.0.2", "other@example.com", now)
+	assert.True(t, result.Allowed)
+
+	// without an account only the address and global limits apply
+	result, _ = policy.Take(ctx, store, "login", "10.0.0.3", "", now)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, policy.IP, result.Limit)
+
+	// a policy without limits allows everything
+	result, err = ratelimit.Policy{}.Take(ctx, store, "none", "10.0.0.1", "", now)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Zero(t, result.Limit)
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimit.json")
+	err := os.WriteFile(path, []byte(`{"routes": {"authenticate": {"ip": "3/m", "account": "5/15m"}}}`), 0600)
+	assert.NoError(t, err)
+
+	cfg, err := ratelimit.LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, ratelimit.Policy{
+		IP:      ratelimit.Limit{Requests: 3, Period: time.Minute},
+		Account: ratelimit.Limit{Requests: 5, Period: 15 * time.Minute},
+	}, cfg.Policy("authenticate"))
+	assert.Equal(t, ratelimit.DefaultConfig().Policy("refresh"), cfg.Policy("refresh"))
+
+	err = os.WriteFile(path, []byte(`{"routes": {"authenticate": {"ip": "often"}}}`), 0600)
+	assert.NoError(t, err)
+	_, err = ratelimit.LoadConfig(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript takes a token from the bucket in the hash KEYS[1], in one step so servers sharing
+// the bucket do not race. ARGV holds the capacity, the tokens added per millisecond, the current
+// time in milliseconds and the expiry of the hash. It returns whether a token was taken and the
+// tokens left, as strings since Redis truncates the numbers returned by scripts.
+var takeScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(state[1])
+local updated = tonumber(state[2])
+if tokens == nil or updated == nil then
+	tokens = capacity
+	updated = now
+end
+if now > updated then
+	tokens = math.min(capacity, tokens + (now - updated) * rate)
+	updated = now
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(updated))
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+return {allowed, tostring(tokens)}
+`)
+
+// Redis keeps the buckets in Redis, so the servers using the same Redis share the limits.
+// Each bucket is a hash under Prefix followed by its key, expiring once it has refilled.
+type Redis struct {
+	Client redis.UniversalClient
+	Prefix string
+}
+
+// Take implements Store.
+func (s Redis) Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	perMillisecond := limit.rate() / 1000
+	values, err := takeScript.Run(ctx, s.Client, []string{s.Prefix + key},
+		limit.Requests,
+		strconv.FormatFloat(perMillisecond, 'g', -1, 64),
+		now.UnixMilli(),
+		limit.Period.Milliseconds(),
+	).Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(values) != 2 {
+		return Result{}, fmt.Errorf("unexpected answer from the rate limit script: %v", values)
+	}
+	allowed, _ := values[0].(int64)
+	left, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(left, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("unexpected answer from the rate limit script: %w", err)
+	}
+
+	result := Result{
+		Allowed:   allowed == 1,
+		Limit:     limit,
+		Remaining: int(tokens),
+		Reset:     seconds((float64(limit.Requests) - tokens) / limit.rate()),
+	}
+	if !result.Allowed {
+		result.RetryAfter = seconds((1 - tokens) / limit.rate())
+	}
+	return result, nil
+}
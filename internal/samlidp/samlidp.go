@@ -0,0 +1,150 @@
+// Package samlidp lets the server act as a SAML 2.0 identity provider for the catalogue apps
+// that only speak SAML. It builds on the identity provider of github.com/crewjam/saml,
+// which signs the assertions; the api package decides who the user is and which
+// service providers, registered per app, may receive assertions.
+package samlidp
+
+import (
+	"authserver-backend/internal/models"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlsp"
+)
+
+// The NameID formats the server can put in the subject of an assertion.
+const (
+	NameIDFormatEmail       = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	NameIDFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+)
+
+// attributeNameFormat is the name format of the mapped attributes.
+const attributeNameFormat = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+
+// LoadKeyPair reads the PEM encoded certificate and private key used to sign the assertions.
+func LoadKeyPair(certFile, keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("the SAML private key cannot sign")
+	}
+	return cert, signer, nil
+}
+
+// New returns an identity provider whose metadata is served at <baseURL>/saml/metadata
+// and whose single sign-on service is at <baseURL>/saml/sso.
+func New(baseURL url.URL, cert *x509.Certificate, key crypto.Signer, sps saml.ServiceProviderProvider, sessions saml.SessionProvider) *saml.IdentityProvider {
+	metadataURL := baseURL.JoinPath("saml", "metadata")
+	ssoURL := baseURL.JoinPath("saml", "sso")
+
+	return &saml.IdentityProvider{
+		Key:                     key,
+		Signer:                  key,
+		Logger:                  logger.DefaultLogger,
+		Certificate:             cert,
+		MetadataURL:             *metadataURL,
+		SSOURL:                  *ssoURL,
+		ServiceProviderProvider: sps,
+		SessionProvider:         sessions,
+	}
+}
+
+// ParseMetadata reads the metadata of a service provider and checks it has somewhere
+// to post the assertions to.
+func ParseMetadata(data []byte) (*saml.EntityDescriptor, error) {
+	metadata, err := samlsp.ParseMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service provider metadata: %w", err)
+	}
+	if metadata.EntityID == "" {
+		return nil, errors.New("the service provider metadata has no entityID")
+	}
+	for _, descriptor := range metadata.SPSSODescriptors {
+		for _, acs := range descriptor.AssertionConsumerServices {
+			if acs.Binding == saml.HTTPPostBinding {
+				return metadata, nil
+			}
+		}
+	}
+	return nil, errors.New("the service provider metadata has no HTTP-POST assertion consumer service")
+}
+
+// UserField returns a field of a user by its JSON name, as used in the attribute mapping.
+// The password and the other secrets of the user cannot be mapped.
+func UserField(user *models.User, field string) (string, error) {
+	switch field {
+	case "id":
+		return strconv.Itoa(user.ID), nil
+	case "username":
+		return user.UserName, nil
+	case "email":
+		return user.Email, nil
+	case "profile_id":
+		return strconv.Itoa(user.ProfileId), nil
+	case "group_id":
+		return strconv.Itoa(user.GroupId), nil
+	case "company_id":
+		return strconv.Itoa(user.CompanyId), nil
+	case "lan":
+		return user.Lan, nil
+	}
+	return "", fmt.Errorf("user field %s cannot be mapped to a SAML attribute", field)
+}
+
+// Session builds the session the identity provider turns into an assertion for a service provider.
+// The NameID is the NameIDField of the service provider, the user email by default,
+// and every attribute of its mapping becomes an attribute of the assertion.
+// authTime is when the user logged in, the session lasts an hour from now.
+func Session(user *models.User, sp *models.SAMLServiceProvider, authTime time.Time, sessionID string) (*saml.Session, error) {
+	nameIDField := sp.NameIDField
+	if nameIDField == "" {
+		nameIDField = "email"
+	}
+	nameID, err := UserField(user, nameIDField)
+	if err != nil {
+		return nil, err
+	}
+	nameIDFormat := NameIDFormatUnspecified
+	if nameIDField == "email" {
+		nameIDFormat = NameIDFormatEmail
+	}
+
+	session := &saml.Session{
+		ID:           sessionID,
+		CreateTime:   authTime,
+		ExpireTime:   time.Now().Add(time.Hour),
+		Index:        sessionID,
+		NameID:       nameID,
+		NameIDFormat: nameIDFormat,
+		UserName:     user.UserName,
+		UserEmail:    user.Email,
+	}
+
+	for name, field := range sp.Attributes {
+		value, err := UserField(user, field)
+		if err != nil {
+			return nil, err
+		}
+		session.CustomAttributes = append(session.CustomAttributes, saml.Attribute{
+			Name:       name,
+			NameFormat: attributeNameFormat,
+			Values:     []saml.AttributeValue{{Type: "xs:string", Value: value}},
+		})
+	}
+	return session, nil
+}
@@ -0,0 +1,111 @@
+package samlidp_test
+
+import (
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/samlidp"
+	"authserver-backend/internal/samlidp/samlidptest"
+	"crypto/x509"
+	"encoding/pem"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNew tests the endpoints published in the identity provider metadata.
+func TestNew(t *testing.T) {
+	cert, key, err := samlidptest.KeyPair("auth.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse("https://auth.example.com")
+
+	idp := samlidp.New(*base, cert, key, nil, nil)
+	metadata := idp.Metadata()
+
+	assert.Equal(t, "https://auth.example.com/saml/metadata", metadata.EntityID)
+	assert.Equal(t, "https://auth.example.com/saml/sso", metadata.IDPSSODescriptors[0].SingleSignOnServices[0].Location)
+}
+
+// TestLoadKeyPair tests reading the signing key from PEM files.
+func TestLoadKeyPair(t *testing.T) {
+	cert, key, err := samlidptest.KeyPair("auth.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "idp.crt")
+	keyFile := filepath.Join(dir, "idp.key")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600)
+
+	loaded, signer, err := samlidp.LoadKeyPair(certFile, keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Raw, loaded.Raw)
+	assert.NotNil(t, signer)
+
+	_, _, err = samlidp.LoadKeyPair(certFile, filepath.Join(dir, "missing.key"))
+	assert.Error(t, err)
+}
+
+// TestParseMetadata tests that the metadata of a service provider is accepted only with
+// a HTTP-POST assertion consumer service.
+func TestParseMetadata(t *testing.T) {
+	sp, err := samlidptest.NewServiceProvider("https://sp.example.com", &saml.EntityDescriptor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := sp.MetadataXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := samlidp.ParseMetadata([]byte(metadata))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp.example.com/saml/metadata", parsed.EntityID)
+
+	withoutPost := strings.ReplaceAll(metadata, saml.HTTPPostBinding, saml.HTTPArtifactBinding)
+	_, err = samlidp.ParseMetadata([]byte(withoutPost))
+	assert.Error(t, err)
+
+	_, err = samlidp.ParseMetadata([]byte("not xml"))
+	assert.Error(t, err)
+}
+
+// TestSession tests the NameID and the attribute mapping of a service provider.
+func TestSession(t *testing.T) {
+	user := &models.User{ID: 7, UserName: "jdoe", Email: "jdoe@example.com", CompanyId: 3, GroupId: 2, Lan: "es"}
+	authTime := time.Now().Add(-time.Hour * 3)
+
+	session, err := samlidp.Session(user, &models.SAMLServiceProvider{
+		Attributes: map[string]string{"companyId": "company_id", "language": "lan"},
+	}, authTime, "session-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "jdoe@example.com", session.NameID)
+	assert.Equal(t, samlidp.NameIDFormatEmail, session.NameIDFormat)
+	assert.Equal(t, authTime, session.CreateTime)
+	assert.True(t, session.ExpireTime.After(time.Now()), "an old login still gets a valid session")
+	assert.Len(t, session.CustomAttributes, 2)
+	for _, attribute := range session.CustomAttributes {
+		switch attribute.Name {
+		case "companyId":
+			assert.Equal(t, "3", attribute.Values[0].Value)
+		case "language":
+			assert.Equal(t, "es", attribute.Values[0].Value)
+		}
+	}
+
+	session, err = samlidp.Session(user, &models.SAMLServiceProvider{NameIDField: "id"}, authTime, "session-2")
+	assert.NoError(t, err)
+	assert.Equal(t, "7", session.NameID)
+	assert.Equal(t, samlidp.NameIDFormatUnspecified, session.NameIDFormat)
+
+	// secrets of the user cannot be mapped
+	_, err = samlidp.Session(user, &models.SAMLServiceProvider{Attributes: map[string]string{"pw": "password"}}, authTime, "session-3")
+	assert.Error(t, err)
+}
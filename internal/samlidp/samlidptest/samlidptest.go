@@ -0,0 +1,158 @@
+// Package samlidptest provides a SAML service provider, built on github.com/crewjam/saml,
+// to test the identity provider in-process.
+package samlidptest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"errors"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+// KeyPair returns a new self-signed certificate and its RSA key.
+func KeyPair(commonName string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// ServiceProvider is a SAML app at baseURL, with its metadata at /saml/metadata
+// and its assertion consumer service at /saml/acs.
+type ServiceProvider struct {
+	*saml.ServiceProvider
+}
+
+// NewServiceProvider returns a service provider trusting the identity provider of the given metadata.
+func NewServiceProvider(baseURL string, idpMetadata *saml.EntityDescriptor) (*ServiceProvider, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	cert, key, err := KeyPair(base.Host)
+	if err != nil {
+		return nil, err
+	}
+	metadataURL := base.JoinPath("saml", "metadata")
+	acsURL := base.JoinPath("saml", "acs")
+
+	return &ServiceProvider{&saml.ServiceProvider{
+		EntityID:    metadataURL.String(),
+		Key:         key,
+		Certificate: cert,
+		MetadataURL: *metadataURL,
+		AcsURL:      *acsURL,
+		IDPMetadata: idpMetadata,
+	}}, nil
+}
+
+// MetadataXML returns the metadata of the service provider, as registered at the identity provider.
+func (sp *ServiceProvider) MetadataXML() (string, error) {
+	buf, err := xml.Marshal(sp.Metadata())
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// AuthnRequestURL returns the address of an SP-initiated login at the identity provider,
+// using the HTTP-Redirect binding, and the ID of the request the assertion must answer.
+func (sp *ServiceProvider) AuthnRequestURL(relayState string) (*url.URL, string, error) {
+	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return nil, "", err
+	}
+	redirect, err := req.Redirect(relayState, sp.ServiceProvider)
+	if err != nil {
+		return nil, "", err
+	}
+	return redirect, req.ID, nil
+}
+
+// AuthnRequestForm returns the form of an SP-initiated login posted to the identity provider,
+// using the HTTP-POST binding, its address and the ID of the request the assertion must answer.
+func (sp *ServiceProvider) AuthnRequestForm(relayState string) (url.Values, string, string, error) {
+	location := sp.GetSSOBindingLocation(saml.HTTPPostBinding)
+	req, err := sp.MakeAuthenticationRequest(location, saml.HTTPPostBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return formValues(string(req.Post(relayState))), location, req.ID, nil
+}
+
+var formInput = regexp.MustCompile(`name="(SAMLRequest|SAMLResponse|RelayState)" value="([^"]*)"`)
+
+// formValues returns the inputs of an auto-submitted SAML form.
+func formValues(body string) url.Values {
+	form := url.Values{}
+	for _, input := range formInput.FindAllStringSubmatch(body, -1) {
+		form.Set(input[1], html.UnescapeString(input[2]))
+	}
+	return form
+}
+
+// ParseForm reads the auto-submitted form written by the identity provider, posts it to the
+// assertion consumer service and returns the assertion once its signature and conditions are verified.
+// requestIDs are the IDs of the requests the assertion may answer, none for an IdP-initiated login.
+func (sp *ServiceProvider) ParseForm(body string, requestIDs ...string) (*saml.Assertion, string, error) {
+	form := formValues(body)
+	if form.Get("SAMLResponse") == "" {
+		return nil, "", errors.New("no SAMLResponse in the identity provider response")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, sp.AcsURL.String(), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := req.ParseForm(); err != nil {
+		return nil, "", err
+	}
+
+	assertion, err := sp.ParseResponse(req, requestIDs)
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			return nil, "", invalid.PrivateErr
+		}
+		return nil, "", err
+	}
+	return assertion, form.Get("RelayState"), nil
+}
+
+// Attribute returns the first value of an attribute of the assertion.
+func Attribute(assertion *saml.Assertion, name string) string {
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name == name && len(attribute.Values) > 0 {
+				return attribute.Values[0].Value
+			}
+		}
+	}
+	return ""
+}
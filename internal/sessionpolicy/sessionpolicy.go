@@ -0,0 +1,132 @@
+// Package sessionpolicy holds the session policies of the users: how many sessions they may have
+// at once, what happens to a login past that limit, and how long a session may stay idle. The
+// policies are configured per company and per profile. A Tracker records the activity of the
+// sessions in memory and writes it to the database in batches.
+package sessionpolicy
+
+import (
+	"authserver-backend/internal/models"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// What a login past MaxSessions does.
+const (
+	// OnLimitEvict revokes the oldest sessions of the user to make room for the new one.
+	OnLimitEvict = "evict_oldest"
+	// OnLimitDeny refuses the login.
+	OnLimitDeny = "deny"
+)
+
+// Duration is a time.Duration written as a string in JSON, like "30m".
+type Duration time.Duration
+
+// UnmarshalJSON reads a duration parsed by time.ParseDuration.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil || parsed < 0 {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes a duration like time.Duration.String.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	if d == 0 {
+		return json.Marshal("")
+	}
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Policy is the session policy of a user. The zero Policy limits nothing.
+type Policy struct {
+	// MaxSessions is how many active sessions a user may have at once, 0 for no limit.
+	MaxSessions int `json:"max_sessions,omitempty"`
+	// OnLimit is OnLimitEvict or OnLimitDeny, OnLimitEvict when empty.
+	OnLimit string `json:"on_limit,omitempty"`
+	// IdleTimeout ends a session when none of its tokens was used for that long, 0 for never.
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+}
+
+// Admit returns the sessions of a user to revoke before a new one starts, the oldest first,
+// or false when the login must be denied. sessions are the active sessions of the user.
+func (p Policy) Admit(sessions []*models.Session) ([]*models.Session, bool) {
+	if p.MaxSessions <= 0 || len(sessions) < p.MaxSessions {
+		return nil, true
+	}
+	if p.OnLimit == OnLimitDeny {
+		return nil, false
+	}
+	oldest := append([]*models.Session(nil), sessions...)
+	sort.SliceStable(oldest, func(i, j int) bool { return oldest[i].Created < oldest[j].Created })
+	return oldest[:len(sessions)-p.MaxSessions+1], true
+}
+
+// Config holds the policy of every user. A user gets the policy of their profile, or else the one
+// of their company, or else Default; a policy applies as a whole, its fields are not merged.
+type Config struct {
+	Default   Policy         `json:"default"`
+	Companies map[int]Policy `json:"companies,omitempty"`
+	Profiles  map[int]Policy `json:"profiles,omitempty"`
+}
+
+// LoadConfig reads the session policies from a JSON file, like:
+//
+//	{"default": {"idle_timeout": "8h"},
+//	 "companies": {"3": {"max_sessions": 3, "idle_timeout": "30m"}},
+//	 "profiles": {"1": {"max_sessions": 1, "on_limit": "deny"}}}
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("invalid session policy configuration %s: %w", path, err)
+	}
+	for _, p := range cfg.all() {
+		if p.OnLimit != "" && p.OnLimit != OnLimitEvict && p.OnLimit != OnLimitDeny {
+			return Config{}, fmt.Errorf("invalid session policy configuration %s: on_limit must be %s or %s", path, OnLimitEvict, OnLimitDeny)
+		}
+		if p.MaxSessions < 0 {
+			return Config{}, fmt.Errorf("invalid session policy configuration %s: max_sessions cannot be negative", path)
+		}
+	}
+	return cfg, nil
+}
+
+// For returns the policy of a user.
+func (c Config) For(user *models.User) Policy {
+	if p, ok := c.Profiles[user.ProfileId]; ok {
+		return p
+	}
+	if p, ok := c.Companies[user.CompanyId]; ok {
+		return p
+	}
+	return c.Default
+}
+
+// all returns every policy of the configuration.
+func (c Config) all() []Policy {
+	policies := []Policy{c.Default}
+	for _, p := range c.Companies {
+		policies = append(policies, p)
+	}
+	for _, p := range c.Profiles {
+		policies = append(policies, p)
+	}
+	return policies
+}
@@ -0,0 +1,59 @@
+package sessionpolicy_test
+
+import (
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/sessionpolicy"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{
+		"default": {"idle_timeout": "8h"},
+		"companies": {"3": {"max_sessions": 3, "idle_timeout": "30m"}},
+		"profiles": {"1": {"max_sessions": 1, "on_limit": "deny"}}
+	}`), 0o600))
+
+	cfg, err := sessionpolicy.LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, sessionpolicy.Policy{IdleTimeout: sessionpolicy.Duration(time.Hour * 8)}, cfg.Default)
+
+	// the profile comes before the company, which comes before the default
+	assert.Equal(t, sessionpolicy.Policy{MaxSessions: 1, OnLimit: sessionpolicy.OnLimitDeny}, cfg.For(&models.User{CompanyId: 3, ProfileId: 1}))
+	assert.Equal(t, 3, cfg.For(&models.User{CompanyId: 3, ProfileId: 2}).MaxSessions)
+	assert.Equal(t, cfg.Default, cfg.For(&models.User{CompanyId: 4}))
+
+	for _, invalid := range []string{
+		`{"default": {"on_limit": "queue"}}`,
+		`{"default": {"idle_timeout": "soon"}}`,
+		`{"profiles": {"1": {"max_sessions": -1}}}`,
+	} {
+		assert.NoError(t, os.WriteFile(path, []byte(invalid), 0o600))
+		_, err = sessionpolicy.LoadConfig(path)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	sessions := []*models.Session{{ID: 3, Created: 300}, {ID: 1, Created: 100}, {ID: 2, Created: 200}}
+
+	evicted, ok := sessionpolicy.Policy{}.Admit(sessions)
+	assert.True(t, ok)
+	assert.Empty(t, evicted, "no limit")
+
+	evicted, ok = sessionpolicy.Policy{MaxSessions: 4}.Admit(sessions)
+	assert.True(t, ok)
+	assert.Empty(t, evicted)
+
+	evicted, ok = sessionpolicy.Policy{MaxSessions: 2}.Admit(sessions)
+	assert.True(t, ok)
+	assert.Equal(t, []*models.Session{{ID: 1, Created: 100}, {ID: 2, Created: 200}}, evicted, "the oldest make room for the new one")
+
+	_, ok = sessionpolicy.Policy{MaxSessions: 3, OnLimit: sessionpolicy.OnLimitDeny}.Admit(sessions)
+	assert.False(t, ok)
+}
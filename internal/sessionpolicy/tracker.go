@@ -0,0 +1,107 @@
+package sessionpolicy
+
+import (
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/logerror"
+	"context"
+	"sync"
+	"time"
+)
+
+// Tracker records when the sessions and their users were last active, and writes it to the database
+// in batches rather than on every request: the last seen time of the sessions and User.LastAction.
+// Its methods can be called on a nil Tracker, which records nothing.
+type Tracker struct {
+	DB dbrepo.DatabaseRepo
+
+	mu       sync.Mutex
+	sessions map[int]int64
+	users    map[int]int64
+}
+
+// NewTracker returns a tracker writing to a database.
+func NewTracker(db dbrepo.DatabaseRepo) *Tracker {
+	return &Tracker{DB: db, sessions: make(map[int]int64), users: make(map[int]int64)}
+}
+
+// Seen records that a session of a user was active at a time.
+func (t *Tracker) Seen(sessionID, userID int, at int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if sessionID != 0 && at > t.sessions[sessionID] {
+		t.sessions[sessionID] = at
+	}
+	if userID != 0 && at > t.users[userID] {
+		t.users[userID] = at
+	}
+}
+
+// LastSeen returns when a session was last active since the last flush, 0 when it was not.
+func (t *Tracker) LastSeen(sessionID int) int64 {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[sessionID]
+}
+
+// Flush writes the recorded activity to the database. The activity that could not be written
+// is kept for the next flush.
+func (t *Tracker) Flush() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	sessions, users := t.sessions, t.users
+	t.sessions, t.users = make(map[int]int64), make(map[int]int64)
+	t.mu.Unlock()
+
+	var err error
+	if len(sessions) > 0 {
+		if err = t.DB.TouchSessions(sessions); err != nil {
+			t.restore(sessions, users)
+			return err
+		}
+	}
+	if len(users) > 0 {
+		if err = t.DB.UpdateLastActions(users); err != nil {
+			t.restore(nil, users)
+		}
+	}
+	return err
+}
+
+// restore records again the activity of a failed flush.
+func (t *Tracker) restore(sessions, users map[int]int64) {
+	for id, at := range sessions {
+		t.Seen(id, 0, at)
+	}
+	for id, at := range users {
+		t.Seen(0, id, at)
+	}
+}
+
+// Run flushes the activity every interval until the context is cancelled, then a last time.
+// It is meant to be started in its own goroutine from main.
+func (t *Tracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := t.Flush(); err != nil {
+				logerror.LogError(err)
+			}
+			return
+		case <-ticker.C:
+			if err := t.Flush(); err != nil {
+				logerror.LogError(err)
+			}
+		}
+	}
+}
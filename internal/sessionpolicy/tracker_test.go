@@ -0,0 +1,41 @@
+package sessionpolicy_test
+
+import (
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/sessionpolicy"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTracker tests that the activity is written in batches, the latest time of each session and
+// user, and that the activity of a failed flush is written by the next one.
+func TestTracker(t *testing.T) {
+	mockDB := new(dbrepo.MockDBRepo)
+	tracker := sessionpolicy.NewTracker(mockDB)
+
+	tracker.Seen(5, 2, 100)
+	tracker.Seen(5, 2, 90)
+	tracker.Seen(8, 3, 110)
+	assert.Equal(t, int64(100), tracker.LastSeen(5))
+
+	mockDB.On("TouchSessions", map[int]int64{5: 100, 8: 110}).Return(errors.New("connection refused")).Once()
+	assert.Error(t, tracker.Flush())
+	assert.Equal(t, int64(100), tracker.LastSeen(5), "kept for the next flush")
+
+	tracker.Seen(5, 2, 120)
+	mockDB.On("TouchSessions", map[int]int64{5: 120, 8: 110}).Return(nil).Once()
+	mockDB.On("UpdateLastActions", map[int]int64{2: 120, 3: 110}).Return(nil).Once()
+	assert.NoError(t, tracker.Flush())
+	assert.Zero(t, tracker.LastSeen(5))
+
+	// nothing to write
+	assert.NoError(t, tracker.Flush())
+	mockDB.AssertExpectations(t)
+
+	var none *sessionpolicy.Tracker
+	none.Seen(5, 2, 100)
+	assert.Zero(t, none.LastSeen(5))
+	assert.NoError(t, none.Flush())
+}
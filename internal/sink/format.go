@@ -0,0 +1,231 @@
+package sink
+
+import (
+	"authserver-backend/internal/events"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The formats of the sinks.
+const (
+	FormatSyslog = "syslog"
+	FormatCEF    = "cef"
+	FormatJSON   = "json"
+)
+
+// The syslog severities of the events.
+const (
+	severityWarning = 4
+	severityNotice  = 5
+	severityInfo    = 6
+)
+
+// facilityAuthPriv is the syslog facility of the security and authorization messages.
+const facilityAuthPriv = 10
+
+// appName names the server in the syslog messages and in the CEF headers.
+const appName = "authserver"
+
+// sdID is the id of the structured data element of the syslog messages. 32473 is the private
+// enterprise number reserved for documentation by RFC 5612.
+const sdID = "event@32473"
+
+// cefNames are the CEF event names of the known event types, the others are named by their type.
+var cefNames = map[string]string{
+	events.TypeLockout:            "Account locked out",
+	events.TypeMFAFailed:          "Multi-factor authentication failed",
+	events.TypeAdminChange:        "Admin change",
+	events.AuthPrefix + "login":   "Login",
+	events.AuthPrefix + "refresh": "Token refresh",
+	events.AuthPrefix + "logout":  "Logout",
+	events.AuthPrefix + "lockout": "Lockout",
+	events.AuthPrefix + "mfa":     "Multi-factor authentication",
+}
+
+// Formatter turns an event into a line, without its framing.
+type Formatter func(events.Event) ([]byte, error)
+
+// NewFormatter returns the formatter of a format. host is the hostname of the syslog messages.
+func NewFormatter(format, host string) (Formatter, error) {
+	switch format {
+	case FormatSyslog:
+		if host == "" {
+			host = "-"
+		}
+		return func(e events.Event) ([]byte, error) { return Syslog(e, host, os.Getpid()) }, nil
+	case FormatCEF:
+		return CEF, nil
+	case FormatJSON, "":
+		return func(e events.Event) ([]byte, error) { return json.Marshal(e) }, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// severity is the syslog severity of an event: warning for the failures and the lockouts,
+// notice for the admin changes and info for the rest.
+func severity(e events.Event) int {
+	switch {
+	case e.Type == events.TypeLockout || e.Type == events.TypeMFAFailed || e.Type == events.AuthPrefix+"lockout":
+		return severityWarning
+	case e.Data["success"] == false:
+		return severityWarning
+	case e.Type == events.TypeAdminChange:
+		return severityNotice
+	}
+	return severityInfo
+}
+
+// Syslog formats an event as an RFC 5424 message of the authpriv facility, with the event type
+// as MSGID, its fields as structured data and its JSON as message.
+func Syslog(e events.Event, host string, pid int) ([]byte, error) {
+	msg, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s [%s", facilityAuthPriv*8+severity(e),
+		time.Unix(e.Time, 0).UTC().Format(time.RFC3339), host, appName, pid, syslogName(e.Type), sdID)
+	for _, param := range fields(e) {
+		fmt.Fprintf(&b, ` %s="%s"`, param[0], sdEscaper.Replace(param[1]))
+	}
+	b.WriteString("] ")
+	b.Write(msg)
+	return []byte(b.String()), nil
+}
+
+// sdEscaper escapes the structured data parameter values.
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// syslogName makes a MSGID of an event type: at most 32 printable ASCII characters.
+func syslogName(eventType string) string {
+	name := []byte(eventType)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	for i, c := range name {
+		if c < 33 || c > 126 {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 {
+		return "-"
+	}
+	return string(name)
+}
+
+// fields are the names and the values of the fields of an event, then of its data by name.
+// The empty ones are left out.
+func fields(e events.Event) [][2]string {
+	list := [][2]string{{"id", e.ID}, {"type", e.Type}}
+	if e.UserID != 0 {
+		list = append(list, [2]string{"user_id", strconv.Itoa(e.UserID)})
+	}
+	if e.Login != "" {
+		list = append(list, [2]string{"login", e.Login})
+	}
+	if e.IP != "" {
+		list = append(list, [2]string{"ip", e.IP})
+	}
+	names := make([]string, 0, len(e.Data))
+	for name := range e.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if v := value(e.Data[name]); v != "" {
+			list = append(list, [2]string{name, v})
+		}
+	}
+	return list
+}
+
+// value is the text of a data value, its JSON when it is not a string, a number or a boolean.
+func value(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int, int64, float64, bool:
+		return fmt.Sprint(v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// CEF formats an event as an ArcSight Common Event Format line.
+func CEF(e events.Event) ([]byte, error) {
+	name, ok := cefNames[e.Type]
+	if !ok {
+		name = e.Type
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|", appName, "authserver-backend", "1.0",
+		cefHeaderEscaper.Replace(e.Type), cefHeaderEscaper.Replace(name), cefSeverity(e))
+
+	ext := [][2]string{{"rt", strconv.FormatInt(e.Time*1000, 10)}}
+	add := func(key, v string) {
+		if v != "" {
+			ext = append(ext, [2]string{key, v})
+		}
+	}
+	add("externalId", e.ID)
+	add("src", e.IP)
+	add("suser", e.Login)
+	if e.UserID != 0 {
+		add("suid", strconv.Itoa(e.UserID))
+	}
+	if success, ok := e.Data["success"].(bool); ok {
+		outcome := "failure"
+		if success {
+			outcome = "success"
+		}
+		add("outcome", outcome)
+	}
+	add("reason", value(e.Data["reason"]))
+	add("act", value(e.Data["action"]))
+	add("requestClientApplication", value(e.Data["user_agent"]))
+	if method := value(e.Data["method"]); method != "" {
+		add("cs1Label", "method")
+		add("cs1", method)
+	}
+	if entityType := value(e.Data["entity_type"]); entityType != "" {
+		add("cs2Label", "entity")
+		add("cs2", entityType+":"+value(e.Data["entity_id"]))
+	}
+
+	for i, kv := range ext {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(kv[0] + "=" + cefExtensionEscaper.Replace(kv[1]))
+	}
+	return []byte(b.String()), nil
+}
+
+// cefSeverity maps the syslog severity of an event to the 0 to 10 scale of CEF.
+func cefSeverity(e events.Event) int {
+	switch severity(e) {
+	case severityWarning:
+		return 7
+	case severityNotice:
+		return 5
+	}
+	return 3
+}
+
+// The escapers of the CEF header fields and extension values.
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
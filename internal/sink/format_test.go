@@ -0,0 +1,67 @@
+package sink_test
+
+import (
+	"authserver-backend/internal/events"
+	"authserver-backend/internal/sink"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslog(t *testing.T) {
+	e := events.Event{
+		ID:    "e1",
+		Type:  events.AuthPrefix + "login",
+		Time:  1700000000,
+		Login: `user"]@example.com`,
+		IP:    "10.0.0.1",
+		Data:  map[string]any{"success": false, "reason": "invalid_password", "method": ""},
+	}
+	line, err := sink.Syslog(e, "auth1", 42)
+	assert.NoError(t, err)
+
+	// authpriv.warning, the failed logins are warnings
+	prefix := `<84>1 2023-11-14T22:13:20Z auth1 authserver 42 auth.login [event@32473 id="e1" type="auth.login" ` +
+		`login="user\"\]@example.com" ip="10.0.0.1" reason="invalid_password" success="false"] `
+	if assert.True(t, len(line) > len(prefix)) {
+		assert.Equal(t, prefix, string(line[:len(prefix)]))
+		var decoded events.Event
+		assert.NoError(t, json.Unmarshal(line[len(prefix):], &decoded))
+		assert.Equal(t, e.Login, decoded.Login)
+	}
+
+	line, err = sink.Syslog(events.Event{Type: events.TypeAdminChange, Time: 1700000000, UserID: 2}, "auth1", 42)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^<85>1 .* admin\.change \[event@32473 id="" type="admin.change" user_id="2"\] `, string(line))
+}
+
+func TestCEF(t *testing.T) {
+	line, err := sink.CEF(events.Event{
+		ID:     "e2",
+		Type:   events.TypeAdminChange,
+		Time:   1700000000,
+		UserID: 2,
+		Login:  "admin@example.com",
+		IP:     "10.0.0.1",
+		Data:   map[string]any{"action": "update", "entity_type": "app", "entity_id": 7, "reason": "a=b\nc\\"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `CEF:0|authserver|authserver-backend|1.0|admin.change|Admin change|5|rt=1700000000000 externalId=e2 `+
+		`src=10.0.0.1 suser=admin@example.com suid=2 reason=a\=b\nc\\ act=update cs2Label=entity cs2=app:7`, string(line))
+
+	line, err = sink.CEF(events.Event{Type: "custom|type", Data: map[string]any{"success": true, "method": "pwd"}})
+	assert.NoError(t, err)
+	assert.Equal(t, `CEF:0|authserver|authserver-backend|1.0|custom\|type|custom\|type|3|rt=0 outcome=success cs1Label=method cs1=pwd`, string(line))
+}
+
+func TestNewFormatter(t *testing.T) {
+	format, err := sink.NewFormatter(sink.FormatJSON, "")
+	assert.NoError(t, err)
+	line, err := format(events.Event{ID: "e3", Type: events.TypeLockout})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"e3","type":"account.lockout","time":0}`, string(line))
+
+	_, err = sink.NewFormatter("xml", "")
+	assert.EqualError(t, err, `unknown format "xml"`)
+}
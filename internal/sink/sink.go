@@ -0,0 +1,225 @@
+// Package sink streams the events of the event bus to the SIEMs: as RFC 5424 syslog messages over
+// UDP, TCP or TLS, as CEF lines or as JSON lines, to the network or to a file. Each sink has its
+// own filter and buffer, and writes in its own goroutine, so a slow sink drops events rather than
+// slowing down the requests publishing them.
+package sink
+
+import (
+	"authserver-backend/internal/events"
+	"authserver-backend/internal/mtls"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// defaultBuffer is how many events a sink holds when its configuration does not say.
+const defaultBuffer = 1000
+
+// writeTimeout bounds the dial and every write to the network.
+const writeTimeout = time.Second * 5
+
+// Config is the configuration of a sink.
+type Config struct {
+	Name string `json:"name"`
+	// Format is "syslog", "cef" or "json".
+	Format string `json:"format"`
+	// Output is "udp://host:port", "tcp://host:port", "tls://host:port" or "file:///path".
+	Output string `json:"output"`
+	// CAFile is the PEM bundle verifying the certificate of a TLS output, the system roots when empty.
+	CAFile string `json:"ca_file,omitempty"`
+	// Events are the patterns of the event types sent, like the ones of the webhooks.
+	// Every event is sent when there are none.
+	Events []string `json:"events,omitempty"`
+	// Buffer is how many events wait to be written before the next ones are dropped.
+	Buffer int `json:"buffer,omitempty"`
+}
+
+// LoadConfig reads the sink configurations from a JSON file holding an array of Config, like:
+//
+//	[{"name": "siem", "format": "syslog", "output": "tls://siem.example.com:6514", "events": ["auth.*", "admin.*"]}]
+func LoadConfig(path string) ([]Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []Config
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid event sink configuration %s: %w", path, err)
+	}
+	return configs, nil
+}
+
+// Sink writes the events it is handed to its output. Handle is subscribed to the event bus
+// and Run does the writes in the background.
+type Sink struct {
+	Name   string
+	Events []string
+	// TLSConfig is the configuration of a TLS output.
+	TLSConfig *tls.Config
+
+	format  Formatter
+	syslog  bool
+	scheme  string
+	address string
+	queue   chan events.Event
+	dropped atomic.Int64
+	out     io.WriteCloser
+}
+
+// New returns the sink of a configuration, without connecting to its output yet.
+func New(cfg Config) (*Sink, error) {
+	target, err := url.Parse(cfg.Output)
+	if err != nil {
+		return nil, fmt.Errorf("event sink %s: %w", cfg.Name, err)
+	}
+	s := &Sink{Name: cfg.Name, Events: cfg.Events, scheme: target.Scheme, address: target.Host}
+	switch target.Scheme {
+	case "udp", "tcp", "tls":
+		if target.Host == "" {
+			return nil, fmt.Errorf("event sink %s: the output has no address", cfg.Name)
+		}
+	case "file":
+		s.address = target.Path
+		if s.address == "" {
+			return nil, fmt.Errorf("event sink %s: the output has no path", cfg.Name)
+		}
+	default:
+		return nil, fmt.Errorf("event sink %s: the output must be a udp, tcp, tls or file URL", cfg.Name)
+	}
+	if target.Scheme == "tls" {
+		s.TLSConfig = &tls.Config{ServerName: target.Hostname(), MinVersion: tls.VersionTLS12}
+		if cfg.CAFile != "" {
+			if s.TLSConfig.RootCAs, err = mtls.LoadCAPool(cfg.CAFile); err != nil {
+				return nil, fmt.Errorf("event sink %s: %w", cfg.Name, err)
+			}
+		}
+	}
+
+	s.syslog = cfg.Format == FormatSyslog
+	host, _ := os.Hostname()
+	if s.format, err = NewFormatter(cfg.Format, host); err != nil {
+		return nil, fmt.Errorf("event sink %s: %w", cfg.Name, err)
+	}
+
+	buffer := cfg.Buffer
+	if buffer <= 0 {
+		buffer = defaultBuffer
+	}
+	s.queue = make(chan events.Event, buffer)
+	return s, nil
+}
+
+// Handle queues an event selected by the filter of the sink for Run, it never blocks the publisher.
+// The event is dropped when the buffer is full.
+func (s *Sink) Handle(e events.Event) {
+	if !events.Match(s.Events, e.Type) {
+		return
+	}
+	select {
+	case s.queue <- e:
+	default:
+		if s.dropped.Add(1) == 1 {
+			log.Printf("The buffer of event sink %s is full, dropping events", s.Name)
+		}
+	}
+}
+
+// Dropped is how many events were dropped because the buffer of the sink was full.
+func (s *Sink) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Run writes the queued events until the context is cancelled, then closes the output.
+// It is meant to be started in its own goroutine from main.
+func (s *Sink) Run(ctx context.Context) {
+	defer s.close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-s.queue:
+			if err := s.Write(e); err != nil {
+				log.Printf("Event sink %s could not write event %s: %v", s.Name, e.ID, err)
+			}
+		}
+	}
+}
+
+// Write formats an event and writes it to the output, connecting first when the sink is not.
+// A failed write is tried once more on a new connection.
+func (s *Sink) Write(e events.Event) error {
+	line, err := s.format(e)
+	if err != nil {
+		return err
+	}
+	frame := s.frame(line)
+
+	for attempt := 0; ; attempt++ {
+		if err = s.open(); err == nil {
+			if s.scheme != "file" {
+				_ = s.out.(net.Conn).SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
+			if _, err = s.out.Write(frame); err == nil {
+				return nil
+			}
+		}
+		s.close()
+		if attempt == 1 {
+			return err
+		}
+	}
+}
+
+// frame frames a line for the output: a datagram holds one line as is, a stream holds the syslog
+// messages with their octet count as in RFC 6587 and the other lines ended by a newline.
+func (s *Sink) frame(line []byte) []byte {
+	switch {
+	case s.scheme == "udp":
+		return line
+	case s.syslog && s.scheme != "file":
+		return append([]byte(strconv.Itoa(len(line))+" "), line...)
+	}
+	return append(line, '\n')
+}
+
+// open connects to the output, or opens the file, when the sink is not yet.
+func (s *Sink) open() error {
+	if s.out != nil {
+		return nil
+	}
+	var err error
+	switch s.scheme {
+	case "file":
+		s.out, err = os.OpenFile(s.address, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	case "tls":
+		dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: writeTimeout}, Config: s.TLSConfig}
+		s.out, err = dialer.Dial("tcp", s.address)
+	case "udp", "tcp":
+		s.out, err = net.DialTimeout(s.scheme, s.address, writeTimeout)
+	default:
+		err = errors.New("unknown output")
+	}
+	if err != nil {
+		s.out = nil
+	}
+	return err
+}
+
+// close closes the output, the next write opens it again.
+func (s *Sink) close() {
+	if s.out != nil {
+		_ = s.out.Close()
+		s.out = nil
+	}
+}
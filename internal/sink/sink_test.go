@@ -0,0 +1,235 @@
+package sink_test
+
+import (
+	"authserver-backend/internal/events"
+	"authserver-backend/internal/mtls/mtlstest"
+	"authserver-backend/internal/sink"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// accept reads the first connection of a listener line by line and passes the lines on the returned channel.
+func accept(t *testing.T, listener net.Listener) chan string {
+	t.Cleanup(func() { listener.Close() })
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+}
+
+// receive waits for the next line of a channel.
+func receive(t *testing.T, lines chan string) string {
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(time.Second * 5):
+		t.Fatal("nothing was received")
+		return ""
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sinks.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "siem", "format": "syslog", "output": "udp://127.0.0.1:514", "events": ["auth.*"]},
+		{"name": "archive", "format": "json", "output": "file:///var/log/authserver/events.jsonl", "buffer": 10}
+	]`), 0o600))
+
+	configs, err := sink.LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []sink.Config{
+		{Name: "siem", Format: "syslog", Output: "udp://127.0.0.1:514", Events: []string{"auth.*"}},
+		{Name: "archive", Format: "json", Output: "file:///var/log/authserver/events.jsonl", Buffer: 10},
+	}, configs)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{}`), 0o600))
+	_, err = sink.LoadConfig(path)
+	assert.Error(t, err)
+}
+
+func TestNew_Invalid(t *testing.T) {
+	for _, cfg := range []sink.Config{
+		{Name: "a", Format: "json", Output: "http://siem.example.com"},
+		{Name: "b", Format: "json", Output: "tcp://"},
+		{Name: "c", Format: "xml", Output: "udp://127.0.0.1:514"},
+	} {
+		_, err := sink.New(cfg)
+		assert.Error(t, err, cfg.Name)
+	}
+}
+
+func TestWrite_UDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := sink.New(sink.Config{Name: "siem", Format: sink.FormatSyslog, Output: "udp://" + conn.LocalAddr().String()})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Write(events.Event{ID: "e1", Type: events.TypeLockout, Time: 1700000000}))
+
+	buf := make([]byte, 2048)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "<84>1 2023-11-14T22:13:20Z "), string(buf[:n]))
+	assert.True(t, strings.HasSuffix(string(buf[:n]), "}"), "a datagram is not framed")
+}
+
+// TestWrite_TCP tests the newline framing and that the sink connects again once its output is back.
+func TestWrite_TCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	s, err := sink.New(sink.Config{Name: "siem", Format: sink.FormatCEF, Output: "tcp://" + address})
+	assert.NoError(t, err)
+	assert.Error(t, s.Write(events.Event{ID: "e1", Type: events.TypeMFAFailed}))
+
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Skip("the address could not be listened on again:", err)
+	}
+	lines := accept(t, listener)
+	assert.NoError(t, s.Write(events.Event{ID: "e2", Type: events.TypeMFAFailed}))
+	assert.NoError(t, s.Write(events.Event{ID: "e3", Type: events.TypeMFAFailed}))
+	line := receive(t, lines)
+	assert.Contains(t, line, "|mfa.failed|Multi-factor authentication failed|7|")
+	assert.Contains(t, line, "externalId=e2")
+	assert.Contains(t, receive(t, lines), "externalId=e3")
+}
+
+// TestWrite_TLS tests the octet counting framing of the syslog messages over TLS.
+func TestWrite_TLS(t *testing.T) {
+	ca, err := mtlstest.NewCA("sink test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.Issue(mtlstest.Names{DNS: []string{"localhost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conns := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if err := conn.(*tls.Conn).Handshake(); err != nil {
+				conn.Close()
+				continue
+			}
+			conns <- conn
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, ca.PEM(), 0o600))
+	s, err := sink.New(sink.Config{Name: "siem", Format: sink.FormatSyslog, Output: "tls://localhost:" + port, CAFile: caFile})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Write(events.Event{ID: "e1", Type: events.TypeAdminChange}))
+	assert.NoError(t, s.Write(events.Event{ID: "e2", Type: events.TypeAdminChange}))
+
+	// the messages are not ended by newlines but prefixed with their length
+	var conn net.Conn
+	select {
+	case conn = <-conns:
+	case <-time.After(time.Second * 5):
+		t.Fatal("the sink did not connect")
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	r := bufio.NewReader(conn)
+	for _, id := range []string{"e1", "e2"} {
+		prefix, err := r.ReadString(' ')
+		assert.NoError(t, err)
+		length, err := strconv.Atoi(strings.TrimSuffix(prefix, " "))
+		assert.NoError(t, err)
+		message := make([]byte, length)
+		_, err = io.ReadFull(r, message)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(message), "<85>1 "), string(message))
+		assert.True(t, strings.HasSuffix(string(message), `"id":"`+id+`","type":"admin.change","time":0}`), string(message))
+	}
+
+	untrusted, err := sink.New(sink.Config{Name: "siem", Format: sink.FormatSyslog, Output: "tls://localhost:" + port})
+	assert.NoError(t, err)
+	assert.Error(t, untrusted.Write(events.Event{ID: "e3", Type: events.TypeAdminChange}))
+}
+
+// TestRun tests that a sink writes the events it selects in the background, one JSON line each.
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	s, err := sink.New(sink.Config{Name: "archive", Format: sink.FormatJSON, Output: "file://" + path, Events: []string{"auth.*"}})
+	assert.NoError(t, err)
+
+	var bus events.Bus
+	bus.Subscribe(s.Handle)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	bus.Publish(events.Event{ID: "e1", Type: events.TypeAdminChange})
+	bus.Publish(events.Event{ID: "e2", Type: events.AuthPrefix + "login"})
+	bus.Publish(events.Event{ID: "e3", Type: events.AuthPrefix + "logout"})
+
+	assert.Eventually(t, func() bool {
+		data, _ := os.ReadFile(path)
+		return strings.Count(string(data), "\n") == 2
+	}, time.Second*5, time.Millisecond*10)
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	assert.Contains(t, lines[0], `"id":"e2"`)
+	assert.Contains(t, lines[1], `"id":"e3"`)
+}
+
+// TestHandle_Full tests that a sink drops the events rather than blocking the publisher when its buffer is full.
+func TestHandle_Full(t *testing.T) {
+	s, err := sink.New(sink.Config{Name: "siem", Format: sink.FormatJSON, Output: "tcp://127.0.0.1:1", Buffer: 2})
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			s.Handle(events.Event{Type: events.TypeLockout})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Handle blocked")
+	}
+	assert.Equal(t, int64(3), s.Dropped())
+}
@@ -1,6 +1,10 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
@@ -71,3 +75,21 @@ func (jsr JSONResponse) ErrorJSON(w http.ResponseWriter, err error, status ...in
 
 	return jsr.WriteJSON(w, statusCode, payload)
 }
+
+// RandomToken returns a URL-safe, base64 encoded string built from n random bytes.
+// It is used wherever the server has to hand out an unguessable value,
+// like temporary passwords or one-time codes.
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded SHA-256 hash of a token.
+// Tokens handed out to clients are only stored hashed, so a leaked table does not leak usable tokens.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -109,3 +109,21 @@ func TestErrorJSON(t *testing.T) {
 	assert.True(t, jsonResponse.Error)
 	assert.Equal(t, "test error message", jsonResponse.Message)
 }
+
+func TestRandomToken(t *testing.T) {
+	first, err := utils.RandomToken(32)
+	assert.NoError(t, err)
+	second, err := utils.RandomToken(32)
+	assert.NoError(t, err)
+
+	// 32 bytes encode to 43 characters without padding
+	assert.Len(t, first, 43)
+	assert.NotEqual(t, first, second)
+}
+
+func TestHashToken(t *testing.T) {
+	hash := utils.HashToken("abc")
+	assert.Equal(t, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", hash)
+	assert.Equal(t, hash, utils.HashToken("abc"))
+	assert.NotEqual(t, hash, utils.HashToken("abd"))
+}
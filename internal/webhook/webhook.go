@@ -0,0 +1,303 @@
+// Package webhook posts the security events to the outbound webhooks configured by the admins.
+// Every delivery is stored before it is attempted, attempted again with an exponential backoff
+// while it fails, and moved to the dead letters after its last attempt. A delivery may reach its
+// receiver more than once, the receivers drop the duplicates by the X-Webhook-Delivery header.
+package webhook
+
+import (
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/events"
+	"authserver-backend/internal/models"
+	"authserver-backend/logerror"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The headers of the posted events.
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// retryBatch is how many due deliveries are attempted at a time.
+const retryBatch = 100
+
+// ErrPrivateTarget is returned for the webhook targets on a loopback, private, link-local, unspecified
+// or multicast address: the server must not be made to call its own network.
+var ErrPrivateTarget = errors.New("the webhook target is not a public address")
+
+// privateIP tells whether an address is not a public unicast one.
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// CheckHost returns ErrPrivateTarget when the host of a webhook url is a private address or a localhost
+// name. The other names are only resolved when a delivery is posted, the dispatcher checks their addresses then.
+func CheckHost(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrPrivateTarget
+	}
+	if ip := net.ParseIP(host); ip != nil && privateIP(ip) {
+		return ErrPrivateTarget
+	}
+	return nil
+}
+
+// Sign returns the signature header of a payload posted at a time: "t=<Unix time>,v1=<hex HMAC-SHA256
+// of "<Unix time>.<payload>" keyed with the secret of the webhook>". The time is signed too,
+// so a captured request cannot be replayed later.
+func Sign(secret string, t int64, payload []byte) string {
+	ts := strconv.FormatInt(t, 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(payload)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature header of a payload, as a receiver does: the signature must match
+// and its time be within tolerance of now.
+func Verify(secret, header string, payload []byte, tolerance time.Duration, now time.Time) error {
+	var ts, signature string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			signature = v
+		}
+	}
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || signature == "" {
+		return errors.New("malformed signature header")
+	}
+	if !hmac.Equal([]byte(Sign(secret, t, payload)), []byte("t="+ts+",v1="+signature)) {
+		return errors.New("invalid signature")
+	}
+	if d := now.Sub(time.Unix(t, 0)); d > tolerance || d < -tolerance {
+		return errors.New("the signature is too old")
+	}
+	return nil
+}
+
+// Dispatcher delivers the security events to the webhooks. Handle is subscribed to the event bus
+// and Run does the deliveries in the background.
+type Dispatcher struct {
+	DB     dbrepo.DatabaseRepo
+	Client *http.Client
+	// MaxAttempts is how many times a delivery is attempted before it is dead.
+	MaxAttempts int
+	// Backoff is the delay before the second attempt, doubled before each next one up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// AllowPrivate lets the deliveries reach the private addresses, see ErrPrivateTarget.
+	AllowPrivate bool
+
+	queue chan events.Event
+}
+
+// NewDispatcher returns a dispatcher attempting each delivery 8 times over about two hours,
+// with a queue of 1024 events. Its client refuses to connect to the private addresses unless
+// AllowPrivate is set, whatever the names of the webhooks resolve to when they are posted.
+func NewDispatcher(db dbrepo.DatabaseRepo) *Dispatcher {
+	d := &Dispatcher{
+		DB:          db,
+		MaxAttempts: 8,
+		Backoff:     time.Minute,
+		MaxBackoff:  time.Hour,
+		queue:       make(chan events.Event, 1024),
+	}
+	dialer := &net.Dialer{Timeout: time.Second * 10, Control: d.control}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// through a proxy, the address checked would be the proxy's
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	d.Client = &http.Client{Timeout: time.Second * 10, Transport: transport}
+	return d
+}
+
+// control refuses the connections of the client to the private addresses, see AllowPrivate.
+func (d *Dispatcher) control(network, address string, _ syscall.RawConn) error {
+	if d.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || privateIP(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateTarget, host)
+	}
+	return nil
+}
+
+// Handle queues an event for Run, it never blocks the publisher. The event is dropped
+// when the queue is full.
+func (d *Dispatcher) Handle(e events.Event) {
+	select {
+	case d.queue <- e:
+	default:
+		log.Printf("The webhook queue is full, event %s of type %s dropped", e.ID, e.Type)
+	}
+}
+
+// Run delivers the queued events, and attempts the due deliveries every interval,
+// until the context is cancelled. It is meant to be started in its own goroutine from main.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-d.queue:
+			if err := d.Dispatch(e); err != nil {
+				logerror.LogError(err)
+			}
+		case <-ticker.C:
+			if _, err := d.RetryDue(); err != nil {
+				logerror.LogError(err)
+			}
+		}
+	}
+}
+
+// Dispatch stores a delivery of an event for every webhook subscribed to its type, and attempts them.
+func (d *Dispatcher) Dispatch(e events.Event) error {
+	webhooks, err := d.DB.Webhooks()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, webhook := range webhooks {
+		if !events.Match(webhook.EventTypes, e.Type) {
+			continue
+		}
+		delivery := models.WebhookDelivery{
+			WebhookID:   webhook.ID,
+			EventID:     e.ID,
+			EventType:   e.Type,
+			Payload:     payload,
+			Status:      models.WebhookDeliveryPending,
+			NextAttempt: now,
+			Created:     now,
+			Updated:     now,
+		}
+		if delivery.ID, err = d.DB.InsertWebhookDelivery(delivery); err != nil {
+			logerror.LogError(err)
+			continue
+		}
+		d.attempt(webhook, delivery)
+	}
+	return nil
+}
+
+// RetryDue attempts the pending deliveries that are due and returns how many were attempted.
+func (d *Dispatcher) RetryDue() (int, error) {
+	deliveries, err := d.DB.DueWebhookDeliveries(time.Now().Unix(), retryBatch)
+	if err != nil || len(deliveries) == 0 {
+		return 0, err
+	}
+	webhooks, err := d.DB.Webhooks()
+	if err != nil {
+		return 0, err
+	}
+	byID := make(map[int]*models.Webhook, len(webhooks))
+	for _, webhook := range webhooks {
+		byID[webhook.ID] = webhook
+	}
+
+	attempted := 0
+	for _, delivery := range deliveries {
+		if webhook, ok := byID[delivery.WebhookID]; ok {
+			d.attempt(webhook, *delivery)
+			attempted++
+		}
+	}
+	return attempted, nil
+}
+
+// attempt posts a delivery and records the outcome: delivered, pending until the next attempt,
+// or dead after the last one.
+func (d *Dispatcher) attempt(webhook *models.Webhook, delivery models.WebhookDelivery) {
+	delivery.Attempts++
+	delivery.ResponseCode, delivery.Error = d.post(webhook, delivery)
+	now := time.Now()
+	delivery.Updated = now.Unix()
+
+	var err error
+	switch {
+	case delivery.Error == "":
+		delivery.Status = models.WebhookDeliveryDelivered
+		delivery.NextAttempt = 0
+		err = d.DB.UpdateWebhookDelivery(delivery)
+	case delivery.Attempts >= d.MaxAttempts:
+		err = d.DB.DeadLetterWebhookDelivery(delivery)
+	default:
+		delivery.NextAttempt = now.Add(d.backoff(delivery.Attempts)).Unix()
+		err = d.DB.UpdateWebhookDelivery(delivery)
+	}
+	if err != nil {
+		logerror.LogError(err)
+	}
+}
+
+// post sends a delivery to its webhook and returns the status code of the answer,
+// and why the delivery failed when it did.
+func (d *Dispatcher) post(webhook *models.Webhook, delivery models.WebhookDelivery) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(delivery.ID))
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, time.Now().Unix(), delivery.Payload))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, ""
+}
+
+// backoff returns the delay after the attempt of a number.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.Backoff
+	for i := 1; i < attempts && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxBackoff {
+		delay = d.MaxBackoff
+	}
+	return delay
+}
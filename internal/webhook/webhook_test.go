@@ -0,0 +1,165 @@
+package webhook_test
+
+import (
+	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/events"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/webhook"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// received is a request of the test receiver.
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver answers status to the deliveries and passes them on the returned channel.
+func receiver(t *testing.T, status int) (*httptest.Server, chan received) {
+	requests := make(chan received, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{r.Header.Clone(), body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestSign(t *testing.T) {
+	payload := []byte(`{"type":"account.lockout"}`)
+	now := time.Unix(1700000000, 0)
+	header := webhook.Sign("secret", now.Unix(), payload)
+	assert.Regexp(t, `^t=1700000000,v1=[0-9a-f]{64}$`, header)
+
+	assert.NoError(t, webhook.Verify("secret", header, payload, time.Minute*5, now.Add(time.Minute)))
+	assert.EqualError(t, webhook.Verify("other", header, payload, time.Minute*5, now), "invalid signature")
+	assert.EqualError(t, webhook.Verify("secret", header, []byte(`{}`), time.Minute*5, now), "invalid signature")
+	assert.EqualError(t, webhook.Verify("secret", header, payload, time.Minute*5, now.Add(time.Hour)), "the signature is too old")
+	assert.EqualError(t, webhook.Verify("secret", "v1=abc", payload, time.Minute*5, now), "malformed signature header")
+}
+
+// TestDispatch tests that an event is signed and posted to the webhooks subscribed to its type only.
+func TestDispatch(t *testing.T) {
+	server, requests := receiver(t, http.StatusNoContent)
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("Webhooks").Return([]*models.Webhook{
+		{ID: 1, URL: server.URL, Secret: "s1", EventTypes: []string{"account.*"}},
+		{ID: 2, URL: server.URL, Secret: "s2", EventTypes: []string{events.TypeMFAFailed}},
+	}, nil)
+	mockDB.On("InsertWebhookDelivery", mock.MatchedBy(func(d models.WebhookDelivery) bool {
+		return d.WebhookID == 1 && d.EventType == events.TypeLockout && d.Status == models.WebhookDeliveryPending
+	})).Return(5, nil)
+	mockDB.On("UpdateWebhookDelivery", mock.Anything).Return(nil)
+
+	d := webhook.NewDispatcher(mockDB)
+	d.AllowPrivate = true
+	err := d.Dispatch(events.Event{ID: "e1", Type: events.TypeLockout, Time: 1700000000, Login: "user@example.com"})
+	assert.NoError(t, err)
+
+	if assert.Len(t, requests, 1) {
+		r := <-requests
+		assert.Equal(t, events.TypeLockout, r.header.Get(webhook.EventHeader))
+		assert.Equal(t, "5", r.header.Get(webhook.DeliveryHeader))
+		assert.NoError(t, webhook.Verify("s1", r.header.Get(webhook.SignatureHeader), r.body, time.Minute, time.Now()))
+		var e events.Event
+		assert.NoError(t, json.Unmarshal(r.body, &e))
+		assert.Equal(t, "user@example.com", e.Login)
+	}
+	mockDB.AssertCalled(t, "UpdateWebhookDelivery", mock.MatchedBy(func(d models.WebhookDelivery) bool {
+		return d.ID == 5 && d.Status == models.WebhookDeliveryDelivered && d.Attempts == 1 && d.ResponseCode == http.StatusNoContent
+	}))
+}
+
+// TestDispatch_PrivateTarget tests that a delivery to a private address fails unless they are allowed.
+func TestDispatch_PrivateTarget(t *testing.T) {
+	server, requests := receiver(t, http.StatusNoContent)
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("Webhooks").Return([]*models.Webhook{{ID: 1, URL: server.URL, Secret: "s1"}}, nil)
+	mockDB.On("InsertWebhookDelivery", mock.Anything).Return(5, nil)
+	mockDB.On("UpdateWebhookDelivery", mock.Anything).Return(nil)
+
+	d := webhook.NewDispatcher(mockDB)
+	assert.NoError(t, d.Dispatch(events.Event{ID: "e1", Type: events.TypeLockout}))
+	assert.Len(t, requests, 0)
+	mockDB.AssertCalled(t, "UpdateWebhookDelivery", mock.MatchedBy(func(d models.WebhookDelivery) bool {
+		return d.ID == 5 && d.Status == models.WebhookDeliveryPending && d.Attempts == 1 &&
+			strings.Contains(d.Error, webhook.ErrPrivateTarget.Error())
+	}))
+}
+
+func TestCheckHost(t *testing.T) {
+	for _, host := range []string{"localhost", "api.localhost.", "127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "::1", "fe80::1", "0.0.0.0", "224.0.0.1"} {
+		assert.ErrorIs(t, webhook.CheckHost(host), webhook.ErrPrivateTarget, host)
+	}
+	for _, host := range []string{"soc.example.com", "93.184.216.34", "2001:db8::1"} {
+		assert.NoError(t, webhook.CheckHost(host), host)
+	}
+}
+
+// TestRetryDue tests the backoff of a failing delivery and its dead letter after the last attempt.
+func TestRetryDue(t *testing.T) {
+	server, requests := receiver(t, http.StatusInternalServerError)
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("Webhooks").Return([]*models.Webhook{{ID: 1, URL: server.URL, Secret: "s1"}}, nil)
+	mockDB.On("DueWebhookDeliveries", mock.Anything, 100).Return([]*models.WebhookDelivery{
+		{ID: 5, WebhookID: 1, EventType: events.TypeLockout, Payload: json.RawMessage(`{}`), Status: models.WebhookDeliveryPending, Attempts: 2},
+		{ID: 6, WebhookID: 1, EventType: events.TypeLockout, Payload: json.RawMessage(`{}`), Status: models.WebhookDeliveryPending, Attempts: 7},
+		{ID: 7, WebhookID: 9, EventType: events.TypeLockout, Payload: json.RawMessage(`{}`), Status: models.WebhookDeliveryPending},
+	}, nil)
+	mockDB.On("UpdateWebhookDelivery", mock.Anything).Return(nil)
+	mockDB.On("DeadLetterWebhookDelivery", mock.Anything).Return(nil)
+
+	d := webhook.NewDispatcher(mockDB)
+	d.AllowPrivate = true
+	start := time.Now().Unix()
+	attempted, err := d.RetryDue()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempted)
+	assert.Len(t, requests, 2)
+
+	// the third attempt is retried after 4 minutes
+	mockDB.AssertCalled(t, "UpdateWebhookDelivery", mock.MatchedBy(func(d models.WebhookDelivery) bool {
+		return d.ID == 5 && d.Status == models.WebhookDeliveryPending && d.Attempts == 3 &&
+			d.ResponseCode == http.StatusInternalServerError && d.Error == "unexpected status 500" &&
+			d.NextAttempt >= start+240 && d.NextAttempt <= time.Now().Unix()+240
+	}))
+	mockDB.AssertCalled(t, "DeadLetterWebhookDelivery", mock.MatchedBy(func(d models.WebhookDelivery) bool {
+		return d.ID == 6 && d.Attempts == 8
+	}))
+}
+
+// TestRun tests that the events handed to the dispatcher are delivered in the background.
+func TestRun(t *testing.T) {
+	server, requests := receiver(t, http.StatusOK)
+	mockDB := new(dbrepo.MockDBRepo)
+	mockDB.On("Webhooks").Return([]*models.Webhook{{ID: 1, URL: server.URL, Secret: "s1"}}, nil)
+	mockDB.On("InsertWebhookDelivery", mock.Anything).Return(5, nil)
+	mockDB.On("UpdateWebhookDelivery", mock.Anything).Return(nil)
+
+	var bus events.Bus
+	d := webhook.NewDispatcher(mockDB)
+	d.AllowPrivate = true
+	bus.Subscribe(d.Handle)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx, time.Hour)
+
+	bus.Publish(events.Event{Type: events.TypeAdminChange})
+	select {
+	case r := <-requests:
+		assert.Equal(t, events.TypeAdminChange, r.header.Get(webhook.EventHeader))
+	case <-time.After(time.Second * 5):
+		t.Fatal("the event was not delivered")
+	}
+}
@@ -3,22 +3,49 @@ package main
 import (
 	"authserver-backend/api"
 	"authserver-backend/auth"
+	"authserver-backend/internal/audit"
+	"authserver-backend/internal/authenticator"
 	"authserver-backend/internal/dbrepo"
+	"authserver-backend/internal/events"
+	"authserver-backend/internal/federation"
+	"authserver-backend/internal/mailer"
+	"authserver-backend/internal/models"
+	"authserver-backend/internal/mtls"
+	"authserver-backend/internal/ratelimit"
+	"authserver-backend/internal/samlidp"
+	"authserver-backend/internal/sessionpolicy"
+	"authserver-backend/internal/sink"
+	"authserver-backend/internal/webhook"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib" // Import the pgx  driver for database/sql
 	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
 )
 
 var port int
+var reapInterval time.Duration
+var samlBaseURL string
+var auditCheckpointInterval time.Duration
+var webhookRetryInterval time.Duration
+var activityFlushInterval time.Duration
+var jwtAudiences string
+var jwtLeeway time.Duration
+var adminProfiles string
 
-// main is the entry point for the application.
+// main is the entry point for the application. Run as "authserver-backend verify-audit [log...]"
+// it verifies the hash chains of the audit logs instead of serving.
 func main() {
 	// Locate the current directory
 	app := api.AuthServerApp{}
@@ -53,18 +80,52 @@ func main() {
 	// Set default values for the app configuration
 	flag.StringVar(&app.JWTIssuer, "jwt-issuer", "example.com", "signing issuer")
 	flag.StringVar(&app.JWTAudience, "jwt-audience", "example.com", "signing audience")
+	flag.StringVar(&jwtAudiences, "jwt-accepted-audiences", "", "comma-separated audiences accepted besides the signing audience")
+	flag.DurationVar(&jwtLeeway, "jwt-leeway", time.Second*30, "clock skew tolerated when checking the times of the tokens")
 	flag.StringVar(&app.CookieDomain, "cookie-domain", "localhost", "cookie domain")
 	flag.StringVar(&app.Domain, "domain", "example.com", "domain")
 	flag.IntVar(&port, "port", 8080, "API server port")
+	flag.DurationVar(&app.DBCredentialTTL, "db-credential-ttl", time.Hour, "default lifetime of dynamic database credentials")
+	flag.DurationVar(&app.DBCredentialMaxTTL, "db-credential-max-ttl", time.Hour*8, "maximum lifetime of dynamic database credentials")
+	flag.DurationVar(&app.LaunchCodeTTL, "launch-code-ttl", time.Minute, "how long an app launch code can be exchanged")
+	flag.StringVar(&app.ForwardAuthLoginURL, "forward-auth-login-url", "", "login page for browsers rejected by forward-auth")
+	flag.StringVar(&app.ForwardAuthCookieName, "forward-auth-cookie", "auth_session", "session cookie read by forward-auth")
+	flag.StringVar(&app.ForwardAuthAudience, "forward-auth-audience", "forward-auth", "audience of the forward-auth session tokens")
+	flag.StringVar(&app.FederationRedirectURL, "federation-redirect-url", "", "frontend page to return to after a federated login")
+	flag.StringVar(&app.MagicLinkURL, "magic-link-url", "", "page the emailed login links point to, the server's own when empty")
+	flag.DurationVar(&app.MagicLinkTTL, "magic-link-ttl", time.Minute*15, "how long an emailed login link and code can be used")
+	flag.DurationVar(&app.PersonalAccessTokenTTL, "pat-ttl", time.Hour*24*90, "default lifetime of personal access tokens")
+	flag.DurationVar(&app.PersonalAccessTokenMaxTTL, "pat-max-ttl", time.Hour*24*365, "maximum lifetime of personal access tokens")
+	flag.DurationVar(&app.ImpersonationTTL, "impersonation-ttl", time.Minute*15, "how long an admin can impersonate a user")
+	flag.DurationVar(&app.StepUpMaxAge, "step-up-max-age", time.Minute*5, "how recent the multi-factor authentication of sensitive admin actions must be")
+	flag.DurationVar(&app.TrustedDeviceTTL, "trusted-device-ttl", time.Hour*24*30, "how long a trusted browser skips the second factor")
+	flag.StringVar(&app.TrustedDeviceCookieName, "trusted-device-cookie", "__Host-trusted_device", "cookie remembering a trusted browser")
+	flag.StringVar(&samlBaseURL, "saml-base-url", "", "public address of the server used in the SAML metadata")
+	flag.DurationVar(&reapInterval, "db-credential-reap-interval", time.Minute, "how often expired database credentials are revoked")
+	flag.DurationVar(&auditCheckpointInterval, "audit-checkpoint-interval", time.Hour, "how often the audit logs are checkpointed")
+	flag.DurationVar(&webhookRetryInterval, "webhook-retry-interval", time.Second*30, "how often the failed webhook deliveries due are retried")
+	flag.BoolVar(&app.AllowPrivateWebhooks, "webhook-allow-private", false, "let the webhooks target loopback and private addresses")
+	flag.DurationVar(&activityFlushInterval, "activity-flush-interval", time.Second*30, "how often the activity of the sessions is written to the database")
 
+	flag.StringVar(&adminProfiles, "admin-profiles", "", "comma-separated ids of the profiles of the admins")
 	flag.Parse()
+	verifyOnly := flag.Arg(0) == "verify-audit"
+
 	// Initialize the database connection
 	if app.DSN == "" {
 		log.Fatal("DSN environment variable is not set")
 	}
-	if app.JWTSecret == "" {
+	if app.JWTSecret == "" && !verifyOnly {
 		log.Fatal("JWT_SECRET environment variable is not set")
 	}
+	// the tokens are only accepted for a configured audience
+	if app.JWTAudience == "" && !verifyOnly {
+		log.Fatal("-jwt-audience is not set")
+	}
+	app.AdminProfiles, err = profileIDs(adminProfiles)
+	if err != nil {
+		log.Fatalf("Invalid -admin-profiles: %v", err)
+	}
 
 	repo := &dbrepo.PostgresDBRepo{}
 	db, err := repo.ConnectToDB(app.DSN)
@@ -88,10 +149,25 @@ func main() {
 	// Assign the initialized repo to app.DB
 	app.DB = repo
 
+	// Sign checkpoints of the audit logs when a signing key is configured
+	if keyFile := os.Getenv("AUDIT_SIGNING_KEY_FILE"); keyFile != "" {
+		app.AuditSigningKey, err = audit.LoadSigningKey(keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load the audit signing key: %v", err)
+		}
+	}
+	if verifyOnly {
+		code := verifyAudit(&app, flag.Args()[1:])
+		db.Close()
+		os.Exit(code)
+	}
+
 	app.Auth = auth.Auth{
 		Issuer:        app.JWTIssuer,
 		Audience:      app.JWTAudience,
-		Secret:        app.JWTSecret,
+		Audiences:     acceptedAudiences(jwtAudiences),
+		Leeway:        jwtLeeway,
+		JWTSecret:     app.JWTSecret,
 		TokenExpiry:   time.Minute * 15,
 		RefreshExpiry: time.Hour * 24,
 		CookiePath:    "/",
@@ -99,11 +175,223 @@ func main() {
 		CookieDomain:  app.CookieDomain,
 	}
 
+	// Load the upstream identity providers, if any are configured
+	if providersFile := os.Getenv("OIDC_PROVIDERS_FILE"); providersFile != "" {
+		configs, err := federation.LoadConfig(providersFile)
+		if err != nil {
+			log.Fatalf("Failed to load identity providers: %v", err)
+		}
+		app.Federation, err = federation.NewProviders(context.Background(), configs)
+		if err != nil {
+			log.Printf("Some identity providers are not available: %v", err)
+		}
+		log.Printf("Loaded %d identity providers", len(app.Federation))
+	}
+
+	// Check the passwords against a directory too, when one is configured
+	if ldapFile := os.Getenv("LDAP_CONFIG_FILE"); ldapFile != "" {
+		cfg, err := authenticator.LoadLDAPConfig(ldapFile)
+		if err != nil {
+			log.Fatalf("Failed to load the LDAP configuration: %v", err)
+		}
+		app.Authenticator = authenticator.Chain{
+			authenticator.Local{DB: app.DB},
+			authenticator.LDAP{Config: cfg, DB: app.DB},
+		}
+		log.Printf("LDAP authentication enabled with %s", cfg.URL)
+	}
+
+	// Act as a SAML identity provider when a signing key is configured
+	if certFile := os.Getenv("SAML_CERT_FILE"); certFile != "" {
+		cert, key, err := samlidp.LoadKeyPair(certFile, os.Getenv("SAML_KEY_FILE"))
+		if err != nil {
+			log.Fatalf("Failed to load the SAML signing key: %v", err)
+		}
+		baseURL, err := url.Parse(samlBaseURL)
+		if err != nil || baseURL.Host == "" {
+			log.Fatal("saml-base-url must be the public address of the server")
+		}
+		app.EnableSAML(*baseURL, cert, key)
+		log.Printf("SAML identity provider enabled at %s", app.SAML.MetadataURL.String())
+	}
+
+	// Send the passwordless login emails through SMTP, or to a directory in development
+	if smtpHost := os.Getenv("SMTP_HOST"); smtpHost != "" {
+		smtpPort, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+		if err != nil {
+			log.Fatal("SMTP_PORT must be a port number")
+		}
+		app.Mailer = mailer.SMTP{
+			Host:     smtpHost,
+			Port:     smtpPort,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+		log.Printf("Passwordless login enabled, emails sent through %s", smtpHost)
+	} else if outboxDir := os.Getenv("MAIL_OUTBOX_DIR"); outboxDir != "" {
+		app.Mailer = mailer.FileOutbox{Dir: outboxDir, From: os.Getenv("MAIL_FROM")}
+		log.Printf("Passwordless login enabled, emails written to %s", outboxDir)
+	}
+
+	// Rate limit the authentication routes, in Redis when the limits are shared by several servers
+	app.RateLimitStore = ratelimit.NewMemory()
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			log.Fatalf("Invalid REDIS_URL: %v", err)
+		}
+		client := redis.NewClient(opts)
+		defer client.Close()
+		app.RateLimitStore = ratelimit.Redis{Client: client, Prefix: "ratelimit:"}
+		log.Printf("Rate limits kept in Redis at %s", opts.Addr)
+	}
+	app.RateLimits = ratelimit.DefaultConfig()
+	if rateLimitFile := os.Getenv("RATE_LIMIT_CONFIG_FILE"); rateLimitFile != "" {
+		app.RateLimits, err = ratelimit.LoadConfig(rateLimitFile)
+		if err != nil {
+			log.Fatalf("Failed to load the rate limits: %v", err)
+		}
+	}
+
+	// Limit the concurrent and idle sessions with the session policies, if any are configured
+	if policyFile := os.Getenv("SESSION_POLICY_FILE"); policyFile != "" {
+		app.SessionPolicies, err = sessionpolicy.LoadConfig(policyFile)
+		if err != nil {
+			log.Fatalf("Failed to load the session policies: %v", err)
+		}
+	}
+	app.Activity = sessionpolicy.NewTracker(app.DB)
+
+	// Publish the security events to the webhooks configured by the admins
+	app.Events = &events.Bus{}
+	dispatcher := webhook.NewDispatcher(app.DB)
+	dispatcher.AllowPrivate = app.AllowPrivateWebhooks
+	app.Events.Subscribe(dispatcher.Handle)
+
+	// Stream the events to the SIEMs through the configured sinks, if any
+	var sinks []*sink.Sink
+	if sinksFile := os.Getenv("EVENT_SINKS_FILE"); sinksFile != "" {
+		configs, err := sink.LoadConfig(sinksFile)
+		if err != nil {
+			log.Fatalf("Failed to load the event sinks: %v", err)
+		}
+		for _, cfg := range configs {
+			s, err := sink.New(cfg)
+			if err != nil {
+				log.Fatalf("Failed to create the event sinks: %v", err)
+			}
+			app.Events.Subscribe(s.Handle)
+			sinks = append(sinks, s)
+		}
+		log.Printf("Streaming the events to %d sinks", len(sinks))
+	}
+
+	// Revoke expired dynamic database credentials in the background
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.StartDBCredentialReaper(ctx, reapInterval)
+	go dispatcher.Run(ctx, webhookRetryInterval)
+	go app.Activity.Run(ctx, activityFlushInterval)
+	for _, s := range sinks {
+		go s.Run(ctx)
+	}
+	if app.AuditSigningKey != nil {
+		go app.StartAuditCheckpointer(ctx, auditCheckpointInterval)
+		log.Printf("Audit checkpoints signed every %s", auditCheckpointInterval)
+	}
+
 	// Start a web server
 	fmt.Printf("Starting server on port %d\n", port)
 
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port)}
+
+	// Serve TLS when a certificate is configured, asking for client certificates when a CA bundle is too
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, os.Getenv("TLS_KEY_FILE"))
+		if err != nil {
+			log.Fatalf("Failed to load the TLS certificate: %v", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+		if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+			clientCAs, err := mtls.LoadCAPool(caFile)
+			if err != nil {
+				log.Fatalf("Failed to load the client CA bundle: %v", err)
+			}
+			cfg, err := mtls.LoadConfig(os.Getenv("MTLS_CONFIG_FILE"))
+			if err != nil {
+				log.Fatalf("Failed to load the client certificate mapping: %v", err)
+			}
+			server.TLSConfig = mtls.ServerConfig(cert, clientCAs)
+			app.ClientCertificates = &cfg
+			log.Printf("Client certificate authentication enabled with %d rules", len(cfg.Rules))
+		}
+	}
+
 	// Set up your app's router/handler
-	handler := app.Routes()
+	server.Handler = app.Routes()
+
+	if server.TLSConfig != nil {
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(server.ListenAndServe())
+}
+
+// acceptedAudiences splits the comma-separated audiences of the -jwt-accepted-audiences flag.
+func acceptedAudiences(list string) []string {
+	var audiences []string
+	for _, audience := range strings.Split(list, ",") {
+		if audience = strings.TrimSpace(audience); audience != "" {
+			audiences = append(audiences, audience)
+		}
+	}
+	return audiences
+}
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), handler))
+// profileIDs parses the comma-separated profile ids of the -admin-profiles flag.
+func profileIDs(list string) ([]int, error) {
+	var ids []int
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// verifyAudit verifies the hash chains of the named audit logs, or of all of them, and prints
+// the first broken link of each. It returns the exit status: 0 when every chain is intact,
+// 1 when one is broken and 2 when one could not be verified.
+func verifyAudit(app *api.AuthServerApp, logs []string) int {
+	if len(logs) == 0 {
+		logs = []string{models.AuditLogLogins, models.AuditLogAdmin}
+	}
+	if app.AuditSigningKey == nil {
+		fmt.Println("AUDIT_SIGNING_KEY_FILE is not set, the checkpoint signatures are not checked")
+	}
+
+	status := 0
+	for _, name := range logs {
+		report, err := app.VerifyAudit(name)
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			status = 2
+			continue
+		}
+		if report.Break != nil {
+			fmt.Printf("%s: broken at event %d: %s\n", name, report.Break.EventID, report.Break.Reason)
+			if status == 0 {
+				status = 1
+			}
+			continue
+		}
+		fmt.Printf("%s: %d records and %d checkpoints verified, head %s\n", name, report.Records, report.Checkpoints, report.Head)
+	}
+	return status
 }